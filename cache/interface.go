@@ -50,4 +50,12 @@ type Stats struct {
 	Values int
 	// Evictions counts the number of multihashes evicted from cache.
 	Evictions int
+	// Rotations counts the number of times the cache has been rotated.
+	Rotations int
+	// EvictedEntries counts the number of interned values dropped from cache
+	// by rotations.
+	EvictedEntries int
+	// ReleasedEntries counts the number of interned values dropped from cache
+	// because no cached multihash maps to them any longer.
+	ReleasedEntries int
 }
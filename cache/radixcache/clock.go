@@ -0,0 +1,163 @@
+package radixcache
+
+import (
+	"math/bits"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/gammazero/radixtree"
+)
+
+// clock tracks the cached multihashes for the Clock and CostAware eviction
+// strategies. Each cached multihash has a slot in a ring, with a number of
+// credits that is raised when the multihash is looked up. When a slot is
+// needed for a new multihash and the ring is full, the hand moves around the
+// ring, taking one credit from each slot it passes, until it finds a slot with
+// no credits. The multihash in that slot is evicted, and the slot is given to
+// the new multihash.
+//
+// With the Clock strategy, a lookup gives a multihash one credit, which works
+// as a reference bit. With the CostAware strategy, a multihash gets credits
+// according to the size of its values, which approximates the cost of reading
+// them from the value store again. A multihash with large values survives more
+// passes of the hand, and each lookup adds more credits, up to maxCredits.
+//
+// Multihashes that are removed from the cache keep their slot until the hand
+// reaches it, since the slot of a removed multihash is free to reuse without
+// evicting anything.
+type clock struct {
+	keys    []string
+	credits []uint8
+	slots   map[string]int
+	hand    int
+	size    int
+	hint    int
+	// costAware selects the CostAware strategy.
+	costAware bool
+}
+
+const (
+	// maxCredits is the most credits that a multihash can have with the
+	// CostAware strategy.
+	maxCredits = 32
+	// costUnitBytes is the size of values worth one credit with the CostAware
+	// strategy. Each doubling of the size of the values of a multihash adds
+	// another credit.
+	costUnitBytes = 64
+)
+
+// newClock creates a clock with up to size slots. Space for hint slots is
+// allocated up front.
+func newClock(size, hint int, costAware bool) *clock {
+	if size < 1 {
+		size = 1
+	}
+	if hint > size {
+		hint = size
+	} else if hint < 0 {
+		hint = 0
+	}
+	ck := &clock{
+		size:      size,
+		hint:      hint,
+		costAware: costAware,
+	}
+	ck.reset()
+	return ck
+}
+
+// reset removes all slots.
+func (ck *clock) reset() {
+	ck.keys = make([]string, 0, ck.hint)
+	ck.credits = make([]uint8, 0, ck.hint)
+	ck.slots = make(map[string]int, ck.hint)
+	ck.hand = 0
+}
+
+// weight returns the number of credits that a lookup of a multihash that maps
+// to values gives it.
+func (ck *clock) weight(values []*indexer.Value) uint8 {
+	if !ck.costAware {
+		return 1
+	}
+	var size int
+	for _, v := range values {
+		size += len(v.ProviderID) + len(v.ContextID) + len(v.MetadataBytes)
+	}
+	w := 1 + bits.Len(uint(size/costUnitBytes))
+	if w > maxCredits {
+		w = maxCredits
+	}
+	return uint8(w)
+}
+
+// touch gives credits to k for a lookup, if k has a slot.
+func (ck *clock) touch(k string, values []*indexer.Value) {
+	i, ok := ck.slots[k]
+	if !ok {
+		return
+	}
+	if !ck.costAware {
+		ck.credits[i] = 1
+		return
+	}
+	c := int(ck.credits[i]) + int(ck.weight(values))
+	if c > maxCredits {
+		c = maxCredits
+	}
+	ck.credits[i] = uint8(c)
+}
+
+// charge gives k the credits for the size of its values when it is put, if it
+// has fewer. This keeps a multihash with large values from being the first
+// evicted before it is looked up. It does nothing with the Clock strategy.
+func (ck *clock) charge(k string, values []*indexer.Value) {
+	if !ck.costAware {
+		return
+	}
+	i, ok := ck.slots[k]
+	if !ok {
+		return
+	}
+	if c := ck.weight(values) - 1; c > ck.credits[i] {
+		ck.credits[i] = c
+	}
+}
+
+// add gives k a slot, if it does not already have one. If the ring is full,
+// then the slot of a multihash that has no credits and is not pinned is taken,
+// and that multihash is deleted from tree. Returns the multihash deleted from
+// tree and its values, or nil values if no multihash was deleted.
+func (ck *clock) add(k string, tree *radixtree.Bytes, pinned map[string]struct{}) (string, []*indexer.Value) {
+	if _, ok := ck.slots[k]; ok {
+		return "", nil
+	}
+	if len(ck.keys) < ck.size {
+		ck.slots[k] = len(ck.keys)
+		ck.keys = append(ck.keys, k)
+		ck.credits = append(ck.credits, 0)
+		return "", nil
+	}
+
+	var evicted []*indexer.Value
+	for {
+		i := ck.hand
+		ck.hand = (ck.hand + 1) % len(ck.keys)
+		old := ck.keys[i]
+		if v, found := tree.Get(old); found {
+			if ck.credits[i] != 0 {
+				ck.credits[i]--
+				continue
+			}
+			if _, ok := pinned[old]; ok {
+				continue
+			}
+			tree.Delete(old)
+			evicted = v.([]*indexer.Value)
+		}
+		delete(ck.slots, old)
+		ck.keys[i] = k
+		ck.credits[i] = 0
+		ck.slots[k] = i
+		return old, evicted
+	}
+}
@@ -0,0 +1,55 @@
+package radixcache
+
+import (
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+// Pin keeps the multihash in the cache when the cache rotates or evicts
+// multihashes to make room for new ones. The multihash does not need to be in
+// the cache when it is pinned, and is kept once it is put into the cache. A
+// pinned multihash is still removed by Remove, RemoveProvider and
+// RemoveProviderContext, and is still counted toward the size of the cache.
+// Pinned multihashes are only evicted if the whole cache is cleared because
+// of indexer misuse.
+// Returns false if the multihash is not pinned because the maximum number of
+// pinned multihashes, set by the MaxPins option, is reached.
+func (c *radixCache) Pin(m multihash.Multihash) bool {
+	k := string(m)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.publishStats()
+
+	if _, ok := c.pinned[k]; !ok {
+		if len(c.pinned) >= c.maxPins {
+			return false
+		}
+		c.pinned[k] = struct{}{}
+	}
+	// Move the multihash out of the previous generation, which is evicted at
+	// the next rotation.
+	c.get(k)
+	return true
+}
+
+// Unpin allows the multihash to be evicted from the cache again.
+func (c *radixCache) Unpin(m multihash.Multihash) {
+	c.mutex.Lock()
+	delete(c.pinned, string(m))
+	c.mutex.Unlock()
+}
+
+// keepPinned moves the pinned multihashes from the previous generation into
+// the current one, so that they are not evicted at the next rotation. This is
+// called after rotating.
+func (c *radixCache) keepPinned() {
+	if c.previous == nil {
+		return
+	}
+	for k := range c.pinned {
+		if v, found := c.previous.Get(k); found {
+			c.moveForward(k, v.([]*indexer.Value))
+		}
+	}
+}
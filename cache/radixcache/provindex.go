@@ -0,0 +1,117 @@
+package radixcache
+
+import (
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/gammazero/radixtree"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// providerIndex maps each provider ID to the cached multihashes that map to a
+// value of that provider, so that the multihashes of a provider are found
+// without walking the whole cache. There is one providerIndex for each
+// generation of multihashes. All methods do nothing on a nil providerIndex,
+// which is used when the ProviderIndex option is not enabled.
+type providerIndex map[peer.ID]map[string]struct{}
+
+// add records that k maps to a value of the provider.
+func (pi providerIndex) add(providerID peer.ID, k string) {
+	if pi == nil {
+		return
+	}
+	keys, ok := pi[providerID]
+	if !ok {
+		keys = make(map[string]struct{})
+		pi[providerID] = keys
+	}
+	keys[k] = struct{}{}
+}
+
+// addValues records that k maps to each of the values.
+func (pi providerIndex) addValues(values []*indexer.Value, k string) {
+	for _, val := range values {
+		pi.add(val.ProviderID, k)
+	}
+}
+
+// remove records that k no longer maps to any value of the provider.
+func (pi providerIndex) remove(providerID peer.ID, k string) {
+	if pi == nil {
+		return
+	}
+	keys, ok := pi[providerID]
+	if !ok {
+		return
+	}
+	delete(keys, k)
+	if len(keys) == 0 {
+		delete(pi, providerID)
+	}
+}
+
+// removeValues records that k no longer maps to any of the values.
+func (pi providerIndex) removeValues(values []*indexer.Value, k string) {
+	for _, val := range values {
+		pi.remove(val.ProviderID, k)
+	}
+}
+
+// update removes k from the multihashes of the provider if k no longer maps to
+// a value of the provider in tree.
+func (pi providerIndex) update(tree *radixtree.Bytes, k string, providerID peer.ID) {
+	if pi == nil {
+		return
+	}
+	if v, found := tree.Get(k); found && hasProvider(v.([]*indexer.Value), providerID) {
+		return
+	}
+	pi.remove(providerID, k)
+}
+
+// removeProviderKeys removes the values of the provider from each of the
+// multihashes in keys, and returns the number of values removed.
+func removeProviderKeys(tree *radixtree.Bytes, keys map[string]struct{}, providerID peer.ID, refs valueRefs) int {
+	var count int
+	for k := range keys {
+		v, found := tree.Get(k)
+		if !found {
+			continue
+		}
+		values, removed := removeProviderValues(v.([]*indexer.Value), providerID, refs)
+		if len(values) == 0 {
+			tree.Delete(k)
+		} else if removed != 0 {
+			tree.Put(k, values)
+		}
+		count += removed
+	}
+	return count
+}
+
+// removeProviderValues removes the values of the provider from values, and
+// returns the remaining values and the number of values removed. The removed
+// values are counted as removed in refs.
+func removeProviderValues(values []*indexer.Value, providerID peer.ID, refs valueRefs) ([]*indexer.Value, int) {
+	var removed int
+	for i := 0; i < len(values); {
+		if values[i].ProviderID == providerID {
+			removed++
+			refs.remove(values[i])
+			values[i] = values[len(values)-1]
+			values[len(values)-1] = nil
+			values = values[:len(values)-1]
+			continue
+		}
+		i++
+	}
+	return values, removed
+}
+
+// hasProvider returns true if any of the values belongs to the provider.
+func hasProvider(values []*indexer.Value, providerID peer.ID) bool {
+	for _, val := range values {
+		if val.ProviderID == providerID {
+			return true
+		}
+	}
+	return false
+}
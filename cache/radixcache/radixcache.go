@@ -5,6 +5,7 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/filecoin-project/go-indexer-core"
 	"github.com/filecoin-project/go-indexer-core/cache"
@@ -18,8 +19,110 @@ import (
 
 var log = logging.Logger("indexer-core/cache")
 
+// Strategy is a strategy for choosing which multihashes to evict from a full
+// cache.
+type Strategy int
+
+const (
+	// Rotate keeps two generations of multihashes, each up to half the size
+	// of the cache. When the current generation is full, the previous
+	// generation is evicted, and the current generation becomes the previous
+	// one. Multihashes that are looked up in the previous generation are moved
+	// into the current one. This is cheap, but evicts half of the cache at a
+	// time, including recently used multihashes that were not looked up since
+	// the last rotation.
+	Rotate Strategy = iota
+	// Clock evicts one multihash at a time, choosing a multihash that has
+	// not been looked up since the last time it was considered for eviction.
+	// This approximates evicting the least recently used multihash, which
+	// keeps more of a frequently used set of multihashes that is larger than
+	// half of the cache.
+	Clock
+	// CostAware is like Clock, but favors keeping the multihashes that would
+	// cost the most to read from the value store again. The cost of a
+	// multihash is approximated by the size of the values it maps to, and
+	// each lookup adds to it, so a multihash with large values that is looked
+	// up often is kept longest. A multihash with small values is evicted
+	// sooner than with Clock, so this suits caches where the values vary
+	// widely in size, such as values with large metadata.
+	CostAware
+)
+
+// config contains options for the cache.
+type config struct {
+	strategy      Strategy
+	expectedKeys  int
+	providerIndex bool
+	maxPins       int
+	evictUnused   bool
+}
+
+type Option func(*config)
+
+// Eviction sets the strategy for evicting multihashes from the cache when it
+// is full. The default is Rotate.
+func Eviction(strategy Strategy) Option {
+	return func(cfg *config) {
+		cfg.strategy = strategy
+	}
+}
+
+// ExpectedKeys sets the number of multihashes that the cache is expected to
+// hold once it is warm. Space to track that many multihashes is allocated when
+// the cache is created, instead of growing as multihashes are put into the
+// cache. This only affects the Clock and CostAware strategies, since the radix
+// trees that hold the cached multihashes cannot be pre-sized.
+func ExpectedKeys(n int) Option {
+	return func(cfg *config) {
+		cfg.expectedKeys = n
+	}
+}
+
+// ProviderIndex sets whether the cache keeps an index of the cached
+// multihashes of each provider. With the index, RemoveProvider only visits the
+// multihashes of the removed provider, instead of every cached multihash. This
+// is useful when providers are removed frequently from a large cache, and
+// costs memory for each cached multihash and provider pair.
+func ProviderIndex(enable bool) Option {
+	return func(cfg *config) {
+		cfg.providerIndex = enable
+	}
+}
+
+// MaxPins sets the maximum number of multihashes that can be pinned in the
+// cache with Pin. The default, and the largest allowed value, is a quarter of
+// the cache size, so that pinned multihashes cannot take the place of most of
+// the cache. A value of 0 disables pinning.
+func MaxPins(n int) Option {
+	return func(cfg *config) {
+		cfg.maxPins = n
+	}
+}
+
+// EvictUnusedValues sets whether the cache counts the cached multihashes that
+// map to each value, and evicts a value as soon as no cached multihash maps to
+// it. Without this, a value can stay in the cache after its last multihash is
+// evicted, until the value itself is rotated out, and with the Clock strategy
+// until the cache has too many values. Counting costs memory for each value
+// and time for each change to the cache.
+func EvictUnusedValues(enable bool) Option {
+	return func(cfg *config) {
+		cfg.evictUnused = enable
+	}
+}
+
 // radixCache is a rotatable cache with value deduplication.
 type radixCache struct {
+	// Statistics read by Stats without locking the cache. These are first in
+	// the struct for 64-bit alignment on 32-bit platforms, since they are
+	// accessed atomically.
+	statIndexes        int64
+	statValues         int64
+	statEvictions      int64
+	statRotations      int64
+	statEvictedEntries int64
+	statReleased       int64
+
 	// multihash -> indexer.Value
 	current  *radixtree.Bytes
 	previous *radixtree.Bytes
@@ -30,16 +133,62 @@ type radixCache struct {
 
 	mutex      sync.Mutex
 	evictions  int
+	rotations  int
 	rotateSize int
+
+	evictedEntries int
+	// releasedEntries counts the values evicted because no cached multihash
+	// maps to them.
+	releasedEntries int
+
+	// curProvs and prevProvs index the multihashes in current and previous
+	// by provider, if the ProviderIndex option is enabled, and are nil
+	// otherwise.
+	curProvs  providerIndex
+	prevProvs providerIndex
+
+	// clock tracks the multihashes in current if the Clock or CostAware
+	// strategy is used, and is nil otherwise. With those there is no previous
+	// generation.
+	clock *clock
+
+	// pinned is the set of multihashes that are not evicted, up to maxPins.
+	pinned  map[string]struct{}
+	maxPins int
+
+	// refs counts the references to each value if the EvictUnusedValues
+	// option is enabled, and is nil otherwise.
+	refs valueRefs
 }
 
-// New creates a new radixCache instance.
-func New(maxSize int) *radixCache {
-	return &radixCache{
+// New creates a new radixCache instance that holds up to maxSize multihashes.
+func New(maxSize int, options ...Option) *radixCache {
+	cfg := config{
+		maxPins: maxSize >> 2,
+	}
+	for _, opt := range options {
+		opt(&cfg)
+	}
+	c := &radixCache{
 		current:    radixtree.New(),
 		curEnts:    radixtree.New(),
 		rotateSize: maxSize >> 1,
+		pinned:     make(map[string]struct{}),
+		maxPins:    cfg.maxPins,
+	}
+	if c.maxPins > maxSize>>2 {
+		c.maxPins = maxSize >> 2
+	}
+	if cfg.strategy == Clock || cfg.strategy == CostAware {
+		c.clock = newClock(maxSize, cfg.expectedKeys, cfg.strategy == CostAware)
 	}
+	if cfg.providerIndex {
+		c.curProvs = make(providerIndex)
+	}
+	if cfg.evictUnused {
+		c.refs = make(valueRefs)
+	}
+	return c
 }
 
 func (c *radixCache) Get(m multihash.Multihash) ([]indexer.Value, bool) {
@@ -47,6 +196,9 @@ func (c *radixCache) Get(m multihash.Multihash) ([]indexer.Value, bool) {
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	// Moving a multihash out of the previous generation can change the
+	// statistics.
+	defer c.publishStats()
 
 	vals, found := c.get(k)
 	if !found {
@@ -65,6 +217,7 @@ func (c *radixCache) Put(value indexer.Value, mhs ...multihash.Multihash) int {
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	defer c.publishStats()
 
 	// Store the new value or update the matching value and return a pointer to
 	// the internally stored value.
@@ -93,18 +246,43 @@ keysLoop:
 			}
 		}
 
-		if c.current.Len() > c.rotateSize {
+		if c.clock != nil {
+			if old, evicted := c.clock.add(k, c.current, c.pinned); evicted != nil {
+				c.evictions++
+				c.curProvs.removeValues(evicted, old)
+				c.release(evicted)
+			}
+		} else if c.current.Len() > c.rotateSize {
 			c.rotate()
+			c.keepPinned()
+			// The existing values are now in previous, unless k is pinned.
+			// Copy them so that changing the values in one generation does
+			// not change the other.
+			existing = append([]*indexer.Value(nil), existing...)
 		}
 
-		c.current.Put(k, append(existing, interned))
+		values := append(existing, interned)
+		c.replaceRefs(k, values)
+		c.current.Put(k, values)
+		if c.clock != nil {
+			c.clock.charge(k, values)
+		}
+		c.curProvs.addValues(values, k)
 		count++
 	}
 
 	// Prevent possible unbounded memory growth, that results from repeatedly
 	// adding and deleting entries with different values, without causing
 	// rotation.
-	if c.curEnts.Len() > (c.rotateSize << 1) {
+	if c.curEnts.Len() > (c.rotateSize<<1) && c.clock != nil {
+		c.removeUnusedInterns()
+		if c.curEnts.Len() > (c.rotateSize << 1) {
+			log.Error("Too many values indexed by multihashes (indexer misuse), clearing cache.",
+				"values", c.curEnts.Len(), "multihashes", c.current.Len())
+			c.clear()
+			stats.Record(context.Background(), metrics.CacheMisuse.M(1))
+		}
+	} else if c.curEnts.Len() > (c.rotateSize << 1) {
 		c.rotate()
 		// Remove all non-indexed cache entries.
 		c.previous.Walk("", func(k string, v interface{}) bool {
@@ -120,6 +298,8 @@ keysLoop:
 		c.current = c.previous
 		c.previous = nil
 		c.prevEnts = nil
+		c.curProvs = c.prevProvs
+		c.prevProvs = nil
 
 		if c.curEnts.Len() > (c.rotateSize << 1) {
 			// If there are still too many values, this means that there are
@@ -140,6 +320,7 @@ keysLoop:
 func (c *radixCache) Remove(value indexer.Value, mhs ...multihash.Multihash) int {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	defer c.publishStats()
 
 	_, val, found := c.findInternValue(&value)
 	if !found {
@@ -149,10 +330,19 @@ func (c *radixCache) Remove(value indexer.Value, mhs ...multihash.Multihash) int
 	var count int
 	for i := range mhs {
 		k := string(mhs[i])
-		removed := removeIndex(c.current, k, val)
-		if c.previous != nil && removeIndex(c.previous, k, val) {
+		var removed bool
+		if rv := removeIndex(c.current, k, val); rv != nil {
+			c.curProvs.update(c.current, k, val.ProviderID)
+			c.release([]*indexer.Value{rv})
 			removed = true
 		}
+		if c.previous != nil {
+			if rv := removeIndex(c.previous, k, val); rv != nil {
+				c.prevProvs.update(c.previous, k, val.ProviderID)
+				c.release([]*indexer.Value{rv})
+				removed = true
+			}
+		}
 		if removed {
 			count++
 		}
@@ -170,28 +360,18 @@ func (c *radixCache) Remove(value indexer.Value, mhs ...multihash.Multihash) int
 func (c *radixCache) RemoveProvider(providerID peer.ID) int {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	defer c.publishStats()
+
+	if c.curProvs != nil {
+		return c.removeIndexedProvider(providerID)
+	}
 
 	var count int
 	var deletes []string
 	var tree *radixtree.Bytes
 
 	walkFunc := func(k string, v interface{}) bool {
-		values := v.([]*indexer.Value)
-		var vrm int
-		for i := 0; i < len(values); {
-			if providerID == values[i].ProviderID {
-				vrm++
-				if len(values) == 1 {
-					values = nil
-					break
-				}
-				values[i] = values[len(values)-1]
-				values[len(values)-1] = nil
-				values = values[:len(values)-1]
-				continue
-			}
-			i++
-		}
+		values, vrm := removeProviderValues(v.([]*indexer.Value), providerID, c.refs)
 		if len(values) == 0 {
 			deletes = append(deletes, k)
 		} else if vrm != 0 {
@@ -231,9 +411,26 @@ func (c *radixCache) RemoveProvider(providerID peer.ID) int {
 	return count
 }
 
+// removeIndexedProvider removes the values of the provider from the
+// multihashes that the provider index lists for the provider.
+func (c *radixCache) removeIndexedProvider(providerID peer.ID) int {
+	removeProviderInterns(c.curEnts, providerID)
+	count := removeProviderKeys(c.current, c.curProvs[providerID], providerID, c.refs)
+	delete(c.curProvs, providerID)
+	if c.previous != nil {
+		if c.prevEnts != nil {
+			removeProviderInterns(c.prevEnts, providerID)
+		}
+		count += removeProviderKeys(c.previous, c.prevProvs[providerID], providerID, c.refs)
+		delete(c.prevProvs, providerID)
+	}
+	return count
+}
+
 func (c *radixCache) RemoveProviderContext(providerID peer.ID, contextID []byte) int {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	defer c.publishStats()
 
 	valKey, val, found := c.findInternValue(&indexer.Value{
 		ProviderID: providerID,
@@ -246,6 +443,7 @@ func (c *radixCache) RemoveProviderContext(providerID peer.ID, contextID []byte)
 	var deletes []string
 	var count int
 	var tree *radixtree.Bytes
+	var provs providerIndex
 
 	walkFunc := func(k string, v interface{}) bool {
 		values := v.([]*indexer.Value)
@@ -269,11 +467,15 @@ func (c *radixCache) RemoveProviderContext(providerID peer.ID, contextID []byte)
 		} else {
 			tree.Put(k, values)
 		}
+		if vrm != 0 && !hasProvider(values, providerID) {
+			provs.remove(providerID, k)
+		}
 		count += vrm
 		return false
 	}
 
 	tree = c.current
+	provs = c.curProvs
 	c.current.Walk("", walkFunc)
 	for _, k := range deletes {
 		c.current.Delete(k)
@@ -281,6 +483,7 @@ func (c *radixCache) RemoveProviderContext(providerID peer.ID, contextID []byte)
 	if c.previous != nil {
 		deletes = deletes[:0]
 		tree = c.previous
+		provs = c.prevProvs
 		c.previous.Walk("", walkFunc)
 		for _, k := range deletes {
 			c.previous.Delete(k)
@@ -291,25 +494,85 @@ func (c *radixCache) RemoveProviderContext(providerID peer.ID, contextID []byte)
 	// findInternValue would have pulled forward any from the previous cache
 	// interns.
 	c.curEnts.Delete(valKey)
+	delete(c.refs, val)
 
 	return count
 }
 
-func (c *radixCache) IndexCount() int {
+// Range calls f for each cached multihash and the values that it maps to. If f
+// returns false, Range stops. The cache is locked while Range runs, so f must
+// not call any cache methods.
+func (c *radixCache) Range(f func(multihash.Multihash, []indexer.Value) bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	indexCount := c.current.Len()
-	if c.previous != nil {
-		indexCount += c.previous.Len()
+	var stop bool
+	walkFunc := func(k string, v interface{}) bool {
+		vals := v.([]*indexer.Value)
+		values := make([]indexer.Value, len(vals))
+		for i, val := range vals {
+			values[i] = *val
+		}
+		stop = !f(multihash.Multihash(k), values)
+		return stop
+	}
+	c.current.Walk("", walkFunc)
+	if !stop && c.previous != nil {
+		c.previous.Walk("", walkFunc)
 	}
-	return indexCount
 }
 
-func (c *radixCache) Stats() cache.Stats {
+// Clear evicts every multihash and value from the cache. Pinned multihashes
+// are also evicted, but stay pinned and are kept once they are put again.
+func (c *radixCache) Clear() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	defer c.publishStats()
+
+	c.evictions += c.current.Len()
+	c.evictedEntries += c.curEnts.Len()
+	if c.previous != nil {
+		c.evictions += c.previous.Len()
+		c.previous = nil
+	}
+	if c.prevEnts != nil {
+		c.evictedEntries += c.prevEnts.Len()
+		c.prevEnts = nil
+	}
+	c.current = radixtree.New()
+	c.curEnts = radixtree.New()
+	if c.curProvs != nil {
+		c.curProvs = make(providerIndex)
+		c.prevProvs = nil
+	}
+	if c.refs != nil {
+		c.refs = make(valueRefs)
+	}
+	if c.clock != nil {
+		c.clock.reset()
+	}
+}
+
+func (c *radixCache) IndexCount() int {
+	return int(atomic.LoadInt64(&c.statIndexes))
+}
 
+// Stats returns the statistics published by the last change to the cache. It
+// does not lock the cache, so it is not delayed by changes in progress.
+func (c *radixCache) Stats() cache.Stats {
+	return cache.Stats{
+		Indexes:         int(atomic.LoadInt64(&c.statIndexes)),
+		Values:          int(atomic.LoadInt64(&c.statValues)),
+		Evictions:       int(atomic.LoadInt64(&c.statEvictions)),
+		Rotations:       int(atomic.LoadInt64(&c.statRotations)),
+		EvictedEntries:  int(atomic.LoadInt64(&c.statEvictedEntries)),
+		ReleasedEntries: int(atomic.LoadInt64(&c.statReleased)),
+	}
+}
+
+// publishStats updates the statistics read by Stats. It is called, with the
+// cache locked, by every method that changes the cache.
+func (c *radixCache) publishStats() {
 	indexCount := c.current.Len()
 	if c.previous != nil {
 		indexCount += c.previous.Len()
@@ -320,16 +583,20 @@ func (c *radixCache) Stats() cache.Stats {
 		valueCount += c.prevEnts.Len()
 	}
 
-	return cache.Stats{
-		Indexes:   indexCount,
-		Values:    valueCount,
-		Evictions: c.evictions,
-	}
+	atomic.StoreInt64(&c.statIndexes, int64(indexCount))
+	atomic.StoreInt64(&c.statValues, int64(valueCount))
+	atomic.StoreInt64(&c.statEvictions, int64(c.evictions))
+	atomic.StoreInt64(&c.statRotations, int64(c.rotations))
+	atomic.StoreInt64(&c.statEvictedEntries, int64(c.evictedEntries))
+	atomic.StoreInt64(&c.statReleased, int64(c.releasedEntries))
 }
 
 func (c *radixCache) get(k string) ([]*indexer.Value, bool) {
 	// Search current cache.
 	v, found := c.current.Get(k)
+	if found && c.clock != nil {
+		c.clock.touch(k, v.([]*indexer.Value))
+	}
 	if !found {
 		if c.previous == nil {
 			return nil, false
@@ -341,28 +608,90 @@ func (c *radixCache) get(k string) ([]*indexer.Value, bool) {
 			return nil, false
 		}
 
-		// Pull the interned values for these values forward from the previous
-		// cache to reuse the interned values instead of allocating them again
-		// in the current cache.
-		values := v.([]*indexer.Value)
-		for i, val := range values {
-			values[i] = c.internValue(val, false, true)
-		}
-
-		// Move the value found in the previous tree into the current one.
-		c.current.Put(k, values)
-		c.previous.Delete(k)
+		c.moveForward(k, v.([]*indexer.Value))
 	}
 	return v.([]*indexer.Value), true
 }
 
+// moveForward moves the multihash k and its values from the previous
+// generation into the current one.
+func (c *radixCache) moveForward(k string, values []*indexer.Value) {
+	// Pull the interned values for these values forward from the previous
+	// cache to reuse the interned values instead of allocating them again
+	// in the current cache.
+	for i, val := range values {
+		values[i] = c.internValue(val, false, true)
+		if values[i] != val {
+			c.refs.add(values[i : i+1])
+			c.release([]*indexer.Value{val})
+		}
+	}
+
+	// Move the value found in the previous tree into the current one.
+	c.current.Put(k, values)
+	c.previous.Delete(k)
+	c.curProvs.addValues(values, k)
+	c.prevProvs.removeValues(values, k)
+}
+
 func (c *radixCache) rotate() {
+	var evicted int
 	if c.previous != nil {
-		c.evictions += c.previous.Len()
-		log.Infow("Rotating cache", "evictions", c.previous.Len())
+		c.releaseTree(c.previous)
+		evicted = c.previous.Len()
+		c.evictions += evicted
+		log.Infow("Rotating cache", "evictions", evicted)
+	}
+	if c.prevEnts != nil {
+		c.evictedEntries += c.prevEnts.Len()
 	}
+	c.rotations++
+	stats.Record(context.Background(), metrics.CacheRotationEvictions.M(int64(evicted)))
 	c.previous, c.current = c.current, radixtree.New()
 	c.prevEnts, c.curEnts = c.curEnts, radixtree.New()
+	if c.curProvs != nil {
+		c.prevProvs, c.curProvs = c.curProvs, make(providerIndex)
+	}
+}
+
+// removeUnusedInterns removes the interned values that no cached multihash
+// maps to. This is used by the Clock and CostAware strategies, which have no
+// previous generation of interned values to discard.
+func (c *radixCache) removeUnusedInterns() {
+	used := make(map[*indexer.Value]struct{})
+	c.current.Walk("", func(k string, v interface{}) bool {
+		for _, val := range v.([]*indexer.Value) {
+			used[val] = struct{}{}
+		}
+		return false
+	})
+	var deletes []string
+	c.curEnts.Walk("", func(k string, v interface{}) bool {
+		if _, ok := used[v.(*indexer.Value)]; !ok {
+			deletes = append(deletes, k)
+		}
+		return false
+	})
+	for _, k := range deletes {
+		c.curEnts.Delete(k)
+	}
+	c.evictedEntries += len(deletes)
+}
+
+// clear evicts everything from a cache that uses the Clock or CostAware
+// strategy.
+func (c *radixCache) clear() {
+	c.evictions += c.current.Len()
+	c.evictedEntries += c.curEnts.Len()
+	c.current = radixtree.New()
+	c.curEnts = radixtree.New()
+	c.clock.reset()
+	if c.curProvs != nil {
+		c.curProvs = make(providerIndex)
+	}
+	if c.refs != nil {
+		c.refs = make(valueRefs)
+	}
 }
 
 // internValue stores a single copy of a Value under a key composed of
@@ -403,11 +732,7 @@ func (c *radixCache) internValue(value *indexer.Value, updateMeta, saveNew bool)
 }
 
 func (c *radixCache) findInternValue(value *indexer.Value) (string, *indexer.Value, bool) {
-	var b strings.Builder
-	b.Grow(len(value.ProviderID) + len(value.ContextID))
-	b.WriteString(string(value.ProviderID))
-	b.Write(value.ContextID)
-	k := b.String()
+	k := internKey(value)
 	v, found := c.curEnts.Get(k)
 	if found {
 		// Found existing interned value.
@@ -427,11 +752,23 @@ func (c *radixCache) findInternValue(value *indexer.Value) (string, *indexer.Val
 	return k, nil, false
 }
 
-func removeIndex(tree *radixtree.Bytes, k string, value *indexer.Value) bool {
+// internKey returns the key of the interned value for the provider and
+// context of value.
+func internKey(value *indexer.Value) string {
+	var b strings.Builder
+	b.Grow(len(value.ProviderID) + len(value.ContextID))
+	b.WriteString(string(value.ProviderID))
+	b.Write(value.ContextID)
+	return b.String()
+}
+
+// removeIndex removes the mapping of k to value from tree, and returns the
+// value that k mapped to, or nil if k did not map to value.
+func removeIndex(tree *radixtree.Bytes, k string, value *indexer.Value) *indexer.Value {
 	// Get from current cache.
 	v, found := tree.Get(k)
 	if !found {
-		return false
+		return nil
 	}
 
 	values := v.([]*indexer.Value)
@@ -444,11 +781,11 @@ func removeIndex(tree *radixtree.Bytes, k string, value *indexer.Value) bool {
 				values[len(values)-1] = nil
 				tree.Put(k, values[:len(values)-1])
 			}
-			return true
+			return v
 		}
 	}
 
-	return false
+	return nil
 }
 
 func removeProviderInterns(tree *radixtree.Bytes, providerID peer.ID) bool {
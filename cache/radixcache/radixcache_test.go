@@ -2,13 +2,19 @@ package radixcache
 
 import (
 	"fmt"
+	"math/rand"
 	"os"
 	"runtime"
+	"sync"
 	"testing"
 
 	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/cache"
+	cachetest "github.com/filecoin-project/go-indexer-core/cache/test"
 	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/gammazero/radixtree"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
 )
 
 const peerID = "12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA"
@@ -624,6 +630,39 @@ func BenchmarkPut(b *testing.B) {
 	}
 }
 
+// BenchmarkPutFewValues puts a small number of distinct values for a large
+// number of multihashes. Values are interned by provider ID and context ID, so
+// the cost of interning does not depend on the number of distinct values.
+func BenchmarkPutFewValues(b *testing.B) {
+	const mhCount = 1000000
+	// test.RandomMultihashes is too slow to make this many multihashes.
+	mhs := make([]multihash.Multihash, mhCount)
+	for i := range mhs {
+		var err error
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	values := make([]indexer.Value, 3)
+	for i := range values {
+		values[i] = indexer.Value{
+			ProviderID:    provID,
+			ContextID:     []byte(fmt.Sprint("test-ctx-", i)),
+			MetadataBytes: []byte("metadata"),
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := New(2 * mhCount)
+		for j := range values {
+			s.Put(values[j], mhs...)
+		}
+	}
+}
+
 func BenchmarkGet(b *testing.B) {
 	mhs := test.RandomMultihashes(1)
 	value := indexer.Value{
@@ -668,3 +707,741 @@ func skipUnlessMemUse(t *testing.T) {
 		t.SkipNow()
 	}
 }
+
+func TestRotationStats(t *testing.T) {
+	s := New(4)
+	for i := 0; i < 4; i++ {
+		value := indexer.Value{
+			ProviderID:    provID,
+			ContextID:     []byte(fmt.Sprint("test-ctx-", i)),
+			MetadataBytes: []byte("metadata"),
+		}
+		s.Put(value, test.RandomMultihashes(3)...)
+	}
+
+	stats := s.Stats()
+	if stats.Rotations < 2 {
+		t.Fatalf("expected at least 2 rotations, got %d", stats.Rotations)
+	}
+	if stats.Evictions == 0 {
+		t.Fatal("expected evicted indexes")
+	}
+	if stats.EvictedEntries == 0 {
+		t.Fatal("expected evicted values")
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := New(1000)
+	value1 := indexer.Value{ProviderID: provID, ContextID: []byte("test-ctx-1"), MetadataBytes: []byte("metadata")}
+	value2 := indexer.Value{ProviderID: provID, ContextID: []byte("test-ctx-2"), MetadataBytes: []byte("metadata")}
+	mhs := test.RandomMultihashes(10)
+	s.Put(value1, mhs...)
+	s.Put(value2, mhs[:5]...)
+	// Move half the multihashes to the previous tree.
+	s.rotate()
+	s.Get(mhs[0])
+
+	seen := make(map[string]int)
+	s.Range(func(m multihash.Multihash, values []indexer.Value) bool {
+		seen[string(m)] = len(values)
+		return true
+	})
+	if len(seen) != len(mhs) {
+		t.Fatalf("expected %d multihashes, got %d", len(mhs), len(seen))
+	}
+	for i, m := range mhs {
+		expect := 1
+		if i < 5 {
+			expect = 2
+		}
+		if seen[string(m)] != expect {
+			t.Fatalf("expected %d values for multihash %d, got %d", expect, i, seen[string(m)])
+		}
+	}
+
+	var count int
+	s.Range(func(multihash.Multihash, []indexer.Value) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("expected Range to stop after 1 multihash, got %d", count)
+	}
+}
+
+func TestClock(t *testing.T) {
+	const maxSize = 10
+	s := New(maxSize, Eviction(Clock))
+	value := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     ctxID,
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(maxSize)
+	if s.Put(value, mhs...) != maxSize {
+		t.Fatal("did not put batch of multihashes")
+	}
+
+	// Use the first half, so that the second half is evicted first.
+	for _, m := range mhs[:maxSize/2] {
+		if _, found := s.Get(m); !found {
+			t.Fatal("multihash not found")
+		}
+	}
+	mhs2 := test.RandomMultihashes(maxSize / 2)
+	if s.Put(value, mhs2...) != len(mhs2) {
+		t.Fatal("did not put batch of multihashes")
+	}
+
+	for _, m := range mhs[maxSize/2:] {
+		if _, found := s.Get(m); found {
+			t.Fatal("expected unused multihash to be evicted")
+		}
+	}
+	for _, m := range append(mhs[:maxSize/2:maxSize/2], mhs2...) {
+		if _, found := s.Get(m); !found {
+			t.Fatal("expected used and new multihashes to be cached")
+		}
+	}
+
+	stats := s.Stats()
+	if stats.Indexes != maxSize {
+		t.Fatalf("expected %d cached multihashes, got %d", maxSize, stats.Indexes)
+	}
+	if stats.Evictions != maxSize/2 || stats.Rotations != 0 {
+		t.Fatalf("expected %d evictions and no rotations, got %d and %d", maxSize/2, stats.Evictions, stats.Rotations)
+	}
+
+	// A removed multihash frees its slot without evicting anything.
+	if s.Remove(value, mhs2[0]) != 1 {
+		t.Fatal("did not remove multihash")
+	}
+	s.Put(value, test.RandomMultihashes(1)...)
+	if s.Stats().Evictions != maxSize/2 {
+		t.Fatal("expected no eviction when putting into a removed multihash slot")
+	}
+}
+
+func TestCostAware(t *testing.T) {
+	const maxSize = 10
+	small := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     []byte("small"),
+		MetadataBytes: []byte("metadata"),
+	}
+	large := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     []byte("large"),
+		MetadataBytes: make([]byte, 4096),
+	}
+	mhsLarge := test.RandomMultihashes(maxSize / 2)
+	mhsSmall := test.RandomMultihashes(maxSize / 2)
+	mhsNew := test.RandomMultihashes(maxSize / 2)
+
+	// With Clock, the multihashes put first are evicted first. With CostAware,
+	// the multihashes with small values are evicted first, even though they
+	// were put later.
+	for _, strategy := range []Strategy{Clock, CostAware} {
+		s := New(maxSize, Eviction(strategy))
+		s.Put(large, mhsLarge...)
+		s.Put(small, mhsSmall...)
+		s.Put(small, mhsNew...)
+
+		kept, evicted := mhsSmall, mhsLarge
+		if strategy == CostAware {
+			kept, evicted = mhsLarge, mhsSmall
+		}
+		for _, m := range evicted {
+			if _, found := s.Get(m); found {
+				t.Fatalf("strategy %d: expected multihash to be evicted", strategy)
+			}
+		}
+		for _, m := range append(kept, mhsNew...) {
+			if _, found := s.Get(m); !found {
+				t.Fatalf("strategy %d: expected multihash to be cached", strategy)
+			}
+		}
+	}
+
+	// Lookups still keep multihashes with small values.
+	s := New(maxSize, Eviction(CostAware))
+	s.Put(large, mhsLarge...)
+	s.Put(small, mhsSmall...)
+	for i := 0; i < maxSize; i++ {
+		for _, m := range mhsSmall {
+			s.Get(m)
+		}
+	}
+	s.Put(small, mhsNew...)
+	for _, m := range mhsSmall {
+		if _, found := s.Get(m); !found {
+			t.Fatal("expected frequently used multihash to be cached")
+		}
+	}
+}
+
+func TestClockUnboundedGrowth(t *testing.T) {
+	const maxSize = 4
+	s := New(maxSize, Eviction(Clock))
+	mhs := test.RandomMultihashes(11)
+
+	mhash := mhs[0]
+	mhs = mhs[1:]
+	value := indexer.Value{
+		ProviderID:    provID,
+		MetadataBytes: []byte("metadata"),
+	}
+
+	for i := range mhs {
+		value.ContextID = []byte(mhs[i])
+		s.Put(value, mhash)
+		s.Remove(value, mhash)
+	}
+
+	st := s.Stats()
+	if st.Values > maxSize {
+		t.Fatal("Unbounded memory growth")
+	}
+}
+
+// BenchmarkExpectedKeys puts multihashes into an empty cache that uses the
+// Clock strategy, with and without the ExpectedKeys option.
+func BenchmarkExpectedKeys(b *testing.B) {
+	const mhCount = 65536
+	mhs := make([]multihash.Multihash, mhCount)
+	for i := range mhs {
+		var err error
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	value := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     ctxID,
+		MetadataBytes: []byte("metadata"),
+	}
+
+	for _, hint := range []int{0, mhCount} {
+		b.Run(fmt.Sprint("PutMany-hint", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := New(mhCount, Eviction(Clock), ExpectedKeys(hint))
+				s.Put(value, mhs...)
+			}
+		})
+	}
+}
+
+// BenchmarkSkewedHitRatio reports the hit ratio of each eviction strategy for
+// lookups that follow a Zipf distribution, where a missed multihash is put into
+// the cache. The frequently used multihashes are more than half of the cache,
+// so rotation evicts some of them at each rotation.
+func BenchmarkSkewedHitRatio(b *testing.B) {
+	const (
+		cacheSize = 4096
+		mhCount   = 65536
+	)
+	mhs := make([]multihash.Multihash, mhCount)
+	for i := range mhs {
+		var err error
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	value := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     ctxID,
+		MetadataBytes: []byte("metadata"),
+	}
+
+	for _, strategy := range []Strategy{Rotate, Clock} {
+		name := "rotate"
+		if strategy == Clock {
+			name = "clock"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := New(cacheSize, Eviction(strategy))
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.01, 1, mhCount-1)
+			var hits int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := mhs[zipf.Uint64()]
+				if _, found := s.Get(m); found {
+					hits++
+					continue
+				}
+				s.Put(value, m)
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+		})
+	}
+}
+
+// BenchmarkMixedSizeHitRatio reports the hit ratio of each eviction strategy,
+// and the bytes of values that hits saved reading from the value store, for
+// lookups that follow a Zipf distribution, where a missed multihash is put into
+// the cache. One in eight multihashes maps to a value with large metadata.
+func BenchmarkMixedSizeHitRatio(b *testing.B) {
+	const (
+		cacheSize = 4096
+		mhCount   = 65536
+	)
+	mhs := make([]multihash.Multihash, mhCount)
+	for i := range mhs {
+		var err error
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	small := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     []byte("small"),
+		MetadataBytes: []byte("metadata"),
+	}
+	large := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     []byte("large"),
+		MetadataBytes: make([]byte, 4096),
+	}
+	valueOf := func(n uint64) indexer.Value {
+		if n%8 == 0 {
+			return large
+		}
+		return small
+	}
+
+	for _, strategy := range []Strategy{Rotate, Clock, CostAware} {
+		name := "rotate"
+		switch strategy {
+		case Clock:
+			name = "clock"
+		case CostAware:
+			name = "costaware"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := New(cacheSize, Eviction(strategy))
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.01, 1, mhCount-1)
+			var hits int
+			var saved int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := zipf.Uint64()
+				if _, found := s.Get(mhs[n]); found {
+					hits++
+					saved += int64(len(valueOf(n).MetadataBytes))
+					continue
+				}
+				s.Put(valueOf(n), mhs[n])
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+			b.ReportMetric(float64(saved)/float64(b.N), "savedB/op")
+		})
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	for _, strategy := range []Strategy{Rotate, Clock, CostAware} {
+		s := New(200, Eviction(strategy))
+		mhs := test.RandomMultihashes(100)
+		values := make([]indexer.Value, 8)
+		for i := range values {
+			values[i] = indexer.Value{
+				ProviderID:    provID,
+				ContextID:     []byte(fmt.Sprint("test-ctx-", i)),
+				MetadataBytes: []byte("metadata"),
+			}
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(int64(w)))
+				for i := 0; i < 2000; i++ {
+					value := values[rng.Intn(len(values))]
+					start := rng.Intn(len(mhs) - 10)
+					switch rng.Intn(10) {
+					case 0:
+						s.RemoveProviderContext(value.ProviderID, value.ContextID)
+					case 1, 2:
+						s.Remove(value, mhs[start:start+10]...)
+					case 3, 4:
+						s.Get(mhs[start])
+					default:
+						s.Put(value, mhs[start:start+10]...)
+					}
+					s.Stats()
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		var indexes int
+		s.Range(func(multihash.Multihash, []indexer.Value) bool {
+			indexes++
+			return true
+		})
+		values2 := s.curEnts.Len()
+		if s.prevEnts != nil {
+			values2 += s.prevEnts.Len()
+		}
+		st := s.Stats()
+		if st.Indexes != indexes || s.IndexCount() != indexes {
+			t.Fatalf("expected %d indexes in stats, got %d", indexes, st.Indexes)
+		}
+		if st.Values != values2 {
+			t.Fatalf("expected %d values in stats, got %d", values2, st.Values)
+		}
+		if st.Rotations != s.rotations || st.Evictions != s.evictions {
+			t.Fatal("rotation and eviction stats do not match cache")
+		}
+	}
+}
+
+func TestProviderIndex(t *testing.T) {
+	provIDs := make([]peer.ID, 3)
+	for i := range provIDs {
+		m, err := multihash.Sum([]byte(fmt.Sprint("provider-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		provIDs[i] = peer.ID(m)
+	}
+	mhs := test.RandomMultihashes(64)
+
+	for _, strategy := range []Strategy{Rotate, Clock, CostAware} {
+		c := New(32, Eviction(strategy), ProviderIndex(true))
+		rng := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 2000; i++ {
+			value := indexer.Value{
+				ProviderID:    provIDs[rng.Intn(len(provIDs))],
+				ContextID:     []byte(fmt.Sprint("ctx-", rng.Intn(3))),
+				MetadataBytes: []byte("metadata"),
+			}
+			m := mhs[rng.Intn(len(mhs))]
+			switch op := rng.Intn(20); {
+			case op < 12:
+				c.Put(value, m)
+			case op < 16:
+				c.Get(m)
+			case op < 18:
+				c.Remove(value, m)
+			case op < 19:
+				c.RemoveProviderContext(value.ProviderID, value.ContextID)
+			default:
+				want := countProviderValues(c, value.ProviderID)
+				if n := c.RemoveProvider(value.ProviderID); n != want {
+					t.Fatalf("removed %d values of provider, expected %d", n, want)
+				}
+				if countProviderValues(c, value.ProviderID) != 0 {
+					t.Fatal("values of removed provider still cached")
+				}
+			}
+			checkProviderIndex(t, c)
+		}
+	}
+}
+
+// countProviderValues counts the values of the provider in each generation of
+// the cache.
+func countProviderValues(c *radixCache, providerID peer.ID) int {
+	var count int
+	walkFunc := func(k string, v interface{}) bool {
+		for _, val := range v.([]*indexer.Value) {
+			if val.ProviderID == providerID {
+				count++
+			}
+		}
+		return false
+	}
+	c.current.Walk("", walkFunc)
+	if c.previous != nil {
+		c.previous.Walk("", walkFunc)
+	}
+	return count
+}
+
+// checkProviderIndex checks that the provider index of each generation lists
+// exactly the multihashes that map to a value of each provider.
+func checkProviderIndex(t *testing.T, c *radixCache) {
+	check := func(tree *radixtree.Bytes, provs providerIndex) {
+		want := make(providerIndex)
+		if tree != nil {
+			tree.Walk("", func(k string, v interface{}) bool {
+				want.addValues(v.([]*indexer.Value), k)
+				return false
+			})
+		}
+		if len(provs) != len(want) {
+			t.Fatalf("provider index has %d providers, expected %d", len(provs), len(want))
+		}
+		for providerID, keys := range want {
+			if len(provs[providerID]) != len(keys) {
+				t.Fatalf("provider index has %d multihashes for provider, expected %d", len(provs[providerID]), len(keys))
+			}
+			for k := range keys {
+				if _, ok := provs[providerID][k]; !ok {
+					t.Fatal("multihash missing from provider index")
+				}
+			}
+		}
+	}
+	check(c.current, c.curProvs)
+	check(c.previous, c.prevProvs)
+}
+
+func TestConformance(t *testing.T) {
+	for _, strategy := range []Strategy{Rotate, Clock, CostAware} {
+		for _, provIndex := range []bool{false, true} {
+			cachetest.ConformanceTest(t, func() cache.Interface {
+				return New(1024, Eviction(strategy), ProviderIndex(provIndex))
+			})
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+	const maxSize = 20
+	value := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     ctxID,
+		MetadataBytes: []byte("metadata"),
+	}
+
+	for _, strategy := range []Strategy{Rotate, Clock} {
+		c := New(maxSize, Eviction(strategy), ProviderIndex(true))
+		mhs := test.RandomMultihashes(2)
+		pinned, unpinned := mhs[0], mhs[1]
+		c.Put(value, pinned, unpinned)
+		if !c.Pin(pinned) {
+			t.Fatal("could not pin multihash")
+		}
+
+		// Put enough multihashes to evict everything that is not pinned
+		// several times over.
+		for i := 0; i < 4; i++ {
+			c.Put(value, test.RandomMultihashes(maxSize)...)
+		}
+		if _, found := c.Get(unpinned); found {
+			t.Fatalf("strategy %d: expected unpinned multihash to be evicted", strategy)
+		}
+		vals, found := c.Get(pinned)
+		if !found {
+			t.Fatalf("strategy %d: expected pinned multihash to be cached", strategy)
+		}
+		if len(vals) != 1 || !vals[0].Equal(value) {
+			t.Fatalf("strategy %d: wrong values for pinned multihash", strategy)
+		}
+		checkProviderIndex(t, c)
+
+		// An unpinned multihash can be evicted again.
+		c.Unpin(pinned)
+		for i := 0; i < 4; i++ {
+			c.Put(value, test.RandomMultihashes(maxSize)...)
+		}
+		if _, found = c.Get(pinned); found {
+			t.Fatalf("strategy %d: expected unpinned multihash to be evicted", strategy)
+		}
+	}
+
+	// The number of pins is limited.
+	c := New(maxSize, MaxPins(2))
+	mhs := test.RandomMultihashes(3)
+	if !c.Pin(mhs[0]) || !c.Pin(mhs[1]) {
+		t.Fatal("could not pin multihash")
+	}
+	if !c.Pin(mhs[1]) {
+		t.Fatal("could not pin already pinned multihash")
+	}
+	if c.Pin(mhs[2]) {
+		t.Fatal("expected pin limit to be reached")
+	}
+	c.Unpin(mhs[0])
+	if !c.Pin(mhs[2]) {
+		t.Fatal("could not pin multihash after unpin")
+	}
+
+	// The limit cannot be more than a quarter of the cache.
+	c = New(maxSize, MaxPins(maxSize))
+	if c.maxPins != maxSize/4 {
+		t.Fatalf("expected max pins to be %d, got %d", maxSize/4, c.maxPins)
+	}
+}
+
+func TestClear(t *testing.T) {
+	value := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     ctxID,
+		MetadataBytes: []byte("metadata"),
+	}
+	for _, strategy := range []Strategy{Rotate, Clock} {
+		c := New(20, Eviction(strategy), ProviderIndex(true))
+		mhs := test.RandomMultihashes(15)
+		c.Put(value, mhs...)
+		c.Clear()
+		for _, m := range mhs {
+			if _, found := c.Get(m); found {
+				t.Fatalf("strategy %d: multihash found after clear", strategy)
+			}
+		}
+		stats := c.Stats()
+		if stats.Indexes != 0 || stats.Values != 0 {
+			t.Fatalf("strategy %d: expected empty cache, got %d indexes and %d values", strategy, stats.Indexes, stats.Values)
+		}
+		if stats.Evictions != len(mhs) {
+			t.Fatalf("strategy %d: expected %d evictions, got %d", strategy, len(mhs), stats.Evictions)
+		}
+
+		// The cache is usable after clearing.
+		c.Put(value, mhs...)
+		if _, found := c.Get(mhs[0]); !found {
+			t.Fatalf("strategy %d: multihash not found after put", strategy)
+		}
+		checkProviderIndex(t, c)
+	}
+}
+
+func TestEvictUnusedValues(t *testing.T) {
+	valueA := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     []byte("ctx-a"),
+		MetadataBytes: []byte("metadata-a"),
+	}
+	valueB := indexer.Value{
+		ProviderID:    provID,
+		ContextID:     []byte("ctx-b"),
+		MetadataBytes: []byte("metadata-b"),
+	}
+
+	for _, evictUnused := range []bool{false, true} {
+		// With the Rotate strategy, updating the metadata of valueA pulls it
+		// into the current generation, where it stays after its multihash is
+		// rotated out.
+		c := New(4, EvictUnusedValues(evictUnused))
+		mhs := test.RandomMultihashes(7)
+		c.Put(valueA, mhs[0])
+		c.Put(valueB, mhs[1:4]...)
+		valueA.MetadataBytes = []byte("metadata-a2")
+		c.Put(valueA)
+		c.Put(valueB, mhs[4:]...)
+		if _, found := c.Get(mhs[0]); found {
+			t.Fatal("multihash of valueA should have been rotated out")
+		}
+		checkInterned(t, c, &valueA, !evictUnused)
+		checkValueRefs(t, c)
+
+		// With the Clock strategy, valueA stays interned after its multihash
+		// is evicted.
+		c = New(4, Eviction(Clock), EvictUnusedValues(evictUnused))
+		c.Put(valueA, mhs[0])
+		c.Put(valueB, mhs[1:5]...)
+		if _, found := c.Get(mhs[0]); found {
+			t.Fatal("multihash of valueA should have been evicted")
+		}
+		checkInterned(t, c, &valueA, !evictUnused)
+		checkValueRefs(t, c)
+
+		stats := c.Stats()
+		if evictUnused && stats.ReleasedEntries != 1 {
+			t.Fatalf("expected 1 released entry, got %d", stats.ReleasedEntries)
+		}
+		if !evictUnused && stats.ReleasedEntries != 0 {
+			t.Fatalf("expected no released entries, got %d", stats.ReleasedEntries)
+		}
+	}
+
+	provIDs := make([]peer.ID, 3)
+	for i := range provIDs {
+		m, err := multihash.Sum([]byte(fmt.Sprint("provider-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		provIDs[i] = peer.ID(m)
+	}
+	mhs := test.RandomMultihashes(64)
+	for _, strategy := range []Strategy{Rotate, Clock, CostAware} {
+		c := New(32, Eviction(strategy), EvictUnusedValues(true))
+		c.Pin(mhs[0])
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 2000; i++ {
+			value := indexer.Value{
+				ProviderID:    provIDs[rng.Intn(len(provIDs))],
+				ContextID:     []byte(fmt.Sprint("ctx-", rng.Intn(8))),
+				MetadataBytes: []byte("metadata"),
+			}
+			m := mhs[rng.Intn(len(mhs))]
+			switch op := rng.Intn(20); {
+			case op < 12:
+				c.Put(value, m)
+			case op < 16:
+				c.Get(m)
+			case op < 18:
+				c.Remove(value, m)
+			case op < 19:
+				c.RemoveProviderContext(value.ProviderID, value.ContextID)
+			default:
+				c.RemoveProvider(value.ProviderID)
+			}
+			checkValueRefs(t, c)
+		}
+	}
+}
+
+// checkInterned checks whether the cache has an interned value for the
+// provider and context of value.
+func checkInterned(t *testing.T, c *radixCache, value *indexer.Value, want bool) {
+	t.Helper()
+	k := internKey(value)
+	_, found := c.curEnts.Get(k)
+	if !found && c.prevEnts != nil {
+		_, found = c.prevEnts.Get(k)
+	}
+	if found != want {
+		t.Fatalf("value interned is %t, expected %t", found, want)
+	}
+}
+
+// checkValueRefs checks that the reference count of each value is the number
+// of cached multihashes that map to it, and that every interned value is
+// referenced.
+func checkValueRefs(t *testing.T, c *radixCache) {
+	t.Helper()
+	if c.refs == nil {
+		return
+	}
+	want := make(valueRefs)
+	walkFunc := func(k string, v interface{}) bool {
+		want.add(v.([]*indexer.Value))
+		return false
+	}
+	c.current.Walk("", walkFunc)
+	if c.previous != nil {
+		c.previous.Walk("", walkFunc)
+	}
+	if len(c.refs) != len(want) {
+		t.Fatalf("cache counts references to %d values, expected %d", len(c.refs), len(want))
+	}
+	for val, n := range want {
+		if c.refs[val] != n {
+			t.Fatalf("value has %d references, expected %d", c.refs[val], n)
+		}
+	}
+	checkEnts := func(k string, v interface{}) bool {
+		if want[v.(*indexer.Value)] == 0 {
+			t.Fatal("interned value is not referenced by any multihash")
+		}
+		return false
+	}
+	c.curEnts.Walk("", checkEnts)
+	if c.prevEnts != nil {
+		c.prevEnts.Walk("", checkEnts)
+	}
+}
@@ -0,0 +1,102 @@
+package radixcache
+
+import (
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/gammazero/radixtree"
+)
+
+// valueRefs counts the cached multihashes that map to each interned value,
+// over both generations of multihashes. A multihash that is in both
+// generations is counted twice. All methods do nothing on a nil valueRefs,
+// which is used when the EvictUnusedValues option is not enabled.
+type valueRefs map[*indexer.Value]int
+
+// add counts one more reference to each of the values.
+func (vr valueRefs) add(values []*indexer.Value) {
+	if vr == nil {
+		return
+	}
+	for _, val := range values {
+		vr[val]++
+	}
+}
+
+// remove counts one less reference to the value, without evicting the value
+// when it is no longer referenced. This is used when the interned value is
+// removed along with its references.
+func (vr valueRefs) remove(val *indexer.Value) {
+	if vr == nil {
+		return
+	}
+	if n := vr[val]; n > 1 {
+		vr[val] = n - 1
+	} else {
+		delete(vr, val)
+	}
+}
+
+// release counts one less reference to each of the values, and evicts the
+// interned values that are no longer referenced by any cached multihash.
+func (c *radixCache) release(values []*indexer.Value) {
+	if c.refs == nil {
+		return
+	}
+	for _, val := range values {
+		n, ok := c.refs[val]
+		if !ok {
+			continue
+		}
+		if n > 1 {
+			c.refs[val] = n - 1
+			continue
+		}
+		delete(c.refs, val)
+		if c.evictIntern(val) {
+			c.releasedEntries++
+		}
+	}
+}
+
+// evictIntern removes the value from the interned values, if it is the
+// interned value for its provider and context. Returns true if the value was
+// removed.
+func (c *radixCache) evictIntern(val *indexer.Value) bool {
+	k := internKey(val)
+	if v, found := c.curEnts.Get(k); found && v.(*indexer.Value) == val {
+		c.curEnts.Delete(k)
+		return true
+	}
+	if c.prevEnts != nil {
+		if v, found := c.prevEnts.Get(k); found && v.(*indexer.Value) == val {
+			c.prevEnts.Delete(k)
+			return true
+		}
+	}
+	return false
+}
+
+// replaceRefs updates the reference counts when the values that k maps to in
+// the current generation are replaced by values.
+func (c *radixCache) replaceRefs(k string, values []*indexer.Value) {
+	if c.refs == nil {
+		return
+	}
+	// Count the new references first, so that a value that k still maps to is
+	// not evicted.
+	c.refs.add(values)
+	if v, found := c.current.Get(k); found {
+		c.release(v.([]*indexer.Value))
+	}
+}
+
+// releaseTree releases the values of every multihash in the generation that
+// is about to be evicted.
+func (c *radixCache) releaseTree(tree *radixtree.Bytes) {
+	if c.refs == nil {
+		return
+	}
+	tree.Walk("", func(k string, v interface{}) bool {
+		c.release(v.([]*indexer.Value))
+		return false
+	})
+}
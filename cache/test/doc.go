@@ -0,0 +1,3 @@
+// Package test provides tests that are usable by any cache that implements
+// cache.Interface.
+package test
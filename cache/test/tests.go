@@ -0,0 +1,179 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/cache"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// ConformanceTest runs the same operations on a cache created by newCache and
+// on an in-memory value store, and checks that the cache returns the same
+// values as the value store after each operation. The cache must be able to
+// hold at least 32 multihashes without evicting any.
+//
+// Some value store behavior has no equivalent in a cache, and is not tested:
+//   - A cache does not return errors, so putting a value without metadata is
+//     not rejected.
+//   - A cache has no Iter, Size, Flush or Close.
+func ConformanceTest(t *testing.T, newCache func() cache.Interface) {
+	prov1, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov2, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mhs := test.RandomMultihashes(15)
+	single := mhs[0]
+	batch := mhs[1:10]
+	remove := mhs[1]
+	other := mhs[10:]
+
+	value1 := indexer.Value{
+		ProviderID:    prov1,
+		ContextID:     []byte("ctx-1"),
+		MetadataBytes: []byte("test-meta-1"),
+	}
+	value1a := indexer.Value{
+		ProviderID:    prov1,
+		ContextID:     []byte("ctx-1"),
+		MetadataBytes: []byte("test-meta-1a"),
+	}
+	value2 := indexer.Value{
+		ProviderID:    prov1,
+		ContextID:     []byte("ctx-2"),
+		MetadataBytes: []byte("test-meta-2"),
+	}
+	value3 := indexer.Value{
+		ProviderID:    prov2,
+		ContextID:     []byte("ctx-3"),
+		MetadataBytes: []byte("test-meta-3"),
+	}
+
+	c := newCache()
+	s := memory.New()
+	defer s.Close()
+
+	put := func(value indexer.Value, wantCount int, mhs ...multihash.Multihash) {
+		t.Helper()
+		if n := c.Put(value, mhs...); n != wantCount {
+			t.Fatalf("cache put %d multihashes, expected %d", n, wantCount)
+		}
+		if err := s.Put(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm := func(value indexer.Value, wantCount int, mhs ...multihash.Multihash) {
+		t.Helper()
+		if n := c.Remove(value, mhs...); n != wantCount {
+			t.Fatalf("cache removed %d multihashes, expected %d", n, wantCount)
+		}
+		if err := s.Remove(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Log("Put a single multihash, and put it again")
+	put(value1, 1, single)
+	put(value1, 0, single)
+	compare(t, c, s, mhs)
+
+	t.Log("Put a batch of multihashes")
+	put(value1, len(batch), batch...)
+	compare(t, c, s, mhs)
+
+	t.Log("Put another value on an existing multihash")
+	put(value2, 1, single)
+	compare(t, c, s, mhs)
+
+	t.Log("Update metadata with no multihashes")
+	put(value1a, 0)
+	compare(t, c, s, mhs)
+
+	t.Log("Put new value with no multihashes")
+	put(value3, 0)
+	put(value3, len(other), other...)
+	compare(t, c, s, mhs)
+
+	t.Log("Remove the only value of a multihash")
+	rm(value1, 1, remove)
+	compare(t, c, s, mhs)
+
+	t.Log("Remove one of the values of a multihash")
+	rm(value1, 1, single)
+	compare(t, c, s, mhs)
+
+	t.Log("Remove a value that is not mapped")
+	rm(value1, 0, single, remove)
+	compare(t, c, s, mhs)
+
+	t.Log("Remove provider context")
+	if n := c.RemoveProviderContext(prov1, value2.ContextID); n != 1 {
+		t.Fatalf("cache removed %d multihashes for provider context, expected 1", n)
+	}
+	if err = s.RemoveProviderContext(prov1, value2.ContextID); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, c, s, mhs)
+
+	t.Log("Remove provider")
+	put(value2, 1, other[0])
+	if n := c.RemoveProvider(prov1); n != len(batch) {
+		t.Fatalf("cache removed %d multihashes for provider, expected %d", n, len(batch))
+	}
+	if err = s.RemoveProvider(context.Background(), prov1); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, c, s, mhs)
+
+	if n := c.IndexCount(); n != len(other) {
+		t.Fatalf("cache has %d multihashes, expected %d", n, len(other))
+	}
+}
+
+// compare checks that the cache and the value store have the same values for
+// each of the multihashes. The values of a multihash may be in any order.
+func compare(t *testing.T, c cache.Interface, s indexer.Interface, mhs []multihash.Multihash) {
+	t.Helper()
+	for i, m := range mhs {
+		want, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			want = nil
+		}
+		got, found := c.Get(m)
+		if found != (len(want) != 0) {
+			t.Fatalf("multihash %d: cache returned found %t with %d values expected", i, found, len(want))
+		}
+		if err = sameValues(got, want); err != nil {
+			t.Fatalf("multihash %d: %s", i, err)
+		}
+	}
+}
+
+func sameValues(got, want []indexer.Value) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("cache has %d values, expected %d", len(got), len(want))
+	}
+next:
+	for _, w := range want {
+		for _, g := range got {
+			if g.Equal(w) {
+				continue next
+			}
+		}
+		return fmt.Errorf("cache does not have value for context %q with metadata %q", w.ContextID, w.MetadataBytes)
+	}
+	return nil
+}
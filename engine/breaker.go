@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+)
+
+// ErrStoreUnavailable is returned by writes to an Engine while its circuit
+// breaker is open, because the value store has failed too many writes in a
+// row.
+var ErrStoreUnavailable = errors.New("value store unavailable")
+
+// breaker is a circuit breaker for writes to the value store. It opens after
+// threshold writes in a row fail, and then fails writes without trying them
+// until the cooldown has passed. After the cooldown, one write is let through
+// as a probe. If the probe succeeds the breaker closes, and otherwise it stays
+// open for another cooldown. All methods do nothing on a nil breaker, which is
+// used when the CircuitBreaker option is not set.
+type breaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	// openUntil is the time when the next probe can be made, and is zero
+	// when the breaker is closed.
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns ErrStoreUnavailable if a write must not be tried because the
+// breaker is open. Otherwise, the write may be tried, and its result must be
+// given to done.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrStoreUnavailable
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the result of a write that allow let through.
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	probe := b.probing
+	b.probing = false
+	if !storeFailed(err) {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if probe || b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// storeFailed returns true if err is a failure of the value store, as opposed
+// to no error, or an error caused by the caller.
+func storeFailed(err error) bool {
+	return err != nil &&
+		!errors.Is(err, indexer.ErrMissingMetadata) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// reset closes the breaker and forgets past failures.
+func (b *breaker) reset() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+	b.mutex.Unlock()
+}
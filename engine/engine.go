@@ -2,6 +2,7 @@ package engine
 
 import (
 	"context"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,9 +17,18 @@ import (
 // Engine is an implementation of indexer.Interface that combines a result
 // cache and a value store.
 type Engine struct {
+	// Accessed atomically; must be first in struct for 64-bit alignment.
+	cacheHits   uint64
+	cacheMisses uint64
+
 	resultCache cache.Interface
 	valueStore  indexer.Interface
 	cacheOnPut  bool
+	cachePart   bool
+	breaker     *breaker
+	// storeLock is held for reading by operations that use the value store,
+	// and for writing while the value store is swapped.
+	storeLock sync.RWMutex
 
 	prevCacheStats atomic.Value
 }
@@ -37,11 +47,19 @@ func New(resultCache cache.Interface, valueStore indexer.Interface, options ...O
 	if valueStore == nil {
 		panic("valueStore is required")
 	}
-	return &Engine{
+	e := &Engine{
 		resultCache: resultCache,
 		valueStore:  valueStore,
 		cacheOnPut:  cfg.cacheOnPut,
+		cachePart:   cfg.partialCache,
+	}
+	if cfg.breakerThreshold != 0 {
+		e.breaker = &breaker{
+			threshold: cfg.breakerThreshold,
+			cooldown:  cfg.breakerCooldown,
+		}
 	}
+	return e
 }
 
 func (e *Engine) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
@@ -51,6 +69,9 @@ func (e *Engine) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
 		stats.Record(ctx, metrics.GetIndexLatency.M(metrics.MsecSince(startTime)))
 	}()
 
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
 	if e.resultCache == nil {
 		// If no result cache, get from value store.
 		return e.valueStore.Get(m)
@@ -59,6 +80,7 @@ func (e *Engine) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
 	// Check if multihash in resultCache.
 	v, found := e.resultCache.Get(m)
 	if !found {
+		atomic.AddUint64(&e.cacheMisses, 1)
 		stats.Record(ctx, metrics.CacheMisses.M(1))
 		var err error
 		v, found, err = e.valueStore.Get(m)
@@ -73,12 +95,55 @@ func (e *Engine) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
 			e.updateCacheStats()
 		}
 	} else {
+		atomic.AddUint64(&e.cacheHits, 1)
 		stats.Record(ctx, metrics.CacheHits.M(1))
+		if e.cachePart {
+			return e.mergeStored(m, v)
+		}
 	}
 	return v, found, nil
 }
 
+// mergeStored returns the union of the cached values of the multihash and the
+// values in the value store. A value in both, with the same provider ID and
+// context ID, is returned as it is in the value store.
+func (e *Engine) mergeStored(m multihash.Multihash, cached []indexer.Value) ([]indexer.Value, bool, error) {
+	stored, _, err := e.valueStore.Get(m)
+	if err != nil {
+		return nil, false, err
+	}
+
+	merged := stored
+	var stale bool
+cached:
+	for _, cv := range cached {
+		for _, sv := range stored {
+			if isMatch, isEqual := cv.MatchEqual(sv); isMatch {
+				if !isEqual {
+					stale = true
+				}
+				continue cached
+			}
+		}
+		merged = append(merged, cv)
+	}
+	// Update the cache if it is missing stored values or has old metadata.
+	if len(merged) != len(cached) || stale {
+		for i := range stored {
+			e.resultCache.Put(stored[i], m)
+		}
+		e.updateCacheStats()
+	}
+	return merged, true, nil
+}
+
 func (e *Engine) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	if err := e.breaker.allow(); err != nil {
+		return err
+	}
 	if e.resultCache != nil {
 		var addToCache, mhsCopy []multihash.Multihash
 		for i := 0; i < len(mhs); {
@@ -126,6 +191,7 @@ func (e *Engine) Put(value indexer.Value, mhs ...multihash.Multihash) error {
 		e.updateCacheStats()
 	}
 	err := e.valueStore.Put(value, mhs...)
+	e.breaker.done(err)
 	if err != nil {
 		return err
 	}
@@ -134,8 +200,15 @@ func (e *Engine) Put(value indexer.Value, mhs ...multihash.Multihash) error {
 }
 
 func (e *Engine) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	if err := e.breaker.allow(); err != nil {
+		return err
+	}
 	// Remove first from valueStore.
 	err := e.valueStore.Remove(value, mhs...)
+	e.breaker.done(err)
 	if err != nil {
 		return err
 	}
@@ -150,8 +223,15 @@ func (e *Engine) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
 }
 
 func (e *Engine) RemoveProvider(ctx context.Context, providerID peer.ID) error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	if err := e.breaker.allow(); err != nil {
+		return err
+	}
 	// Remove first from valueStore.
 	err := e.valueStore.RemoveProvider(ctx, providerID)
+	e.breaker.done(err)
 	if err != nil {
 		return err
 	}
@@ -167,8 +247,15 @@ func (e *Engine) RemoveProvider(ctx context.Context, providerID peer.ID) error {
 }
 
 func (e *Engine) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	if err := e.breaker.allow(); err != nil {
+		return err
+	}
 	// Remove first from valueStore.
 	err := e.valueStore.RemoveProviderContext(providerID, contextID)
+	e.breaker.done(err)
 	if err != nil {
 		return err
 	}
@@ -183,21 +270,159 @@ func (e *Engine) RemoveProviderContext(providerID peer.ID, contextID []byte) err
 }
 
 func (e *Engine) Size() (int64, error) {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
 	return e.valueStore.Size()
 }
 
 func (e *Engine) Flush() error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
 	return e.valueStore.Flush()
 }
 
 func (e *Engine) Close() error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
 	return e.valueStore.Close()
 }
 
+// Ping pings the value store. The result cache is in memory and always
+// responds.
+func (e *Engine) Ping(ctx context.Context) error {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+	return e.valueStore.Ping(ctx)
+}
+
 func (e *Engine) Iter() (indexer.Iterator, error) {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
 	return e.valueStore.Iter()
 }
 
+// Stats is a snapshot of result cache and value store statistics. Any
+// statistic that the cache or value store does not provide is zero.
+type Stats struct {
+	// CacheHits is the number of multihash lookups answered by the cache.
+	CacheHits uint64
+	// CacheMisses is the number of multihash lookups not found in the cache.
+	CacheMisses uint64
+	// CacheHitRatio is CacheHits divided by the total number of lookups.
+	CacheHitRatio float64
+	// CacheIndexes is the number of multihashes in the cache.
+	CacheIndexes int
+	// CacheValues is the number of values interned in the cache.
+	CacheValues int
+	// CacheEvictions is the number of multihashes evicted from the cache.
+	CacheEvictions int
+	// CacheRotations is the number of times the cache has been rotated.
+	CacheRotations int
+	// CacheEvictedEntries is the number of values dropped from the cache by
+	// rotations.
+	CacheEvictedEntries int
+	// CacheReleasedEntries is the number of values dropped from the cache
+	// because no cached multihash maps to them.
+	CacheReleasedEntries int
+
+	// StoreIndexes is the number of multihashes in the value store.
+	StoreIndexes int
+	// StoreValues is the number of values in the value store.
+	StoreValues int
+	// StoreSize is the number of bytes used by the value store.
+	StoreSize int64
+	// StorePrunedValueKeys is the number of dangling value-keys that the value
+	// store has pruned.
+	StorePrunedValueKeys uint64
+	// StoreCorruptValues is the number of values that the value store could
+	// not decode and left out of read results.
+	StoreCorruptValues uint64
+	// StoreValueLockWait is the total time the value store has spent waiting
+	// to lock values, if it records lock waits.
+	StoreValueLockWait time.Duration
+	// StoreKeyLockWait is the total time the value store has spent waiting to
+	// lock individual keys, if it records lock waits.
+	StoreKeyLockWait time.Duration
+	// StoreMaxValueKeys is the largest number of values that the value store
+	// has seen a multihash map to.
+	StoreMaxValueKeys int
+	// StoreAvgValueKeys is the average number of values that the value store
+	// has seen multihashes map to.
+	StoreAvgValueKeys float64
+}
+
+// Stats returns a snapshot of cache and value store statistics. If the
+// statistics cannot be collected before the context is done, then the
+// context's error is returned.
+func (e *Engine) Stats(ctx context.Context) (*Stats, error) {
+	type result struct {
+		st  *Stats
+		err error
+	}
+	// Buffered so that the goroutine can exit if the caller stops waiting.
+	resultChan := make(chan result, 1)
+	go func() {
+		st, err := e.collectStats()
+		resultChan <- result{st, err}
+	}()
+
+	select {
+	case r := <-resultChan:
+		return r.st, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (e *Engine) collectStats() (*Stats, error) {
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	st := &Stats{
+		CacheHits:   atomic.LoadUint64(&e.cacheHits),
+		CacheMisses: atomic.LoadUint64(&e.cacheMisses),
+	}
+	if lookups := st.CacheHits + st.CacheMisses; lookups != 0 {
+		st.CacheHitRatio = float64(st.CacheHits) / float64(lookups)
+	}
+
+	if e.resultCache != nil {
+		cst := e.resultCache.Stats()
+		st.CacheIndexes = cst.Indexes
+		st.CacheValues = cst.Values
+		st.CacheEvictions = cst.Evictions
+		st.CacheRotations = cst.Rotations
+		st.CacheEvictedEntries = cst.EvictedEntries
+		st.CacheReleasedEntries = cst.ReleasedEntries
+	}
+
+	size, err := e.valueStore.Size()
+	if err != nil {
+		return nil, err
+	}
+	st.StoreSize = size
+
+	// Not all value stores provide statistics.
+	if sp, ok := e.valueStore.(interface {
+		Stats() (*indexer.Stats, error)
+	}); ok {
+		sst, err := sp.Stats()
+		if err != nil {
+			return nil, err
+		}
+		st.StoreIndexes = sst.Indexes
+		st.StoreValues = sst.Values
+		st.StorePrunedValueKeys = sst.PrunedValueKeys
+		st.StoreCorruptValues = sst.CorruptValues
+		st.StoreValueLockWait = sst.ValueLockWait
+		st.StoreKeyLockWait = sst.KeyLockWait
+		st.StoreMaxValueKeys = sst.MaxValueKeys
+		st.StoreAvgValueKeys = sst.AvgValueKeys
+	}
+
+	return st, nil
+}
+
 func (e *Engine) updateCacheStats() {
 	st := e.resultCache.Stats()
 	var prevStats *cache.Stats
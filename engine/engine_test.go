@@ -1,15 +1,20 @@
 package engine
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/go-indexer-core"
 	"github.com/filecoin-project/go-indexer-core/cache"
 	"github.com/filecoin-project/go-indexer-core/cache/radixcache"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
 	"github.com/filecoin-project/go-indexer-core/store/storethehash"
 	"github.com/filecoin-project/go-indexer-core/store/test"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
 )
 
 func initEngine(t *testing.T, withCache, cacheOnPut bool) *Engine {
@@ -688,3 +693,534 @@ func SizeTest(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// statsStore is a value store that reports fixed statistics.
+type statsStore struct {
+	indexer.Interface
+	stats indexer.Stats
+}
+
+func (s *statsStore) Stats() (*indexer.Stats, error) {
+	st := s.stats
+	return &st, nil
+}
+
+func TestStats(t *testing.T) {
+	eng := New(radixcache.New(1000), memory.New())
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(3)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("metadata"),
+	}
+	if err = eng.Put(value, mhs[:2]...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Miss that loads the cache, hit from the cache, and a miss that is not
+	// found anywhere.
+	for _, m := range []multihash.Multihash{mhs[0], mhs[0], mhs[2]} {
+		if _, _, err = eng.Get(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := eng.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.CacheHits != 1 || st.CacheMisses != 2 {
+		t.Fatalf("expected 1 hit and 2 misses, got %d and %d", st.CacheHits, st.CacheMisses)
+	}
+	if st.CacheHitRatio < 0.33 || st.CacheHitRatio > 0.34 {
+		t.Fatalf("wrong hit ratio: %f", st.CacheHitRatio)
+	}
+	if st.CacheIndexes != 1 || st.CacheValues != 1 {
+		t.Fatalf("expected 1 cached index and value, got %d and %d", st.CacheIndexes, st.CacheValues)
+	}
+	if st.StoreIndexes != 2 || st.StoreValues != 1 {
+		t.Fatalf("expected 2 stored indexes and 1 value, got %d and %d", st.StoreIndexes, st.StoreValues)
+	}
+
+	// Without a cache, and with a value store that does not count indexes or
+	// values, those stats are zero.
+	eng = initEngine(t, false, false)
+	if err = eng.Put(value, mhs[:2]...); err != nil {
+		t.Fatal(err)
+	}
+	st, err = eng.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.StoreIndexes != 0 || st.StoreValues != 0 || st.CacheIndexes != 0 {
+		t.Fatal("expected zero values for untracked stats")
+	}
+	if err = eng.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counters kept only by the value store are copied from its stats.
+	eng = New(nil, &statsStore{
+		Interface: memory.New(),
+		stats:     indexer.Stats{PrunedValueKeys: 2, CorruptValues: 3},
+	})
+	st, err = eng.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.StorePrunedValueKeys != 2 || st.StoreCorruptValues != 3 {
+		t.Fatalf("expected 2 pruned value-keys and 3 corrupt values, got %d and %d", st.StorePrunedValueKeys, st.StoreCorruptValues)
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	eng := New(radixcache.New(1000), memory.New(), CacheOnPut(true))
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(10)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("metadata")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("metadata")}
+	if err = eng.Put(value1, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err = eng.Put(value2, mhs[:5]...); err != nil {
+		t.Fatal(err)
+	}
+
+	mm, err := eng.VerifyConsistency(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Checked != len(mhs) || len(mm.Found) != 0 {
+		t.Fatalf("expected %d consistent multihashes, got %d checked and %d mismatches", len(mhs), mm.Checked, len(mm.Found))
+	}
+
+	// Change the value store without going through the engine.
+	if err = eng.valueStore.Remove(value2, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	mm, err = eng.VerifyConsistency(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm.Found) != 1 || !bytes.Equal(mm.Found[0].Multihash, mhs[0]) {
+		t.Fatalf("expected 1 mismatch for changed multihash, got %d", len(mm.Found))
+	}
+	if len(mm.Found[0].Cached) != 2 || len(mm.Found[0].Stored) != 1 {
+		t.Fatal("mismatch has wrong values")
+	}
+
+	// Sampling checks fewer multihashes.
+	mm, err = eng.VerifyConsistency(context.Background(), 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mm.Checked == len(mhs) {
+		t.Fatal("expected sample to check fewer multihashes")
+	}
+
+	if _, err = eng.VerifyConsistency(context.Background(), 0); err == nil {
+		t.Fatal("expected error for zero sample rate")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	valueStore := memory.New()
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(20)
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctxid"), MetadataBytes: []byte("metadata")}
+	if err = valueStore.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strategy := range []WarmStrategy{WarmFirst, WarmSample} {
+		eng := New(radixcache.New(1000), valueStore)
+		n, err := eng.Warm(context.Background(), 5, strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 5 || eng.resultCache.IndexCount() != 5 {
+			t.Fatalf("expected 5 cached multihashes, got %d and %d in cache", n, eng.resultCache.IndexCount())
+		}
+
+		// Asking for more than the value store has caches everything.
+		n, err = eng.Warm(context.Background(), 100, strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(mhs) || eng.resultCache.IndexCount() != len(mhs) {
+			t.Fatalf("expected %d cached multihashes, got %d", len(mhs), n)
+		}
+		vals, found := eng.resultCache.Get(mhs[0])
+		if !found || len(vals) != 1 || !vals[0].Equal(value) {
+			t.Fatal("warmed cache has wrong values")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	eng := New(radixcache.New(1000), valueStore)
+	if _, err = eng.Warm(ctx, 5, WarmFirst); err != context.Canceled {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if eng.resultCache.IndexCount() != 0 {
+		t.Fatal("canceled warm should not cache anything")
+	}
+}
+
+// countingStore is a value store that counts the multihashes put into it.
+type countingStore struct {
+	indexer.Interface
+	puts int
+}
+
+func (s *countingStore) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	s.puts += len(mhs)
+	return s.Interface.Put(value, mhs...)
+}
+
+func TestFlushCache(t *testing.T) {
+	valueStore := &countingStore{Interface: memory.New()}
+	resultCache := radixcache.New(1000)
+	eng := New(resultCache, valueStore, CacheOnPut(true))
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(10)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("metadata")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("metadata")}
+
+	// Persisted through the engine.
+	if err = eng.Put(value1, mhs[:5]...); err != nil {
+		t.Fatal(err)
+	}
+	// Only in the cache.
+	resultCache.Put(value2, mhs[3:]...)
+	valueStore.puts = 0
+
+	if _, found, _ := valueStore.Get(mhs[7]); found {
+		t.Fatal("cache-only multihash should not be in value store before flush")
+	}
+	if err = eng.FlushCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Only the cache-only entries are written.
+	if valueStore.puts != 7 {
+		t.Fatalf("expected 7 multihashes put, got %d", valueStore.puts)
+	}
+	for i, m := range mhs {
+		vals, found, err := valueStore.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []indexer.Value
+		if i < 5 {
+			expected = append(expected, value1)
+		}
+		if i >= 3 {
+			expected = append(expected, value2)
+		}
+		if !found || !equalValues(vals, expected) {
+			t.Fatalf("value store has wrong values for multihash %d after flush", i)
+		}
+	}
+
+	// Flushing again writes nothing.
+	valueStore.puts = 0
+	if err = eng.FlushCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if valueStore.puts != 0 {
+		t.Fatalf("expected nothing put by second flush, got %d", valueStore.puts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = eng.FlushCache(ctx); err != context.Canceled {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+}
+
+// failingStore is a value store whose writes fail while fail is set.
+type failingStore struct {
+	indexer.Interface
+	fail  bool
+	calls int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (s *failingStore) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	s.calls++
+	if s.fail {
+		return errDiskFull
+	}
+	return s.Interface.Put(value, mhs...)
+}
+
+func (s *failingStore) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	s.calls++
+	if s.fail {
+		return errDiskFull
+	}
+	return s.Interface.Remove(value, mhs...)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const (
+		threshold = 3
+		cooldown  = 50 * time.Millisecond
+	)
+	valueStore := &failingStore{Interface: memory.New(), fail: true}
+	eng := New(radixcache.New(1000), valueStore, CircuitBreaker(threshold, cooldown))
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(10)
+
+	// Errors caused by the caller do not open the breaker.
+	valueStore.fail = false
+	for i := 0; i < threshold; i++ {
+		if err = eng.Put(indexer.Value{ProviderID: p}, mhs[0]); !errors.Is(err, indexer.ErrMissingMetadata) {
+			t.Fatalf("expected ErrMissingMetadata, got %v", err)
+		}
+	}
+	if err = eng.Put(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	valueStore.fail = true
+
+	// The breaker opens after threshold failed writes in a row.
+	for i := 0; i < threshold; i++ {
+		if err = eng.Put(value, mhs[1]); err != errDiskFull {
+			t.Fatalf("expected store error, got %v", err)
+		}
+	}
+	calls := valueStore.calls
+	if err = eng.Put(value, mhs[1]); err != ErrStoreUnavailable {
+		t.Fatalf("expected ErrStoreUnavailable, got %v", err)
+	}
+	if err = eng.Remove(value, mhs[0]); err != ErrStoreUnavailable {
+		t.Fatalf("expected ErrStoreUnavailable, got %v", err)
+	}
+	if valueStore.calls != calls {
+		t.Fatal("value store was called while breaker was open")
+	}
+	// Lookups still work.
+	if _, found, err := eng.Get(mhs[0]); err != nil || !found {
+		t.Fatal("lookup failed while breaker was open")
+	}
+
+	// A failed probe keeps the breaker open for another cooldown.
+	time.Sleep(cooldown)
+	if err = eng.Put(value, mhs[1]); err != errDiskFull {
+		t.Fatalf("expected probe to reach the store, got %v", err)
+	}
+	if err = eng.Put(value, mhs[1]); err != ErrStoreUnavailable {
+		t.Fatalf("expected ErrStoreUnavailable after failed probe, got %v", err)
+	}
+
+	// A successful probe closes the breaker.
+	valueStore.fail = false
+	time.Sleep(cooldown)
+	for _, m := range mhs[1:] {
+		if err = eng.Put(value, m); err != nil {
+			t.Fatalf("expected write to succeed after recovery, got %v", err)
+		}
+	}
+	if _, found, err := eng.Get(mhs[len(mhs)-1]); err != nil || !found {
+		t.Fatal("multihash not stored after recovery")
+	}
+}
+
+// blockingStore is a value store whose Put waits until release is closed.
+type blockingStore struct {
+	indexer.Interface
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	close(s.started)
+	<-s.release
+	return s.Interface.Put(value, mhs...)
+}
+
+func TestSwapStore(t *testing.T) {
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldValue := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("old"),
+		MetadataBytes: []byte("metadata"),
+	}
+	newValue := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("new"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(20)
+
+	oldStore := memory.New()
+	newStore := memory.New()
+	if err = oldStore.Put(oldValue, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err = newStore.Put(newValue, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	eng := New(radixcache.New(1000), oldStore)
+
+	// Read and write from several goroutines while the store is swapped. Each
+	// lookup sees the values of only one store.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			extra := test.RandomMultihashes(1)
+			for ctx.Err() == nil {
+				if err := eng.Put(oldValue, extra...); err != nil {
+					errs <- err
+					return
+				}
+				vals, found, err := eng.Get(mhs[i])
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !found || len(vals) != 1 {
+					errs <- errors.New("lookup saw a half-swapped store")
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err = eng.SwapStore(context.Background(), newStore); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	for i := 0; i < 4; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Lookups after the swap read the new store, not values cached from the
+	// old one.
+	for _, m := range mhs {
+		vals, found, err := eng.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(newValue) {
+			t.Fatal("lookup after swap did not read the new store")
+		}
+	}
+
+	// A swap that cannot drain operations in progress before the context is
+	// done does not change the store.
+	blocking := &blockingStore{
+		Interface: newStore,
+		started:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	if err = eng.SwapStore(context.Background(), blocking); err != nil {
+		t.Fatal(err)
+	}
+	putDone := make(chan error, 1)
+	go func() {
+		putDone <- eng.Put(newValue, test.RandomMultihashes(1)...)
+	}()
+	<-blocking.started
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = eng.SwapStore(timeoutCtx, oldStore); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	close(blocking.release)
+	if err = <-putDone; err != nil {
+		t.Fatal(err)
+	}
+	if eng.valueStore != blocking {
+		t.Fatal("store was swapped after context was done")
+	}
+	// The engine is usable after the canceled swap.
+	if _, _, err = eng.Get(mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialCache(t *testing.T) {
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value1 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-1"),
+		MetadataBytes: []byte("metadata-1"),
+	}
+	value2 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-2"),
+		MetadataBytes: []byte("metadata-2"),
+	}
+	m := test.RandomMultihashes(1)[0]
+
+	for _, partial := range []bool{false, true} {
+		valueStore := memory.New()
+		resultCache := radixcache.New(1000)
+		if err = valueStore.Put(value1, m); err != nil {
+			t.Fatal(err)
+		}
+		if err = valueStore.Put(value2, m); err != nil {
+			t.Fatal(err)
+		}
+		// The cache only has one of the values, as if partly warmed.
+		resultCache.Put(value1, m)
+		eng := New(resultCache, valueStore, PartialCache(partial))
+
+		vals, found, err := eng.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatal("multihash not found")
+		}
+		if !partial {
+			if len(vals) != 1 || !vals[0].Equal(value1) {
+				t.Fatal("expected only the cached value without partial cache")
+			}
+			continue
+		}
+		if !equalValues(vals, []indexer.Value{value1, value2}) {
+			t.Fatalf("expected union of cached and stored values, got %d values", len(vals))
+		}
+		// The missing value is added to the cache.
+		cached, _ := resultCache.Get(m)
+		if !equalValues(cached, []indexer.Value{value1, value2}) {
+			t.Fatal("stored value was not added to the cache")
+		}
+	}
+}
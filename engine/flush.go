@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"context"
+	"errors"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+// FlushCache makes sure that every multihash and value in the result cache is
+// also in the value store, by putting each cached value into the value store
+// for the cached multihashes that the value store does not already map to it.
+// Entries that are already in the value store are skipped. This is meant to be
+// called before shutdown, or before clearing the cache, when the cache may
+// hold entries that were not written to the value store.
+//
+// The value store is read once for each cached multihash, and written once for
+// each cached value that is missing for any multihash.
+func (e *Engine) FlushCache(ctx context.Context) error {
+	if e.resultCache == nil {
+		return nil
+	}
+	rc, ok := e.resultCache.(rangeCache)
+	if !ok {
+		return errors.New("result cache cannot list its contents")
+	}
+
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	type entry struct {
+		m      multihash.Multihash
+		values []indexer.Value
+	}
+	// Copy the entries out of the cache first, so that the cache is not
+	// locked while reading and writing the value store.
+	var entries []entry
+	rc.Range(func(m multihash.Multihash, values []indexer.Value) bool {
+		entries = append(entries, entry{m, values})
+		return ctx.Err() == nil
+	})
+
+	// Group the missing multihashes by value, so that each value is put once.
+	type group struct {
+		value indexer.Value
+		mhs   []multihash.Multihash
+	}
+	var groups []*group
+	// Groups keyed by provider ID and context ID. A provider ID is a
+	// multihash, which encodes its own length, so the two can be
+	// concatenated to make a unique key.
+	byValue := make(map[string][]*group)
+	for _, ent := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stored, _, err := e.valueStore.Get(ent.m)
+		if err != nil {
+			return err
+		}
+	values:
+		for _, value := range ent.values {
+			for i := range stored {
+				if stored[i].Equal(value) {
+					continue values
+				}
+			}
+			vk := string(value.ProviderID) + string(value.ContextID)
+			var g *group
+			for _, vg := range byValue[vk] {
+				if vg.value.Equal(value) {
+					g = vg
+					break
+				}
+			}
+			if g == nil {
+				g = &group{value: value}
+				byValue[vk] = append(byValue[vk], g)
+				groups = append(groups, g)
+			}
+			g.mhs = append(g.mhs, ent.m)
+		}
+	}
+
+	for _, g := range groups {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := e.valueStore.Put(g.value, g.mhs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,16 @@
 package engine
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // config contains all options for configuring Engine.
 type config struct {
-	cacheOnPut bool
+	cacheOnPut       bool
+	partialCache     bool
+	breakerThreshold int
+	breakerCooldown  time.Duration
 }
 
 type Option func(*config) error
@@ -26,3 +32,37 @@ func CacheOnPut(on bool) Option {
 		return nil
 	}
 }
+
+// PartialCache sets whether the result cache may hold only some of the values
+// of a cached multihash, such as while it is being warmed. When enabled, a Get
+// that finds the multihash in the cache also reads the value store, and
+// returns the union of the cached and stored values. This reads the value
+// store for every Get, so the cache only saves decoding work, and should only
+// be enabled until the cache is known to be complete.
+func PartialCache(on bool) Option {
+	return func(c *config) error {
+		c.partialCache = on
+		return nil
+	}
+}
+
+// CircuitBreaker makes the engine fail writes with ErrStoreUnavailable,
+// without trying them, after threshold writes to the value store fail in a
+// row. This keeps a failing value store, such as one with a full disk, from
+// slowing every write. After the cooldown one write is tried as a probe, and
+// if it succeeds writes are tried again as normal. If it fails, writes keep
+// failing for another cooldown. Lookups are not affected. The breaker is
+// disabled by default.
+func CircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *config) error {
+		if threshold < 1 {
+			return fmt.Errorf("circuit breaker threshold must be at least 1, got %d", threshold)
+		}
+		if cooldown <= 0 {
+			return fmt.Errorf("circuit breaker cooldown must be positive, got %s", cooldown)
+		}
+		c.breakerThreshold = threshold
+		c.breakerCooldown = cooldown
+		return nil
+	}
+}
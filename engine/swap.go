@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"context"
+	"errors"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+// SwapStore replaces the engine's value store with newStore, so that a store
+// built offline, such as a compacted copy or a restored backup, can be used
+// without restarting. SwapStore waits for operations that are using the
+// current value store to finish, and blocks new operations until the swap is
+// done. No operation sees both value stores. The result cache is cleared, so
+// that nothing read from the previous value store is returned after the swap.
+//
+// If the context is done before operations in progress finish, then the value
+// store is not swapped and the context's error is returned. The previous value
+// store is not closed. Iterators created before the swap continue to read the
+// previous value store.
+func (e *Engine) SwapStore(ctx context.Context, newStore indexer.Interface) error {
+	if newStore == nil {
+		return errors.New("nil value store")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		e.storeLock.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		// Release the lock once it is acquired, since nothing else will.
+		go func() {
+			<-locked
+			e.storeLock.Unlock()
+		}()
+		return ctx.Err()
+	}
+	defer e.storeLock.Unlock()
+
+	if e.resultCache != nil {
+		if err := e.clearCache(); err != nil {
+			return err
+		}
+	}
+	e.valueStore = newStore
+	e.breaker.reset()
+	return nil
+}
+
+// clearCache removes everything from the result cache.
+func (e *Engine) clearCache() error {
+	defer e.updateCacheStats()
+
+	if c, ok := e.resultCache.(interface{ Clear() }); ok {
+		c.Clear()
+		return nil
+	}
+	rc, ok := e.resultCache.(rangeCache)
+	if !ok {
+		return errors.New("result cache cannot be cleared")
+	}
+	type entry struct {
+		m      multihash.Multihash
+		values []indexer.Value
+	}
+	var entries []entry
+	rc.Range(func(m multihash.Multihash, values []indexer.Value) bool {
+		entries = append(entries, entry{m, values})
+		return true
+	})
+	for _, ent := range entries {
+		for i := range ent.values {
+			e.resultCache.Remove(ent.values[i], ent.m)
+		}
+	}
+	return nil
+}
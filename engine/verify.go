@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+// Mismatch is a cached multihash whose cached values are different from the
+// values in the value store.
+type Mismatch struct {
+	Multihash multihash.Multihash
+	Cached    []indexer.Value
+	Stored    []indexer.Value
+}
+
+// Mismatches is the result of checking the result cache against the value
+// store.
+type Mismatches struct {
+	// Checked is the number of cached multihashes that were checked.
+	Checked int
+	// Found lists the checked multihashes where the cache and the value store
+	// disagree.
+	Found []Mismatch
+}
+
+// rangeCache is implemented by a result cache that can list its contents.
+type rangeCache interface {
+	Range(func(multihash.Multihash, []indexer.Value) bool)
+}
+
+// VerifyConsistency checks that the values in the result cache are the same as
+// the values in the value store. A random sample of cached multihashes is
+// checked, where sampleRate is the fraction of multihashes to check, from 0 to
+// 1. The values of a multihash are compared with Value.Equal, ignoring order.
+//
+// Values that are put or removed while the check runs can be reported as
+// mismatches. This is meant for debugging and auditing, and the cost of a
+// check grows with the size of the cache and the sample rate.
+func (e *Engine) VerifyConsistency(ctx context.Context, sampleRate float64) (Mismatches, error) {
+	var result Mismatches
+	if sampleRate <= 0 || sampleRate > 1 {
+		return result, errors.New("sample rate must be greater than 0 and at most 1")
+	}
+	if e.resultCache == nil {
+		return result, nil
+	}
+	rc, ok := e.resultCache.(rangeCache)
+	if !ok {
+		return result, errors.New("result cache cannot list its contents")
+	}
+
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	// Copy the sample out of the cache first, so that the cache is not locked
+	// while reading the value store.
+	var sample []Mismatch
+	rc.Range(func(m multihash.Multihash, values []indexer.Value) bool {
+		if sampleRate == 1 || rand.Float64() < sampleRate {
+			sample = append(sample, Mismatch{
+				Multihash: m,
+				Cached:    values,
+			})
+		}
+		return ctx.Err() == nil
+	})
+
+	for _, mm := range sample {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		stored, _, err := e.valueStore.Get(mm.Multihash)
+		if err != nil {
+			return result, err
+		}
+		result.Checked++
+		if !equalValues(mm.Cached, stored) {
+			mm.Stored = stored
+			result.Found = append(result.Found, mm)
+		}
+	}
+	return result, ctx.Err()
+}
+
+// equalValues returns true if a and b contain the same values in any order.
+func equalValues(a, b []indexer.Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	matched := make([]bool, len(b))
+outer:
+	for i := range a {
+		for j := range b {
+			if !matched[j] && a[i].Equal(b[j]) {
+				matched[j] = true
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+// WarmStrategy selects the multihashes that Warm loads into the cache.
+type WarmStrategy int
+
+const (
+	// WarmFirst loads the first multihashes returned by the value store
+	// iterator. This stops reading the value store once enough multihashes
+	// are loaded.
+	WarmFirst WarmStrategy = iota
+	// WarmSample loads a random sample of multihashes, chosen uniformly from
+	// the whole value store. This reads the whole value store.
+	WarmSample
+)
+
+// Warm loads up to n multihashes and their values from the value store into
+// the result cache, to avoid reading every lookup from the value store after
+// the engine starts. The strategy selects which multihashes are loaded.
+// Returns the number of multihashes loaded into the cache.
+func (e *Engine) Warm(ctx context.Context, n int, strategy WarmStrategy) (int, error) {
+	if e.resultCache == nil || n <= 0 {
+		return 0, nil
+	}
+	if strategy != WarmFirst && strategy != WarmSample {
+		return 0, errors.New("unknown warm strategy")
+	}
+
+	e.storeLock.RLock()
+	defer e.storeLock.RUnlock()
+
+	iter, err := e.valueStore.Iter()
+	if err != nil {
+		return 0, err
+	}
+
+	type entry struct {
+		m      multihash.Multihash
+		values []indexer.Value
+	}
+	entries := make([]entry, 0, n)
+	var seen int
+	for {
+		if err = ctx.Err(); err != nil {
+			return 0, err
+		}
+		if strategy == WarmFirst && len(entries) == n {
+			break
+		}
+		m, values, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		seen++
+		if len(entries) < n {
+			entries = append(entries, entry{m, values})
+			continue
+		}
+		// Reservoir sampling: replace an entry so that each multihash seen
+		// so far has the same chance, n/seen, of being in the sample.
+		if i := rand.Intn(seen); i < n {
+			entries[i] = entry{m, values}
+		}
+	}
+
+	for _, ent := range entries {
+		for i := range ent.values {
+			e.resultCache.Put(ent.values[i], ent.m)
+		}
+	}
+	e.updateCacheStats()
+	return len(entries), nil
+}
@@ -0,0 +1,13 @@
+package indexer
+
+import "errors"
+
+var (
+	// ErrClosed is returned when an operation is attempted on a value store
+	// that has been closed.
+	ErrClosed = errors.New("value store closed")
+	// ErrMissingMetadata is returned when storing a value that has no
+	// metadata. All values must have metadata, even if this only consists of
+	// the protocol ID.
+	ErrMissingMetadata = errors.New("value missing metadata")
+)
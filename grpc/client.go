@@ -0,0 +1,205 @@
+package grpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/grpc/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"google.golang.org/grpc"
+)
+
+// Client is an indexer.Interface that accesses a value store served by a
+// remote Server.
+type Client struct {
+	conn   *grpc.ClientConn
+	client pb.IndexerClient
+}
+
+type clientIter struct {
+	recv   func() (*pb.GetResponse, error)
+	cancel context.CancelFunc
+	// err is the error that ended the iteration, returned by every later
+	// call to Next.
+	err error
+}
+
+var _ indexer.Interface = &Client{}
+
+// NewClient creates a new Client that sends requests over the given
+// connection. The connection is closed when the Client is closed.
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{
+		conn:   conn,
+		client: pb.NewIndexerClient(conn),
+	}
+}
+
+func (c *Client) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
+	rsp, err := c.client.Get(context.Background(), &pb.GetRequest{Multihash: m})
+	if err != nil {
+		return nil, false, err
+	}
+	return valuesFromPb(rsp.GetValues()), rsp.GetFound(), nil
+}
+
+// BatchResult is the result of looking up one indexed multihash with
+// GetBatch.
+type BatchResult struct {
+	// Found is true if the multihash has values. It is false if the multihash
+	// is indexed, but all of its values were removed.
+	Found bool
+	// Values are the values that the multihash maps to.
+	Values []indexer.Value
+}
+
+// GetBatch looks up the values for multiple multihashes. Returns a map, keyed
+// by multihash string, of the results for the multihashes that are in the
+// index, and a list of the multihashes that are not in the index at all. A
+// multihash that is indexed, but whose values were all removed, is in the map
+// with Found set to false, so that callers can tell it apart from a multihash
+// that was never indexed.
+//
+// A remote value store that cannot tell whether a multihash without values is
+// in the index reports it as not in the index.
+func (c *Client) GetBatch(ctx context.Context, mhs []multihash.Multihash) (map[string]BatchResult, []multihash.Multihash, error) {
+	stream, err := c.client.GetBatch(ctx, &pb.GetBatchRequest{Multihashes: multihashBytes(mhs)})
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make(map[string]BatchResult, len(mhs))
+	var absent []multihash.Multihash
+	for {
+		rsp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		m := multihash.Multihash(rsp.GetMultihash())
+		if !rsp.GetIndexed() {
+			absent = append(absent, m)
+			continue
+		}
+		results[string(m)] = BatchResult{
+			Found:  rsp.GetFound(),
+			Values: valuesFromPb(rsp.GetValues()),
+		}
+	}
+	return results, absent, nil
+}
+
+// Has returns true if the multihash is indexed by the remote value store.
+func (c *Client) Has(m multihash.Multihash) (bool, error) {
+	rsp, err := c.client.Has(context.Background(), &pb.HasRequest{Multihash: m})
+	if err != nil {
+		return false, err
+	}
+	return rsp.GetFound(), nil
+}
+
+func (c *Client) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	// Check locally so that the error can be matched with errors.Is, which is
+	// not possible once it has been sent over gRPC.
+	if len(value.MetadataBytes) == 0 {
+		return indexer.ErrMissingMetadata
+	}
+	_, err := c.client.Put(context.Background(), &pb.PutRequest{
+		Value:       valueToPb(value),
+		Multihashes: multihashBytes(mhs),
+	})
+	return err
+}
+
+func (c *Client) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	_, err := c.client.Remove(context.Background(), &pb.RemoveRequest{
+		Value:       valueToPb(value),
+		Multihashes: multihashBytes(mhs),
+	})
+	return err
+}
+
+func (c *Client) RemoveProvider(ctx context.Context, providerID peer.ID) error {
+	_, err := c.client.RemoveProvider(ctx, &pb.RemoveProviderRequest{
+		ProviderId: []byte(providerID),
+	})
+	return err
+}
+
+func (c *Client) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
+	_, err := c.client.RemoveProviderContext(context.Background(), &pb.RemoveProviderContextRequest{
+		ProviderId: []byte(providerID),
+		ContextId:  contextID,
+	})
+	return err
+}
+
+func (c *Client) Size() (int64, error) {
+	rsp, err := c.client.Size(context.Background(), &pb.Empty{})
+	if err != nil {
+		return 0, err
+	}
+	return rsp.GetSize(), nil
+}
+
+func (c *Client) Flush() error {
+	_, err := c.client.Flush(context.Background(), &pb.Empty{})
+	return err
+}
+
+// Close closes the connection to the server. It does not close the remote
+// value store.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Ping checks that the server responds and that the remote value store is
+// usable.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.client.Ping(ctx, &pb.Empty{})
+	return err
+}
+
+// Iter creates an iterator over all the multihashes and values in the remote
+// value store. The results are streamed from the server as the iterator is
+// read.
+//
+// The stream is released when Next returns an error, including io.EOF. An
+// iterator that is not read until then keeps its stream open on the server
+// until the Client is closed.
+func (c *Client) Iter() (indexer.Iterator, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.client.Iter(ctx, &pb.Empty{})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &clientIter{recv: stream.Recv, cancel: cancel}, nil
+}
+
+func (it *clientIter) Next() (multihash.Multihash, []indexer.Value, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	rsp, err := it.recv()
+	if err != nil {
+		it.err = err
+		it.cancel()
+		return nil, nil, err
+	}
+	return multihash.Multihash(rsp.GetMultihash()), valuesFromPb(rsp.GetValues()), nil
+}
+
+func multihashBytes(mhs []multihash.Multihash) [][]byte {
+	if len(mhs) == 0 {
+		return nil
+	}
+	mhbs := make([][]byte, len(mhs))
+	for i := range mhs {
+		mhbs[i] = mhs[i]
+	}
+	return mhbs
+}
@@ -0,0 +1,288 @@
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	indexergrpc "github.com/filecoin-project/go-indexer-core/grpc"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/storethehash"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func initClient(t *testing.T, valueStore indexer.Interface) *indexergrpc.Client {
+	lis := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	indexergrpc.NewServer(valueStore).Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexergrpc.NewClient(conn)
+}
+
+func TestE2E(t *testing.T) {
+	c := initClient(t, memory.New())
+	test.E2ETest(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := initClient(t, memory.New())
+	test.RemoveTest(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveProviderContext(t *testing.T) {
+	c := initClient(t, memory.New())
+	test.RemoveProviderContextTest(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveProvider(t *testing.T) {
+	c := initClient(t, memory.New())
+	test.RemoveProviderTest(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	c := initClient(t, memory.New())
+	test.ParallelUpdateTest(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s, err := storethehash.New(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := initClient(t, s)
+	defer c.Close()
+
+	if err = c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Ping fails once the remote value store is closed.
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Ping(context.Background())
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable error, got %v", err)
+	}
+}
+
+func TestIterEnd(t *testing.T) {
+	c := initClient(t, memory.New())
+	defer c.Close()
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctx"), MetadataBytes: []byte("meta")}
+	if err = c.Put(value, test.RandomMultihashes(3)...); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := c.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		if _, _, err = iter.Next(); err != nil {
+			break
+		}
+		count++
+	}
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 multihashes, got %d", count)
+	}
+	// The iterator keeps returning io.EOF after its stream is released.
+	if _, _, err = iter.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestGetBatchHas(t *testing.T) {
+	c := initClient(t, memory.New())
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(10)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("metadata"),
+	}
+	if err = c.Put(value, mhs[:5]...); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := c.Has(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("expected multihash to be found")
+	}
+	found, err = c.Has(mhs[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expected multihash not to be found")
+	}
+
+	results, absent, err := c.GetBatch(context.Background(), mhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected 5 batch results, got %d", len(results))
+	}
+	for _, m := range mhs[:5] {
+		res, ok := results[string(m)]
+		if !ok || !res.Found {
+			t.Fatal("expected multihash to be found")
+		}
+		if len(res.Values) != 1 || !res.Values[0].Equal(value) {
+			t.Fatal("wrong value for multihash")
+		}
+	}
+	if len(absent) != 5 {
+		t.Fatalf("expected 5 absent multihashes, got %d", len(absent))
+	}
+	for i, m := range absent {
+		if !bytes.Equal(m, mhs[5+i]) {
+			t.Fatal("wrong absent multihash")
+		}
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBatchPruned(t *testing.T) {
+	s, err := storethehash.New(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := initClient(t, s)
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(6)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("metadata")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("metadata")}
+	if err = c.Put(value1, mhs[:4]...); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Put(value2, mhs[:2]...); err != nil {
+		t.Fatal(err)
+	}
+	// Removing the value leaves the multihashes in the index, with value-keys
+	// that are pruned when read.
+	if err = c.RemoveProviderContext(p, value1.ContextID); err != nil {
+		t.Fatal(err)
+	}
+
+	results, absent, err := c.GetBatch(context.Background(), mhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 indexed multihashes, got %d", len(results))
+	}
+	for i, m := range mhs[:4] {
+		res, ok := results[string(m)]
+		if !ok {
+			t.Fatal("expected multihash to be indexed")
+		}
+		if i < 2 {
+			if !res.Found || len(res.Values) != 1 || !res.Values[0].Equal(value2) {
+				t.Fatal("wrong result for multihash with values")
+			}
+		} else if res.Found || len(res.Values) != 0 {
+			t.Fatal("expected multihash with pruned values not to be found")
+		}
+	}
+	if len(absent) != 2 || !bytes.Equal(absent[0], mhs[4]) || !bytes.Equal(absent[1], mhs[5]) {
+		t.Fatal("wrong absent multihashes")
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHasValueKeys(t *testing.T) {
+	s, err := storethehash.New(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := initClient(t, s)
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(2)
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("metadata")}
+	if err = c.Put(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := c.Has(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("expected multihash to be found")
+	}
+	found, err = c.Has(mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expected multihash not to be found")
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
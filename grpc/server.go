@@ -0,0 +1,304 @@
+// Package grpc provides a gRPC server that exposes an indexer.Interface value
+// store for remote access, and a matching client that implements
+// indexer.Interface so that remote and local value stores are
+// interchangeable.
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/grpc/pb"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server serves an indexer.Interface over gRPC.
+type Server struct {
+	pb.UnimplementedIndexerServer
+	valueStore indexer.Interface
+}
+
+var _ pb.IndexerServer = &Server{}
+
+// valueKeyStore is implemented by a value store that can tell whether a
+// multihash is in the index without reading its values, such as storethehash.
+type valueKeyStore interface {
+	ValueKeys(multihash.Multihash) ([][]byte, bool, error)
+}
+
+// hasBatchStore is implemented by a value store that can check whether
+// multihashes are in the index without reading their values.
+type hasBatchStore interface {
+	HasBatch([]multihash.Multihash) ([]bool, error)
+}
+
+// NewServer creates a new Server that serves requests from the given value
+// store.
+func NewServer(valueStore indexer.Interface) *Server {
+	if valueStore == nil {
+		panic("valueStore is required")
+	}
+	return &Server{
+		valueStore: valueStore,
+	}
+}
+
+// Register registers the Server with a grpc.Server.
+func (s *Server) Register(gs *grpc.Server) {
+	pb.RegisterIndexerServer(gs, s)
+}
+
+func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	return s.get(req.GetMultihash())
+}
+
+func (s *Server) GetBatch(req *pb.GetBatchRequest, stream pb.Indexer_GetBatchServer) error {
+	ctx := stream.Context()
+	for _, mhb := range req.GetMultihashes() {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		rsp, err := s.getIndexed(mhb)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(rsp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) Has(ctx context.Context, req *pb.HasRequest) (*pb.HasResponse, error) {
+	m, err := multihash.Cast(req.GetMultihash())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	found, err := s.has(m)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.HasResponse{Found: found}, nil
+}
+
+// has returns true if the multihash is in the value store. The values are only
+// read if the value store has no cheaper way to check the index.
+func (s *Server) has(m multihash.Multihash) (bool, error) {
+	switch vs := s.valueStore.(type) {
+	case valueKeyStore:
+		_, found, err := vs.ValueKeys(m)
+		return found, err
+	case hasBatchStore:
+		found, err := vs.HasBatch([]multihash.Multihash{m})
+		if err != nil {
+			return false, err
+		}
+		return found[0], nil
+	}
+	_, found, err := s.valueStore.Get(m)
+	return found, err
+}
+
+func (s *Server) Put(ctx context.Context, req *pb.PutRequest) (*pb.Empty, error) {
+	mhs, err := castMultihashes(req.GetMultihashes())
+	if err != nil {
+		return nil, err
+	}
+	err = s.valueStore.Put(valueFromPb(req.GetValue()), mhs...)
+	if err != nil {
+		if errors.Is(err, indexer.ErrMissingMetadata) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) Remove(ctx context.Context, req *pb.RemoveRequest) (*pb.Empty, error) {
+	mhs, err := castMultihashes(req.GetMultihashes())
+	if err != nil {
+		return nil, err
+	}
+	err = s.valueStore.Remove(valueFromPb(req.GetValue()), mhs...)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) RemoveProvider(ctx context.Context, req *pb.RemoveProviderRequest) (*pb.Empty, error) {
+	err := s.valueStore.RemoveProvider(ctx, peer.ID(req.GetProviderId()))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) RemoveProviderContext(ctx context.Context, req *pb.RemoveProviderContextRequest) (*pb.Empty, error) {
+	err := s.valueStore.RemoveProviderContext(peer.ID(req.GetProviderId()), req.GetContextId())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) Size(ctx context.Context, req *pb.Empty) (*pb.SizeResponse, error) {
+	size, err := s.valueStore.Size()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.SizeResponse{Size: size}, nil
+}
+
+func (s *Server) Flush(ctx context.Context, req *pb.Empty) (*pb.Empty, error) {
+	if err := s.valueStore.Flush(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) Ping(ctx context.Context, req *pb.Empty) (*pb.Empty, error) {
+	if err := s.valueStore.Ping(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) Iter(req *pb.Empty, stream pb.Indexer_IterServer) error {
+	iter, err := s.valueStore.Iter()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	ctx := stream.Context()
+	for {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		m, values, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+		err = stream.Send(&pb.GetResponse{
+			Multihash: m,
+			Values:    valuesToPb(values),
+			Found:     true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) get(mhb []byte) (*pb.GetResponse, error) {
+	m, err := multihash.Cast(mhb)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	values, found, err := s.valueStore.Get(m)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.GetResponse{
+		Multihash: m,
+		Values:    valuesToPb(values),
+		Found:     found,
+	}, nil
+}
+
+// getIndexed is the same as get, and also sets whether the multihash is in the
+// index. A multihash is indexed and not found if the index has value-keys for
+// it, but none of its values remain. Value stores that cannot tell this apart
+// report a multihash as indexed only if it is found.
+func (s *Server) getIndexed(mhb []byte) (*pb.GetResponse, error) {
+	vks, ok := s.valueStore.(valueKeyStore)
+	if !ok {
+		rsp, err := s.get(mhb)
+		if err != nil {
+			return nil, err
+		}
+		rsp.Indexed = rsp.Found
+		return rsp, nil
+	}
+
+	m, err := multihash.Cast(mhb)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Check the index before getting the values, since getting the values
+	// prunes the value-keys of values that were removed.
+	_, indexed, err := vks.ValueKeys(m)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	rsp, err := s.get(mhb)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Indexed = indexed || rsp.Found
+	return rsp, nil
+}
+
+func castMultihashes(mhbs [][]byte) ([]multihash.Multihash, error) {
+	mhs := make([]multihash.Multihash, len(mhbs))
+	for i := range mhbs {
+		m, err := multihash.Cast(mhbs[i])
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		mhs[i] = m
+	}
+	return mhs, nil
+}
+
+func valueFromPb(pv *pb.Value) indexer.Value {
+	return indexer.Value{
+		ProviderID:    peer.ID(pv.GetProviderId()),
+		ContextID:     pv.GetContextId(),
+		MetadataBytes: pv.GetMetadata(),
+	}
+}
+
+func valueToPb(value indexer.Value) *pb.Value {
+	return &pb.Value{
+		ProviderId: []byte(value.ProviderID),
+		ContextId:  value.ContextID,
+		Metadata:   value.MetadataBytes,
+	}
+}
+
+func valuesFromPb(pvs []*pb.Value) []indexer.Value {
+	if len(pvs) == 0 {
+		return nil
+	}
+	values := make([]indexer.Value, len(pvs))
+	for i := range pvs {
+		values[i] = valueFromPb(pvs[i])
+	}
+	return values
+}
+
+func valuesToPb(values []indexer.Value) []*pb.Value {
+	if len(values) == 0 {
+		return nil
+	}
+	pvs := make([]*pb.Value, len(values))
+	for i := range values {
+		pvs[i] = valueToPb(values[i])
+	}
+	return pvs
+}
@@ -0,0 +1,177 @@
+// Package http provides a read-only HTTP interface for querying the values
+// stored in an indexer.Interface value store.
+//
+// The following endpoints are served:
+//
+//	GET /multihash/{multihash}
+//
+// Returns the values for a base58-encoded multihash, or 404 if the multihash
+// is not indexed.
+//
+//	POST /multihash
+//
+// Takes a JSON list of base58-encoded multihashes and returns the results for
+// those that are indexed, or 404 if none are indexed.
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/filecoin-project/go-indexer-core"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+var log = logging.Logger("indexer-core/http")
+
+// maxBatchBody is the maximum size of a batch request body.
+const maxBatchBody = 8 * 1024 * 1024
+
+// Value is the JSON encoding of an indexer.Value.
+type Value struct {
+	// ProviderID is encoded as a peer ID string.
+	ProviderID peer.ID
+	// ContextID is encoded as base64.
+	ContextID []byte
+	// Metadata is encoded as base64.
+	Metadata []byte
+}
+
+// MultihashResult is the JSON encoding of the values for a multihash.
+type MultihashResult struct {
+	// Multihash is the base58-encoded multihash.
+	Multihash string
+	Values    []Value
+}
+
+// Handler serves read-only HTTP queries for a value store.
+type Handler struct {
+	valueStore indexer.Interface
+	mux        *http.ServeMux
+}
+
+var _ http.Handler = &Handler{}
+
+// New creates a new Handler that serves queries from the given value store.
+func New(valueStore indexer.Interface) *Handler {
+	if valueStore == nil {
+		panic("valueStore is required")
+	}
+	h := &Handler{
+		valueStore: valueStore,
+		mux:        http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/multihash/", h.getMultihash)
+	h.mux.HandleFunc("/multihash", h.getMultihashBatch)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) getMultihash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := multihash.FromB58String(path.Base(r.URL.Path))
+	if err != nil {
+		http.Error(w, "invalid multihash: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values, found, err := h.valueStore.Get(m)
+	if err != nil {
+		log.Errorw("Cannot get values for multihash", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, MultihashResult{
+		Multihash: m.B58String(),
+		Values:    encodeValues(values),
+	})
+}
+
+func (h *Handler) getMultihashBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatchBody))
+	if err != nil {
+		http.Error(w, "cannot read request body", http.StatusBadRequest)
+		return
+	}
+	var mhStrs []string
+	if err = json.Unmarshal(body, &mhStrs); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]MultihashResult, 0, len(mhStrs))
+	for _, mhStr := range mhStrs {
+		m, err := multihash.FromB58String(mhStr)
+		if err != nil {
+			http.Error(w, "invalid multihash: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		values, found, err := h.valueStore.Get(m)
+		if err != nil {
+			log.Errorw("Cannot get values for multihash", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			continue
+		}
+		results = append(results, MultihashResult{
+			Multihash: mhStr,
+			Values:    encodeValues(values),
+		})
+	}
+	if len(results) == 0 {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, results)
+}
+
+func encodeValues(values []indexer.Value) []Value {
+	encVals := make([]Value, len(values))
+	for i := range values {
+		encVals[i] = Value{
+			ProviderID: values[i].ProviderID,
+			ContextID:  values[i].ContextID,
+			Metadata:   values[i].MetadataBytes,
+		}
+	}
+	return encVals
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorw("Cannot marshal response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		log.Errorw("Cannot write response", "err", err)
+	}
+}
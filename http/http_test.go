@@ -0,0 +1,156 @@
+package http_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	indexerhttp "github.com/filecoin-project/go-indexer-core/http"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestGetMultihash(t *testing.T) {
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := memory.New()
+	mhs := test.RandomMultihashes(2)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("metadata"),
+	}
+	if err = s.Put(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(indexerhttp.New(s))
+	defer srv.Close()
+
+	rsp, err := http.Get(srv.URL + "/multihash/" + mhs[0].B58String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rsp.StatusCode)
+	}
+	var result indexerhttp.MultihashResult
+	if err = json.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Multihash != mhs[0].B58String() {
+		t.Fatal("wrong multihash in result")
+	}
+	if len(result.Values) != 1 {
+		t.Fatalf("expected 1 value, got %d", len(result.Values))
+	}
+	v := result.Values[0]
+	if v.ProviderID != p || !bytes.Equal(v.ContextID, value.ContextID) || !bytes.Equal(v.Metadata, value.MetadataBytes) {
+		t.Fatal("wrong value in result")
+	}
+
+	rsp, err = http.Get(srv.URL + "/multihash/" + mhs[1].B58String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rsp.StatusCode)
+	}
+
+	rsp, err = http.Get(srv.URL + "/multihash/not-a-multihash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rsp.StatusCode)
+	}
+
+	rsp, err = http.Post(srv.URL+"/multihash/"+mhs[0].B58String(), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, rsp.StatusCode)
+	}
+}
+
+func TestGetMultihashBatch(t *testing.T) {
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := memory.New()
+	mhs := test.RandomMultihashes(4)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("metadata"),
+	}
+	if err = s.Put(value, mhs[:3]...); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(indexerhttp.New(s))
+	defer srv.Close()
+
+	mhStrs := make([]string, len(mhs))
+	for i := range mhs {
+		mhStrs[i] = mhs[i].B58String()
+	}
+	body, err := json.Marshal(mhStrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Post(srv.URL+"/multihash", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rsp.StatusCode)
+	}
+	var results []indexerhttp.MultihashResult
+	if err = json.NewDecoder(rsp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i := range results {
+		if results[i].Multihash != mhStrs[i] {
+			t.Fatal("wrong multihash in result")
+		}
+		if len(results[i].Values) != 1 || results[i].Values[0].ProviderID != p {
+			t.Fatal("wrong value in result")
+		}
+	}
+
+	body, _ = json.Marshal(mhStrs[3:])
+	rsp, err = http.Post(srv.URL+"/multihash", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, rsp.StatusCode)
+	}
+
+	rsp, err = http.Get(srv.URL + "/multihash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, rsp.StatusCode)
+	}
+}
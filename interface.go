@@ -2,6 +2,7 @@ package indexer
 
 import (
 	"context"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multihash"
@@ -45,6 +46,11 @@ type Interface interface {
 
 	// Iter creates a new value store iterator.
 	Iter() (Iterator, error)
+
+	// Ping checks that the value store is open and responding, for use as a
+	// readiness or liveness check. It returns an error if the value store is
+	// closed, has failed, or does not respond before the context is done.
+	Ping(context.Context) error
 }
 
 // Iterator iterates multihashes and values in the value store. Any write
@@ -54,3 +60,32 @@ type Iterator interface {
 	// when finished iterating.
 	Next() (multihash.Multihash, []Value, error)
 }
+
+// Stats contains statistics about the values held in a value store. A value
+// store leaves any statistic that it does not track as zero.
+type Stats struct {
+	// Indexes is the number of multihashes that map to values.
+	Indexes int
+	// Values is the number of stored values.
+	Values int
+	// PrunedValueKeys is the number of value-keys that were removed from
+	// multihash value-key lists, during reads, because the values they
+	// referred to no longer exist or, if the value store prunes them, could
+	// not be decoded.
+	PrunedValueKeys uint64
+	// CorruptValues is the number of values that could not be decoded, and
+	// were left out of the results of reads instead of failing them.
+	CorruptValues uint64
+	// ValueLockWait is the total time spent waiting to lock values, if the
+	// value store records lock waits.
+	ValueLockWait time.Duration
+	// KeyLockWait is the total time spent waiting to lock individual keys, if
+	// the value store records lock waits.
+	KeyLockWait time.Duration
+	// MaxValueKeys is the largest number of values that a multihash was seen
+	// to map to, when the values of multihashes were read or written.
+	MaxValueKeys int
+	// AvgValueKeys is the average number of values that multihashes were seen
+	// to map to, when the values of multihashes were read or written.
+	AvgValueKeys float64
+}
@@ -0,0 +1,117 @@
+package indexer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MetadataCodec identifies how the metadata of a serialized value is
+// compressed.
+type MetadataCodec byte
+
+const (
+	// MetadataUncompressed stores metadata as is.
+	MetadataUncompressed MetadataCodec = iota
+	// MetadataGzip compresses metadata with gzip.
+	MetadataGzip
+	// MetadataZstd compresses metadata with zstd.
+	MetadataZstd
+)
+
+// zstd encoders and decoders are expensive to create, and are safe for
+// concurrent use with EncodeAll and DecodeAll, so one of each is shared.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// MarshalValueCompressed serializes a value the same as MarshalValueTime, with
+// the metadata compressed by codec if the metadata is at least minSize bytes
+// and compressing it makes it smaller. The codec is stored with the value, so
+// that UnmarshalValue and UnmarshalValueTime decompress the metadata. Values
+// that were serialized without compression are decoded as before. If t is the
+// zero time, then no time is stored.
+func MarshalValueCompressed(value Value, t time.Time, codec MetadataCodec, minSize int) ([]byte, error) {
+	tv := timedValue{Value: value}
+	if !t.IsZero() {
+		tv.Time = t.UnixNano()
+	}
+	if codec != MetadataUncompressed && len(value.MetadataBytes) >= minSize {
+		compressed, err := compressMetadata(codec, value.MetadataBytes)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(value.MetadataBytes) {
+			tv.MetadataBytes = compressed
+			tv.Codec = codec
+		}
+	}
+	return json.Marshal(&tv)
+}
+
+func compressMetadata(codec MetadataCodec, data []byte) ([]byte, error) {
+	switch codec {
+	case MetadataGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case MetadataZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown metadata codec %d", codec)
+}
+
+func decompressMetadata(codec MetadataCodec, data []byte) ([]byte, error) {
+	switch codec {
+	case MetadataGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress metadata: %w", err)
+		}
+		defer zr.Close()
+		data, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress metadata: %w", err)
+		}
+		return data, nil
+	case MetadataZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		data, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress metadata: %w", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown metadata codec %d", codec)
+}
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
@@ -22,8 +22,12 @@ var (
 	CacheEvictions   = stats.Int64("core/cache/evictions", "Number of indexes evicted from cache", stats.UnitDimensionless)
 	CacheMisuse      = stats.Int64("core/cache/misuse", "Cache clears due to high value to multihash ratio (indexer misuse)", stats.UnitDimensionless)
 
+	CacheRotationEvictions = stats.Int64("core/cache/rotation_evictions", "Number of indexes evicted from cache by a single rotation", stats.UnitDimensionless)
+
 	GetIndexLatency   = stats.Float64("core/get_index_latency", "Internal lookup time for a single index", stats.UnitMilliseconds)
 	IngestMultihashes = stats.Int64("core/ingest_multihashes", "Number of multihashes put into the indexer", stats.UnitDimensionless)
+	PrunedValueKeys   = stats.Int64("core/pruned_value_keys", "Number of dangling value-keys removed during reads", stats.UnitDimensionless)
+	CorruptValues     = stats.Int64("core/corrupt_values", "Number of corrupt values skipped during reads", stats.UnitDimensionless)
 	RemovedProviders  = stats.Int64("core/removed_providers", "Number of providers removed from indexer", stats.UnitDimensionless)
 	StoreSize         = stats.Int64("core/storage_size", "Bytes of storage used to store the indexed content", stats.UnitBytes)
 )
@@ -54,6 +58,10 @@ var (
 		Measure:     CacheMisuse,
 		Aggregation: view.Count(),
 	}
+	cacheRotationEvictionsView = &view.View{
+		Measure:     CacheRotationEvictions,
+		Aggregation: view.Distribution(0, 1000, 10000, 100000, 250000, 500000, 1000000, 2500000, 5000000, 10000000),
+	}
 
 	getIndexLatencyView = &view.View{
 		Measure:     GetIndexLatency,
@@ -63,6 +71,14 @@ var (
 		Measure:     IngestMultihashes,
 		Aggregation: view.Sum(),
 	}
+	prunedValueKeysView = &view.View{
+		Measure:     PrunedValueKeys,
+		Aggregation: view.Sum(),
+	}
+	corruptValuesView = &view.View{
+		Measure:     CorruptValues,
+		Aggregation: view.Sum(),
+	}
 	removedProvidersView = &view.View{
 		Measure:     RemovedProviders,
 		Aggregation: view.Sum(),
@@ -82,8 +98,11 @@ var DefaultViews = []*view.View{
 	cacheValuesView,
 	cacheEvictionsView,
 	cacheMisuseView,
+	cacheRotationEvictionsView,
 	getIndexLatencyView,
 	ingestMultihashesView,
+	prunedValueKeysView,
+	corruptValuesView,
 	removedProvidersView,
 	storeSizeView,
 }
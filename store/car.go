@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+// CARExportVersion is the version of the block schema written by ExportCAR.
+const CARExportVersion = 1
+
+// Field names of the blocks written by ExportCAR. The value fields use the
+// same names as the JSON encoding of indexer.Value.
+const (
+	CARFieldVersion    = "version"
+	CARFieldProviderID = "p"
+	CARFieldContextID  = "c"
+	CARFieldMetadata   = "m"
+	CARFieldMultihash  = "mh"
+	CARFieldValues     = "values"
+)
+
+// ExportCAR writes all multihashes and values in the value store to w, as a
+// CARv1 file of DAG-CBOR blocks. This makes the index data readable by IPLD
+// and IPFS tooling. There are three kinds of blocks:
+//
+//	Root:  {"version": 1}
+//	Value: {"p": Bytes, "c": Bytes, "m": Bytes}
+//	Index: {"mh": Bytes, "values": [&Value]}
+//
+// The root block is the only root of the CAR, and is written first. Value
+// blocks hold the provider ID, context ID and metadata of a value. Each index
+// block holds one multihash, and links to the value blocks of the values that
+// the multihash maps to. A value block is written once, before the first index
+// block that links to it.
+//
+// All blocks are addressed by a CIDv1 of their sha2-256 hash, so that their
+// content can be verified. The data is written as it is read from the value
+// store, so the value store must not be changed while it is being exported.
+func ExportCAR(ctx context.Context, s indexer.Interface, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	root, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, CARFieldVersion, qp.Int(CARExportVersion))
+	})
+	if err != nil {
+		return err
+	}
+	rootData, rootCid, err := encodeBlock(root)
+	if err != nil {
+		return err
+	}
+	header, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "roots", qp.List(1, func(la datamodel.ListAssembler) {
+			qp.ListEntry(la, qp.Link(cidlink.Link{Cid: rootCid}))
+		}))
+		qp.MapEntry(ma, "version", qp.Int(1))
+	})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = dagcbor.Encode(header, &buf); err != nil {
+		return err
+	}
+	if err = writeSection(bw, nil, buf.Bytes()); err != nil {
+		return err
+	}
+	if err = writeSection(bw, rootCid.Bytes(), rootData); err != nil {
+		return err
+	}
+
+	iter, err := s.Iter()
+	if err != nil {
+		return err
+	}
+	// CIDs of the values already written, keyed by provider ID and context
+	// ID. A provider ID is a multihash, which encodes its own length, so the
+	// two can be concatenated to make a unique key.
+	valueCids := make(map[string]cid.Cid)
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		m, values, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		links := make([]cid.Cid, len(values))
+		for i, value := range values {
+			vk := string(value.ProviderID) + string(value.ContextID)
+			c, ok := valueCids[vk]
+			if !ok {
+				c, err = writeValueBlock(bw, value)
+				if err != nil {
+					return err
+				}
+				valueCids[vk] = c
+			}
+			links[i] = c
+		}
+		if err = writeIndexBlock(bw, m, links); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeValueBlock(w io.Writer, value indexer.Value) (cid.Cid, error) {
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 3, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, CARFieldProviderID, qp.Bytes([]byte(value.ProviderID)))
+		qp.MapEntry(ma, CARFieldContextID, qp.Bytes(value.ContextID))
+		qp.MapEntry(ma, CARFieldMetadata, qp.Bytes(value.MetadataBytes))
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	data, c, err := encodeBlock(n)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return c, writeSection(w, c.Bytes(), data)
+}
+
+func writeIndexBlock(w io.Writer, m multihash.Multihash, links []cid.Cid) error {
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, CARFieldMultihash, qp.Bytes(m))
+		qp.MapEntry(ma, CARFieldValues, qp.List(int64(len(links)), func(la datamodel.ListAssembler) {
+			for _, c := range links {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: c}))
+			}
+		}))
+	})
+	if err != nil {
+		return err
+	}
+	data, c, err := encodeBlock(n)
+	if err != nil {
+		return err
+	}
+	return writeSection(w, c.Bytes(), data)
+}
+
+// encodeBlock encodes n as DAG-CBOR and returns the data and its CID.
+func encodeBlock(n datamodel.Node) ([]byte, cid.Cid, error) {
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(n, &buf); err != nil {
+		return nil, cid.Undef, fmt.Errorf("cannot encode block: %w", err)
+	}
+	mh, err := multihash.Sum(buf.Bytes(), multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	return buf.Bytes(), cid.NewCidV1(cid.DagCBOR, mh), nil
+}
+
+// writeSection writes a CAR section, which is the length of the CID and data
+// as a varint, followed by the CID and the data. The header section has no
+// CID.
+func writeSection(w io.Writer, c, data []byte) error {
+	if _, err := w.Write(varint.ToUvarint(uint64(len(c) + len(data)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(c); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
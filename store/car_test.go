@@ -0,0 +1,194 @@
+package store_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+func TestExportCAR(t *testing.T) {
+	s := memory.New()
+	p1, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value1 := indexer.Value{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p2, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(10)
+	if err = s.Put(value1, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(value2, mhs[:3]...); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = store.ExportCAR(context.Background(), s, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the CAR back, checking that each block has the right CID.
+	r := bufio.NewReader(&buf)
+	header := readSection(t, r, false)
+	roots, err := header.n.LookupByString("roots")
+	if err != nil || roots.Length() != 1 {
+		t.Fatal("expected one root in CAR header")
+	}
+	rootLink, err := roots.LookupByIndex(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid := linkCid(t, rootLink)
+
+	var blocks []block
+	for {
+		if _, err = r.Peek(1); err == io.EOF {
+			break
+		}
+		blocks = append(blocks, readSection(t, r, true))
+	}
+	if len(blocks) == 0 || !blocks[0].c.Equals(rootCid) {
+		t.Fatal("expected root block first")
+	}
+
+	// Reconstruct the index from the value and index blocks.
+	values := make(map[cid.Cid]indexer.Value)
+	got := make(map[string][]indexer.Value)
+	for _, b := range blocks[1:] {
+		if _, err = b.n.LookupByString(store.CARFieldMultihash); err != nil {
+			values[b.c] = indexer.Value{
+				ProviderID:    peer.ID(lookupBytes(t, b.n, store.CARFieldProviderID)),
+				ContextID:     lookupBytes(t, b.n, store.CARFieldContextID),
+				MetadataBytes: lookupBytes(t, b.n, store.CARFieldMetadata),
+			}
+			continue
+		}
+		m := multihash.Multihash(lookupBytes(t, b.n, store.CARFieldMultihash))
+		links, err := b.n.LookupByString(store.CARFieldValues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := links.ListIterator()
+		for !it.Done() {
+			_, l, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, ok := values[linkCid(t, l)]
+			if !ok {
+				t.Fatal("index block links to value that was not written before it")
+			}
+			got[string(m)] = append(got[string(m)], value)
+		}
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected 2 value blocks, got %d", len(values))
+	}
+	if len(got) != len(mhs) {
+		t.Fatalf("expected %d index blocks, got %d", len(mhs), len(got))
+	}
+	for i, m := range mhs {
+		expected := []indexer.Value{value1}
+		if i < 3 {
+			expected = append(expected, value2)
+		}
+		vals := got[string(m)]
+		if len(vals) != len(expected) {
+			t.Fatalf("expected %d values for multihash, got %d", len(expected), len(vals))
+		}
+		for _, v := range expected {
+			var found bool
+			for _, gv := range vals {
+				if gv.Equal(v) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatal("value not reconstructed from CAR")
+			}
+		}
+	}
+}
+
+type block struct {
+	c cid.Cid
+	n datamodel.Node
+}
+
+// readSection reads and decodes one CAR section, and checks the CID of the
+// block if hasCid is true.
+func readSection(t *testing.T, r *bufio.Reader, hasCid bool) block {
+	size, err := varint.ReadUvarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	var b block
+	if hasCid {
+		n, c, err := cid.CidFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+		if c.Type() != cid.DagCBOR {
+			t.Fatal("expected DAG-CBOR block")
+		}
+		check, err := c.Prefix().Sum(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !check.Equals(c) {
+			t.Fatal("block data does not match its CID")
+		}
+		b.c = c
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = dagcbor.Decode(nb, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	b.n = nb.Build()
+	return b
+}
+
+func lookupBytes(t *testing.T, n datamodel.Node, field string) []byte {
+	fn, err := n.LookupByString(field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fn.AsBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func linkCid(t *testing.T, n datamodel.Node) cid.Cid {
+	l, err := n.AsLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.(cidlink.Link).Cid
+}
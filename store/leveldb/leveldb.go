@@ -0,0 +1,502 @@
+// Package leveldb defines a value store that keeps its data in a LevelDB
+// database.
+//
+// Data is stored using the same key scheme as the pogreb value store. Index
+// keys are the multihash with an "idx" prefix, and value keys are a hash of the
+// provider ID and context ID with an "md" prefix. Since LevelDB keeps keys
+// sorted, all index keys and all value keys can be read by iterating over the
+// range of keys with the respective prefix.
+package leveldb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/blake2b"
+)
+
+// valueKeySize is the number of bytes of hash(providerID + contextID) used as
+// key to lookup values.
+const valueKeySize = 20
+
+var (
+	indexKeyPrefix = []byte("idx")
+	valueKeyPrefix = []byte("md")
+
+	// flushKey is deleted by a synced write to flush the write-ahead log. It
+	// is never stored.
+	flushKey = []byte("flush")
+)
+
+type ldbStorage struct {
+	dir   string
+	store *leveldb.DB
+	// idxLock serializes updates to the value-key lists of multihashes, since
+	// each update is read-modify-write and updates are written in batches.
+	idxLock sync.Mutex
+	valLock sync.RWMutex
+}
+
+type ldbIter struct {
+	iter iterator.Iterator
+	s    *ldbStorage
+}
+
+// New creates a new indexer.Interface implemented by a LevelDB-based value
+// store.
+func New(dir string) (indexer.Interface, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ldbStorage{
+		dir:   dir,
+		store: db,
+	}, nil
+}
+
+func (s *ldbStorage) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
+	return s.get(makeIndexKey(m))
+}
+
+func (s *ldbStorage) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	valKey, err := s.updateValue(value, len(mhs) != 0)
+	if err != nil {
+		return fmt.Errorf("cannot store value: %w", err)
+	}
+	if len(mhs) == 0 {
+		return nil
+	}
+
+	keys := indexKeys(mhs)
+	s.idxLock.Lock()
+	defer s.idxLock.Unlock()
+
+	// Update the value-key lists of all the multihashes in one batch, so that
+	// either all or none of the multihashes are mapped to the value.
+	batch := new(leveldb.Batch)
+	for _, k := range keys {
+		existingValKeys, err := s.getValueKeys(k)
+		if err != nil {
+			return fmt.Errorf("cannot get value keys for multihash: %w", err)
+		}
+		if containsKey(existingValKeys, valKey) {
+			continue
+		}
+		b, err := indexer.MarshalValueKeys(append(existingValKeys, valKey))
+		if err != nil {
+			return err
+		}
+		batch.Put(k, b)
+	}
+	if err = s.store.Write(batch, nil); err != nil {
+		return fmt.Errorf("cannot store index: %w", err)
+	}
+	return nil
+}
+
+func (s *ldbStorage) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	if len(mhs) == 0 {
+		return nil
+	}
+	valKey := makeValueKey(value)
+
+	keys := indexKeys(mhs)
+	s.idxLock.Lock()
+	defer s.idxLock.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, k := range keys {
+		valueKeys, err := s.getValueKeys(k)
+		if err != nil {
+			return err
+		}
+		for i := range valueKeys {
+			if !bytes.Equal(valKey, valueKeys[i]) {
+				continue
+			}
+			if len(valueKeys) == 1 {
+				batch.Delete(k)
+				break
+			}
+			// Remove the value-key from the list of value-keys.
+			valueKeys[i] = valueKeys[len(valueKeys)-1]
+			valueKeys = valueKeys[:len(valueKeys)-1]
+			b, err := indexer.MarshalValueKeys(valueKeys)
+			if err != nil {
+				return err
+			}
+			batch.Put(k, b)
+			break
+		}
+	}
+	return s.store.Write(batch, nil)
+}
+
+func (s *ldbStorage) RemoveProvider(ctx context.Context, providerID peer.ID) error {
+	s.valLock.Lock()
+	defer s.valLock.Unlock()
+
+	iter := s.store.NewIterator(util.BytesPrefix(valueKeyPrefix), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	var count int
+	for iter.Next() {
+		if count%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		count++
+
+		// Skip the value if the provider is different than the one being
+		// removed.
+		value, err := indexer.UnmarshalValue(iter.Value())
+		if err != nil {
+			return err
+		}
+		if value.ProviderID != providerID {
+			continue
+		}
+		// The batch copies the key, so the iterator's buffer can be reused.
+		batch.Delete(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return s.store.Write(batch, nil)
+}
+
+func (s *ldbStorage) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
+	valKey := makeValueKey(indexer.Value{
+		ProviderID: providerID,
+		ContextID:  contextID,
+	})
+
+	s.valLock.Lock()
+	defer s.valLock.Unlock()
+
+	// Remove any previous value.
+	return s.store.Delete(valKey, nil)
+}
+
+func (s *ldbStorage) Size() (int64, error) {
+	var size int64
+	err := filepath.Walk(s.dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+// Flush syncs the LevelDB write-ahead log to disk. LevelDB has no explicit
+// sync, so this is done with a synced write that deletes a key that is never
+// stored.
+func (s *ldbStorage) Flush() error {
+	batch := new(leveldb.Batch)
+	batch.Delete(flushKey)
+	return s.store.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (s *ldbStorage) Close() error {
+	s.valLock.Lock()
+	defer s.valLock.Unlock()
+	if s.store == nil {
+		// Already closed
+		return nil
+	}
+	err := s.store.Close()
+	s.store = nil
+	return err
+}
+
+// Compact compacts the whole LevelDB key range, reclaiming the space of
+// removed and replaced records. Values cannot be changed while the store is
+// compacted. This allows the store to be compacted on a schedule by the
+// maintenance package.
+func (s *ldbStorage) Compact(ctx context.Context) error {
+	s.valLock.RLock()
+	defer s.valLock.RUnlock()
+	if s.store == nil {
+		return indexer.ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.store.CompactRange(util.Range{}); err != nil {
+		return fmt.Errorf("cannot compact leveldb: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that the LevelDB database is open and can be read.
+func (s *ldbStorage) Ping(ctx context.Context) error {
+	s.valLock.RLock()
+	defer s.valLock.RUnlock()
+	if s.store == nil {
+		return indexer.ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := s.store.Has(indexKeyPrefix, nil)
+	return err
+}
+
+func (s *ldbStorage) Iter() (indexer.Iterator, error) {
+	return &ldbIter{
+		iter: s.store.NewIterator(util.BytesPrefix(indexKeyPrefix), nil),
+		s:    s,
+	}, nil
+}
+
+func (it *ldbIter) Next() (multihash.Multihash, []indexer.Value, error) {
+	if it.iter == nil {
+		return nil, nil, io.EOF
+	}
+	for it.iter.Next() {
+		// Copy the key and value, since the iterator reuses its buffers.
+		key := append([]byte(nil), it.iter.Key()...)
+		valueKeys, err := indexer.UnmarshalValueKeys(it.iter.Value())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Get the value for each value key
+		values, err := it.s.getValues(key, valueKeys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot get values for multihash: %w", err)
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		return multihash.Multihash(key[len(indexKeyPrefix):]), values, nil
+	}
+
+	err := it.iter.Error()
+	it.iter.Release()
+	it.iter = nil
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, io.EOF
+}
+
+// getData returns the data stored under k, or nil if k is not found.
+func (s *ldbStorage) getData(k []byte) ([]byte, error) {
+	data, err := s.store.Get(k, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *ldbStorage) getValueKeys(k []byte) ([][]byte, error) {
+	valueKeysData, err := s.getData(k)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get multihash from store: %w", err)
+	}
+	if valueKeysData == nil {
+		return nil, nil
+	}
+
+	return indexer.UnmarshalValueKeys(valueKeysData)
+}
+
+func (s *ldbStorage) get(k []byte) ([]indexer.Value, bool, error) {
+	valueKeys, err := s.getValueKeys(k)
+	if err != nil {
+		return nil, false, err
+	}
+	if valueKeys == nil {
+		return nil, false, nil
+	}
+
+	// Get the value for each value key.
+	values, err := s.getValues(k, valueKeys)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot get values for multihash: %w", err)
+	}
+
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+
+	return values, true, nil
+}
+
+func (s *ldbStorage) updateValue(value indexer.Value, saveNew bool) ([]byte, error) {
+	// All values must have metadata, even if this only consists of the
+	// protocol ID.
+	if len(value.MetadataBytes) == 0 {
+		return nil, indexer.ErrMissingMetadata
+	}
+
+	valKey := makeValueKey(value)
+
+	s.valLock.Lock()
+	defer s.valLock.Unlock()
+
+	// See if there is a previous value.
+	valData, err := s.getData(valKey)
+	if err != nil {
+		return nil, err
+	}
+	if valData == nil {
+		if saveNew {
+			// Store the new value.
+			valData, err := indexer.MarshalValue(value)
+			if err != nil {
+				return nil, err
+			}
+			err = s.store.Put(valKey, valData, nil)
+			if err != nil {
+				return nil, fmt.Errorf("cannot save new value: %w", err)
+			}
+		}
+		return valKey, nil
+	}
+
+	// Found previous value.  If it is different, then update it.
+	newValData, err := indexer.MarshalValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(newValData, valData) {
+		err = s.store.Put(valKey, newValData, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot update existing value: %w", err)
+		}
+	}
+
+	return valKey, nil
+}
+
+// indexKeys returns the index keys of the multihashes, with duplicates
+// removed.
+func indexKeys(mhs []multihash.Multihash) [][]byte {
+	keys := make([][]byte, 0, len(mhs))
+	seen := make(map[string]struct{}, len(mhs))
+	for _, m := range mhs {
+		if _, ok := seen[string(m)]; ok {
+			continue
+		}
+		seen[string(m)] = struct{}{}
+		keys = append(keys, makeIndexKey(m))
+	}
+	return keys
+}
+
+func (s *ldbStorage) getValues(key []byte, valueKeys [][]byte) ([]indexer.Value, error) {
+	values := make([]indexer.Value, 0, len(valueKeys))
+
+	s.valLock.RLock()
+	for i := 0; i < len(valueKeys); {
+		// Fetch value from datastore
+		valData, err := s.getData(valueKeys[i])
+		if err != nil {
+			s.valLock.RUnlock()
+			return nil, fmt.Errorf("cannot get value: %w", err)
+		}
+		if valData == nil {
+			// If value not in datastore, this means it has been
+			// deleted, and the mapping from the multihash to that value
+			// should also be removed.
+			valueKeys[i] = valueKeys[len(valueKeys)-1]
+			valueKeys[len(valueKeys)-1] = nil
+			valueKeys = valueKeys[:len(valueKeys)-1]
+			continue
+		}
+		val, err := indexer.UnmarshalValue(valData)
+		if err != nil {
+			s.valLock.RUnlock()
+			return nil, err
+		}
+		values = append(values, val)
+		i++
+	}
+	s.valLock.RUnlock()
+
+	// If some of the values were removed, then update the value-key list for
+	// the multihash.
+	if len(valueKeys) < cap(values) {
+		s.idxLock.Lock()
+		defer s.idxLock.Unlock()
+
+		if len(valueKeys) == 0 {
+			err := s.store.Delete(key, nil)
+			if err != nil {
+				return nil, fmt.Errorf("cannot delete multihash: %w", err)
+			}
+			return nil, nil
+		}
+
+		// Update the values this multihash maps to.
+		b, err := indexer.MarshalValueKeys(valueKeys)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.store.Put(key, b, nil); err != nil {
+			return nil, fmt.Errorf("cannot update value keys for multihash: %w", err)
+		}
+	}
+
+	return values, nil
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func makeIndexKey(m multihash.Multihash) []byte {
+	mhb := []byte(m)
+	var b bytes.Buffer
+	b.Grow(len(indexKeyPrefix) + len(mhb))
+	b.Write(indexKeyPrefix)
+	b.Write(mhb)
+	return b.Bytes()
+}
+
+func makeValueKey(value indexer.Value) []byte {
+	// Create a hash of the ProviderID and ContextID so that the key length is
+	// fixed.  This hash is used to look up the Value, which contains
+	// ProviderID, ContextID, and Metadata.
+	h, err := blake2b.New(valueKeySize, nil)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = io.WriteString(h, string(value.ProviderID))
+	h.Write(value.ContextID)
+
+	var b bytes.Buffer
+	b.Grow(len(valueKeyPrefix) + h.Size())
+	b.Write(valueKeyPrefix)
+	b.Write(h.Sum(nil))
+	return b.Bytes()
+}
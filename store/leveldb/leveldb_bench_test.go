@@ -0,0 +1,33 @@
+package leveldb_test
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/leveldb"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+// benchMetadataSize is the size of value metadata used in put benchmarks.
+const benchMetadataSize = 128
+
+func initBenchStore(b *testing.B) indexer.Interface {
+	s, err := leveldb.New(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+func BenchmarkGet(b *testing.B) {
+	test.BenchMultihashGet(initBenchStore(b), b)
+}
+func BenchmarkParallelGet(b *testing.B) {
+	test.BenchParallelMultihashGet(initBenchStore(b), b)
+}
+func BenchmarkPut(b *testing.B) {
+	test.BenchMultihashPut(initBenchStore(b), benchMetadataSize, b)
+}
+func BenchmarkParallelPut(b *testing.B) {
+	test.BenchParallelMultihashPut(initBenchStore(b), benchMetadataSize, b)
+}
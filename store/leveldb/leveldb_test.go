@@ -0,0 +1,93 @@
+package leveldb_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/leveldb"
+	"github.com/filecoin-project/go-indexer-core/store/maintenance"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func initLevelDB(t *testing.T) indexer.Interface {
+	s, err := leveldb.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestE2E(t *testing.T) {
+	s := initLevelDB(t)
+	test.E2ETest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	s := initLevelDB(t)
+	test.ParallelUpdateTest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	s := initLevelDB(t)
+	test.SizeTest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := initLevelDB(t)
+	test.PingTest(t, s)
+}
+
+func TestCompact(t *testing.T) {
+	s := initLevelDB(t)
+	test.RemoveProviderTest(t, s)
+	if err := s.(maintenance.Compactor).Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	test.PingTest(t, s)
+}
+
+func TestRemove(t *testing.T) {
+	s := initLevelDB(t)
+	test.RemoveTest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveProviderContext(t *testing.T) {
+	s := initLevelDB(t)
+	test.RemoveProviderContextTest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveProvider(t *testing.T) {
+	s := initLevelDB(t)
+	test.RemoveProviderTest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := initLevelDB(t)
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
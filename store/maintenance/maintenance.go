@@ -0,0 +1,245 @@
+// Package maintenance runs background maintenance, such as compaction, of a
+// value store on a schedule.
+//
+// A value store that can be maintained while it is open implements Compactor.
+// A Scheduler calls Compact at a regular interval, with random jitter so that
+// the stores of many indexers started together are not all compacted at once.
+// If a run is still going when the next one is due, then the next run is
+// skipped instead of waiting, so that a slow compaction does not cause runs to
+// pile up.
+//
+// The leveldb and pogreb value stores implement Compactor. The storethehash
+// value store does not, since it can only be compacted while it is closed, by
+// storethehash.Compact, so New returns an error for it.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("indexer-core/maintenance")
+
+// Compactor is implemented by value stores that can compact their data, or do
+// other maintenance such as garbage collection, while they are open.
+type Compactor interface {
+	// Compact compacts the value store. It should stop early and return the
+	// context's error if the context is canceled.
+	Compact(context.Context) error
+}
+
+// config contains options for the scheduler.
+type config struct {
+	jitter  time.Duration
+	timeout time.Duration
+}
+
+type Option func(*config)
+
+// Jitter sets the largest random time added to the interval before each run.
+// The default is no jitter.
+func Jitter(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.jitter = d
+	}
+}
+
+// RunTimeout sets how long a run can take before its context is canceled. The
+// default is no timeout.
+func RunTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = d
+	}
+}
+
+// Stats describes the runs of a Scheduler.
+type Stats struct {
+	// Runs is the number of runs started.
+	Runs int
+	// Failures is the number of runs that returned an error.
+	Failures int
+	// Skipped is the number of runs that were not started because the
+	// previous run was still going.
+	Skipped int
+	// Running is true if a run is going.
+	Running bool
+	// LastStart is when the last run started, or zero if there has been no
+	// run.
+	LastStart time.Time
+	// LastDuration is how long the last finished run took.
+	LastDuration time.Duration
+	// LastErr is the error returned by the last finished run, or nil if it
+	// succeeded.
+	LastErr error
+}
+
+// Scheduler runs the compaction of a value store at a regular interval.
+type Scheduler struct {
+	compactor Compactor
+	interval  time.Duration
+	jitter    time.Duration
+	timeout   time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	stats   Stats
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+	runs    sync.WaitGroup
+}
+
+// New creates a Scheduler that compacts the value store every interval, once
+// it is started. The value store must implement Compactor.
+func New(valueStore indexer.Interface, interval time.Duration, options ...Option) (*Scheduler, error) {
+	compactor, ok := valueStore.(Compactor)
+	if !ok {
+		return nil, errors.New("value store does not support compaction")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be greater than 0")
+	}
+	var cfg config
+	for _, opt := range options {
+		opt(&cfg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		compactor: compactor,
+		interval:  interval,
+		jitter:    cfg.jitter,
+		timeout:   cfg.timeout,
+		ctx:       ctx,
+		cancel:    cancel,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Start starts running compaction on schedule. The first run is one interval
+// after Start is called. Calling Start again does nothing.
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	go s.loop()
+}
+
+// Stop stops running compaction, cancels the context of a run in progress,
+// and waits for it to return. The Scheduler cannot be started again.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	started := s.started
+	s.started = true
+	select {
+	case <-s.stop:
+		s.mutex.Unlock()
+		return
+	default:
+		close(s.stop)
+	}
+	s.mutex.Unlock()
+
+	s.cancel()
+	if started {
+		<-s.done
+	}
+	s.runs.Wait()
+}
+
+// RunNow starts a run without waiting for the schedule, unless a run is
+// already going or the Scheduler is stopped. It does not wait for the run to
+// finish. Returns false if no run was started.
+func (s *Scheduler) RunNow() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	if s.stats.Running {
+		s.stats.Skipped++
+		return false
+	}
+	s.stats.Running = true
+	s.stats.Runs++
+	s.stats.LastStart = time.Now()
+	s.runs.Add(1)
+	go s.run(s.stats.LastStart)
+	return true
+}
+
+// Stats returns the statistics of the runs so far.
+func (s *Scheduler) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+
+	timer := time.NewTimer(s.nextDelay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if s.RunNow() {
+				log.Debug("Started scheduled compaction")
+			} else {
+				log.Warn("Skipped scheduled compaction because the previous one is still running")
+			}
+			timer.Reset(s.nextDelay())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// nextDelay returns the time until the next run.
+func (s *Scheduler) nextDelay() time.Duration {
+	if s.jitter <= 0 {
+		return s.interval
+	}
+	return s.interval + time.Duration(rand.Int63n(int64(s.jitter)+1))
+}
+
+func (s *Scheduler) run(start time.Time) {
+	defer s.runs.Done()
+
+	ctx := s.ctx
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	err := s.compactor.Compact(ctx)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Errorw("Compaction failed", "err", err, "elapsed", elapsed)
+	} else {
+		log.Infow("Compaction finished", "elapsed", elapsed)
+	}
+
+	s.mutex.Lock()
+	s.stats.Running = false
+	s.stats.LastDuration = elapsed
+	s.stats.LastErr = err
+	if err != nil {
+		s.stats.Failures++
+	}
+	s.mutex.Unlock()
+}
@@ -0,0 +1,139 @@
+package maintenance_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/maintenance"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+)
+
+// fakeCompactor is a value store whose Compact blocks until it is released,
+// and records how many calls overlap.
+type fakeCompactor struct {
+	indexer.Interface
+	active    int32
+	maxActive int32
+	calls     int32
+	release   chan struct{}
+}
+
+func newFakeCompactor() *fakeCompactor {
+	return &fakeCompactor{
+		Interface: memory.New(),
+		release:   make(chan struct{}),
+	}
+}
+
+func (f *fakeCompactor) Compact(ctx context.Context) error {
+	atomic.AddInt32(&f.calls, 1)
+	n := atomic.AddInt32(&f.active, 1)
+	defer atomic.AddInt32(&f.active, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxActive)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxActive, max, n) {
+			break
+		}
+	}
+	select {
+	case <-f.release:
+		return nil
+	default:
+	}
+	select {
+	case <-f.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	f := newFakeCompactor()
+	s, err := maintenance.New(f, 5*time.Millisecond, maintenance.Jitter(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+
+	// The first run blocks, so the runs due while it is going are skipped.
+	waitFor(t, func() bool { return s.Stats().Skipped >= 3 })
+	stats := s.Stats()
+	if stats.Runs != 1 || !stats.Running {
+		t.Fatalf("expected 1 running run, got %d runs, running %t", stats.Runs, stats.Running)
+	}
+	if stats.LastStart.IsZero() {
+		t.Fatal("start time of run not recorded")
+	}
+
+	// Once released, runs continue on schedule, without overlapping.
+	close(f.release)
+	waitFor(t, func() bool { return s.Stats().Runs >= 5 })
+	s.Stop()
+
+	if n := atomic.LoadInt32(&f.maxActive); n != 1 {
+		t.Fatalf("expected runs not to overlap, got %d concurrent runs", n)
+	}
+	stats = s.Stats()
+	if stats.Running {
+		t.Fatal("run still going after stop")
+	}
+	if stats.Failures != 0 || stats.LastErr != nil {
+		t.Fatalf("expected no failures, got %d: %v", stats.Failures, stats.LastErr)
+	}
+	if n := int(atomic.LoadInt32(&f.calls)); n != stats.Runs {
+		t.Fatalf("compacted %d times, but recorded %d runs", n, stats.Runs)
+	}
+
+	// No more runs after stop.
+	runs := stats.Runs
+	time.Sleep(20 * time.Millisecond)
+	if s.Stats().Runs != runs || s.RunNow() {
+		t.Fatal("scheduler ran after stop")
+	}
+}
+
+func TestSchedulerStopCancelsRun(t *testing.T) {
+	f := newFakeCompactor()
+	s, err := maintenance.New(f, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	if !s.RunNow() {
+		t.Fatal("expected run to start")
+	}
+	if s.RunNow() {
+		t.Fatal("expected run to be skipped while another is going")
+	}
+	s.Stop()
+
+	stats := s.Stats()
+	if stats.Runs != 1 || stats.Skipped != 1 {
+		t.Fatalf("expected 1 run and 1 skipped, got %d and %d", stats.Runs, stats.Skipped)
+	}
+	if !errors.Is(stats.LastErr, context.Canceled) || stats.Failures != 1 {
+		t.Fatalf("expected run to be canceled, got %v", stats.LastErr)
+	}
+}
+
+func TestSchedulerRequiresCompactor(t *testing.T) {
+	if _, err := maintenance.New(memory.New(), time.Hour); err == nil {
+		t.Fatal("expected error for value store that cannot compact")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
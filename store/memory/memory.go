@@ -11,7 +11,6 @@ package memory
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -65,7 +64,7 @@ func (s *memoryStore) Get(m multihash.Multihash) ([]indexer.Value, bool, error)
 
 func (s *memoryStore) Put(value indexer.Value, mhs ...multihash.Multihash) error {
 	if len(value.MetadataBytes) == 0 {
-		return errors.New("value missing metadata")
+		return indexer.ErrMissingMetadata
 	}
 
 	s.mutex.Lock()
@@ -184,10 +183,24 @@ func (s *memoryStore) Size() (int64, error) {
 	return 0, nil
 }
 
+// Stats returns the number of multihashes and values held in the store.
+func (s *memoryStore) Stats() (*indexer.Stats, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return &indexer.Stats{
+		Indexes: s.rtree.Len(),
+		Values:  s.interns.Len(),
+	}, nil
+}
+
 func (s *memoryStore) Flush() error { return nil }
 
 func (s *memoryStore) Close() error { return nil }
 
+// Ping always succeeds, since the store is held in memory.
+func (s *memoryStore) Ping(ctx context.Context) error { return nil }
+
 func (s *memoryStore) Iter() (indexer.Iterator, error) {
 	return &memoryIter{
 		iter: s.rtree.Iter(),
@@ -0,0 +1,216 @@
+// Package mirror defines a value store that writes to two underlying value
+// stores, to migrate data from one value store to another without downtime.
+//
+// All reads are served by the primary store. Every write is applied to the
+// primary store, and then to the secondary store. Migrate copies the existing
+// data from the primary to the secondary, while new writes are mirrored. When
+// Migrate has finished, the secondary has the same data as the primary, and
+// can replace it.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/filecoin-project/go-indexer-core"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+var log = logging.Logger("indexer-core/mirror")
+
+// Store is an indexer.Interface that mirrors writes to a secondary store, and
+// can migrate the existing data of its primary store to the secondary store.
+type Store struct {
+	primary               indexer.Interface
+	secondary             indexer.Interface
+	ignoreSecondaryErrors bool
+
+	// writeMutex is held for reading by each mirrored write, from the write
+	// to the primary store until the write to the secondary store, and for
+	// writing by Migrate while it copies a multihash. This keeps Migrate from
+	// copying data that a mirrored write has changed in only one store.
+	writeMutex sync.RWMutex
+}
+
+var _ indexer.Interface = &Store{}
+
+// config contains options for the mirror store.
+type config struct {
+	ignoreSecondaryErrors bool
+}
+
+type Option func(*config)
+
+// IgnoreSecondaryErrors sets whether errors writing to the secondary store are
+// logged and ignored. By default, an error writing to the secondary store is
+// returned, the same as an error writing to the primary store.
+func IgnoreSecondaryErrors(ignore bool) Option {
+	return func(cfg *config) {
+		cfg.ignoreSecondaryErrors = ignore
+	}
+}
+
+// New creates a new Store that reads from primary, and writes to both primary
+// and secondary.
+func New(primary, secondary indexer.Interface, options ...Option) (*Store, error) {
+	if primary == nil || secondary == nil {
+		return nil, errors.New("primary and secondary stores are required")
+	}
+	var cfg config
+	for _, opt := range options {
+		opt(&cfg)
+	}
+	return &Store{
+		primary:               primary,
+		secondary:             secondary,
+		ignoreSecondaryErrors: cfg.ignoreSecondaryErrors,
+	}, nil
+}
+
+func (s *Store) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
+	return s.primary.Get(m)
+}
+
+func (s *Store) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+
+	if err := s.primary.Put(value, mhs...); err != nil {
+		return err
+	}
+	return s.secondaryErr("put", s.secondary.Put(value, mhs...))
+}
+
+func (s *Store) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+
+	if err := s.primary.Remove(value, mhs...); err != nil {
+		return err
+	}
+	return s.secondaryErr("remove", s.secondary.Remove(value, mhs...))
+}
+
+func (s *Store) RemoveProvider(ctx context.Context, providerID peer.ID) error {
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+
+	if err := s.primary.RemoveProvider(ctx, providerID); err != nil {
+		return err
+	}
+	return s.secondaryErr("remove provider", s.secondary.RemoveProvider(ctx, providerID))
+}
+
+func (s *Store) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+
+	if err := s.primary.RemoveProviderContext(providerID, contextID); err != nil {
+		return err
+	}
+	return s.secondaryErr("remove provider context", s.secondary.RemoveProviderContext(providerID, contextID))
+}
+
+// Size returns the size of the primary store.
+func (s *Store) Size() (int64, error) {
+	return s.primary.Size()
+}
+
+func (s *Store) Flush() error {
+	if err := s.primary.Flush(); err != nil {
+		return err
+	}
+	return s.secondaryErr("flush", s.secondary.Flush())
+}
+
+// Close closes both stores, returning the first error encountered.
+func (s *Store) Close() error {
+	err := s.primary.Close()
+	if err2 := s.secondary.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Ping pings both stores. An error from the secondary store is only returned
+// if secondary errors are not ignored.
+func (s *Store) Ping(ctx context.Context) error {
+	if err := s.primary.Ping(ctx); err != nil {
+		return err
+	}
+	return s.secondaryErr("ping", s.secondary.Ping(ctx))
+}
+
+// Iter iterates the primary store.
+func (s *Store) Iter() (indexer.Iterator, error) {
+	return s.primary.Iter()
+}
+
+// Migrate copies all multihashes and values in the primary store to the
+// secondary store. Writes that happen while Migrate runs are mirrored as
+// usual, so the secondary store has the same data as the primary store once
+// Migrate returns. Each multihash is read again from the primary store while
+// mirrored writes are held off, so that Migrate does not copy values that a
+// mirrored write has since updated or removed. The primary store's iterator
+// must allow writes while iterating if writes are not stopped during Migrate.
+//
+// Errors writing to the secondary store are always returned by Migrate,
+// whether or not they are ignored for mirrored writes.
+func (s *Store) Migrate(ctx context.Context) error {
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return err
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		m, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err = s.migrateMultihash(m); err != nil {
+			return err
+		}
+	}
+	return s.secondary.Flush()
+}
+
+// migrateMultihash copies the current values of the multihash in the primary
+// store to the secondary store.
+func (s *Store) migrateMultihash(m multihash.Multihash) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	values, _, err := s.primary.Get(m)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		if err = s.secondary.Put(value, m); err != nil {
+			return fmt.Errorf("cannot copy value to secondary store: %w", err)
+		}
+	}
+	return nil
+}
+
+// secondaryErr returns the error from a write to the secondary store, or logs
+// and drops it if secondary errors are ignored.
+func (s *Store) secondaryErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if s.ignoreSecondaryErrors {
+		log.Errorw("Cannot "+op+" in secondary store", "err", err)
+		return nil
+	}
+	return fmt.Errorf("cannot %s in secondary store: %w", op, err)
+}
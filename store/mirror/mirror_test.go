@@ -0,0 +1,263 @@
+package mirror_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/mirror"
+	"github.com/filecoin-project/go-indexer-core/store/storethehash"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+func initMirror(t *testing.T) indexer.Interface {
+	s, err := mirror.New(memory.New(), memory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestE2E(t *testing.T) {
+	s := initMirror(t)
+	test.E2ETest(t, s)
+}
+
+func TestRemove(t *testing.T) {
+	s := initMirror(t)
+	test.RemoveTest(t, s)
+}
+
+func TestRemoveProviderContext(t *testing.T) {
+	s := initMirror(t)
+	test.RemoveProviderContextTest(t, s)
+}
+
+func TestRemoveProvider(t *testing.T) {
+	s := initMirror(t)
+	test.RemoveProviderTest(t, s)
+}
+
+func TestMigrate(t *testing.T) {
+	primary := memory.New()
+	secondary, err := storethehash.New(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]indexer.Value, 6)
+	for i := range values {
+		p := p1
+		if i%2 != 0 {
+			p = p2
+		}
+		values[i] = indexer.Value{ProviderID: p, ContextID: []byte(fmt.Sprint("ctxid-", i)), MetadataBytes: []byte("meta")}
+	}
+	mhs := test.RandomMultihashes(60)
+
+	// Data in the primary store before mirroring starts.
+	for i := 0; i < 3; i++ {
+		if err = primary.Put(values[i], mhs[i*10:i*10+20]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := mirror.New(primary, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mixed workload after migration.
+	for i := 3; i < len(values); i++ {
+		if err = s.Put(values[i], mhs[i*10-10:i*10+10]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Remove(values[0], mhs[:5]...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveProviderContext(values[2].ProviderID, values[2].ContextID); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveProvider(context.Background(), p2); err != nil {
+		t.Fatal(err)
+	}
+	updated := values[4]
+	updated.MetadataBytes = []byte("new-meta")
+	if err = s.Put(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both stores must have the same data.
+	iter, err := primary.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		m, vals, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+		secVals, found, err := secondary.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(secVals) != len(vals) {
+			t.Fatalf("secondary has %d values for multihash, expected %d", len(secVals), len(vals))
+		}
+		for _, v := range vals {
+			var ok bool
+			for _, sv := range secVals {
+				if v.Equal(sv) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				t.Fatal("value missing from secondary store")
+			}
+		}
+	}
+	if count == 0 {
+		t.Fatal("no multihashes in primary store")
+	}
+	// Removed values are gone from the secondary store.
+	for _, m := range mhs[:5] {
+		if _, found, _ := secondary.Get(m); found {
+			t.Fatal("removed multihash found in secondary store")
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hookStore is a value store whose iterator calls a function after reading
+// each multihash and its values.
+type hookStore struct {
+	indexer.Interface
+	afterNext func(multihash.Multihash)
+}
+
+func (s *hookStore) Iter() (indexer.Iterator, error) {
+	iter, err := s.Interface.Iter()
+	if err != nil {
+		return nil, err
+	}
+	return &hookIter{Iterator: iter, afterNext: s.afterNext}, nil
+}
+
+type hookIter struct {
+	indexer.Iterator
+	afterNext func(multihash.Multihash)
+}
+
+func (it *hookIter) Next() (multihash.Multihash, []indexer.Value, error) {
+	m, values, err := it.Iterator.Next()
+	if err == nil {
+		it.afterNext(m)
+	}
+	return m, values, err
+}
+
+func TestMigrateMetadataUpdate(t *testing.T) {
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta-1")}
+	updated := indexer.Value{ProviderID: p, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(10)
+
+	sth, err := storethehash.New(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &hookStore{Interface: sth}
+	if err = primary.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	secondary := memory.New()
+	s, err := mirror.New(primary, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Update the metadata of the value after Migrate reads the first
+	// multihash, and before Migrate copies it.
+	var once sync.Once
+	primary.afterNext = func(m multihash.Multihash) {
+		once.Do(func() {
+			if err := s.Put(updated, m); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	if err = s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range mhs {
+		vals, found, err := secondary.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(updated) {
+			t.Fatal("secondary store does not have updated metadata")
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryErrors(t *testing.T) {
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta")}
+
+	for _, ignore := range []bool{false, true} {
+		secondary, err := storethehash.New(context.Background(), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Writes to a closed store fail.
+		if err = secondary.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s, err := mirror.New(memory.New(), secondary, mirror.IgnoreSecondaryErrors(ignore))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Put(value, test.RandomMultihashes(1)...)
+		if ignore && err != nil {
+			t.Fatal("secondary error should have been ignored:", err)
+		}
+		if !ignore && err == nil {
+			t.Fatal("expected secondary error")
+		}
+	}
+}
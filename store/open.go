@@ -0,0 +1,181 @@
+// Package store opens value stores from a configuration string, so that the
+// value store backend can be chosen by configuration, and exports value store
+// contents in formats that other tools can read.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/leveldb"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/pogreb"
+	"github.com/filecoin-project/go-indexer-core/store/storethehash"
+)
+
+const (
+	SchemeStorethehash = "storethehash"
+	SchemePogreb       = "pogreb"
+	SchemeLevelDB      = "leveldb"
+	SchemeMemory       = "memory"
+)
+
+// config contains options for opening a value store.
+type config struct {
+	sthOpts []storethehash.Option
+}
+
+type Option func(*config)
+
+// StorethehashOptions sets options used when opening a storethehash value
+// store. These are applied after any options given in the spec.
+func StorethehashOptions(opts ...storethehash.Option) Option {
+	return func(cfg *config) {
+		cfg.sthOpts = append(cfg.sthOpts, opts...)
+	}
+}
+
+// Open creates the value store described by spec. The scheme of spec selects
+// the backend, and the path is the directory of the value store:
+//
+//	storethehash:///path/to/valuestore?syncInterval=1s
+//	pogreb:///path/to/valuestore
+//	leveldb:///path/to/valuestore
+//	memory://
+//
+// A storethehash spec may have the query parameters: syncInterval, gcInterval,
+// burstRate, indexBitSize, indexFileSize, putConcurrency, valueCacheSize,
+// flushEvery, reverseIndex, valueTimestamps, closeTimeout, indexDir. Durations
+// are given in time.ParseDuration format. Other backends have no parameters.
+func Open(ctx context.Context, spec string, options ...Option) (indexer.Interface, error) {
+	var cfg config
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value store spec: %w", err)
+	}
+	query := u.Query()
+	dir := u.Opaque
+	if dir == "" {
+		// Allow a relative path, as in "pogreb://relative/dir".
+		dir = u.Host + u.Path
+	}
+
+	switch u.Scheme {
+	case SchemeStorethehash:
+		if dir == "" {
+			return nil, fmt.Errorf("%s value store requires a path", u.Scheme)
+		}
+		sthOpts, err := storethehashOptions(query)
+		if err != nil {
+			return nil, err
+		}
+		return storethehash.New(ctx, dir, append(sthOpts, cfg.sthOpts...)...)
+	case SchemePogreb, SchemeLevelDB:
+		if dir == "" {
+			return nil, fmt.Errorf("%s value store requires a path", u.Scheme)
+		}
+		if len(query) != 0 {
+			return nil, fmt.Errorf("%s value store does not have options", u.Scheme)
+		}
+		if u.Scheme == SchemePogreb {
+			return pogreb.New(dir)
+		}
+		return leveldb.New(dir)
+	case SchemeMemory:
+		if dir != "" {
+			return nil, fmt.Errorf("%s value store does not have a path", u.Scheme)
+		}
+		if len(query) != 0 {
+			return nil, fmt.Errorf("%s value store does not have options", u.Scheme)
+		}
+		return memory.New(), nil
+	case "":
+		return nil, fmt.Errorf("value store spec %q has no scheme", spec)
+	default:
+		return nil, fmt.Errorf("unknown value store scheme %q", u.Scheme)
+	}
+}
+
+// storethehashOptions converts query parameters into storethehash options.
+func storethehashOptions(query url.Values) ([]storethehash.Option, error) {
+	var opts []storethehash.Option
+	for name, vals := range query {
+		if len(vals) != 1 {
+			return nil, fmt.Errorf("option %s given more than once", name)
+		}
+		opt, err := storethehashOption(name, vals[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %s: %w", name, err)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+func storethehashOption(name, val string) (storethehash.Option, error) {
+	switch name {
+	case "syncInterval", "gcInterval", "closeTimeout":
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "syncInterval":
+			return storethehash.SyncInterval(d), nil
+		case "gcInterval":
+			return storethehash.GCInterval(d), nil
+		}
+		return storethehash.CloseTimeout(d), nil
+	case "burstRate", "flushEvery":
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if name == "burstRate" {
+			return storethehash.BurstRate(n), nil
+		}
+		return storethehash.FlushEvery(n), nil
+	case "indexBitSize":
+		n, err := strconv.ParseUint(val, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		return storethehash.IndexBitSize(uint8(n)), nil
+	case "indexFileSize":
+		n, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		return storethehash.IndexFileSize(uint32(n)), nil
+	case "putConcurrency", "valueCacheSize":
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+		if name == "putConcurrency" {
+			return storethehash.PutConcurrency(n), nil
+		}
+		return storethehash.ValueCacheSize(n), nil
+	case "reverseIndex", "valueTimestamps":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, err
+		}
+		if name == "reverseIndex" {
+			return storethehash.ReverseIndex(b), nil
+		}
+		return storethehash.ValueTimestamps(b), nil
+	case "indexDir":
+		return storethehash.IndexDir(val), nil
+	}
+	return nil, errors.New("unknown option")
+}
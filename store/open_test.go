@@ -0,0 +1,74 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core/store"
+	"github.com/filecoin-project/go-indexer-core/store/storethehash"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestOpen(t *testing.T) {
+	sthDir := filepath.Join(t.TempDir(), "sth")
+	// storethehash requires an existing directory.
+	if err := os.Mkdir(sthDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	specs := []string{
+		"storethehash://" + sthDir + "?syncInterval=100ms&putConcurrency=2&indexBitSize=16",
+		"pogreb://" + filepath.Join(dir, "pogreb"),
+		"leveldb://" + filepath.Join(dir, "leveldb"),
+		"memory://",
+	}
+	for _, spec := range specs {
+		s, err := store.Open(context.Background(), spec)
+		if err != nil {
+			t.Fatalf("cannot open %s: %s", spec, err)
+		}
+		test.E2ETest(t, s)
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenStorethehashOptions(t *testing.T) {
+	spec := "storethehash://" + t.TempDir()
+	s, err := store.Open(context.Background(), spec, store.StorethehashOptions(storethehash.PutConcurrency(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*storethehash.Store); !ok {
+		t.Fatalf("expected storethehash value store, got %T", s)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	specs := []string{
+		"",
+		dir,
+		"badger://" + dir,
+		"storethehash://",
+		"storethehash://" + dir + "?unknown=1",
+		"storethehash://" + dir + "?syncInterval=often",
+		"storethehash://" + dir + "?indexBitSize=300",
+		"pogreb://",
+		"pogreb://" + dir + "?syncInterval=1s",
+		"memory://" + dir,
+	}
+	for _, spec := range specs {
+		s, err := store.Open(context.Background(), spec)
+		if err == nil {
+			s.Close()
+			t.Fatalf("expected error opening %q", spec)
+		}
+	}
+}
@@ -9,7 +9,6 @@ package pogreb
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -189,6 +188,39 @@ func (s *pStorage) Close() error {
 	return err
 }
 
+// Compact compacts the pogreb data files, reclaiming the space of removed and
+// replaced records. Values cannot be changed while the store is compacted.
+// This allows the store to be compacted on a schedule by the maintenance
+// package.
+func (s *pStorage) Compact(ctx context.Context) error {
+	s.valLock.RLock()
+	defer s.valLock.RUnlock()
+	if s.store == nil {
+		return indexer.ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.store.Compact(); err != nil {
+		return fmt.Errorf("cannot compact pogreb: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that the pogreb database is open and can be read.
+func (s *pStorage) Ping(ctx context.Context) error {
+	s.valLock.RLock()
+	defer s.valLock.RUnlock()
+	if s.store == nil {
+		return indexer.ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := s.store.Has(indexKeyPrefix)
+	return err
+}
+
 func (s *pStorage) Iter() (indexer.Iterator, error) {
 	err := s.store.Sync()
 	if err != nil {
@@ -335,7 +367,7 @@ func (s *pStorage) updateValue(value indexer.Value, saveNew bool) ([]byte, error
 	// All values must have metadata, even if this only consists of the
 	// protocol ID.
 	if len(value.MetadataBytes) == 0 {
-		return nil, errors.New("value missing metadata")
+		return nil, indexer.ErrMissingMetadata
 	}
 
 	valKey := makeValueKey(value)
@@ -9,6 +9,9 @@ import (
 	"github.com/filecoin-project/go-indexer-core/store/test"
 )
 
+// benchMetadataSize is the size of value metadata used in put benchmarks.
+const benchMetadataSize = 128
+
 func initBenchStore(b *testing.B) indexer.Interface {
 	s, err := pogreb.New(b.TempDir())
 	if err != nil {
@@ -25,6 +28,14 @@ func BenchmarkParallelGet(b *testing.B) {
 	skipBenchIf32bit(b)
 	test.BenchParallelMultihashGet(initBenchStore(b), b)
 }
+func BenchmarkPut(b *testing.B) {
+	skipBenchIf32bit(b)
+	test.BenchMultihashPut(initBenchStore(b), benchMetadataSize, b)
+}
+func BenchmarkParallelPut(b *testing.B) {
+	skipBenchIf32bit(b)
+	test.BenchParallelMultihashPut(initBenchStore(b), benchMetadataSize, b)
+}
 
 // To run this storage benchmarks run:
 // TEST_STORAGE=true go test -v -timeout=30m
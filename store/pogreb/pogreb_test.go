@@ -1,10 +1,12 @@
 package pogreb_test
 
 import (
+	"context"
 	"runtime"
 	"testing"
 
 	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/maintenance"
 	"github.com/filecoin-project/go-indexer-core/store/pogreb"
 	"github.com/filecoin-project/go-indexer-core/store/test"
 )
@@ -47,6 +49,24 @@ func TestSize(t *testing.T) {
 	}
 }
 
+func TestPing(t *testing.T) {
+	skipIf32bit(t)
+
+	s := initPogreb(t)
+	test.PingTest(t, s)
+}
+
+func TestCompact(t *testing.T) {
+	skipIf32bit(t)
+
+	s := initPogreb(t)
+	test.RemoveProviderTest(t, s)
+	if err := s.(maintenance.Compactor).Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	test.PingTest(t, s)
+}
+
 func TestRemove(t *testing.T) {
 	skipIf32bit(t)
 
@@ -0,0 +1,236 @@
+// Package sharded defines a value store that spreads its data across a number
+// of underlying value stores.
+//
+// Each multihash is routed to one shard by a hash of the multihash. A value is
+// stored in every shard that has a multihash mapped to it, so a Get only needs
+// to look in a single shard. Operations that are not specific to a multihash,
+// such as RemoveProvider, are sent to all shards.
+//
+// The shard for a multihash depends on the number of shards, so a sharded
+// store must always be opened with the same shards in the same order. Adding
+// shards requires reindexing the data.
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+type shardedStore struct {
+	shards []indexer.Interface
+}
+
+type shardedIter struct {
+	shards []indexer.Interface
+	iter   indexer.Iterator
+	next   int
+}
+
+// New creates a new indexer.Interface that distributes multihashes across the
+// given value stores.
+func New(shards ...indexer.Interface) (indexer.Interface, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards given")
+	}
+	for i := range shards {
+		if shards[i] == nil {
+			return nil, errors.New("nil shard")
+		}
+	}
+	return &shardedStore{
+		shards: shards,
+	}, nil
+}
+
+func (s *shardedStore) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
+	return s.shards[s.shardIndex(m)].Get(m)
+}
+
+func (s *shardedStore) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	groups := s.groupByShard(mhs)
+	for i, shard := range s.shards {
+		// A shard with no multihashes still gets the value, so that existing
+		// copies of the value are updated in all shards.
+		err := shard.Put(value, groups[i]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	groups := s.groupByShard(mhs)
+	for i, shard := range s.shards {
+		if len(groups[i]) == 0 {
+			continue
+		}
+		err := shard.Remove(value, groups[i]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) RemoveProvider(ctx context.Context, providerID peer.ID) error {
+	for _, shard := range s.shards {
+		err := shard.RemoveProvider(ctx, providerID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
+	for _, shard := range s.shards {
+		err := shard.RemoveProviderContext(providerID, contextID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Size() (int64, error) {
+	var total int64
+	for _, shard := range s.shards {
+		size, err := shard.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// Stats returns the sum of the statistics of all shards that provide them.
+// Values stored in more than one shard are counted once for each shard. The
+// value-key list statistics are the largest maximum and the mean of the
+// averages of the shards.
+func (s *shardedStore) Stats() (*indexer.Stats, error) {
+	var total indexer.Stats
+	var avgShards int
+	for _, shard := range s.shards {
+		sp, ok := shard.(interface {
+			Stats() (*indexer.Stats, error)
+		})
+		if !ok {
+			continue
+		}
+		st, err := sp.Stats()
+		if err != nil {
+			return nil, err
+		}
+		total.Indexes += st.Indexes
+		total.Values += st.Values
+		total.PrunedValueKeys += st.PrunedValueKeys
+		total.CorruptValues += st.CorruptValues
+		total.ValueLockWait += st.ValueLockWait
+		total.KeyLockWait += st.KeyLockWait
+		if st.MaxValueKeys > total.MaxValueKeys {
+			total.MaxValueKeys = st.MaxValueKeys
+		}
+		if st.AvgValueKeys != 0 {
+			total.AvgValueKeys += st.AvgValueKeys
+			avgShards++
+		}
+	}
+	if avgShards != 0 {
+		// Each shard's average has the same weight, since the shards do not
+		// report how many value-key lists their averages are over.
+		total.AvgValueKeys /= float64(avgShards)
+	}
+	return &total, nil
+}
+
+func (s *shardedStore) Flush() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes all shards, returning the first error encountered.
+func (s *shardedStore) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Ping pings each shard, and returns the first error.
+func (s *shardedStore) Ping(ctx context.Context) error {
+	for i, shard := range s.shards {
+		if err := shard.Ping(ctx); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Iter iterates the multihashes of each shard in turn. Since each multihash is
+// held by only one shard, no multihash is visited more than once.
+func (s *shardedStore) Iter() (indexer.Iterator, error) {
+	iter, err := s.shards[0].Iter()
+	if err != nil {
+		return nil, err
+	}
+	return &shardedIter{
+		shards: s.shards,
+		iter:   iter,
+		next:   1,
+	}, nil
+}
+
+func (it *shardedIter) Next() (multihash.Multihash, []indexer.Value, error) {
+	for {
+		m, values, err := it.iter.Next()
+		if err != io.EOF {
+			return m, values, err
+		}
+		if it.next == len(it.shards) {
+			return nil, nil, io.EOF
+		}
+		it.iter, err = it.shards[it.next].Iter()
+		if err != nil {
+			return nil, nil, err
+		}
+		it.next++
+	}
+}
+
+// shardIndex returns the index of the shard that the multihash is stored in.
+func (s *shardedStore) shardIndex(m multihash.Multihash) int {
+	if len(s.shards) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(m)
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// groupByShard returns the multihashes grouped by the index of the shard they
+// are stored in.
+func (s *shardedStore) groupByShard(mhs []multihash.Multihash) [][]multihash.Multihash {
+	groups := make([][]multihash.Multihash, len(s.shards))
+	for _, m := range mhs {
+		i := s.shardIndex(m)
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
@@ -0,0 +1,194 @@
+package sharded_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/memory"
+	"github.com/filecoin-project/go-indexer-core/store/sharded"
+	"github.com/filecoin-project/go-indexer-core/store/storethehash"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const shardCount = 4
+
+func initShards(t *testing.T) []indexer.Interface {
+	shards := make([]indexer.Interface, shardCount)
+	for i := range shards {
+		s, err := storethehash.New(context.Background(), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards[i] = s
+	}
+	return shards
+}
+
+func initSharded(t *testing.T) indexer.Interface {
+	s, err := sharded.New(initShards(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestE2E(t *testing.T) {
+	s := initSharded(t)
+	test.E2ETest(t, s)
+}
+
+func TestPing(t *testing.T) {
+	s := initSharded(t)
+	test.PingTest(t, s)
+}
+
+func TestSize(t *testing.T) {
+	s := initSharded(t)
+	test.SizeTest(t, s)
+}
+
+func TestRemove(t *testing.T) {
+	s := initSharded(t)
+	test.RemoveTest(t, s)
+}
+
+func TestRemoveProviderContext(t *testing.T) {
+	s := initSharded(t)
+	test.RemoveProviderContextTest(t, s)
+}
+
+func TestRemoveProvider(t *testing.T) {
+	s := initSharded(t)
+	test.RemoveProviderTest(t, s)
+}
+
+func TestParallel(t *testing.T) {
+	s := initSharded(t)
+	test.ParallelUpdateTest(t, s)
+}
+
+func TestShards(t *testing.T) {
+	shards := initShards(t)
+	s, err := sharded.New(shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("meta-1"),
+	}
+	mhs := test.RandomMultihashes(64)
+	if err = s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each multihash must be in exactly one shard, and the data must be spread
+	// across more than one shard.
+	used := make(map[int]struct{})
+	for _, m := range mhs {
+		var count int
+		for i, shard := range shards {
+			_, found, err := shard.Get(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				used[i] = struct{}{}
+				count++
+			}
+		}
+		if count != 1 {
+			t.Fatalf("multihash found in %d shards", count)
+		}
+
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !vals[0].Equal(value) {
+			t.Fatal("did not get value from sharded store")
+		}
+	}
+	if len(used) < 2 {
+		t.Fatal("expected multihashes to be stored in multiple shards")
+	}
+
+	// Updating the value updates it in all shards.
+	value.MetadataBytes = []byte("meta-2")
+	if err = s.Put(value); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mhs {
+		vals, _, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !vals[0].Equal(value) {
+			t.Fatal("value not updated")
+		}
+	}
+
+	if err = s.RemoveProvider(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mhs {
+		for _, shard := range shards {
+			_, found, err := shard.Get(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				t.Fatal("provider not removed from all shards")
+			}
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// statsStore is a value store that reports fixed statistics.
+type statsStore struct {
+	indexer.Interface
+	stats indexer.Stats
+}
+
+func (s *statsStore) Stats() (*indexer.Stats, error) {
+	st := s.stats
+	return &st, nil
+}
+
+func TestStats(t *testing.T) {
+	s, err := sharded.New(
+		&statsStore{Interface: memory.New(), stats: indexer.Stats{Indexes: 1, PrunedValueKeys: 2, CorruptValues: 3, MaxValueKeys: 4}},
+		&statsStore{Interface: memory.New(), stats: indexer.Stats{Indexes: 5, PrunedValueKeys: 6, CorruptValues: 7, MaxValueKeys: 2}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, ok := s.(interface {
+		Stats() (*indexer.Stats, error)
+	})
+	if !ok {
+		t.Fatal("sharded store does not provide stats")
+	}
+	st, err := sp.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Indexes != 6 || st.PrunedValueKeys != 8 || st.CorruptValues != 10 {
+		t.Fatalf("expected counters summed over shards, got %d indexes, %d pruned value-keys and %d corrupt values",
+			st.Indexes, st.PrunedValueKeys, st.CorruptValues)
+	}
+	if st.MaxValueKeys != 4 {
+		t.Fatalf("expected largest maximum of shards, got %d", st.MaxValueKeys)
+	}
+}
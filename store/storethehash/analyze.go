@@ -0,0 +1,186 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// AnalyzeOptions selects the aggregates that Analyze computes. Records are
+// always counted. Each selected aggregate adds reads of the store for the
+// records it needs.
+type AnalyzeOptions struct {
+	// Indexes counts the multihashes and the bytes of their value-key lists.
+	Indexes bool
+	// Values counts the values and the bytes of their records and metadata.
+	Values bool
+	// Providers computes the value statistics of each provider. This reads
+	// the same records as Values.
+	Providers bool
+}
+
+// ProviderAnalysis holds the value statistics of one provider.
+type ProviderAnalysis struct {
+	// Values is the number of stored values of the provider.
+	Values int
+	// MetadataBytes is the total size of the metadata of the provider's
+	// values, uncompressed.
+	MetadataBytes int64
+}
+
+// AnalysisReport is the result of Analyze. The aggregates that were not
+// selected by the AnalyzeOptions are zero.
+type AnalysisReport struct {
+	// Complete is false if the scan stopped before the end of the primary
+	// storage, in which case the aggregates only cover the records scanned.
+	Complete bool
+	// Records is the number of records in the primary storage, including
+	// records that were removed or replaced.
+	Records int
+	// RecordBytes is the total size of the keys and data of all records.
+	RecordBytes int64
+	// BadRecords is the number of current records that could not be decoded.
+	BadRecords int
+
+	// Indexes is the number of multihashes.
+	Indexes int
+	// IndexBytes is the total size of the value-key lists of the multihashes.
+	IndexBytes int64
+
+	// Values is the number of stored values.
+	Values int
+	// ValueBytes is the total size of the stored value records.
+	ValueBytes int64
+	// MetadataBytes is the total size of the metadata of the stored values,
+	// uncompressed.
+	MetadataBytes int64
+
+	// Providers holds the value statistics of each provider.
+	Providers map[peer.ID]ProviderAnalysis
+}
+
+// Analyze computes the aggregates selected by opts in a single pass over the
+// primary storage, instead of one pass for each. This is the building block
+// for dashboards and audits of the store.
+//
+// Analyze does not lock the store, so the aggregates do not describe a single
+// point in time if the store is changed during the scan. A multihash whose
+// value-key list was written more than once with the same content may be
+// counted more than once.
+//
+// If the context is canceled, then Analyze returns the report for the records
+// scanned so far, with Complete set to false, along with the context's error.
+func (s *Store) Analyze(ctx context.Context, opts AnalyzeOptions) (AnalysisReport, error) {
+	report := AnalysisReport{}
+	if opts.Providers {
+		report.Providers = make(map[peer.ID]ProviderAnalysis)
+	}
+	if err := s.begin(); err != nil {
+		return report, err
+	}
+	defer s.end()
+
+	if err := s.flush(); err != nil {
+		return report, err
+	}
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return report, err
+	}
+
+	readValues := opts.Values || opts.Providers
+	// The primary storage may hold more than one record for the same value,
+	// if the value was updated, so count each value only once.
+	seen := make(map[string]struct{})
+	for {
+		if report.Records%1024 == 0 && ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		key, data, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return report, err
+		}
+		report.Records++
+		report.RecordBytes += int64(len(key) + len(data))
+
+		dm, err := multihash.Decode(key)
+		if err != nil {
+			report.BadRecords++
+			continue
+		}
+		switch {
+		case opts.Indexes && s.keys.isIndexDigest(dm.Digest):
+			if err = s.analyzeIndex(key, data, &report); err != nil {
+				return report, err
+			}
+		case readValues && s.keys.isValueKey(key):
+			if _, ok := seen[string(key)]; ok {
+				continue
+			}
+			seen[string(key)] = struct{}{}
+			if err = s.analyzeValue(key, opts, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	report.Complete = true
+	return report, nil
+}
+
+// analyzeIndex adds the index record with the key and data to the report, if
+// it is the current record for the key.
+func (s *Store) analyzeIndex(key, data []byte, report *AnalysisReport) error {
+	current, found, err := s.getWithTimeout(key)
+	if err != nil {
+		return err
+	}
+	if !found || !bytes.Equal(current, data) {
+		// Removed or replaced record.
+		return nil
+	}
+	if _, err = indexer.UnmarshalValueKeys(current); err != nil {
+		report.BadRecords++
+		return nil
+	}
+	report.Indexes++
+	report.IndexBytes += int64(len(current))
+	return nil
+}
+
+// analyzeValue adds the current record of the value with the key to the
+// report.
+func (s *Store) analyzeValue(key []byte, opts AnalyzeOptions, report *AnalysisReport) error {
+	valueData, found, err := s.getWithTimeout(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// Value was removed.
+		return nil
+	}
+	value, err := indexer.UnmarshalValue(valueData)
+	if err != nil {
+		report.BadRecords++
+		return nil
+	}
+	if opts.Values {
+		report.Values++
+		report.ValueBytes += int64(len(valueData))
+		report.MetadataBytes += int64(len(value.MetadataBytes))
+	}
+	if opts.Providers {
+		pa := report.Providers[value.ProviderID]
+		pa.Values++
+		pa.MetadataBytes += int64(len(value.MetadataBytes))
+		report.Providers[value.ProviderID] = pa
+	}
+	return nil
+}
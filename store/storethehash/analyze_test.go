@@ -0,0 +1,93 @@
+package storethehash
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestAnalyze(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(4)
+	values := []indexer.Value{
+		{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")},
+		{ProviderID: p1, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("metadata-2")},
+		{ProviderID: p2, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-3")},
+	}
+	for i, v := range values {
+		if err = s.Put(v, mhs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Removed multihash is not counted.
+	if err = s.Put(values[0], mhs[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Remove(values[0], mhs[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Analyze(context.Background(), AnalyzeOptions{
+		Indexes:   true,
+		Values:    true,
+		Providers: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Complete {
+		t.Fatal("expected complete report")
+	}
+	if report.Indexes != 3 || report.Values != 3 || report.MetadataBytes != 22 {
+		t.Fatalf("expected 3 indexes, 3 values and 22 metadata bytes, got %d, %d and %d",
+			report.Indexes, report.Values, report.MetadataBytes)
+	}
+	if report.Records < report.Indexes+report.Values || report.BadRecords != 0 {
+		t.Fatalf("unexpected record counts: %d records, %d bad", report.Records, report.BadRecords)
+	}
+	if report.IndexBytes == 0 || report.ValueBytes == 0 || report.RecordBytes < report.IndexBytes+report.ValueBytes {
+		t.Fatalf("unexpected byte totals: %+v", report)
+	}
+	want := map[peer.ID]ProviderAnalysis{
+		p1: {Values: 2, MetadataBytes: 16},
+		p2: {Values: 1, MetadataBytes: 6},
+	}
+	if len(report.Providers) != len(want) {
+		t.Fatalf("expected %d providers, got %d", len(want), len(report.Providers))
+	}
+	for p, pa := range want {
+		if report.Providers[p] != pa {
+			t.Fatalf("expected %+v for provider %s, got %+v", pa, p, report.Providers[p])
+		}
+	}
+
+	// Only the requested aggregates are computed.
+	report, err = s.Analyze(context.Background(), AnalyzeOptions{Indexes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Indexes != 3 || report.Values != 0 || report.Providers != nil {
+		t.Fatalf("expected only indexes to be counted, got %+v", report)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err = s.Analyze(ctx, AnalyzeOptions{Values: true})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if report.Complete {
+		t.Fatal("expected partial report on cancel")
+	}
+}
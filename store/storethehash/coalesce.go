@@ -0,0 +1,186 @@
+package storethehash
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// indexCoalescer collects the value-keys being added to each multihash over a
+// short window, and then adds all the value-keys for a multihash with a single
+// read-modify-write of its value-key list. This reduces the lock contention
+// and the number of store writes when concurrent Puts map the same
+// multihashes to different values.
+type indexCoalescer struct {
+	s       *Store
+	window  time.Duration
+	workers int
+
+	mutex   sync.Mutex
+	pending map[string]*pendingIndex
+}
+
+// pendingIndex is the value-keys waiting to be added to a multihash.
+type pendingIndex struct {
+	key  multihash.Multihash
+	adds []pendingAdd
+}
+
+type pendingAdd struct {
+	valKey []byte
+	done   chan indexResult
+}
+
+type indexResult struct {
+	added bool
+	err   error
+}
+
+func newIndexCoalescer(s *Store, window time.Duration, workers int) *indexCoalescer {
+	if workers < 1 {
+		workers = 1
+	}
+	return &indexCoalescer{
+		s:       s,
+		window:  window,
+		workers: workers,
+		pending: make(map[string]*pendingIndex),
+	}
+}
+
+// putIndexes adds valKey to the value-key lists of the multihashes, and waits
+// until all are written. It returns the number of multihashes that were newly
+// mapped to valKey.
+func (c *indexCoalescer) putIndexes(mhs []multihash.Multihash, valKey []byte) (int, error) {
+	results := make([]chan indexResult, len(mhs))
+
+	c.mutex.Lock()
+	if len(c.pending) == 0 && len(mhs) != 0 {
+		time.AfterFunc(c.window, c.flush)
+	}
+	for i, m := range mhs {
+		k := c.s.keys.makeIndexKey(m)
+		p, ok := c.pending[string(k)]
+		if !ok {
+			p = &pendingIndex{key: k}
+			c.pending[string(k)] = p
+		}
+		results[i] = make(chan indexResult, 1)
+		p.adds = append(p.adds, pendingAdd{
+			valKey: valKey,
+			done:   results[i],
+		})
+	}
+	c.mutex.Unlock()
+
+	var added, errCount int
+	var firstErr error
+	for i := range results {
+		r := <-results[i]
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			errCount++
+		} else if r.added {
+			added++
+		}
+	}
+	if firstErr != nil {
+		if errCount > 1 {
+			return 0, fmt.Errorf("cannot store %d indexes: %w", errCount, firstErr)
+		}
+		return 0, fmt.Errorf("cannot store index: %w", firstErr)
+	}
+	return added, nil
+}
+
+// flush writes all the pending value-keys.
+func (c *indexCoalescer) flush() {
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*pendingIndex)
+	c.mutex.Unlock()
+
+	work := make(chan *pendingIndex)
+	var wg sync.WaitGroup
+	workers := c.workers
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				c.s.putPendingIndex(p)
+			}
+		}()
+	}
+	for _, p := range pending {
+		work <- p
+	}
+	close(work)
+	wg.Wait()
+}
+
+// putPendingIndex adds the pending value-keys to the multihash's value-key
+// list, and sends the result to each waiting Put.
+func (s *Store) putPendingIndex(p *pendingIndex) {
+	results := make([]indexResult, len(p.adds))
+	err := func() error {
+		s.lock(p.key)
+		defer s.unlock(p.key)
+
+		valKeys, err := s.getValueKeys(p.key)
+		if err != nil {
+			return fmt.Errorf("cannot get value keys for multihash: %w", err)
+		}
+		var changed bool
+		for i := range p.adds {
+			if containsKey(valKeys, p.adds[i].valKey) {
+				continue
+			}
+			if s.maxValues != 0 && len(valKeys) >= s.maxValues {
+				results[i].err = ErrTooManyValues
+				continue
+			}
+			valKeys = append(valKeys, p.adds[i].valKey)
+			results[i].added = true
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+
+		b, err := s.marshalValueKeys(valKeys)
+		if err != nil {
+			return err
+		}
+		if err = s.store.Put(p.key, b); err != nil {
+			return fmt.Errorf("cannot put multihash: %w", err)
+		}
+		s.countIndexKey(p.key)
+		s.observeValueKeys(len(valKeys))
+		return nil
+	}()
+
+	for i := range p.adds {
+		if err != nil {
+			results[i] = indexResult{err: err}
+		}
+		p.adds[i].done <- results[i]
+	}
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for i := range keys {
+		if bytes.Equal(keys[i], key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package storethehash
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/ipld/go-storethehash/store/primary"
+	mhprimary "github.com/ipld/go-storethehash/store/primary/multihash"
+	sthtypes "github.com/ipld/go-storethehash/store/types"
+	"github.com/multiformats/go-multihash"
+)
+
+// countingPrimary counts the records put into the primary storage.
+type countingPrimary struct {
+	primary.PrimaryStorage
+	puts uint64
+}
+
+func (p *countingPrimary) Put(key, value []byte) (sthtypes.Block, error) {
+	atomic.AddUint64(&p.puts, 1)
+	return p.PrimaryStorage.Put(key, value)
+}
+
+func newCountingStore(tb testing.TB, window time.Duration) (*Store, *countingPrimary) {
+	mp, err := mhprimary.OpenMultihashPrimary(filepath.Join(tb.TempDir(), dataFileName))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cp := &countingPrimary{PrimaryStorage: mp}
+	s := newStore(tb, tb.TempDir(), Primary(cp), CoalesceWindow(window))
+	return s, cp
+}
+
+// putConcurrently puts a value for each worker, mapping the same multihashes
+// to all the values, and returns the values.
+func putConcurrently(tb testing.TB, s *Store, workers int, mhs []multihash.Multihash) []indexer.Value {
+	p := testPeer(tb)
+	values := make([]indexer.Value, workers)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := range values {
+		values[i] = indexer.Value{ProviderID: p, ContextID: []byte(fmt.Sprint("ctxid-", i)), MetadataBytes: []byte("meta")}
+		wg.Add(1)
+		go func(value indexer.Value) {
+			defer wg.Done()
+			added, err := s.PutMany(value, mhs)
+			if err == nil && added != len(mhs) {
+				err = fmt.Errorf("expected %d multihashes added, got %d", len(mhs), added)
+			}
+			errs <- err
+		}(values[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return values
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	s, cp := newCountingStore(t, 20*time.Millisecond)
+	defer s.Close()
+
+	mhs := test.RandomMultihashes(10)
+	values := putConcurrently(t, s, 8, mhs)
+	for _, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != len(values) {
+			t.Fatalf("expected %d values, got %d", len(values), len(vals))
+		}
+	}
+
+	// Putting the same multihashes again adds nothing, and writes no index
+	// entries.
+	before := atomic.LoadUint64(&cp.puts)
+	added, err := s.PutMany(values[0], append(mhs, mhs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Fatalf("expected 0 multihashes added, got %d", added)
+	}
+	if n := atomic.LoadUint64(&cp.puts) - before; n != 0 {
+		t.Fatalf("expected no index writes, got %d", n)
+	}
+}
+
+// BenchmarkCoalesceWindow reports the number of primary storage writes for
+// concurrent Puts that map the same multihashes to different values.
+func BenchmarkCoalesceWindow(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprint("window-", window), func(b *testing.B) {
+			s, cp := newCountingStore(b, window)
+			defer s.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				putConcurrently(b, s, 16, test.RandomMultihashes(100))
+			}
+			b.ReportMetric(float64(atomic.LoadUint64(&cp.puts))/float64(b.N), "puts/op")
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package storethehash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	compactNewDir = "compact.new"
+	compactOldDir = "compact.old"
+)
+
+// CompactStats describes the result of compacting a store.
+type CompactStats struct {
+	// LiveRecords is the number of records copied to the compacted store.
+	LiveRecords int
+	// StaleRecords is the number of records, removed or replaced by later
+	// records, that were dropped.
+	StaleRecords int
+	// SizeBefore is the size of the store before compacting, in bytes.
+	SizeBefore int64
+	// SizeAfter is the size of the store after compacting, in bytes.
+	SizeAfter int64
+	// Reclaimed is the number of bytes freed by compacting.
+	Reclaimed int64
+}
+
+// Compact rewrites the store in dir so that it only contains live records.
+// Records that were removed or replaced stay in the storethehash data file
+// until the store is compacted, so this reclaims space after many values or
+// providers have been removed.
+//
+// The store must not be open while it is compacted, so Store does not
+// implement maintenance.Compactor, and cannot be compacted on a schedule by
+// the maintenance package. The options must include any IndexDir and DataDir
+// options that the store is opened with. Options that set index parameters
+// apply to the compacted store.
+//
+// The compacted store is written to a "compact.new" directory next to the
+// existing files, which are moved to a "compact.old" directory before the new
+// files are moved into place. If Compact fails while moving files, the
+// original files are restored when possible. Otherwise they are left in
+// "compact.old" for manual recovery.
+func Compact(ctx context.Context, dir string, options ...Option) (*CompactStats, error) {
+	cfg := newConfig(dir, options)
+	if cfg.primarySet {
+		return nil, errors.New("cannot compact store with custom primary storage")
+	}
+
+	newIndexDir := filepath.Join(cfg.indexDir, compactNewDir)
+	newDataDir := filepath.Join(cfg.dataDir, compactNewDir)
+	for _, d := range []string{newIndexDir, newDataDir} {
+		// Remove anything left by an earlier failed compaction.
+		if err := os.RemoveAll(d); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	stats, err := copyLiveRecords(ctx, dir, newIndexDir, newDataDir, options)
+	if err != nil {
+		os.RemoveAll(newIndexDir)
+		os.RemoveAll(newDataDir)
+		return nil, err
+	}
+
+	if err = swapFiles(cfg.indexDir, cfg.dataDir); err != nil {
+		return nil, err
+	}
+
+	stats.Reclaimed = stats.SizeBefore - stats.SizeAfter
+	return stats, nil
+}
+
+// copyLiveRecords copies the current record for each key in the store to a
+// new store in the given directories.
+func copyLiveRecords(ctx context.Context, dir, newIndexDir, newDataDir string, options []Option) (*CompactStats, error) {
+	src, err := openStore(ctx, dir, options...)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	newOpts := append(options[:len(options):len(options)], IndexDir(newIndexDir), DataDir(newDataDir))
+	dst, err := openStore(ctx, newDataDir, newOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+
+	var stats CompactStats
+	stats.SizeBefore, err = src.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := src.primary.Iter()
+	if err != nil {
+		return nil, err
+	}
+	// The primary storage may hold more than one record for the same key. The
+	// current record for a key is copied when the key is first seen, and any
+	// other records for the key are dropped. Whether a key was seen is looked
+	// up in the new store, so that memory use does not grow with the number
+	// of keys.
+	for {
+		if (stats.LiveRecords+stats.StaleRecords)%1024 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		copied, err := dst.store.Has(key)
+		if err != nil {
+			return nil, err
+		}
+		if copied {
+			stats.StaleRecords++
+			continue
+		}
+
+		value, found, err := src.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			stats.StaleRecords++
+			continue
+		}
+		if err = dst.store.Put(key, value); err != nil {
+			return nil, fmt.Errorf("cannot write compacted record: %w", err)
+		}
+		stats.LiveRecords++
+	}
+
+	if err = dst.Flush(); err != nil {
+		return nil, err
+	}
+	stats.SizeAfter, err = dst.Size()
+	if err != nil {
+		return nil, err
+	}
+	if err = dst.Close(); err != nil {
+		return nil, err
+	}
+	if err = src.Close(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// swapFiles moves the existing store files into compact.old, moves the
+// compacted files from compact.new into their place, and then removes both
+// directories.
+func swapFiles(indexDir, dataDir string) error {
+	oldIndexDir := filepath.Join(indexDir, compactOldDir)
+	oldDataDir := filepath.Join(dataDir, compactOldDir)
+	newIndexDir := filepath.Join(indexDir, compactNewDir)
+	newDataDir := filepath.Join(dataDir, compactNewDir)
+
+	for _, d := range []string{oldIndexDir, oldDataDir} {
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	err := moveFiles(indexDir, oldIndexDir, indexFileName+"*")
+	if err == nil {
+		err = moveFiles(dataDir, oldDataDir, dataFileName)
+	}
+	if err == nil {
+		err = moveFiles(newIndexDir, indexDir, indexFileName+"*")
+	}
+	if err == nil {
+		err = moveFiles(newDataDir, dataDir, dataFileName)
+	}
+	if err != nil {
+		// Try to put the original files back.
+		restoreErr := moveFiles(oldIndexDir, indexDir, indexFileName+"*")
+		if restoreErr == nil {
+			restoreErr = moveFiles(oldDataDir, dataDir, dataFileName)
+		}
+		if restoreErr != nil {
+			return fmt.Errorf("cannot move compacted files: %w, and cannot restore original files from %s: %s", err, compactOldDir, restoreErr)
+		}
+		return fmt.Errorf("cannot move compacted files: %w", err)
+	}
+
+	for _, d := range []string{oldIndexDir, oldDataDir, newIndexDir, newDataDir} {
+		if err = os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFiles moves the files in srcDir that match pattern into dstDir.
+func moveFiles(srcDir, dstDir, pattern string) error {
+	paths, err := filepath.Glob(filepath.Join(srcDir, pattern))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err = os.Rename(p, filepath.Join(dstDir, filepath.Base(p))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package storethehash
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir)
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value1 := indexer.Value{ProviderID: p1, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p2, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta-1")}
+	mhs1 := test.RandomMultihashes(200)
+	mhs2 := test.RandomMultihashes(20)
+	if err = s.Put(value1, mhs1...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(value2, mhs2...); err != nil {
+		t.Fatal(err)
+	}
+	// Update the value to leave a replaced record.
+	value2.MetadataBytes = []byte("meta-2")
+	if err = s.Put(value2); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Remove(value1, mhs1...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveProvider(context.Background(), p1); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Compact(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LiveRecords != len(mhs2)+1 {
+		t.Fatalf("expected %d live records, got %d", len(mhs2)+1, stats.LiveRecords)
+	}
+	if stats.StaleRecords == 0 {
+		t.Fatal("expected stale records")
+	}
+	if stats.Reclaimed <= 0 || stats.SizeAfter >= stats.SizeBefore {
+		t.Fatalf("expected space to be reclaimed, size before %d, after %d", stats.SizeBefore, stats.SizeAfter)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(dir, "compact.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 0 {
+		t.Fatal("compaction directories not removed:", dirs)
+	}
+
+	s = newStore(t, dir)
+	size, err := s.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != stats.SizeAfter {
+		t.Fatalf("expected size %d, got %d", stats.SizeAfter, size)
+	}
+	for _, m := range mhs2 {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(value2) {
+			t.Fatal("did not get value from compacted store")
+		}
+	}
+	_, found, err := s.Get(mhs1[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("removed multihash found in compacted store")
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+package storethehash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// ValueHeader is a value without its metadata. It has the length of the
+// metadata, and the value-key to get the metadata with GetMetadata.
+type ValueHeader struct {
+	ProviderID  peer.ID
+	ContextID   []byte
+	MetadataLen int
+	Key         []byte
+}
+
+// valueHeader decodes a stored value, leaving the metadata encoded.
+type valueHeader struct {
+	ProviderID peer.ID               `json:"p"`
+	ContextID  []byte                `json:"c"`
+	Metadata   json.RawMessage       `json:"m"`
+	Codec      indexer.MetadataCodec `json:"z"`
+}
+
+// GetHeaders is the same as Get, but returns the values without their
+// metadata, so that callers that only need the provider and context ID do not
+// decode the metadata.
+func (s *Store) GetHeaders(m multihash.Multihash) ([]ValueHeader, bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, false, err
+	}
+	defer s.end()
+
+	valueKeys, err := s.getValueKeys(s.keys.makeIndexKey(m))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var headers []ValueHeader
+	s.rlockValues()
+	defer s.valLock.RUnlock()
+	for _, valKey := range valueKeys {
+		if val, ok := s.valueCache.get(valKey); ok {
+			headers = append(headers, ValueHeader{
+				ProviderID:  val.ProviderID,
+				ContextID:   val.ContextID,
+				MetadataLen: len(val.MetadataBytes),
+				Key:         valKey,
+			})
+			continue
+		}
+
+		valData, found, err := s.store.Get(valKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot get value: %w", err)
+		}
+		if !found {
+			// Value was removed. The value-key is pruned by Get.
+			continue
+		}
+		var vh valueHeader
+		if err = json.Unmarshal(valData, &vh); err != nil {
+			return nil, false, err
+		}
+		var mdLen int
+		if vh.Codec != 0 {
+			// Compressed metadata must be decoded to get its length.
+			val, err := indexer.UnmarshalValue(valData)
+			if err != nil {
+				return nil, false, err
+			}
+			mdLen = len(val.MetadataBytes)
+		} else {
+			mdLen, err = base64DecodedLen(vh.Metadata)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		headers = append(headers, ValueHeader{
+			ProviderID:  vh.ProviderID,
+			ContextID:   vh.ContextID,
+			MetadataLen: mdLen,
+			Key:         valKey,
+		})
+	}
+	if len(headers) == 0 {
+		return nil, false, nil
+	}
+	return headers, true, nil
+}
+
+// GetMetadata returns the metadata of the value with the given value-key, as
+// returned by GetHeaders. Returns nil if there is no value for the value-key.
+func (s *Store) GetMetadata(valueKey []byte) ([]byte, error) {
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	if val, ok := s.valueCache.get(valueKey); ok {
+		return val.MetadataBytes, nil
+	}
+
+	s.rlockValues()
+	valData, found, err := s.store.Get(valueKey)
+	s.valLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get value: %w", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	val, err := indexer.UnmarshalValue(valData)
+	if err != nil {
+		return nil, err
+	}
+	return val.MetadataBytes, nil
+}
+
+// base64DecodedLen returns the length of the data encoded in a JSON base64
+// string, without decoding it. A JSON null or an empty message is length 0.
+func base64DecodedLen(msg json.RawMessage) (int, error) {
+	if len(msg) == 0 || string(msg) == "null" {
+		return 0, nil
+	}
+	if len(msg) < 2 || msg[0] != '"' || msg[len(msg)-1] != '"' {
+		return 0, errors.New("metadata is not a base64 string")
+	}
+	// encoding/json encodes []byte as padded standard base64, which has no
+	// characters that are escaped in JSON strings.
+	enc := msg[1 : len(msg)-1]
+	if len(enc)%4 != 0 {
+		return 0, fmt.Errorf("metadata has invalid base64 length %d", len(enc))
+	}
+	n := len(enc) / 4 * 3
+	for i := len(enc) - 1; i >= 0 && enc[i] == '='; i-- {
+		n--
+	}
+	return n, nil
+}
@@ -0,0 +1,71 @@
+package storethehash
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestGetHeaders(t *testing.T) {
+	for _, cacheSize := range []int{0, 10} {
+		s := newStore(t, t.TempDir(), ValueCacheSize(cacheSize))
+		p := testPeer(t)
+		m := test.RandomMultihashes(1)[0]
+		// Use metadata lengths that need each amount of base64 padding.
+		values := make(map[string]indexer.Value)
+		for i := 1; i <= 6; i++ {
+			value := indexer.Value{
+				ProviderID:    p,
+				ContextID:     []byte(fmt.Sprint("ctxid-", i)),
+				MetadataBytes: bytes.Repeat([]byte{byte(i)}, i),
+			}
+			if err := s.Put(value, m); err != nil {
+				t.Fatal(err)
+			}
+			values[string(value.ContextID)] = value
+		}
+		// Put values in the cache, if there is one.
+		if _, _, err := s.Get(m); err != nil {
+			t.Fatal(err)
+		}
+
+		headers, found, err := s.GetHeaders(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(headers) != len(values) {
+			t.Fatalf("expected %d headers, got %d", len(values), len(headers))
+		}
+		for _, h := range headers {
+			value, ok := values[string(h.ContextID)]
+			if !ok || h.ProviderID != p {
+				t.Fatal("wrong value header")
+			}
+			if h.MetadataLen != len(value.MetadataBytes) {
+				t.Fatalf("expected metadata length %d, got %d", len(value.MetadataBytes), h.MetadataLen)
+			}
+			md, err := s.GetMetadata(h.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(md, value.MetadataBytes) {
+				t.Fatal("wrong metadata for value key")
+			}
+		}
+
+		_, found, err = s.GetHeaders(test.RandomMultihashes(1)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Fatal("should not have found headers for unknown multihash")
+		}
+
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
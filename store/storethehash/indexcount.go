@@ -0,0 +1,115 @@
+package storethehash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// hllPrecision is the number of hash bits that select a register of the
+// index count sketch. The sketch has 2^hllPrecision one-byte registers, and
+// its standard error is about 1.04 / sqrt(2^hllPrecision), which is 0.8%.
+const hllPrecision = 14
+
+// hyperLogLog is a HyperLogLog sketch that estimates the number of distinct
+// keys added to it, using a fixed amount of memory however many keys there
+// are. Keys cannot be removed from the sketch.
+type hyperLogLog struct {
+	mutex     sync.Mutex
+	registers [1 << hllPrecision]uint8
+}
+
+// add adds the key to the sketch.
+func (h *hyperLogLog) add(key []byte) {
+	sum := blake2b.Sum256(key)
+	x := binary.LittleEndian.Uint64(sum[:8])
+	i := x >> (64 - hllPrecision)
+	// Position of the first set bit in the remaining bits, counting from 1.
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+
+	h.mutex.Lock()
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+	h.mutex.Unlock()
+}
+
+// estimate returns the estimated number of distinct keys added to the sketch.
+func (h *hyperLogLog) estimate() uint64 {
+	const m = float64(1 << hllPrecision)
+
+	var sum float64
+	var zeros int
+	h.mutex.Lock()
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	h.mutex.Unlock()
+
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros != 0 {
+		// Linear counting is more accurate for small counts.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// ApproxIndexCount returns an estimate of the number of distinct multihashes
+// in the store, with an error of about 1%. The estimate is kept up to date as
+// multihashes are put, and reading it does not read the store. Multihashes
+// that are removed are still counted until the store is opened again. This
+// requires the IndexCountSketch option, and returns 0 otherwise.
+func (s *Store) ApproxIndexCount() uint64 {
+	if s.indexCount == nil {
+		return 0
+	}
+	return s.indexCount.estimate()
+}
+
+// countIndexKey adds the index key to the index count sketch, if it is
+// enabled.
+func (s *Store) countIndexKey(k []byte) {
+	if s.indexCount != nil {
+		s.indexCount.add(k)
+	}
+}
+
+// buildIndexCount creates the index count sketch from the index keys in the
+// primary storage. The primary storage keeps the records of removed keys, so
+// each key is looked up to check that it is still in the store.
+func (s *Store) buildIndexCount() error {
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return err
+	}
+	hll := new(hyperLogLog)
+	for {
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("cannot build index count: %w", err)
+		}
+		if _, ok := s.keys.decodeIndexKey(key); !ok {
+			continue
+		}
+		found, err := s.store.Has(key)
+		if err != nil {
+			return fmt.Errorf("cannot build index count: %w", err)
+		}
+		if found {
+			hll.add(key)
+		}
+	}
+	s.indexCount = hll
+	return nil
+}
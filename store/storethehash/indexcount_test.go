@@ -0,0 +1,87 @@
+package storethehash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestApproxIndexCount(t *testing.T) {
+	tmpDir := t.TempDir()
+	s := newStore(t, tmpDir, IndexCountSketch(true))
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := make([]multihash.Multihash, 2000)
+	var err error
+	for i := range mhs {
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	// Multihashes that are put again are not counted again.
+	if err = s.Put(value, mhs[:100]...); err != nil {
+		t.Fatal(err)
+	}
+	checkCount := func(n uint64, want int) {
+		t.Helper()
+		if n < uint64(want)*97/100 || n > uint64(want)*103/100 {
+			t.Fatalf("estimated %d multihashes, expected about %d", n, want)
+		}
+	}
+	checkCount(s.ApproxIndexCount(), len(mhs))
+
+	if err = s.Remove(value, mhs[1000:]...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The count is rebuilt without the removed multihashes.
+	s = newStore(t, tmpDir, IndexCountSketch(true))
+	defer s.Close()
+	checkCount(s.ApproxIndexCount(), 1000)
+
+	s2 := newStore(t, t.TempDir())
+	defer s2.Close()
+	if s2.ApproxIndexCount() != 0 {
+		t.Fatal("expected 0 without index count sketch")
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	var hll hyperLogLog
+	if n := hll.estimate(); n != 0 {
+		t.Fatalf("expected 0 for empty sketch, got %d", n)
+	}
+
+	key := make([]byte, 8)
+	var added uint64
+	for _, count := range []uint64{10, 1000, 100000, 500000} {
+		for ; added < count; added++ {
+			binary.BigEndian.PutUint64(key, added)
+			hll.add(key)
+			// Adding the same key again does not change the estimate.
+			hll.add(key)
+		}
+		est := hll.estimate()
+		diff := float64(est) - float64(count)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff/float64(count) > 0.03 {
+			t.Fatalf("estimated %d keys, expected about %d", est, count)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package storethehash
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/filecoin-project/go-indexer-core"
+	mhprimary "github.com/ipld/go-storethehash/store/primary/multihash"
+	"github.com/multiformats/go-multihash"
+)
+
+// Checkpoint is a position in the write history of a store, returned by
+// IterSince. It is the size of the primary storage at the time it was taken,
+// so later writes are after it. The zero Checkpoint is before all writes.
+type Checkpoint uint64
+
+// ErrInvalidCheckpoint is returned by IterSince when the checkpoint is past the
+// end of the store, which happens if the store was compacted or replaced after
+// the checkpoint was taken.
+var ErrInvalidCheckpoint = errors.New("checkpoint is past the end of the store")
+
+// IterSince creates an iterator over the multihashes written since the
+// checkpoint, and returns it with a new checkpoint to pass to the next call.
+// This lets a store be exported or replicated incrementally, without reading
+// all of it each time. The iterator returns each multihash once, with all of
+// the values it currently maps to, the same as the iterator returned by
+// IterContext. It reads only the part of the primary storage written between
+// the two checkpoints.
+//
+// A multihash is written when a value is put for it or one of its values is
+// removed, so it is returned if that happened since the checkpoint. A
+// multihash is not returned if:
+//   - all of its values were removed, so it no longer exists;
+//   - a value it maps to was updated, but the multihash itself was not written.
+//
+// Writes that happen after IterSince is called are not returned until the
+// next call. Compact rewrites the primary storage, so the checkpoints taken
+// before compacting cannot be used after it. If such a checkpoint is past the
+// end of the compacted store then ErrInvalidCheckpoint is returned, but
+// otherwise this is not detected, so iterate from the zero Checkpoint after
+// compacting. IterSince is not supported with a custom primary storage.
+func (s *Store) IterSince(ctx context.Context, checkpoint Checkpoint) (indexer.Iterator, Checkpoint, error) {
+	if err := s.begin(); err != nil {
+		return nil, 0, err
+	}
+	defer s.end()
+
+	if s.dataPath == "" {
+		return nil, 0, errors.New("cannot iterate since checkpoint with custom primary storage")
+	}
+	if err := s.flush(); err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(s.dataPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	start := uint64(checkpoint)
+	if start > uint64(fi.Size()) {
+		file.Close()
+		return nil, 0, fmt.Errorf("%w: checkpoint %d, store size %d", ErrInvalidCheckpoint, start, fi.Size())
+	}
+	// The primary storage may be written while it is read, so find the end of
+	// the last whole record to use as the new checkpoint.
+	end, err := lastRecordEnd(file, start, uint64(fi.Size()))
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return &sthIterator{
+		ctx: ctx,
+		iter: &primaryRangeIter{
+			file:   file,
+			reader: bufio.NewReader(io.NewSectionReader(file, int64(start), int64(end-start))),
+		},
+		storage:  s,
+		uniqKeys: map[string]struct{}{},
+		scanned:  start,
+		total:    end,
+		values:   newValueCache(iterValueCacheSize),
+	}, Checkpoint(end), nil
+}
+
+// lastRecordEnd returns the end of the last whole record in the primary
+// storage file between start and size, reading only the size of each record.
+func lastRecordEnd(file *os.File, start, size uint64) (uint64, error) {
+	r := bufio.NewReader(io.NewSectionReader(file, int64(start), int64(size-start)))
+	sizeBuf := make([]byte, mhprimary.SizePrefix)
+	pos := start
+	for {
+		if _, err := io.ReadFull(r, sizeBuf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return pos, nil
+			}
+			return 0, err
+		}
+		recSize := uint64(binary.LittleEndian.Uint32(sizeBuf))
+		if pos+mhprimary.SizePrefix+recSize > size {
+			return pos, nil
+		}
+		if _, err := r.Discard(int(recSize)); err != nil {
+			return 0, err
+		}
+		pos += mhprimary.SizePrefix + recSize
+	}
+}
+
+// primaryRangeIter reads the records in part of the primary storage file. The
+// file is closed when the end is reached or reading fails.
+type primaryRangeIter struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func (it *primaryRangeIter) Next() ([]byte, []byte, error) {
+	key, value, err := it.next()
+	if err != nil && it.file != nil {
+		it.file.Close()
+		it.file = nil
+	}
+	return key, value, err
+}
+
+func (it *primaryRangeIter) next() ([]byte, []byte, error) {
+	if it.file == nil {
+		return nil, nil, io.EOF
+	}
+	sizeBuf := make([]byte, mhprimary.SizePrefix)
+	if _, err := io.ReadFull(it.reader, sizeBuf); err != nil {
+		return nil, nil, err
+	}
+	record := make([]byte, binary.LittleEndian.Uint32(sizeBuf))
+	if _, err := io.ReadFull(it.reader, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	n, _, err := multihash.MHFromBytes(record)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read key of primary record: %w", err)
+	}
+	return record[:n], record[n:], nil
+}
@@ -0,0 +1,86 @@
+package storethehash
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestIterSince(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(4)
+
+	// iterSince returns the multihashes written since the checkpoint.
+	iterSince := func(cp Checkpoint) (map[string][]indexer.Value, Checkpoint) {
+		iter, next, err := s.IterSince(context.Background(), cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string][]indexer.Value)
+		for {
+			m, values, err := iter.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+			found[m.String()] = values
+		}
+		return found, next
+	}
+
+	if err := s.Put(value1, mhs[0], mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+	found, cp1 := iterSince(0)
+	if len(found) != 2 || found[mhs[0].String()] == nil || found[mhs[1].String()] == nil {
+		t.Fatalf("expected first 2 multihashes, got %d", len(found))
+	}
+
+	if err := s.Put(value1, mhs[2]); err != nil {
+		t.Fatal(err)
+	}
+	// Adding a value to an existing multihash writes it again.
+	if err := s.Put(value2, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	found, cp2 := iterSince(cp1)
+	if cp2 <= cp1 {
+		t.Fatalf("expected checkpoint to advance past %d, got %d", cp1, cp2)
+	}
+	if len(found) != 2 || found[mhs[2].String()] == nil || len(found[mhs[0].String()]) != 2 {
+		t.Fatalf("expected multihashes written since checkpoint, got %v", found)
+	}
+
+	// Nothing was written since the last checkpoint.
+	found, cp3 := iterSince(cp2)
+	if len(found) != 0 || cp3 != cp2 {
+		t.Fatalf("expected no multihashes and same checkpoint, got %d and %d", len(found), cp3)
+	}
+
+	// A multihash whose values were all removed is not returned.
+	if err := s.Remove(value1, mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[3]); err != nil {
+		t.Fatal(err)
+	}
+	found, _ = iterSince(cp3)
+	if len(found) != 1 || found[mhs[3].String()] == nil {
+		t.Fatalf("expected only the last multihash, got %v", found)
+	}
+
+	if _, _, err := s.IterSince(context.Background(), 1<<40); !errors.Is(err, ErrInvalidCheckpoint) {
+		t.Fatalf("expected invalid checkpoint error, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package storethehash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// markerFileName is the name of the file, kept with the index, that records
+// the settings that determine how data is laid out in the store. Opening a
+// store with settings that do not match the marker fails, instead of reading
+// or writing data in an incompatible layout.
+const markerFileName = "storethehash.marker"
+
+// indexKeysReversed is the index key layout where the bytes of the multihash
+// are reversed, so that the random digest bytes are first. storethehash uses
+// the first bytes of a key to choose its index bucket, so the multihash code
+// and length must not be first.
+const indexKeysReversed = "reversed"
+
+// namespaceKeysTagged is the layout of the keys of a store with a namespace,
+// where the namespace is followed by its length and a tag byte, as described
+// by keyFormat. Stores with a namespace that were created before the layout
+// was recorded put the namespace right before the kind suffix, and cannot be
+// opened by this code.
+const namespaceKeysTagged = "tagged"
+
+// FormatVersion is the version of the on-disk format written by this code.
+// It changes when the layout of keys or the encoding of stored data changes in
+// a way that earlier code cannot read, or that this code cannot read without
+// migrating the store. A store is stamped with the version that created it,
+// and New refuses to open a store with a different version.
+const FormatVersion = 1
+
+// ErrFormatVersion is returned by New when the store was written with a
+// different format version than FormatVersion.
+var ErrFormatVersion = errors.New("incompatible store format version")
+
+// storeMarker is the content of the marker file.
+type storeMarker struct {
+	// FormatVersion is the format version of the code that created the store.
+	// Stores created before the version was recorded have version 0, which
+	// has the same format as version 1.
+	FormatVersion int `json:"formatVersion,omitempty"`
+	// IndexKeys is the layout of index keys.
+	IndexKeys string `json:"indexKeys"`
+	// Namespace is the namespace added to keys, if any.
+	Namespace string `json:"namespace,omitempty"`
+	// NamespaceKeys is the layout of keys with a namespace, if any.
+	NamespaceKeys string `json:"namespaceKeys,omitempty"`
+}
+
+// StoreFormatVersion returns the format version of the store in dir, without
+// opening the store. Returns 0 if the store has no marker.
+func StoreFormatVersion(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, markerFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("cannot read store marker: %w", err)
+	}
+	var stored storeMarker
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return 0, fmt.Errorf("cannot decode store marker: %w", err)
+	}
+	if stored.FormatVersion == 0 {
+		return 1, nil
+	}
+	return stored.FormatVersion, nil
+}
+
+// checkMarker compares the marker in dir with the marker for the current
+// settings and format version. If there is no marker, then one is written. A
+// marker without a format version is updated to record version 1.
+func checkMarker(dir string, marker storeMarker) error {
+	path := filepath.Join(dir, markerFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot read store marker: %w", err)
+		}
+		// New store, or store created before markers were added, which has
+		// the same layout as the default settings.
+		return writeMarker(path, marker)
+	}
+
+	var stored storeMarker
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("cannot decode store marker %s: %w", path, err)
+	}
+	storedVersion := stored.FormatVersion
+	if storedVersion == 0 {
+		storedVersion = 1
+	}
+	if storedVersion > marker.FormatVersion {
+		return fmt.Errorf("%w: store in %s has format version %d, but this release only supports up to version %d; open it with the release that wrote it, or a newer one",
+			ErrFormatVersion, dir, storedVersion, marker.FormatVersion)
+	}
+	if storedVersion < marker.FormatVersion {
+		return fmt.Errorf("%w: store in %s has format version %d, but this release requires version %d; migrate the store to the new format before opening it with this release",
+			ErrFormatVersion, dir, storedVersion, marker.FormatVersion)
+	}
+	if stored.IndexKeys != marker.IndexKeys {
+		return fmt.Errorf("store has %q index keys, but is opened with %q index keys", stored.IndexKeys, marker.IndexKeys)
+	}
+	if stored.Namespace != marker.Namespace {
+		return fmt.Errorf("store has namespace %q, but is opened with namespace %q", stored.Namespace, marker.Namespace)
+	}
+	if stored.NamespaceKeys != marker.NamespaceKeys {
+		return fmt.Errorf("store has %q namespace keys, but is opened with %q namespace keys", stored.NamespaceKeys, marker.NamespaceKeys)
+	}
+	if stored.FormatVersion == 0 {
+		return writeMarker(path, marker)
+	}
+	return nil
+}
+
+func writeMarker(path string, marker storeMarker) error {
+	data, err := json.Marshal(&marker)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("cannot write store marker: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreMarker(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	markerPath := filepath.Join(dir, "storethehash.marker")
+	if _, err := os.Stat(markerPath); err != nil {
+		t.Fatal("store marker not written:", err)
+	}
+
+	// Reopening with the same settings succeeds.
+	s = newStore(t, dir)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := StoreFormatVersion(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != FormatVersion {
+		t.Fatalf("expected format version %d, got %d", FormatVersion, version)
+	}
+
+	// A marker written before format versions were recorded is read as
+	// version 1, and is updated when the store is opened.
+	if err = os.WriteFile(markerPath, []byte(`{"indexKeys":"reversed"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version, err = StoreFormatVersion(dir); err != nil || version != 1 {
+		t.Fatalf("expected format version 1 for old marker, got %d, %v", version, err)
+	}
+	s = newStore(t, dir)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(markerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"formatVersion":1`)) {
+		t.Fatalf("expected marker to be updated with format version, got %s", data)
+	}
+
+	// Opening a store written with a newer format version fails.
+	newer := fmt.Sprintf(`{"formatVersion":%d,"indexKeys":"reversed"}`, FormatVersion+1)
+	if err = os.WriteFile(markerPath, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(context.Background(), dir); !errors.Is(err, ErrFormatVersion) {
+		t.Fatalf("expected ErrFormatVersion, got %v", err)
+	}
+
+	// Opening a store with a different layout fails.
+	if err = os.WriteFile(markerPath, []byte(`{"indexKeys":"plain"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(context.Background(), dir); err == nil {
+		t.Fatal("expected error opening store with different index key layout")
+	}
+
+	if version, err = StoreFormatVersion(t.TempDir()); err != nil || version != 0 {
+		t.Fatalf("expected format version 0 for directory without store, got %d, %v", version, err)
+	}
+}
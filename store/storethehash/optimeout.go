@@ -0,0 +1,69 @@
+package storethehash
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrOpTimeout is returned when a read or delete of the underlying store takes
+// longer than the time set by the OpTimeout option.
+var ErrOpTimeout = errors.New("store operation timed out")
+
+// getWithTimeout gets the data stored under key, giving up after the
+// OpTimeout.
+func (s *Store) getWithTimeout(key []byte) ([]byte, bool, error) {
+	var data []byte
+	var found bool
+	err := s.withOpTimeout(func() error {
+		var err error
+		data, found, err = s.store.Get(key)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return data, found, nil
+}
+
+// removeWithTimeout removes the data stored under key, giving up after the
+// OpTimeout.
+func (s *Store) removeWithTimeout(key []byte) (bool, error) {
+	var removed bool
+	err := s.withOpTimeout(func() error {
+		var err error
+		removed, err = s.store.Remove(key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return removed, nil
+}
+
+// withOpTimeout calls op, and returns ErrOpTimeout if op does not return
+// within the OpTimeout. The underlying store cannot cancel an operation, so op
+// keeps running on its own goroutine after a timeout, and its result is
+// dropped. The goroutine is counted as an operation in progress, so Close does
+// not close the store until it finishes.
+func (s *Store) withOpTimeout(op func() error) error {
+	if s.opTimeout == 0 {
+		return op()
+	}
+
+	// Buffered so that the goroutine can exit after a timeout.
+	done := make(chan error, 1)
+	s.opWait.Add(1)
+	go func() {
+		defer s.opWait.Done()
+		done <- op()
+	}()
+
+	timer := time.NewTimer(s.opTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrOpTimeout
+	}
+}
@@ -0,0 +1,87 @@
+package storethehash
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/ipld/go-storethehash/store/primary"
+	mhprimary "github.com/ipld/go-storethehash/store/primary/multihash"
+	sthtypes "github.com/ipld/go-storethehash/store/types"
+)
+
+// stuckPrimary is a primary storage whose Get blocks, once stuck is set and
+// the next skip calls have returned, until release is closed.
+type stuckPrimary struct {
+	primary.PrimaryStorage
+	stuck   int32
+	skip    int32
+	release chan struct{}
+}
+
+func (p *stuckPrimary) Get(blk sthtypes.Block) ([]byte, []byte, error) {
+	if atomic.LoadInt32(&p.stuck) != 0 && atomic.AddInt32(&p.skip, -1) < 0 {
+		<-p.release
+	}
+	return p.PrimaryStorage.Get(blk)
+}
+
+func TestOpTimeout(t *testing.T) {
+	mp, err := mhprimary.OpenMultihashPrimary(filepath.Join(t.TempDir(), "custom.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &stuckPrimary{PrimaryStorage: mp, release: make(chan struct{})}
+	s := newStore(t, t.TempDir(),
+		Primary(sp),
+		ValueTimestamps(true),
+		OpTimeout(50*time.Millisecond))
+	p := testPeer(t)
+	value := testValue(t)
+	if err = s.Put(value, test.RandomMultihashes(3)...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the scan read the value, so that the delete of the value is stuck.
+	atomic.StoreInt32(&sp.skip, 1)
+	atomic.StoreInt32(&sp.stuck, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := s.RemoveValuesOlderThan(context.Background(), time.Now().Add(time.Hour))
+		errChan <- err
+	}()
+	select {
+	case err = <-errChan:
+		if err != ErrOpTimeout {
+			t.Fatalf("expected ErrOpTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RemoveValuesOlderThan did not time out")
+	}
+
+	atomic.StoreInt32(&sp.skip, 0)
+	go func() {
+		errChan <- s.RemoveProvider(context.Background(), p)
+	}()
+	select {
+	case err = <-errChan:
+		if err != ErrOpTimeout {
+			t.Fatalf("expected ErrOpTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RemoveProvider did not time out")
+	}
+
+	// The store is usable after the stuck operation finishes.
+	atomic.StoreInt32(&sp.stuck, 0)
+	close(sp.release)
+	if err = s.RemoveProvider(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,29 +3,102 @@ package storethehash
 import (
 	"time"
 
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/ipld/go-storethehash/store/primary"
 	sthtypes "github.com/ipld/go-storethehash/store/types"
 )
 
-// TODO: Benchmark and fine-tune for better performance.
+// TODO: Benchmark and fine-tune for better performance. SuggestIndexParams
+// gives values for a specific dataset size.
 const (
 	defaultBurstRate     = 4 * 1024 * 1024
 	defaultIndexSizeBits = uint8(24)
 	defaultIndexFileSize = uint32(1024 * 1024 * 1024)
 	defaultSyncInterval  = time.Second
 	defaultGCInterval    = 30 * time.Minute
+	defaultCloseTimeout  = 30 * time.Second
+
+	// defaultSlowOpThreshold is how long an operation takes before it is
+	// reported to the OnSlowOp function.
+	defaultSlowOpThreshold = time.Second
+
+	// minGCInterval is the shortest GC interval. Garbage collection reads
+	// index files, so running it more often than this keeps the index busy
+	// without freeing more space.
+	minGCInterval = time.Minute
+
+	// defaultCompressMinSize is the smallest metadata that CompressMetadata
+	// compresses. Smaller metadata rarely gets smaller when compressed.
+	defaultCompressMinSize = 256
 )
 
 // config contains all options for configuring storethehash valuestore.
 type config struct {
-	burstRate     sthtypes.Work
-	indexSizeBits uint8
-	indexFileSize uint32
-	syncInterval  time.Duration
-	gcInterval    time.Duration
+	burstRate          sthtypes.Work
+	indexSizeBits      uint8
+	indexFileSize      uint32
+	syncInterval       time.Duration
+	gcInterval         time.Duration
+	mergeFunc          MergeFunc
+	putConcurrency     int
+	indexDir           string
+	dataDir            string
+	valueCacheSize     int
+	flushEvery         uint64
+	reverseIndex       bool
+	timestamps         bool
+	closeTimeout       time.Duration
+	primary            primary.PrimaryStorage
+	primarySet         bool
+	onSyncError        func(error)
+	coalesceWindow     time.Duration
+	onPut              func(indexer.Value, int)
+	lockTiming         bool
+	opTimeout          time.Duration
+	removeBatchSize    int
+	orderedIndex       bool
+	removeOrphanValues bool
+	mdCodec            indexer.MetadataCodec
+	sortValues         bool
+	indexCountSketch   bool
+	skipDupCheck       bool
+	maxValues          int
+	wal                bool
+	packValueKeys      bool
+	slowOpThreshold    time.Duration
+	onSlowOp           func(string, time.Duration, int)
+	namespace          string
+	skipCorruptValues  bool
+	pruneCorruptValues bool
+	sizeAfterFlush     bool
 }
 
+// MergeFunc is called when a Value is put that has the same ProviderID and
+// ContextID as an existing Value, but is otherwise different. It returns the
+// Value to store. The returned Value must have the same ProviderID and
+// ContextID as the existing value.
+type MergeFunc func(existing, incoming indexer.Value) indexer.Value
+
 type Option func(*config)
 
+// newConfig returns the default config for a store in dir, with the given
+// options applied.
+func newConfig(dir string, options []Option) config {
+	cfg := config{
+		indexSizeBits:   defaultIndexSizeBits,
+		indexFileSize:   defaultIndexFileSize,
+		syncInterval:    defaultSyncInterval,
+		burstRate:       defaultBurstRate,
+		gcInterval:      defaultGCInterval,
+		closeTimeout:    defaultCloseTimeout,
+		slowOpThreshold: defaultSlowOpThreshold,
+		indexDir:        dir,
+		dataDir:         dir,
+	}
+	cfg.apply(options)
+	return cfg
+}
+
 // apply applies the given options to this config.
 func (c *config) apply(opts []Option) {
 	for _, opt := range opts {
@@ -57,8 +130,416 @@ func BurstRate(burstRate uint64) Option {
 	}
 }
 
+// GCInterval sets how often index garbage collection runs. An interval of 0,
+// or a negative interval, disables garbage collection. A non-zero interval
+// shorter than one minute is set to one minute.
 func GCInterval(gcInterval time.Duration) Option {
 	return func(cfg *config) {
+		switch {
+		case gcInterval <= 0:
+			gcInterval = 0
+		case gcInterval < minGCInterval:
+			gcInterval = minGCInterval
+		}
 		cfg.gcInterval = gcInterval
 	}
 }
+
+// MergeValues sets the function used to resolve a conflict between an
+// existing value and an incoming value that has the same ProviderID and
+// ContextID but different metadata. By default, the incoming value replaces
+// the existing value.
+//
+// With the WAL option, a put that was already synced to disk when the process
+// stopped may be replayed from the write-ahead log, which calls the merge
+// function again with the same values. So, the merge function must be
+// idempotent: merging a value into the result of merging it must not change
+// the result.
+func MergeValues(mergeFunc MergeFunc) Option {
+	return func(cfg *config) {
+		cfg.mergeFunc = mergeFunc
+	}
+}
+
+// PutConcurrency sets the number of goroutines used to write the index entries
+// for the multihashes given to a single Put. A value of 1 or less writes them
+// serially, which is the default.
+func PutConcurrency(n int) Option {
+	return func(cfg *config) {
+		cfg.putConcurrency = n
+	}
+}
+
+// IndexDir sets the directory where the storethehash index file is kept,
+// instead of the directory given to New. This allows the index, which is
+// accessed randomly, to be put on faster storage than the data.
+func IndexDir(path string) Option {
+	return func(cfg *config) {
+		cfg.indexDir = path
+	}
+}
+
+// DataDir sets the directory where the storethehash data file is kept, instead
+// of the directory given to New.
+func DataDir(path string) Option {
+	return func(cfg *config) {
+		cfg.dataDir = path
+	}
+}
+
+// ValueCacheSize sets the number of decoded values to keep in an LRU cache, so
+// that values shared by many multihashes are not unmarshalled on every read. A
+// size of 0, the default, disables the cache.
+func ValueCacheSize(size int) Option {
+	return func(cfg *config) {
+		cfg.valueCacheSize = size
+	}
+}
+
+// FlushEvery sets the number of Put and Remove operations after which the
+// store is flushed, independent of SyncInterval. This limits the amount of
+// unsynced data that can be lost after a crash during heavy ingest. A value of
+// 0, the default, disables flushing by write count.
+func FlushEvery(nWrites uint64) Option {
+	return func(cfg *config) {
+		cfg.flushEvery = nWrites
+	}
+}
+
+// ReverseIndex sets whether the store maintains a reverse index, which records
+// the values of each provider and the multihashes mapped to each value. This
+// allows reading a single provider's data, with IterProvider, without scanning
+// the whole store, at the cost of extra writes on every Put and Remove.
+//
+// Only data written while the reverse index is enabled is indexed, so it
+// should be enabled when the store is first created.
+func ReverseIndex(enable bool) Option {
+	return func(cfg *config) {
+		cfg.reverseIndex = enable
+	}
+}
+
+// ValueTimestamps sets whether the time that each value is stored is recorded
+// with the value. A value's time is updated whenever the value is put again,
+// even if it is unchanged. The times allow RemoveValuesOlderThan to remove
+// values that have not been put recently.
+func ValueTimestamps(enable bool) Option {
+	return func(cfg *config) {
+		cfg.timestamps = enable
+	}
+}
+
+// CloseTimeout sets the maximum time that Close waits for operations that are
+// in progress to finish. If they do not finish in time, then Close returns
+// ErrCloseTimeout without closing the underlying storage.
+func CloseTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.closeTimeout = timeout
+	}
+}
+
+// Primary sets the primary storage that holds the keys and values, instead of
+// the multihash primary that is opened in the data directory by default. The
+// primary storage must store and iterate keys unchanged, since the keys are
+// decoded as multihashes when the store is scanned. The storage is closed
+// when the store is closed.
+//
+// When a custom primary storage is used, Size only reports the size of the
+// index.
+func Primary(primaryStorage primary.PrimaryStorage) Option {
+	return func(cfg *config) {
+		cfg.primary = primaryStorage
+		cfg.primarySet = true
+	}
+}
+
+// OnSyncError sets a function that is called when the storethehash store
+// reports an error, such as from a background sync. Background syncs happen
+// at the sync interval, and their errors are otherwise only seen when Flush is
+// called or on the next write. The store is checked for an error at the sync
+// interval, and the function is called when an error is seen that is different
+// from the last error seen.
+//
+// The function is called on an internal goroutine, and must not block.
+func OnSyncError(handler func(error)) Option {
+	return func(cfg *config) {
+		cfg.onSyncError = handler
+	}
+}
+
+// CoalesceWindow sets how long to collect the value-keys being added to each
+// multihash by concurrent Puts, before adding them with a single update of the
+// multihash's value-key list. This reduces the number of index writes when
+// many Puts map the same multihashes to different values, at the cost of
+// adding up to the window to the time each Put takes. A window of 0, the
+// default, writes each index entry as it is put.
+//
+// PutNew does not coalesce writes.
+//
+// go-storethehash has no batched write, so every index entry is written with
+// its own store Put, and the coalescer is the only batching of index writes.
+// It only saves writes when concurrent Puts share multihashes. For a single
+// Put of distinct multihashes it adds overhead, so the default of writing
+// each index entry as it is put is faster in that case.
+func CoalesceWindow(window time.Duration) Option {
+	return func(cfg *config) {
+		cfg.coalesceWindow = window
+	}
+}
+
+// OnPut sets a function that is called after each successful Put, PutMany,
+// PutNew or PutReturningPrevious, and each batch of PutStream, with the value
+// given to the put and the number of multihashes given with it. This lets
+// other systems observe the values that are stored.
+//
+// The function is called inline, before the put returns, so it must not block
+// for long. Heavy work should be done on another goroutine.
+func OnPut(hook func(value indexer.Value, mhCount int)) Option {
+	return func(cfg *config) {
+		cfg.onPut = hook
+	}
+}
+
+// LockTiming sets whether the store records the time spent waiting to acquire
+// its internal locks. The totals are reported by Stats as ValueLockWait, for
+// the lock held while reading and writing values, and KeyLockWait, for the
+// per-key locks held while updating index entries. This is meant for finding
+// lock contention, and adds the cost of reading the clock to every lock.
+func LockTiming(enable bool) Option {
+	return func(cfg *config) {
+		cfg.lockTiming = enable
+	}
+}
+
+// OpTimeout sets the maximum time that a single read or delete of the
+// underlying store may take while RemoveProvider, RemoveValuesOlderThan or
+// CountProviderRecords scans the store. If a read or delete takes longer, the
+// scan stops and returns ErrOpTimeout, so that a stuck disk cannot block the
+// store indefinitely. A timeout of 0, the default, waits for each operation to
+// finish.
+func OpTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.opTimeout = timeout
+	}
+}
+
+// RemoveBatchSize sets the number of value records that RemoveProvider scans
+// at a time while holding the lock that blocks reads and writes of values.
+// The lock is released between batches so that other operations can proceed
+// during a long removal. The scan of the primary storage keeps its position
+// across batches, so each record is read once. Values that are put for the
+// provider while the removal runs are also removed if they are written to the
+// primary storage before the scan reaches its end, and are kept otherwise. A
+// size of 0, the default, holds the lock for the whole removal.
+func RemoveBatchSize(size int) Option {
+	return func(cfg *config) {
+		cfg.removeBatchSize = size
+	}
+}
+
+// OrderedIndex sets whether the store keeps an ordered index of its
+// multihashes, which IterRange uses to iterate over the multihashes in a range.
+// The index keys of the store are hashed, so they have no useful order. The
+// ordered index is a separate LevelDB database in the index directory, and
+// every Put also writes its multihashes to it.
+//
+// When the ordered index is first enabled, it is built from the multihashes
+// already in the store. Multihashes put while the option is disabled are not
+// added to an existing ordered index.
+func OrderedIndex(enable bool) Option {
+	return func(cfg *config) {
+		cfg.orderedIndex = enable
+	}
+}
+
+// RemoveOrphanValues sets whether Remove and RemoveBatch delete the record of a
+// value when they remove the last multihash that maps to it. Otherwise, the
+// record is kept until the provider or context is removed.
+//
+// Checking whether any multihash maps to a value reads the value's multihash
+// list when the ReverseIndex option is enabled. Without the reverse index, it
+// reads the value-key list of every multihash in the store, which is very
+// expensive for a large store. Puts wait while the check runs.
+func RemoveOrphanValues(enable bool) Option {
+	return func(cfg *config) {
+		cfg.removeOrphanValues = enable
+	}
+}
+
+// CompressMetadata sets the codec used to compress the metadata of values
+// when they are stored. Metadata smaller than 256 bytes, or that does not get
+// smaller when compressed, is stored uncompressed. Each stored value records
+// whether its metadata is compressed, so values stored with and without
+// compression are read the same, and this option can be changed for an
+// existing store. The default, indexer.MetadataUncompressed, stores metadata
+// as is.
+func CompressMetadata(codec indexer.MetadataCodec) Option {
+	return func(cfg *config) {
+		cfg.mdCodec = codec
+	}
+}
+
+// SortValues sets whether Get and GetForProvider return values sorted by
+// provider ID and then by context ID. Otherwise, values are returned in the
+// order that they are stored for the multihash, which changes when values are
+// removed. Sorting makes results comparable across calls, at the cost of a
+// sort on each lookup.
+func SortValues(enable bool) Option {
+	return func(cfg *config) {
+		cfg.sortValues = enable
+	}
+}
+
+// IndexCountSketch sets whether the store keeps a sketch of the multihashes in
+// the store, which ApproxIndexCount uses to estimate the number of distinct
+// multihashes. The sketch uses 16KiB of memory. It is not stored, and is
+// built when the store is opened by reading all the records in the store.
+func IndexCountSketch(enable bool) Option {
+	return func(cfg *config) {
+		cfg.indexCountSketch = enable
+	}
+}
+
+// SkipDuplicateCheck sets whether Put appends the value to the value-keys of
+// each multihash without first checking that the multihash is not already
+// mapped to the value. This saves scanning the value-keys of each multihash,
+// and is only safe when a value is never put for the same multihash twice.
+// Otherwise, the multihash maps to the value more than once, and Get returns
+// the value more than once, until RepairValueKeys removes the duplicates.
+// Puts collected by CoalesceWindow still check for duplicates.
+//
+// To also skip reading the existing value-keys of multihashes that are known
+// to be new, use PutNew.
+func SkipDuplicateCheck(enable bool) Option {
+	return func(cfg *config) {
+		cfg.skipDupCheck = enable
+	}
+}
+
+// MaxValuesPerMultihash sets the largest number of values that a multihash can
+// map to. Putting a value for a multihash that already maps to this many
+// values fails with ErrTooManyValues. This bounds the cost of reading and
+// writing the values of a multihash that many providers or contexts are put
+// for. A value of 0, the default, sets no limit.
+//
+// When Put returns ErrTooManyValues, the multihashes put before the one that
+// has too many values are stored. With PutConcurrency, all the multihashes
+// that do not have too many values are stored.
+func MaxValuesPerMultihash(n int) Option {
+	return func(cfg *config) {
+		cfg.maxValues = n
+	}
+}
+
+// WAL sets whether writes are recorded in a write-ahead log before they are
+// made. The store syncs writes to disk at the sync interval, so a crash loses
+// the writes made since the last sync. With the log, those writes are made
+// again when the store is next opened. Each write waits for its log record to
+// be synced to disk, which makes writes slower.
+//
+// These writes are logged: Put, PutMany, PutReturningPrevious, PutNew,
+// PutStrict, PutStream, RegisterValue, Replace, Remove, RemoveBatch,
+// RemoveProvider, RemoveProviderContext, RemoveValuesOlderThan, RemapProvider,
+// RepairValueKeys and CoalesceIdenticalValues. PutStream is logged one batch
+// at a time. Writes that scan the store are logged once, and are made again
+// in full when replayed. The log is cleared when Flush or Close completes,
+// and by flushing the store at each sync interval.
+//
+// A write that was synced to disk after the log was last cleared is made again
+// when the log is replayed, so a MergeValues function must be idempotent. The
+// OnPut function is not called for replayed writes.
+func WAL(enable bool) Option {
+	return func(cfg *config) {
+		cfg.wal = enable
+	}
+}
+
+// PackedValueKeys sets whether the lists of value-keys that multihashes map
+// to, and the lists in the reverse index, are written in a packed binary
+// encoding instead of JSON. The packed encoding is about two thirds the size,
+// and is much faster to encode and decode, which matters for multihashes that
+// map to many values. Lists in either encoding are read regardless of this
+// option, so it can be enabled on an existing store, and lists are converted
+// as they are rewritten.
+func PackedValueKeys(enable bool) Option {
+	return func(cfg *config) {
+		cfg.packValueKeys = enable
+	}
+}
+
+// SlowOpThreshold sets how long a Get, Put or RemoveProvider must take to be
+// reported to the OnSlowOp function. The default is one second.
+func SlowOpThreshold(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.slowOpThreshold = d
+	}
+}
+
+// OnSlowOp sets a function that is called when a Get, Put or RemoveProvider
+// takes longer than the SlowOpThreshold, with the name of the operation, how
+// long it took, and the number of multihashes it was given. The operation is
+// one of SlowOpGet, SlowOpPut or SlowOpRemoveProvider. All the variants of Put
+// are reported as SlowOpPut, and RemoveProvider is reported with no
+// multihashes. Failed operations are also reported. This finds operations
+// slowed by things such as a multihash that maps to very many values, or a
+// stalled disk, without logging every operation.
+//
+// The function is called inline, before the operation returns, so it must not
+// block for long. Operations are not timed if no function is set.
+func OnSlowOp(hook func(op string, d time.Duration, mhCount int)) Option {
+	return func(cfg *config) {
+		cfg.onSlowOp = hook
+	}
+}
+
+// Namespace sets a namespace that is added to every key the store writes, so
+// that the keys of stores with different namespaces do not collide when the
+// stores share the same primary storage (see Primary). Scans of the primary
+// storage, such as Iter and RemoveProvider without a reverse index, only read
+// the records of the store's own namespace. The namespace is recorded when the
+// store is created, and the store must always be opened with the same
+// namespace.
+//
+// The namespace is put at the end of each key, followed by its length, so any
+// stores with different namespaces, and a store with no namespace, can share a
+// primary storage. The namespace must not be longer than 255 bytes. The
+// default is no namespace.
+func Namespace(ns string) Option {
+	return func(cfg *config) {
+		cfg.namespace = ns
+	}
+}
+
+// SkipCorruptValues sets whether a Get leaves out the values whose stored
+// records cannot be decoded, instead of failing. Each value left out is logged
+// and counted in the CorruptValues statistic. This keeps a multihash gettable
+// when some of the values it maps to are corrupted. The value-keys of the
+// corrupted values stay in the multihash's value-key list, unless
+// PruneCorruptValues is also set. The default is to fail the Get.
+func SkipCorruptValues(enable bool) Option {
+	return func(cfg *config) {
+		cfg.skipCorruptValues = enable
+	}
+}
+
+// PruneCorruptValues sets whether the value-keys of values that cannot be
+// decoded are removed from the value-key list of a multihash when it is read,
+// so that the corrupted values are not read again. The value-keys removed are
+// counted in the PrunedValueKeys statistic. Setting this also sets
+// SkipCorruptValues. The default is not to remove them.
+func PruneCorruptValues(enable bool) Option {
+	return func(cfg *config) {
+		cfg.pruneCorruptValues = enable
+	}
+}
+
+// SizeAfterFlush sets whether Size and SizeBreakdown flush the store before
+// reading the size of its files, so that the size includes writes that are
+// still buffered in memory. This makes the size accurate for monitoring disk
+// usage, at the cost of a flush on each call. The default is not to flush, so
+// the size may not include writes made since the last flush.
+func SizeAfterFlush(enable bool) Option {
+	return func(cfg *config) {
+		cfg.sizeAfterFlush = enable
+	}
+}
@@ -0,0 +1,246 @@
+package storethehash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// orderedDirName is the name of the directory, in the index directory, that
+// holds the ordered index.
+const orderedDirName = "storethehash.ordered"
+
+// orderedBatchSize is the number of multihashes that an ordered iterator reads
+// from the ordered index at a time.
+const orderedBatchSize = 256
+
+// ErrNoOrderedIndex is returned when calling a method that requires the
+// ordered index on a store that was opened without the OrderedIndex option.
+var ErrNoOrderedIndex = errors.New("ordered index not enabled")
+
+// openOrderedIndex opens the ordered index in indexDir. If the ordered index
+// does not exist, then it is created and filled with the multihashes already
+// in the store.
+//
+// A new ordered index is built in a temporary directory that is renamed into
+// place when the build is complete, so that a build that is interrupted is
+// started again the next time the store is opened.
+func (s *Store) openOrderedIndex(indexDir string) error {
+	dir := filepath.Join(indexDir, orderedDirName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = s.createOrderedIndex(dir); err != nil {
+			return err
+		}
+	}
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return fmt.Errorf("cannot open ordered index: %w", err)
+	}
+	s.ordered = db
+	return nil
+}
+
+// createOrderedIndex builds the ordered index in a temporary directory, and
+// then renames it to dir.
+func (s *Store) createOrderedIndex(dir string) error {
+	tmpDir := dir + ".tmp"
+	// Remove what is left of a build that was interrupted.
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("cannot remove incomplete ordered index: %w", err)
+	}
+	db, err := leveldb.OpenFile(tmpDir, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create ordered index: %w", err)
+	}
+	err = s.buildOrderedIndex(db)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err = os.Rename(tmpDir, dir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("cannot create ordered index: %w", err)
+	}
+	return nil
+}
+
+// buildOrderedIndex adds the multihashes in the primary storage to db.
+func (s *Store) buildOrderedIndex(db *leveldb.DB) error {
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for {
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		m, ok := s.keys.decodeIndexKey(key)
+		if !ok {
+			continue
+		}
+		batch.Put(m, nil)
+		if batch.Len() >= orderedBatchSize {
+			if err = db.Write(batch, nil); err != nil {
+				return fmt.Errorf("cannot build ordered index: %w", err)
+			}
+			batch.Reset()
+		}
+	}
+	if err = db.Write(batch, nil); err != nil {
+		return fmt.Errorf("cannot build ordered index: %w", err)
+	}
+	return nil
+}
+
+// orderMultihashes adds the multihashes to the ordered index, if the ordered
+// index is enabled.
+func (s *Store) orderMultihashes(mhs []multihash.Multihash) error {
+	if s.ordered == nil || len(mhs) == 0 {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	for _, m := range mhs {
+		batch.Put(m, nil)
+	}
+	return s.ordered.Write(batch, nil)
+}
+
+// unorderIndexKey removes the multihash of the index key k from the ordered
+// index, if the ordered index is enabled.
+func (s *Store) unorderIndexKey(k []byte) error {
+	if s.ordered == nil {
+		return nil
+	}
+	m, ok := s.keys.decodeIndexKey(k)
+	if !ok {
+		return nil
+	}
+	return s.ordered.Delete(m, nil)
+}
+
+// pruneOrdered removes the multihash of the index key k from the ordered
+// index, if the multihash is not in the store. The index key is locked so that
+// a multihash that is put again is not removed.
+func (s *Store) pruneOrdered(k []byte) error {
+	s.lock(k)
+	defer s.unlock(k)
+
+	valueKeys, err := s.getValueKeys(k)
+	if err != nil {
+		return err
+	}
+	if len(valueKeys) != 0 {
+		return nil
+	}
+	return s.unorderIndexKey(k)
+}
+
+type orderedIterator struct {
+	ctx     context.Context
+	storage *Store
+	start   []byte
+	end     []byte
+	batch   [][]byte
+	done    bool
+}
+
+// IterRange creates an iterator over the multihashes from start, inclusive, to
+// end, exclusive, in the byte order of the multihashes, and their values. A
+// nil start iterates from the first multihash, and a nil end iterates to the
+// last. This requires the OrderedIndex option.
+//
+// Multihashes that are put during iteration are returned if they come after
+// the last multihash returned.
+func (s *Store) IterRange(ctx context.Context, start, end multihash.Multihash) (indexer.Iterator, error) {
+	if s.ordered == nil {
+		return nil, ErrNoOrderedIndex
+	}
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	return &orderedIterator{
+		ctx:     ctx,
+		storage: s,
+		start:   start,
+		end:     end,
+	}, nil
+}
+
+func (it *orderedIterator) Next() (multihash.Multihash, []indexer.Value, error) {
+	if err := it.storage.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer it.storage.end()
+
+	for {
+		if err := it.ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if len(it.batch) == 0 {
+			if it.done {
+				return nil, nil, io.EOF
+			}
+			if err := it.readBatch(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		m := multihash.Multihash(it.batch[0])
+		it.batch = it.batch[1:]
+
+		k := it.storage.keys.makeIndexKey(m)
+		values, found, err := it.storage.get(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !found {
+			// The multihash was removed by an operation that does not update
+			// the ordered index.
+			if err = it.storage.pruneOrdered(k); err != nil {
+				return nil, nil, fmt.Errorf("cannot update ordered index: %w", err)
+			}
+			continue
+		}
+		return m, values, nil
+	}
+}
+
+// readBatch reads the next batch of multihashes from the ordered index.
+func (it *orderedIterator) readBatch() error {
+	iter := it.storage.ordered.NewIterator(&util.Range{Start: it.start, Limit: it.end}, nil)
+	defer iter.Release()
+
+	for len(it.batch) < orderedBatchSize && iter.Next() {
+		it.batch = append(it.batch, append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if len(it.batch) < orderedBatchSize {
+		it.done = true
+	}
+	if len(it.batch) != 0 {
+		// Start the next batch after the last multihash in this batch.
+		last := it.batch[len(it.batch)-1]
+		it.start = append(append(make([]byte, 0, len(last)+1), last...), 0)
+	}
+	return nil
+}
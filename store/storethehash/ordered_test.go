@@ -0,0 +1,154 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/multiformats/go-multihash"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestIterRange(t *testing.T) {
+	value := testValue(t)
+
+	s := newStore(t, t.TempDir())
+	if _, err := s.IterRange(context.Background(), nil, nil); err != ErrNoOrderedIndex {
+		t.Fatalf("expected ErrNoOrderedIndex, got %v", err)
+	}
+	s.Close()
+
+	// Multihashes of the same length sort in the order of their digests.
+	var mhs []multihash.Multihash
+	for i := 0; i < 600; i++ {
+		digest := make([]byte, 32)
+		digest[0] = byte(i >> 8)
+		digest[1] = byte(i)
+		m, err := multihash.Encode(digest, multihash.SHA2_256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mhs = append(mhs, m)
+	}
+
+	dir := t.TempDir()
+	s = newStore(t, dir)
+	// Put multihashes before the ordered index is enabled, so that it is
+	// built from the existing store.
+	if err := s.Put(value, mhs[:100]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = newStore(t, dir, OrderedIndex(true))
+	defer s.Close()
+	// Put in reverse order, to check that the order does not come from puts.
+	for i := len(mhs) - 1; i >= 100; i-- {
+		if err := s.Put(value, mhs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Remove(value, mhs[50]); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(start, end multihash.Multihash) []multihash.Multihash {
+		iter, err := s.IterRange(context.Background(), start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []multihash.Multihash
+		for {
+			m, vals, err := iter.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Fatal(err)
+			}
+			if len(vals) != 1 || !vals[0].Equal(value) {
+				t.Fatal("wrong value for multihash")
+			}
+			got = append(got, m)
+		}
+		return got
+	}
+
+	got := scan(mhs[40], mhs[560])
+	expected := append(append([]multihash.Multihash{}, mhs[40:50]...), mhs[51:560]...)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d multihashes in range, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if !bytes.Equal(got[i], expected[i]) {
+			t.Fatalf("multihash %d out of order", i)
+		}
+	}
+
+	if got = scan(nil, nil); len(got) != len(mhs)-1 {
+		t.Fatalf("expected %d multihashes, got %d", len(mhs)-1, len(got))
+	}
+	if got = scan(mhs[599], nil); len(got) != 1 || !bytes.Equal(got[0], mhs[599]) {
+		t.Fatal("expected only the last multihash")
+	}
+	if got = scan(mhs[10], mhs[10]); len(got) != 0 {
+		t.Fatal("expected empty range")
+	}
+}
+
+func TestOrderedIndexInterruptedBuild(t *testing.T) {
+	value := testValue(t)
+	mhs := test.RandomMultihashes(10)
+
+	dir := t.TempDir()
+	s := newStore(t, dir)
+	if err := s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave an incomplete ordered index, as a build that was interrupted
+	// would.
+	tmpDir := filepath.Join(dir, orderedDirName+".tmp")
+	db, err := leveldb.OpenFile(tmpDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put(mhs[0], nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStore(t, dir, OrderedIndex(true))
+	defer s.Close()
+	if _, err = os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Fatal("incomplete ordered index was not removed")
+	}
+	iter, err := s.IterRange(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		_, _, err = iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != len(mhs) {
+		t.Fatalf("expected %d multihashes from rebuilt ordered index, got %d", len(mhs), count)
+	}
+}
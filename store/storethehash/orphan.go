@@ -0,0 +1,93 @@
+package storethehash
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// removeOrphans deletes the record of each value that no multihash maps to,
+// after the value was removed from multihashes. It does nothing unless the
+// RemoveOrphanValues option is enabled.
+func (s *Store) removeOrphans(values []indexer.Value) error {
+	if !s.removeOrphanValues {
+		return nil
+	}
+	// Block puts, so that a multihash is not mapped to a value between
+	// checking the value and deleting it.
+	s.orphanLock.Lock()
+	defer s.orphanLock.Unlock()
+
+	for _, value := range values {
+		valKey := s.keys.makeValueKey(value)
+		referenced, err := s.valueReferenced(valKey)
+		if err != nil {
+			return fmt.Errorf("cannot check references to value: %w", err)
+		}
+		if referenced {
+			continue
+		}
+		if err = s.removeValueRecord(value.ProviderID, valKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeValueRecord deletes a value record, and removes it from the reverse
+// index.
+func (s *Store) removeValueRecord(providerID peer.ID, valKey []byte) error {
+	s.lockValue(valKey)
+	defer s.unlockValue(valKey)
+
+	s.valueCache.remove(valKey)
+	if _, err := s.store.Remove(valKey); err != nil {
+		return err
+	}
+	return s.unindexValue(providerID, valKey)
+}
+
+// valueReferenced returns true if any multihash maps to the value-key. This
+// reads the value's multihash list if the reverse index is enabled, and
+// otherwise reads the value-key list of every multihash in the store until one
+// refers to the value-key.
+func (s *Store) valueReferenced(valKey []byte) (bool, error) {
+	if s.reverseIndex {
+		// The first chunk of the value's multihash list is only empty if
+		// the whole list is.
+		mhs, err := s.getValueKeys(s.keys.makeReverseKey(valKey))
+		if err != nil {
+			return false, err
+		}
+		return len(mhs) != 0, nil
+	}
+
+	if err := s.flush(); err != nil {
+		return false, err
+	}
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return false, err
+	}
+	for {
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		if _, ok := s.keys.decodeIndexKey(key); !ok {
+			continue
+		}
+		valueKeys, err := s.getValueKeys(key)
+		if err != nil {
+			return false, err
+		}
+		if containsKey(valueKeys, valKey) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package storethehash
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestRemoveOrphanValues(t *testing.T) {
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(4)
+
+	for _, reverse := range []bool{false, true} {
+		for _, enable := range []bool{false, true} {
+			s := newStore(t, t.TempDir(),
+				ReverseIndex(reverse),
+				RemoveOrphanValues(enable))
+			if err := s.Put(value1, mhs[:2]...); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put(value2, mhs[1:]...); err != nil {
+				t.Fatal(err)
+			}
+
+			// The value record is kept while a multihash still maps to it.
+			if err := s.Remove(value1, mhs[0]); err != nil {
+				t.Fatal(err)
+			}
+			est, err := s.CountProviderRecords(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if est.Values != 2 {
+				t.Fatalf("expected 2 value records, got %d", est.Values)
+			}
+
+			// Removing the last multihash removes the value record only if
+			// the option is enabled.
+			if err = s.Remove(value1, mhs[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.RemoveBatch([]indexer.Value{value2}, mhs[1:3]); err != nil {
+				t.Fatal(err)
+			}
+			est, err = s.CountProviderRecords(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := 2
+			if enable {
+				expected = 1
+			}
+			if est.Values != expected {
+				t.Fatalf("reverse=%t, enable=%t: expected %d value records, got %d", reverse, enable, expected, est.Values)
+			}
+			vals, found, err := s.Get(mhs[3])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || len(vals) != 1 || !vals[0].Equal(value2) {
+				t.Fatal("expected value that is still referenced to remain")
+			}
+
+			// The value can be put again after its record was removed.
+			if err = s.Put(value1, mhs[0]); err != nil {
+				t.Fatal(err)
+			}
+			vals, found, err = s.Get(mhs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || len(vals) != 1 || !vals[0].Equal(value1) {
+				t.Fatal("value not stored again")
+			}
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
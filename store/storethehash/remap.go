@@ -0,0 +1,113 @@
+package storethehash
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// RemapProvider moves the values of the provider with peer ID oldID to the
+// provider with peer ID newID, for a provider that has changed its peer ID.
+// This saves ingesting all of the provider's content again. Returns the number
+// of values that were moved.
+//
+// The value-key of a value is made from its provider ID, so each value is
+// stored again under a new value-key, and every multihash that maps to the old
+// value-key is changed to map to the new one. If the new provider already has
+// a value with the same context ID, then that value is kept, and the
+// multihashes of the old value are mapped to it. Stored value times are kept.
+//
+// With the ReverseIndex option, only the multihashes of the provider's values
+// are read. Otherwise, the whole store is read to find the multihashes that
+// map to the provider's values. Values cannot be put or removed while the
+// provider is remapped.
+func (s *Store) RemapProvider(ctx context.Context, oldID, newID peer.ID) (uint64, error) {
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+	defer s.end()
+
+	if oldID == newID {
+		return 0, nil
+	}
+
+	done, err := s.logLongWrite(walRecord{op: walRemapProvider, providerID: oldID, newID: newID})
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	s.lockValues()
+	defer s.valLock.Unlock()
+
+	// Map the key of each of the old provider's values to its new key.
+	remaps := make(map[string][]byte)
+	err = s.scanValues(ctx, 0, func(key, valueData []byte) error {
+		value, t, err := indexer.UnmarshalValueTime(valueData)
+		if err != nil {
+			return err
+		}
+		if value.ProviderID != oldID {
+			return nil
+		}
+		value.ProviderID = newID
+		newKey := s.keys.makeValueKey(value)
+		found, err := s.store.Has(newKey)
+		if err != nil {
+			return fmt.Errorf("cannot get value: %w", err)
+		}
+		if !found {
+			data, err := s.marshalValueTime(value, t)
+			if err != nil {
+				return err
+			}
+			if err = s.store.Put(newKey, data); err != nil {
+				return fmt.Errorf("cannot save value: %w", err)
+			}
+			if err = s.indexNewValue(value, newKey); err != nil {
+				return fmt.Errorf("cannot update reverse index: %w", err)
+			}
+		}
+		remaps[string(key)] = newKey
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(remaps) == 0 {
+		return 0, nil
+	}
+
+	// Change the multihashes that map to the old values.
+	if s.reverseIndex {
+		for oldKey := range remaps {
+			mhs, err := s.getReverseList([]byte(oldKey))
+			if err != nil {
+				return 0, err
+			}
+			for _, m := range mhs {
+				if err = ctx.Err(); err != nil {
+					return 0, err
+				}
+				if err = s.repointValueKeys(s.keys.makeIndexKey(m), m, remaps); err != nil {
+					return 0, err
+				}
+			}
+		}
+	} else if err = s.repointAllValueKeys(ctx, remaps); err != nil {
+		return 0, err
+	}
+
+	for oldKey := range remaps {
+		s.valueCache.remove([]byte(oldKey))
+		if _, err = s.store.Remove([]byte(oldKey)); err != nil {
+			return 0, fmt.Errorf("cannot remove value: %w", err)
+		}
+		if err = s.unindexValue(oldID, []byte(oldKey)); err != nil {
+			return 0, fmt.Errorf("cannot update reverse index: %w", err)
+		}
+	}
+	return uint64(len(remaps)), s.countWrite()
+}
@@ -0,0 +1,102 @@
+package storethehash
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestRemapProvider(t *testing.T) {
+	oldID := testPeer(t)
+	newID, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := peer.Decode("12D3KooWJaHnBAPpkCXRAkJxbBkA4h4uqDDxnJyjU8WjtPfgmj6k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		s := newStore(t, t.TempDir(), ReverseIndex(reverse))
+		old1 := indexer.Value{ProviderID: oldID, ContextID: []byte("ctx-1"), MetadataBytes: []byte("old-1")}
+		old2 := indexer.Value{ProviderID: oldID, ContextID: []byte("ctx-2"), MetadataBytes: []byte("old-2")}
+		// The new provider has already put a value for ctx-2.
+		new2 := indexer.Value{ProviderID: newID, ContextID: []byte("ctx-2"), MetadataBytes: []byte("new-2")}
+		other := indexer.Value{ProviderID: otherID, ContextID: []byte("ctx-1"), MetadataBytes: []byte("other")}
+
+		mhs := test.RandomMultihashes(12)
+		if err = s.Put(old1, mhs[:6]...); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put(old2, mhs[6:]...); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put(new2, mhs[10:]...); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put(other, mhs[:3]...); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := s.RemapProvider(context.Background(), oldID, newID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("expected 2 values remapped, got %d", n)
+		}
+
+		new1 := old1
+		new1.ProviderID = newID
+		for i, m := range mhs {
+			var want []indexer.Value
+			switch {
+			case i < 3:
+				want = []indexer.Value{new1, other}
+			case i < 6:
+				want = []indexer.Value{new1}
+			default:
+				want = []indexer.Value{new2}
+			}
+			vals, found, err := s.Get(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || len(vals) != len(want) {
+				t.Fatalf("reverse %t: multihash %d: expected %d values, got %d", reverse, i, len(want), len(vals))
+			}
+			for _, w := range want {
+				var ok bool
+				for _, v := range vals {
+					if v.Equal(w) {
+						ok = true
+					}
+				}
+				if !ok {
+					t.Fatalf("reverse %t: multihash %d: missing value for context %s", reverse, i, w.ContextID)
+				}
+			}
+		}
+
+		// Nothing is left for the old provider.
+		if n, err = s.RemapProvider(context.Background(), oldID, newID); err != nil || n != 0 {
+			t.Fatalf("expected nothing to remap, got %d, %v", n, err)
+		}
+		if reverse {
+			got, err := s.MultihashesForValue(context.Background(), new1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 6 {
+				t.Fatalf("reverse index has %d multihashes for remapped value, expected 6", len(got))
+			}
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// RepairReport describes the result of repairing value-key lists.
+type RepairReport struct {
+	// IndexKeys is the number of multihashes whose value-key lists were
+	// checked.
+	IndexKeys int
+	// Repaired is the number of value-key lists that were rewritten.
+	Repaired int
+	// Removed is the number of multihashes removed because none of their
+	// value-keys referred to an existing value.
+	Removed int
+	// NestedLists is the number of value-key lists found marshalled inside
+	// another value-key list.
+	NestedLists int
+	// DuplicateKeys is the number of duplicate value-keys dropped.
+	DuplicateKeys int
+	// DanglingKeys is the number of value-keys dropped because there is no
+	// value for them.
+	DanglingKeys int
+	// InvalidKeys is the number of entries dropped because they were neither
+	// a value-key nor a value-key list.
+	InvalidKeys int
+}
+
+// RepairValueKeys checks the value-key list of every multihash in the store,
+// and rewrites the lists that are not in canonical form. A list in canonical
+// form has no duplicates, no value-keys without a value, and no value-key lists
+// marshalled inside it. Multihashes that are left with no value-keys are
+// removed.
+//
+// This is a one-time repair for stores written by versions with bugs that
+// stored malformed lists. Lookups only drop value-keys without a value.
+func (s *Store) RepairValueKeys(ctx context.Context) (RepairReport, error) {
+	var report RepairReport
+	if err := s.begin(); err != nil {
+		return report, err
+	}
+	defer s.end()
+
+	done, err := s.logLongWrite(walRecord{op: walRepairValueKeys})
+	if err != nil {
+		return report, err
+	}
+	defer done()
+
+	s.flush()
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return report, err
+	}
+
+	// The primary storage may hold more than one record for a multihash, so
+	// only check each multihash once.
+	seen := make(map[string]struct{})
+	var count int
+	for {
+		if count%1024 == 0 && ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		count++
+
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return report, err
+		}
+		if _, ok := s.keys.decodeIndexKey(key); !ok {
+			continue
+		}
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+
+		if err = s.repairValueKeys(key, &report); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// repairValueKeys repairs the value-key list of one index key.
+func (s *Store) repairValueKeys(key []byte, report *RepairReport) error {
+	s.lock(key)
+	defer s.unlock(key)
+
+	data, found, err := s.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	report.IndexKeys++
+
+	valueKeys, err := indexer.UnmarshalValueKeys(data)
+	if err != nil {
+		return fmt.Errorf("cannot decode value keys for multihash: %w", err)
+	}
+	var changed bool
+	valueKeys, changed = s.keys.flattenValueKeys(valueKeys, report)
+
+	// Drop value-keys that have no value.
+	s.rlockValues()
+	for i := 0; i < len(valueKeys); {
+		_, found, err = s.store.Get(valueKeys[i])
+		if err != nil {
+			s.valLock.RUnlock()
+			return fmt.Errorf("cannot get value: %w", err)
+		}
+		if found {
+			i++
+			continue
+		}
+		report.DanglingKeys++
+		changed = true
+		valueKeys = append(valueKeys[:i], valueKeys[i+1:]...)
+	}
+	s.valLock.RUnlock()
+
+	if !changed {
+		return nil
+	}
+	if len(valueKeys) == 0 {
+		if _, err = s.store.Remove(key); err != nil {
+			return fmt.Errorf("cannot delete multihash: %w", err)
+		}
+		if err = s.unorderIndexKey(key); err != nil {
+			return fmt.Errorf("cannot update ordered index: %w", err)
+		}
+		report.Removed++
+		return nil
+	}
+	b, err := s.marshalValueKeys(valueKeys)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Put(key, b); err != nil {
+		return fmt.Errorf("cannot update value keys for multihash: %w", err)
+	}
+	report.Repaired++
+	return nil
+}
+
+// flattenValueKeys returns the value-keys in the list with nested value-key
+// lists unwrapped, and with duplicates and invalid entries removed. Reports
+// whether the list was changed.
+func (kf keyFormat) flattenValueKeys(valueKeys [][]byte, report *RepairReport) ([][]byte, bool) {
+	var changed bool
+	flat := make([][]byte, 0, len(valueKeys))
+	seen := make(map[string]struct{}, len(valueKeys))
+
+	var add func(keys [][]byte)
+	add = func(keys [][]byte) {
+		for _, vk := range keys {
+			if kf.isValueKey(vk) {
+				if _, ok := seen[string(vk)]; ok {
+					report.DuplicateKeys++
+					changed = true
+					continue
+				}
+				seen[string(vk)] = struct{}{}
+				flat = append(flat, vk)
+				continue
+			}
+			changed = true
+			nested, err := indexer.UnmarshalValueKeys(vk)
+			if err != nil {
+				report.InvalidKeys++
+				continue
+			}
+			report.NestedLists++
+			add(nested)
+		}
+	}
+	add(valueKeys)
+
+	return flat, changed
+}
+
+// isValueKey returns true if b is a value-key made by makeValueKey.
+func (kf keyFormat) isValueKey(b []byte) bool {
+	dm, err := multihash.Decode(b)
+	if err != nil {
+		return false
+	}
+	return dm.Code == multihash.IDENTITY && len(dm.Digest) == valueKeySize+len(kf.value) &&
+		bytes.HasSuffix(dm.Digest, kf.value)
+}
+
+// CoalesceIdenticalValues finds value records that are stored under a
+// value-key that is not the value-key of their ProviderID and ContextID, which
+// only happens if the store is damaged. Each such record is merged into the
+// record stored under the correct value-key, if that record has the same
+// metadata or does not exist, and the multihashes that map to the damaged
+// record are changed to map to the correct one. Returns the number of damaged
+// records that were merged.
+//
+// A damaged record with metadata that differs from the record under the
+// correct value-key is left unchanged, since it cannot be known which metadata
+// is right. This reads the whole store twice.
+func (s *Store) CoalesceIdenticalValues(ctx context.Context) (uint64, error) {
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+	defer s.end()
+
+	done, err := s.logLongWrite(walRecord{op: walCoalesceIdenticalValues})
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	s.lockValues()
+	defer s.valLock.Unlock()
+
+	// Map the key of each damaged record to the key it is merged into.
+	merges := make(map[string][]byte)
+	providers := make(map[string]peer.ID)
+	err = s.scanValues(ctx, 0, func(key, valueData []byte) error {
+		value, err := indexer.UnmarshalValue(valueData)
+		if err != nil {
+			return err
+		}
+		valKey := s.keys.makeValueKey(value)
+		if bytes.Equal(key, valKey) {
+			return nil
+		}
+		canonData, found, err := s.store.Get(valKey)
+		if err != nil {
+			return fmt.Errorf("cannot get value: %w", err)
+		}
+		if found {
+			canon, err := indexer.UnmarshalValue(canonData)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(canon.MetadataBytes, value.MetadataBytes) {
+				log.Warnw("Value record stored under wrong key has different metadata, not merging", "provider", value.ProviderID)
+				return nil
+			}
+		} else {
+			if err = s.store.Put(valKey, valueData); err != nil {
+				return fmt.Errorf("cannot save value: %w", err)
+			}
+			if err = s.indexNewValue(value, valKey); err != nil {
+				return fmt.Errorf("cannot update reverse index: %w", err)
+			}
+		}
+		merges[string(key)] = valKey
+		providers[string(key)] = value.ProviderID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(merges) == 0 {
+		return 0, nil
+	}
+
+	// Change the multihashes that map to a damaged record.
+	if err = s.repointAllValueKeys(ctx, merges); err != nil {
+		return 0, err
+	}
+
+	for oldKey := range merges {
+		s.valueCache.remove([]byte(oldKey))
+		if _, err = s.store.Remove([]byte(oldKey)); err != nil {
+			return 0, fmt.Errorf("cannot remove value: %w", err)
+		}
+		if err = s.unindexValue(providers[oldKey], []byte(oldKey)); err != nil {
+			return 0, fmt.Errorf("cannot update reverse index: %w", err)
+		}
+	}
+	return uint64(len(merges)), s.countWrite()
+}
+
+// repointAllValueKeys calls repointValueKeys for every multihash in the
+// store, reading the whole primary storage.
+func (s *Store) repointAllValueKeys(ctx context.Context, merges map[string][]byte) error {
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]struct{})
+	var count int
+	for {
+		if count%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		count++
+
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		m, ok := s.keys.decodeIndexKey(key)
+		if !ok {
+			continue
+		}
+		if _, ok = seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+
+		if err = s.repointValueKeys(key, m, merges); err != nil {
+			return err
+		}
+	}
+}
+
+// repointValueKeys replaces the value-keys in the value-key list of index key
+// k that are in merges with the value-keys they are merged into.
+func (s *Store) repointValueKeys(k []byte, m multihash.Multihash, merges map[string][]byte) error {
+	repointed, err := s.replaceValueKeys(k, merges)
+	if err != nil {
+		return err
+	}
+	// The reverse index is updated after k is unlocked, because the keys of
+	// the reverse index share locks with index keys.
+	for _, to := range repointed {
+		if err = s.indexMultihashes(to, []multihash.Multihash{m}); err != nil {
+			return fmt.Errorf("cannot update reverse index: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaceValueKeys does the work of repointValueKeys with k locked, and
+// returns the value-keys that k now maps to in place of merged value-keys.
+func (s *Store) replaceValueKeys(k []byte, merges map[string][]byte) ([][]byte, error) {
+	s.lock(k)
+	defer s.unlock(k)
+
+	valueKeys, err := s.getValueKeys(k)
+	if err != nil {
+		return nil, err
+	}
+	var repointed [][]byte
+	newKeys := make([][]byte, 0, len(valueKeys))
+	for _, vk := range valueKeys {
+		if to, ok := merges[string(vk)]; ok {
+			repointed = append(repointed, to)
+			vk = to
+		}
+		if !containsKey(newKeys, vk) {
+			newKeys = append(newKeys, vk)
+		}
+	}
+	if len(repointed) == 0 {
+		return nil, nil
+	}
+	b, err := s.marshalValueKeys(newKeys)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.store.Put(k, b); err != nil {
+		return nil, fmt.Errorf("cannot update value keys for multihash: %w", err)
+	}
+	return repointed, nil
+}
@@ -0,0 +1,67 @@
+//go:build go1.18
+
+package storethehash
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+)
+
+func FuzzFlattenValueKeys(f *testing.F) {
+	p := testPeer(f)
+	valKey1 := defaultKeys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1")})
+	valKey2 := defaultKeys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2")})
+	nested, err := indexer.MarshalValueKeys([][]byte{valKey1, valKey2})
+	if err != nil {
+		f.Fatal(err)
+	}
+	twiceNested, err := indexer.MarshalValueKeys([][]byte{nested, valKey2})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, keys := range [][][]byte{
+		{valKey1, valKey2},
+		{nested, valKey1, []byte("junk")},
+		{twiceNested, valKey1, valKey1, nil},
+	} {
+		data, err := indexer.MarshalValueKeys(keys)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		valueKeys, err := indexer.UnmarshalValueKeys(data)
+		if err != nil {
+			return
+		}
+		var report RepairReport
+		flat, changed := defaultKeys.flattenValueKeys(valueKeys, &report)
+
+		seen := make(map[string]struct{}, len(flat))
+		for _, vk := range flat {
+			if !defaultKeys.isValueKey(vk) {
+				t.Fatal("flattened list has entry that is not a value-key")
+			}
+			if _, ok := seen[string(vk)]; ok {
+				t.Fatal("flattened list has duplicate value-key")
+			}
+			seen[string(vk)] = struct{}{}
+		}
+		if !changed && len(flat) != len(valueKeys) {
+			t.Fatal("list was changed but not reported as changed")
+		}
+
+		// Flattening is idempotent.
+		var report2 RepairReport
+		flat2, changed := defaultKeys.flattenValueKeys(flat, &report2)
+		if changed || len(flat2) != len(flat) {
+			t.Fatal("flattened list changed when flattened again")
+		}
+		if report2 != (RepairReport{}) {
+			t.Fatalf("unexpected repairs of flattened list: %+v", report2)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestRepairValueKeys(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta")}
+	missing := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-3")}
+	mhs := test.RandomMultihashes(3)
+
+	if err := s.Put(value1, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a malformed value-key list for the first multihash.
+	valKey1 := s.keys.makeValueKey(value1)
+	valKey2 := s.keys.makeValueKey(value2)
+	nested, err := indexer.MarshalValueKeys([][]byte{valKey1, valKey2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformed, err := indexer.MarshalValueKeys([][]byte{nested, valKey1, s.keys.makeValueKey(missing), []byte("junk")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.store.Put(s.keys.makeIndexKey(mhs[0]), malformed); err != nil {
+		t.Fatal(err)
+	}
+	// The second multihash only maps to a value that does not exist.
+	dangling, err := indexer.MarshalValueKeys([][]byte{s.keys.makeValueKey(missing)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.store.Put(s.keys.makeIndexKey(mhs[1]), dangling); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.RepairValueKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := RepairReport{
+		IndexKeys:     3,
+		Repaired:      1,
+		Removed:       1,
+		NestedLists:   1,
+		DuplicateKeys: 1,
+		DanglingKeys:  2,
+		InvalidKeys:   1,
+	}
+	if report != expect {
+		t.Fatalf("unexpected report %+v, expected %+v", report, expect)
+	}
+
+	vals, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 2 || !vals[0].Equal(value1) || !vals[1].Equal(value2) {
+		t.Fatalf("wrong values after repair: %v", vals)
+	}
+	_, found, err = s.Get(mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("multihash with no values should have been removed")
+	}
+
+	// A repaired store needs no more repair.
+	report, err = s.RepairValueKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != (RepairReport{IndexKeys: 2}) {
+		t.Fatalf("unexpected report %+v after repair", report)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = s.RepairValueKeys(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCoalesceIdenticalValues(t *testing.T) {
+	s := newStore(t, t.TempDir(), ReverseIndex(true))
+	defer s.Close()
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	value3 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-3"), MetadataBytes: []byte("meta-3")}
+	mhs := test.RandomMultihashes(4)
+	if err := s.Put(value1, mhs[:2]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	// putDamaged stores value under a key that is not its value-key, and maps
+	// the multihashes to that key.
+	putDamaged := func(wrongKey []byte, value indexer.Value, mhs ...multihash.Multihash) {
+		data, err := indexer.MarshalValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.store.Put(wrongKey, data); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range mhs {
+			valueKeys, err := s.getValueKeys(s.keys.makeIndexKey(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := indexer.MarshalValueKeys(append(valueKeys, wrongKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.store.Put(s.keys.makeIndexKey(m), b); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A copy of value1, mapped from a multihash that also maps to value1.
+	wrongKey1 := s.keys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte("wrong-1")})
+	putDamaged(wrongKey1, value1, mhs[1], mhs[2])
+	// A copy of value2 with different metadata, which is not merged.
+	value2b := value2
+	value2b.MetadataBytes = []byte("meta-other")
+	wrongKey2 := s.keys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte("wrong-2")})
+	putDamaged(wrongKey2, value2b)
+	// A value that only exists under the wrong key.
+	wrongKey3 := s.keys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte("wrong-3")})
+	putDamaged(wrongKey3, value3, mhs[3])
+
+	merged, err := s.CoalesceIdenticalValues(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != 2 {
+		t.Fatalf("expected 2 merged values, got %d", merged)
+	}
+
+	for i, m := range mhs[:3] {
+		keys, found, err := s.ValueKeys(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(keys) != 1 || !bytes.Equal(keys[0], s.keys.makeValueKey(value1)) {
+			t.Fatalf("multihash %d does not map only to the correct value-key", i)
+		}
+	}
+	vals, found, err := s.Get(mhs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(vals))
+	}
+	for _, v := range vals {
+		if !v.Equal(value2) && !v.Equal(value3) {
+			t.Fatal("got wrong value")
+		}
+	}
+	for _, k := range [][]byte{wrongKey1, wrongKey3} {
+		if _, found, _ = s.store.Get(k); found {
+			t.Fatal("merged value record was not removed")
+		}
+	}
+	if _, found, _ = s.store.Get(wrongKey2); !found {
+		t.Fatal("value with different metadata should not be removed")
+	}
+
+	mhs3, err := s.MultihashesForValue(context.Background(), value3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mhs3) != 1 || !bytes.Equal(mhs3[0], mhs[3]) {
+		t.Fatal("reverse index not updated for merged value")
+	}
+
+	merged, err = s.CoalesceIdenticalValues(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != 0 {
+		t.Fatal("expected nothing to merge the second time")
+	}
+}
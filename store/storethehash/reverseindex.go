@@ -0,0 +1,627 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/crypto/blake2b"
+)
+
+// The reverse index is made of two kinds of records, both stored as lists of
+// keys in the same format as the value-keys that a multihash maps to:
+//
+//   - provider key -> value-keys of all the provider's values
+//   - reverse key  -> multihashes mapped to a value
+//
+// The list of multihashes mapped to a value can be very long, so it is split
+// into chunks of up to reverseChunkSize multihashes, and a put only rewrites
+// the last chunk. The first chunk is stored under the reverse key, and the
+// others under reverse chunk keys numbered from 1. The chunks are kept
+// contiguous, so the number of chunks is found by looking up chunk keys.
+//
+// The lists are only added to and removed from by the operations that change
+// the data they describe, so entries can become stale when multihash
+// value-key lists are pruned on read. Anything read from the reverse index is
+// therefore checked against the primary records before being used.
+
+var (
+	providerKeySuffix     = []byte("P")
+	reverseKeySuffix      = []byte("R")
+	reverseChunkKeySuffix = []byte("C")
+)
+
+// reverseChunkSize is the most multihashes that are added to each chunk of the
+// list of multihashes mapped to a value. A first chunk written before the list
+// was split into chunks may hold more.
+const reverseChunkSize = 4096
+
+// ErrNoReverseIndex is returned when calling a method that requires the
+// reverse index on a store that was opened without the ReverseIndex option.
+var ErrNoReverseIndex = errors.New("reverse index not enabled")
+
+type providerIterator struct {
+	ctx       context.Context
+	storage   *Store
+	valueKeys [][]byte
+
+	value  indexer.Value
+	valKey []byte
+	mhs    [][]byte
+}
+
+// IterProvider creates an iterator over the multihashes and values of a
+// single provider. It reads only the provider's records, instead of scanning
+// the whole store, and requires the ReverseIndex option.
+//
+// Each returned multihash is given with the one provider value that it maps
+// to. A multihash that maps to several of the provider's values is returned
+// once for each value.
+func (s *Store) IterProvider(ctx context.Context, providerID peer.ID) (indexer.Iterator, error) {
+	if !s.reverseIndex {
+		return nil, ErrNoReverseIndex
+	}
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	valueKeys, err := s.getValueKeys(s.keys.makeProviderKey(providerID))
+	if err != nil {
+		return nil, err
+	}
+	return &providerIterator{
+		ctx:       ctx,
+		storage:   s,
+		valueKeys: valueKeys,
+	}, nil
+}
+
+// Replace stores the value and maps exactly the given multihashes to it. Any
+// multihash that was mapped to a value with the same ProviderID and ContextID,
+// but is not in mhs, no longer maps to that value. Other values that the
+// multihashes map to are not changed. Calling Replace with no multihashes
+// removes all multihashes from the value, but keeps the value.
+//
+// Replace requires the ReverseIndex option, to find the multihashes that were
+// previously mapped to the value. Puts of the same value wait until Replace is
+// done, so that multihashes put while Replace runs are not removed.
+func (s *Store) Replace(value indexer.Value, mhs ...multihash.Multihash) error {
+	if !s.reverseIndex {
+		return ErrNoReverseIndex
+	}
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	done, err := s.logWrite(walRecord{op: walReplace, value: value, mhs: mhs})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	valKey := s.keys.makeValueKey(value)
+	rl := s.replaceLock(valKey)
+	rl.Lock()
+	defer rl.Unlock()
+
+	if _, _, err = s.putLocked(value, mhs, nil); err != nil {
+		return err
+	}
+
+	keep := make(map[string]struct{}, len(mhs))
+	for _, m := range mhs {
+		keep[string(m)] = struct{}{}
+	}
+	prevMhs, err := s.getReverseList(valKey)
+	if err != nil {
+		return err
+	}
+	var stale []multihash.Multihash
+	for _, mhb := range prevMhs {
+		if _, ok := keep[string(mhb)]; ok {
+			continue
+		}
+		stale = append(stale, multihash.Multihash(mhb))
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	rmKeys := map[string]struct{}{
+		string(valKey): {},
+	}
+	for _, m := range stale {
+		if err = s.removeValueKeys(s.keys.makeIndexKey(m), rmKeys); err != nil {
+			return err
+		}
+	}
+	if err = s.unindexMultihashes(valKey, stale); err != nil {
+		return fmt.Errorf("cannot update reverse index: %w", err)
+	}
+	return s.countWrite()
+}
+
+// MultihashesForValue returns the multihashes that map to the value with the
+// same ProviderID and ContextID as value. The metadata of value is ignored.
+//
+// If the ReverseIndex option is enabled, only the multihashes recorded for the
+// value are read. Otherwise, the whole store is scanned, which reads every
+// multihash and its values, and may take a long time for a large store.
+func (s *Store) MultihashesForValue(ctx context.Context, value indexer.Value) ([]multihash.Multihash, error) {
+	if !s.reverseIndex {
+		return s.scanMultihashesForValue(ctx, value)
+	}
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	valKey := s.keys.makeValueKey(value)
+	mhs, err := s.getReverseList(valKey)
+	if err != nil {
+		return nil, err
+	}
+	var found []multihash.Multihash
+	for _, mhb := range mhs {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		// Check that the multihash still maps to the value.
+		valueKeys, err := s.getValueKeys(s.keys.makeIndexKey(mhb))
+		if err != nil {
+			return nil, err
+		}
+		if containsKey(valueKeys, valKey) {
+			found = append(found, multihash.Multihash(mhb))
+		}
+	}
+	return found, nil
+}
+
+// scanMultihashesForValue is MultihashesForValue for a store without a reverse
+// index.
+func (s *Store) scanMultihashesForValue(ctx context.Context, value indexer.Value) ([]multihash.Multihash, error) {
+	iter, err := s.IterContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var found []multihash.Multihash
+	for {
+		m, values, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		for i := range values {
+			if values[i].Match(value) {
+				found = append(found, m)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+func (it *providerIterator) Next() (multihash.Multihash, []indexer.Value, error) {
+	if err := it.storage.begin(); err != nil {
+		return nil, nil, err
+	}
+	defer it.storage.end()
+
+	for {
+		if err := it.ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if len(it.mhs) == 0 {
+			if len(it.valueKeys) == 0 {
+				return nil, nil, io.EOF
+			}
+			it.valKey = it.valueKeys[0]
+			it.valueKeys = it.valueKeys[1:]
+			if err := it.loadValue(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		mhb := it.mhs[0]
+		it.mhs = it.mhs[1:]
+
+		// Check that the multihash still maps to the value.
+		valueKeys, err := it.storage.getValueKeys(it.storage.keys.makeIndexKey(mhb))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, vk := range valueKeys {
+			if bytes.Equal(vk, it.valKey) {
+				return multihash.Multihash(mhb), []indexer.Value{it.value}, nil
+			}
+		}
+	}
+}
+
+// loadValue reads the current value and the list of multihashes mapped to it.
+// If the value no longer exists, the list is left empty.
+func (it *providerIterator) loadValue() error {
+	s := it.storage
+	it.mhs = nil
+
+	s.rlockValues()
+	valData, found, err := s.store.Get(it.valKey)
+	s.valLock.RUnlock()
+	if err != nil {
+		return fmt.Errorf("cannot get value: %w", err)
+	}
+	if !found {
+		return nil
+	}
+	it.value, err = indexer.UnmarshalValue(valData)
+	if err != nil {
+		return err
+	}
+
+	it.mhs, err = s.getReverseList(it.valKey)
+	return err
+}
+
+// indexNewValue adds a newly stored value to its provider's list of values.
+func (s *Store) indexNewValue(value indexer.Value, valKey []byte) error {
+	if !s.reverseIndex {
+		return nil
+	}
+	return s.addToKeyList(s.keys.makeProviderKey(value.ProviderID), [][]byte{valKey})
+}
+
+// indexMultihashes adds multihashes to the list of multihashes mapped to a
+// value.
+func (s *Store) indexMultihashes(valKey []byte, mhs []multihash.Multihash) error {
+	if !s.reverseIndex || len(mhs) == 0 {
+		return nil
+	}
+	items := make([][]byte, len(mhs))
+	for i := range mhs {
+		items[i] = mhs[i]
+	}
+	return s.addToReverseList(valKey, items)
+}
+
+// unindexMultihashes removes multihashes from the list of multihashes mapped
+// to a value.
+func (s *Store) unindexMultihashes(valKey []byte, mhs []multihash.Multihash) error {
+	if !s.reverseIndex || len(mhs) == 0 {
+		return nil
+	}
+	rmKeys := make(map[string]struct{}, len(mhs))
+	for _, m := range mhs {
+		rmKeys[string(m)] = struct{}{}
+	}
+	return s.removeFromReverseList(valKey, rmKeys)
+}
+
+// unindexValue removes a value from its provider's list of values, and removes
+// the value's list of multihashes.
+func (s *Store) unindexValue(providerID peer.ID, valKey []byte) error {
+	if !s.reverseIndex {
+		return nil
+	}
+	err := s.removeValueKeys(s.keys.makeProviderKey(providerID), map[string]struct{}{
+		string(valKey): {},
+	})
+	if err != nil {
+		return err
+	}
+	return s.removeReverseList(valKey)
+}
+
+// getReverseList returns the multihashes mapped to the value with the
+// value-key, read from all chunks of the list.
+func (s *Store) getReverseList(valKey []byte) ([][]byte, error) {
+	k := s.keys.makeReverseKey(valKey)
+	s.lock(k)
+	defer s.unlock(k)
+
+	n, err := s.reverseChunkCount(valKey)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 1 {
+		return s.getValueKeys(k)
+	}
+	var list [][]byte
+	seen := make(map[string]struct{})
+	for i := 0; i < n; i++ {
+		chunk, err := s.getValueKeys(s.keys.makeReverseChunkKey(valKey, i))
+		if err != nil {
+			return nil, err
+		}
+		// A multihash put again after its chunk was filled is also in a
+		// later chunk.
+		for _, item := range chunk {
+			if _, ok := seen[string(item)]; ok {
+				continue
+			}
+			seen[string(item)] = struct{}{}
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// addToReverseList adds the items that are not already in the last chunk to
+// the list of multihashes mapped to the value with the value-key. Only the
+// last chunk is rewritten, and new chunks are added as it fills.
+func (s *Store) addToReverseList(valKey []byte, items [][]byte) error {
+	k := s.keys.makeReverseKey(valKey)
+	s.lock(k)
+	defer s.unlock(k)
+
+	n, err := s.reverseChunkCount(valKey)
+	if err != nil {
+		return err
+	}
+	var last int
+	var tail [][]byte
+	if n != 0 {
+		last = n - 1
+		if tail, err = s.getValueKeys(s.keys.makeReverseChunkKey(valKey, last)); err != nil {
+			return err
+		}
+	}
+	existing := make(map[string]struct{}, len(tail)+len(items))
+	for _, item := range tail {
+		existing[string(item)] = struct{}{}
+	}
+	var changed bool
+	for _, item := range items {
+		if _, ok := existing[string(item)]; ok {
+			continue
+		}
+		existing[string(item)] = struct{}{}
+		if len(tail) >= reverseChunkSize {
+			if changed {
+				if err = s.putReverseChunk(valKey, last, tail); err != nil {
+					return err
+				}
+			}
+			last++
+			tail = nil
+		}
+		tail = append(tail, item)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return s.putReverseChunk(valKey, last, tail)
+}
+
+// removeFromReverseList removes the multihashes in rmKeys from the list of
+// multihashes mapped to the value with the value-key, rewriting only the
+// chunks that hold them. A chunk that is left empty is replaced by the last
+// chunk, to keep the chunks contiguous.
+func (s *Store) removeFromReverseList(valKey []byte, rmKeys map[string]struct{}) error {
+	k := s.keys.makeReverseKey(valKey)
+	s.lock(k)
+	defer s.unlock(k)
+
+	n, err := s.reverseChunkCount(valKey)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; {
+		chunk, err := s.getValueKeys(s.keys.makeReverseChunkKey(valKey, i))
+		if err != nil {
+			return err
+		}
+		keep := chunk[:0]
+		for _, item := range chunk {
+			if _, ok := rmKeys[string(item)]; !ok {
+				keep = append(keep, item)
+			}
+		}
+		if len(keep) == len(chunk) {
+			i++
+			continue
+		}
+		if len(keep) != 0 {
+			if err = s.putReverseChunk(valKey, i, keep); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+
+		n--
+		lastKey := s.keys.makeReverseChunkKey(valKey, n)
+		if i != n {
+			// Move the last chunk into the place of the empty chunk, and
+			// check it again without advancing i.
+			data, found, err := s.store.Get(lastKey)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.New("missing reverse index chunk")
+			}
+			if err = s.store.Put(s.keys.makeReverseChunkKey(valKey, i), data); err != nil {
+				return err
+			}
+		}
+		if _, err = s.store.Remove(lastKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeReverseList removes all chunks of the list of multihashes mapped to the
+// value with the value-key. The chunks are removed from the last, so that the
+// chunks that remain if this fails are still contiguous.
+func (s *Store) removeReverseList(valKey []byte) error {
+	k := s.keys.makeReverseKey(valKey)
+	s.lock(k)
+	defer s.unlock(k)
+
+	n, err := s.reverseChunkCount(valKey)
+	if err != nil {
+		return err
+	}
+	for i := n - 1; i >= 0; i-- {
+		if _, err = s.removeWithTimeout(s.keys.makeReverseChunkKey(valKey, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reverseChunkCount returns the number of chunks in the list of multihashes
+// mapped to the value with the value-key. It looks up chunks at doubling
+// numbers until one is missing, and then searches between the last two, so it
+// reads O(log n) keys for n chunks. The caller must hold the lock of the
+// value's reverse key.
+func (s *Store) reverseChunkCount(valKey []byte) (int, error) {
+	has := func(i int) (bool, error) {
+		return s.store.Has(s.keys.makeReverseChunkKey(valKey, i))
+	}
+	found, err := has(0)
+	if err != nil || !found {
+		return 0, err
+	}
+	// Chunk lo exists and chunk hi does not.
+	lo, hi := 0, 1
+	for {
+		if found, err = has(hi); err != nil {
+			return 0, err
+		}
+		if !found {
+			break
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if found, err = has(mid); err != nil {
+			return 0, err
+		}
+		if found {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
+
+// putReverseChunk writes a chunk of the list of multihashes mapped to the value
+// with the value-key.
+func (s *Store) putReverseChunk(valKey []byte, chunk int, list [][]byte) error {
+	b, err := s.marshalValueKeys(list)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(s.keys.makeReverseChunkKey(valKey, chunk), b)
+}
+
+// addToKeyList adds the items that are not already present to the list of
+// keys stored under k.
+func (s *Store) addToKeyList(k []byte, items [][]byte) error {
+	s.lock(k)
+	defer s.unlock(k)
+
+	list, err := s.getValueKeys(k)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]struct{}, len(list)+len(items))
+	for _, item := range list {
+		existing[string(item)] = struct{}{}
+	}
+	var added bool
+	for _, item := range items {
+		if _, ok := existing[string(item)]; ok {
+			continue
+		}
+		existing[string(item)] = struct{}{}
+		list = append(list, item)
+		added = true
+	}
+	if !added {
+		return nil
+	}
+
+	b, err := s.marshalValueKeys(list)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(k, b)
+}
+
+// makeProviderKey returns the key that a provider's list of value-keys is
+// stored under. The provider ID is hashed, as in makeValueKey, because the
+// index bucket is selected by the leading bytes of the key, and peer IDs of
+// the same key type all begin with the same bytes.
+func (kf keyFormat) makeProviderKey(providerID peer.ID) multihash.Multihash {
+	h, err := blake2b.New(valueKeySize, nil)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = io.WriteString(h, string(providerID))
+
+	var b bytes.Buffer
+	b.Grow(h.Size() + len(kf.provider))
+	b.Write(h.Sum(nil))
+	b.Write(kf.provider)
+	mh, _ := multihash.Encode(b.Bytes(), multihash.IDENTITY)
+	return mh
+}
+
+func (kf keyFormat) makeReverseKey(valKey []byte) multihash.Multihash {
+	// The value-key is an identity multihash of the value hash and the value
+	// key suffix. Replace the suffix to make the reverse key.
+	dm, err := multihash.Decode(valKey)
+	if err != nil {
+		panic(err)
+	}
+	digest := dm.Digest[:len(dm.Digest)-len(kf.value)]
+	var b bytes.Buffer
+	b.Grow(len(digest) + len(kf.reverse))
+	b.Write(digest)
+	b.Write(kf.reverse)
+	mh, _ := multihash.Encode(b.Bytes(), multihash.IDENTITY)
+	return mh
+}
+
+// makeReverseChunkKey makes the key of a chunk of the list of multihashes
+// mapped to a value. The first chunk is stored under the reverse key. The
+// others are stored under the value hash, the chunk number and the reverse
+// chunk key suffix.
+func (kf keyFormat) makeReverseChunkKey(valKey []byte, chunk int) multihash.Multihash {
+	if chunk == 0 {
+		return kf.makeReverseKey(valKey)
+	}
+	dm, err := multihash.Decode(valKey)
+	if err != nil {
+		panic(err)
+	}
+	digest := dm.Digest[:len(dm.Digest)-len(kf.value)]
+	var num [4]byte
+	binary.BigEndian.PutUint32(num[:], uint32(chunk))
+	var b bytes.Buffer
+	b.Grow(len(digest) + len(num) + len(kf.reverseChunk))
+	b.Write(digest)
+	b.Write(num[:])
+	b.Write(kf.reverseChunk)
+	mh, _ := multihash.Encode(b.Bytes(), multihash.IDENTITY)
+	return mh
+}
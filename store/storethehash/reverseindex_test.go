@@ -0,0 +1,346 @@
+package storethehash
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestIterProvider(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	if _, err := s.IterProvider(context.Background(), "some-provider"); err != ErrNoReverseIndex {
+		t.Fatal("expected ErrNoReverseIndex")
+	}
+	s.Close()
+
+	s = newStore(t, t.TempDir(), ReverseIndex(true))
+	test.E2ETest(t, s)
+	s.Close()
+	s = newStore(t, t.TempDir(), ReverseIndex(true))
+	test.RemoveProviderContextTest(t, s)
+	s.Close()
+	s = newStore(t, t.TempDir(), ReverseIndex(true))
+	test.RemoveProviderTest(t, s)
+	s.Close()
+
+	s = newStore(t, t.TempDir(), ReverseIndex(true))
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value1 := indexer.Value{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p1, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	value3 := indexer.Value{ProviderID: p2, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-3")}
+	mhs := test.RandomMultihashes(6)
+	if err = s.Put(value1, mhs[:3]...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(value2, mhs[2:4]...); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(value3, mhs[4:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	// collect returns the number of times each multihash was seen with each
+	// context ID.
+	collect := func(providerID peer.ID) map[string]int {
+		iter, err := s.IterProvider(context.Background(), providerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]int)
+		for {
+			m, vals, err := iter.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vals) != 1 || vals[0].ProviderID != providerID {
+				t.Fatal("got value for wrong provider")
+			}
+			seen[string(vals[0].ContextID)+m.B58String()]++
+		}
+		return seen
+	}
+
+	seen := collect(p1)
+	if len(seen) != 5 {
+		t.Fatalf("expected 5 multihash-value pairs, got %d", len(seen))
+	}
+	for _, m := range mhs[:3] {
+		if seen["ctxid-1"+m.B58String()] != 1 {
+			t.Fatal("missing multihash for value1")
+		}
+	}
+	for _, m := range mhs[2:4] {
+		if seen["ctxid-2"+m.B58String()] != 1 {
+			t.Fatal("missing multihash for value2")
+		}
+	}
+	if len(collect(p2)) != 2 {
+		t.Fatal("expected 2 multihash-value pairs for other provider")
+	}
+
+	if err = s.Remove(value1, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveProviderContext(p1, value2.ContextID); err != nil {
+		t.Fatal(err)
+	}
+	seen = collect(p1)
+	if len(seen) != 2 || seen["ctxid-1"+mhs[0].B58String()] != 0 {
+		t.Fatalf("wrong multihashes after removal: %v", seen)
+	}
+
+	if err = s.RemoveProvider(context.Background(), p1); err != nil {
+		t.Fatal(err)
+	}
+	if len(collect(p1)) != 0 {
+		t.Fatal("expected no multihashes after removing provider")
+	}
+	if len(collect(p2)) != 2 {
+		t.Fatal("other provider should not be affected")
+	}
+
+	// Iteration is cancelled with the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	iter, err := s.IterProvider(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = iter.Next(); err != context.Canceled {
+		t.Fatal("expected context.Canceled error")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReverseListChunks(t *testing.T) {
+	value := testValue(t)
+	s := newStore(t, t.TempDir(), ReverseIndex(true))
+	defer s.Close()
+	valKey := s.keys.makeValueKey(value)
+
+	checkList := func(chunks, items int) {
+		t.Helper()
+		s.lock(s.keys.makeReverseKey(valKey))
+		n, err := s.reverseChunkCount(valKey)
+		s.unlock(s.keys.makeReverseKey(valKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != chunks {
+			t.Fatalf("expected %d chunks, got %d", chunks, n)
+		}
+		list, err := s.getReverseList(valKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != items {
+			t.Fatalf("expected %d multihashes, got %d", items, len(list))
+		}
+	}
+
+	mhs := test.RandomMultihashes(2*reverseChunkSize + 100)
+	items := make([][]byte, len(mhs))
+	for i := range mhs {
+		items[i] = mhs[i]
+	}
+	for i := 0; i < len(items); i += 1000 {
+		end := i + 1000
+		if end > len(items) {
+			end = len(items)
+		}
+		if err := s.addToReverseList(valKey, items[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkList(3, len(items))
+
+	// Adding multihashes that are already in the last chunk changes nothing,
+	// and multihashes in earlier chunks are only returned once.
+	if err := s.addToReverseList(valKey, items[len(items)-10:]); err != nil {
+		t.Fatal(err)
+	}
+	checkList(3, len(items))
+	if err := s.addToReverseList(valKey, items[:10]); err != nil {
+		t.Fatal(err)
+	}
+	checkList(3, len(items))
+
+	// Emptying a chunk moves the last chunk into its place.
+	rmKeys := make(map[string]struct{})
+	for _, item := range items[:reverseChunkSize] {
+		rmKeys[string(item)] = struct{}{}
+	}
+	if err := s.removeFromReverseList(valKey, rmKeys); err != nil {
+		t.Fatal(err)
+	}
+	checkList(2, len(items)-reverseChunkSize)
+	list, err := s.getReverseList(valKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range list {
+		if _, ok := rmKeys[string(item)]; ok {
+			t.Fatal("removed multihash is still in list")
+		}
+	}
+
+	if err = s.removeReverseList(valKey); err != nil {
+		t.Fatal(err)
+	}
+	checkList(0, 0)
+}
+
+func TestProviderKeyPrefix(t *testing.T) {
+	// Ed25519 peer IDs all begin with the same bytes, so the provider keys
+	// must not, or they would all be stored in the same index bucket.
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte(p1)[:4], []byte(p2)[:4]) {
+		t.Fatal("expected peer IDs with the same leading bytes")
+	}
+	dm1, err := multihash.Decode(defaultKeys.makeProviderKey(p1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm2, err := multihash.Decode(defaultKeys.makeProviderKey(p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(dm1.Digest[:4], dm2.Digest[:4]) {
+		t.Fatal("provider keys have the same leading bytes")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	if err := s.Replace(indexer.Value{}); err != ErrNoReverseIndex {
+		t.Fatal("expected ErrNoReverseIndex")
+	}
+	s.Close()
+
+	s = newStore(t, t.TempDir(), ReverseIndex(true))
+	defer s.Close()
+
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(6)
+	if err := s.Put(value1, mhs[:4]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the multihashes of value1, with new metadata.
+	value1.MetadataBytes = []byte("meta-1-new")
+	if err := s.Replace(value1, mhs[2:]...); err != nil {
+		t.Fatal(err)
+	}
+
+	// mhs[0] keeps only value2.
+	vals, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 1 || !vals[0].Equal(value2) {
+		t.Fatal("expected multihash to map only to other value")
+	}
+	if _, found, err = s.Get(mhs[1]); err != nil || found {
+		t.Fatal("expected multihash removed from replaced value to be gone")
+	}
+	for _, m := range mhs[2:] {
+		vals, found, err = s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(value1) {
+			t.Fatal("expected multihash to map to replaced value")
+		}
+	}
+
+	// Replacing with no multihashes removes all of them from the value.
+	if err = s.Replace(value1); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mhs[1:] {
+		if _, found, err = s.Get(m); err != nil || found {
+			t.Fatal("expected all multihashes removed from value")
+		}
+	}
+	if _, found, _ = s.Get(mhs[0]); !found {
+		t.Fatal("expected multihash of other value to remain")
+	}
+}
+
+func TestMultihashesForValue(t *testing.T) {
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(6)
+
+	for _, reverse := range []bool{false, true} {
+		s := newStore(t, t.TempDir(), ReverseIndex(reverse))
+		if err := s.Put(value1, mhs[:4]...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(value2, mhs[2:]...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Remove(value1, mhs[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		// Metadata is ignored.
+		found, err := s.MultihashesForValue(context.Background(), indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 3 {
+			t.Fatalf("expected 3 multihashes, got %d", len(found))
+		}
+		expected := make(map[string]struct{})
+		for _, m := range mhs[1:4] {
+			expected[string(m)] = struct{}{}
+		}
+		for _, m := range found {
+			if _, ok := expected[string(m)]; !ok {
+				t.Fatal("got multihash that does not map to value")
+			}
+		}
+
+		found, err = s.MultihashesForValue(context.Background(), indexer.Value{ProviderID: p, ContextID: []byte("ctxid-3")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 0 {
+			t.Fatal("expected no multihashes for unknown value")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err = s.MultihashesForValue(ctx, value2); err != context.Canceled {
+			t.Fatalf("expected context canceled error, got %v", err)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,20 @@
+package storethehash
+
+import "time"
+
+// Names of the operations reported to the OnSlowOp function.
+const (
+	SlowOpGet            = "Get"
+	SlowOpPut            = "Put"
+	SlowOpRemoveProvider = "RemoveProvider"
+)
+
+// checkSlowOp calls the OnSlowOp function if the operation that started at
+// start took longer than the slow operation threshold. This is deferred by
+// operations only when there is an OnSlowOp function, so that there is no
+// cost otherwise.
+func (s *Store) checkSlowOp(op string, start time.Time, mhCount int) {
+	if d := time.Since(start); d >= s.slowOpThreshold {
+		s.onSlowOp(op, d, mhCount)
+	}
+}
@@ -0,0 +1,68 @@
+package storethehash
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestOnSlowOp(t *testing.T) {
+	type slowOp struct {
+		op      string
+		mhCount int
+	}
+	var ops []slowOp
+	hook := func(op string, d time.Duration, mhCount int) {
+		ops = append(ops, slowOp{op, mhCount})
+	}
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(3)
+
+	runOps := func(s *Store) {
+		t.Helper()
+		if err := s.Put(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Get(mhs[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveProvider(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With no threshold, every operation is slow.
+	s := newStore(t, t.TempDir(), OnSlowOp(hook), SlowOpThreshold(0))
+	runOps(s)
+	s.Close()
+	expect := []slowOp{
+		{SlowOpPut, len(mhs)},
+		{SlowOpGet, 1},
+		{SlowOpRemoveProvider, 0},
+	}
+	if len(ops) != len(expect) {
+		t.Fatalf("expected %d slow operations, got %d", len(expect), len(ops))
+	}
+	for i := range expect {
+		if ops[i] != expect[i] {
+			t.Fatalf("expected slow operation %v, got %v", expect[i], ops[i])
+		}
+	}
+
+	// Fast operations are not reported.
+	ops = nil
+	s = newStore(t, t.TempDir(), OnSlowOp(hook), SlowOpThreshold(time.Hour))
+	defer s.Close()
+	runOps(s)
+	if len(ops) != 0 {
+		t.Fatalf("expected no slow operations, got %d", len(ops))
+	}
+}
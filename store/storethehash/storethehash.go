@@ -3,255 +3,1540 @@ package storethehash
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/metrics"
 	"github.com/gammazero/keymutex"
+	logging "github.com/ipfs/go-log/v2"
 	sth "github.com/ipld/go-storethehash/store"
 	"github.com/ipld/go-storethehash/store/primary"
 	mhprimary "github.com/ipld/go-storethehash/store/primary/multihash"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/multiformats/go-multihash"
+	"github.com/syndtr/goleveldb/leveldb"
+	"go.opencensus.io/stats"
 	"golang.org/x/crypto/blake2b"
 )
 
+// Names of the storethehash index and data files. The index is made up of
+// several files that all start with indexFileName.
+const (
+	indexFileName = "storethehash.index"
+	dataFileName  = "storethehash.data"
+)
+
 // valueKeySize is the number of bytes of hash(providerID + contextID) used as
 // key to lookup values.
 const valueKeySize = 20
 
+var log = logging.Logger("indexer-core/storethehash")
+
 var (
 	indexKeySuffix = []byte("I")
 	valueKeySuffix = []byte("M")
 )
 
-type sthStorage struct {
-	dir     string
-	store   *sth.Store
-	mlk     *keymutex.KeyMutex
-	valLock sync.RWMutex
+// namespaceKeyTag is the last byte of every key written by a store with a
+// Namespace. No kind suffix uses this byte, so the keys of a store with no
+// namespace, which end with a kind suffix, never match the keys of a store
+// with one.
+const namespaceKeyTag = 'N'
+
+// maxNamespaceLen is the longest namespace, which is limited by the one byte
+// that records its length in each key.
+const maxNamespaceLen = 255
+
+// keyFormat holds the suffix added to each kind of key that the store writes.
+// With no Namespace, the suffix is the one-byte kind suffix. With a namespace,
+// the suffix is the kind suffix, the namespace, one byte with the length of
+// the namespace, and namespaceKeyTag. Because the length and tag are at fixed
+// positions from the end of the key, a key only ends with the suffix of one
+// namespace.
+type keyFormat struct {
+	index        []byte
+	value        []byte
+	provider     []byte
+	reverse      []byte
+	reverseChunk []byte
+}
+
+// defaultKeys is the key format of a store with no namespace.
+var defaultKeys = newKeyFormat("")
+
+func newKeyFormat(namespace string) keyFormat {
+	suffix := func(kind []byte) []byte {
+		if namespace == "" {
+			return kind
+		}
+		b := make([]byte, 0, len(kind)+len(namespace)+2)
+		b = append(b, kind...)
+		b = append(b, namespace...)
+		return append(b, byte(len(namespace)), namespaceKeyTag)
+	}
+	return keyFormat{
+		index:        suffix(indexKeySuffix),
+		value:        suffix(valueKeySuffix),
+		provider:     suffix(providerKeySuffix),
+		reverse:      suffix(reverseKeySuffix),
+		reverseChunk: suffix(reverseChunkKeySuffix),
+	}
+}
 
-	primary *mhprimary.MultihashPrimary
+// Store is a storethehash-based value store that implements
+// indexer.Interface.
+type Store struct {
+	// prunedValueKeys, corruptValues, pendingWrites, the lock wait times and
+	// the value-key list statistics are first in the struct for 64-bit
+	// alignment on 32-bit platforms, since they are updated atomically.
+	prunedValueKeys uint64
+	corruptValues   uint64
+	pendingWrites   uint64
+	valueLockWait   uint64
+	keyLockWait     uint64
+	valueKeyLists   uint64
+	valueKeysTotal  uint64
+	maxValueKeys    uint64
+
+	dir      string
+	dataPath string
+	store    *sth.Store
+	mlk      *keymutex.KeyMutex
+	// valLock is held for reading by operations on individual values, which
+	// also lock the value-key in vlk, and is held for writing by operations
+	// that remove many values.
+	valLock sync.RWMutex
+	vlk     *keymutex.KeyMutex
+	// orphanLock is held for reading by puts and for writing while removing
+	// values that no multihash maps to, if removeOrphanValues is enabled.
+	orphanLock sync.RWMutex
+	// replaceLocks are held for reading by puts and for writing by Replace, so
+	// that puts of a value wait while Replace puts the value and removes its
+	// stale multihashes. Each value uses the lock selected by its value-key.
+	replaceLocks [replaceLockCount]sync.RWMutex
+
+	primary            primary.PrimaryStorage
+	mergeFunc          MergeFunc
+	putConcurrency     int
+	valueCache         *valueCache
+	coalescer          *indexCoalescer
+	onPut              func(indexer.Value, int)
+	flushEvery         uint64
+	reverseIndex       bool
+	timestamps         bool
+	lockTiming         bool
+	opTimeout          time.Duration
+	removeBatchSize    int
+	removeOrphanValues bool
+	ordered            *leveldb.DB
+	mdCodec            indexer.MetadataCodec
+	sortValues         bool
+	indexCount         *hyperLogLog
+	skipDupCheck       bool
+	maxValues          int
+	wal                *writeLog
+	packValueKeys      bool
+	slowOpThreshold    time.Duration
+	onSlowOp           func(string, time.Duration, int)
+	keys               keyFormat
+	skipCorruptValues  bool
+	pruneCorruptValues bool
+	sizeAfterFlush     bool
+	now                func() time.Time
+
+	closeMutex   sync.RWMutex
+	closed       bool
+	closeTimeout time.Duration
+	opWait       sync.WaitGroup
+	// shutdownMutex is held by Close, and shutDown is set once Close has
+	// closed the underlying storage.
+	shutdownMutex sync.Mutex
+	shutDown      bool
+
+	// stopWatch and watchDone stop the goroutine that watches for sync
+	// errors. Both are nil if there is no OnSyncError handler.
+	stopWatch chan struct{}
+	watchDone chan struct{}
+	// stopWALSync and walSyncDone stop the goroutine that clears the
+	// write-ahead log at the sync interval. Both are nil if there is no
+	// write-ahead log.
+	stopWALSync chan struct{}
+	walSyncDone chan struct{}
 }
 
 type sthIterator struct {
+	ctx      context.Context
 	iter     primary.PrimaryStorageIter
-	storage  *sthStorage
+	storage  *Store
 	uniqKeys map[string]struct{}
+	scanned  uint64
+	total    uint64
+	// values holds the values decoded during iteration, so that a value
+	// shared by many multihashes is not decoded for each of them.
+	values *valueCache
+	// shard and shards select the multihashes that the iterator returns, if
+	// shards is not 0. See IterShards.
+	shard  uint32
+	shards uint32
 }
 
+// iterValueCacheSize is the number of decoded values kept by an iterator.
+const iterValueCacheSize = 4096
+
+var _ indexer.Interface = &Store{}
+
 // New creates a new indexer.Interface implemented by a storethehash-based
-// value store.
+// value store. The methods that are not part of indexer.Interface are reached
+// through a type assertion to *Store.
 func New(ctx context.Context, dir string, options ...Option) (indexer.Interface, error) {
+	s, err := openStore(ctx, dir, options...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStore opens the storethehash-based value store returned by New.
+func openStore(ctx context.Context, dir string, options ...Option) (*Store, error) {
+	cfg := newConfig(dir, options)
+	if len(cfg.namespace) > maxNamespaceLen {
+		return nil, fmt.Errorf("namespace is longer than %d bytes", maxNamespaceLen)
+	}
+
+	if err := checkWritableDir(cfg.indexDir); err != nil {
+		return nil, fmt.Errorf("bad index directory: %w", err)
+	}
+	if cfg.dataDir != cfg.indexDir {
+		if err := checkWritableDir(cfg.dataDir); err != nil {
+			return nil, fmt.Errorf("bad data directory: %w", err)
+		}
+	}
+	marker := storeMarker{FormatVersion: FormatVersion, IndexKeys: indexKeysReversed, Namespace: cfg.namespace}
+	if cfg.namespace != "" {
+		marker.NamespaceKeys = namespaceKeysTagged
+	}
+	if err := checkMarker(cfg.indexDir, marker); err != nil {
+		return nil, err
+	}
+
 	// Using a single file to store index and data. This may change in the
 	// future, and we may choose to set a max. size to files. Having several
 	// files for storage increases complexity but minimizes the overhead of
 	// compaction (once we have it)
-	indexPath := filepath.Join(dir, "storethehash.index")
-	dataPath := filepath.Join(dir, "storethehash.data")
-	primary, err := mhprimary.OpenMultihashPrimary(dataPath)
+	indexPath := filepath.Join(cfg.indexDir, indexFileName)
+	var dataPath string
+	var primaryStorage primary.PrimaryStorage
+	if cfg.primarySet {
+		if cfg.primary == nil {
+			return nil, errors.New("nil primary storage")
+		}
+		primaryStorage = cfg.primary
+	} else {
+		dataPath = filepath.Join(cfg.dataDir, dataFileName)
+		var err error
+		primaryStorage, err = mhprimary.OpenMultihashPrimary(dataPath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening storethehash primary: %w", err)
+		}
+	}
+
+	s, err := sth.OpenStore(ctx, indexPath, primaryStorage, cfg.indexSizeBits, cfg.indexFileSize, cfg.syncInterval, cfg.burstRate, cfg.gcInterval, false)
+	if err != nil {
+		return nil, fmt.Errorf("error opening storethehash index: %w", err)
+	}
+	s.Start()
+	st := &Store{
+		dir:                dir,
+		dataPath:           dataPath,
+		store:              s,
+		mlk:                keymutex.New(0),
+		vlk:                keymutex.New(0),
+		primary:            primaryStorage,
+		mergeFunc:          cfg.mergeFunc,
+		putConcurrency:     cfg.putConcurrency,
+		valueCache:         newValueCache(cfg.valueCacheSize),
+		flushEvery:         cfg.flushEvery,
+		reverseIndex:       cfg.reverseIndex,
+		timestamps:         cfg.timestamps,
+		lockTiming:         cfg.lockTiming,
+		opTimeout:          cfg.opTimeout,
+		removeBatchSize:    cfg.removeBatchSize,
+		removeOrphanValues: cfg.removeOrphanValues,
+		mdCodec:            cfg.mdCodec,
+		sortValues:         cfg.sortValues,
+		skipDupCheck:       cfg.skipDupCheck,
+		maxValues:          cfg.maxValues,
+		packValueKeys:      cfg.packValueKeys,
+		slowOpThreshold:    cfg.slowOpThreshold,
+		onSlowOp:           cfg.onSlowOp,
+		keys:               newKeyFormat(cfg.namespace),
+		skipCorruptValues:  cfg.skipCorruptValues || cfg.pruneCorruptValues,
+		pruneCorruptValues: cfg.pruneCorruptValues,
+		sizeAfterFlush:     cfg.sizeAfterFlush,
+		now:                time.Now,
+		closeTimeout:       cfg.closeTimeout,
+	}
+	if cfg.orderedIndex {
+		if err = st.openOrderedIndex(cfg.indexDir); err != nil {
+			if st.ordered != nil {
+				st.ordered.Close()
+			}
+			s.Close()
+			return nil, err
+		}
+	}
+	if cfg.wal {
+		if err = st.replayWriteLog(filepath.Join(cfg.indexDir, walFileName)); err != nil {
+			if st.ordered != nil {
+				st.ordered.Close()
+			}
+			s.Close()
+			return nil, err
+		}
+	}
+	// The OnPut hook is set after the write-ahead log is replayed, so that it
+	// is not called again for puts that it was already called for.
+	st.onPut = cfg.onPut
+	if cfg.indexCountSketch {
+		if err = st.buildIndexCount(); err != nil {
+			if st.wal != nil {
+				st.wal.close()
+			}
+			if st.ordered != nil {
+				st.ordered.Close()
+			}
+			s.Close()
+			return nil, err
+		}
+	}
+	if cfg.coalesceWindow > 0 {
+		st.coalescer = newIndexCoalescer(st, cfg.coalesceWindow, cfg.putConcurrency)
+	}
+	if cfg.onSyncError != nil {
+		st.stopWatch = make(chan struct{})
+		st.watchDone = make(chan struct{})
+		go st.watchSyncErrors(cfg.syncInterval, cfg.onSyncError)
+	}
+	if st.wal != nil && cfg.syncInterval > 0 {
+		st.stopWALSync = make(chan struct{})
+		st.walSyncDone = make(chan struct{})
+		go st.syncWriteLog(cfg.syncInterval)
+	}
+	return st, nil
+}
+
+// syncWriteLog flushes the store and clears the write-ahead log every
+// interval. The store syncs its writes to disk at the same interval, and the
+// log only needs to hold the writes that are not yet on disk, so this keeps
+// replay from making again the writes that were already synced.
+func (s *Store) syncWriteLog(interval time.Duration) {
+	defer close(s.walSyncDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flushWriteLog(); err != nil {
+				log.Warnw("Cannot clear write-ahead log", "err", err)
+			}
+		case <-s.stopWALSync:
+			return
+		}
+	}
+}
+
+// watchSyncErrors checks the store for an error every interval, and calls
+// handler when there is an error that is different from the last error.
+func (s *Store) watchSyncErrors(interval time.Duration, handler func(error)) {
+	defer close(s.watchDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-ticker.C:
+			err := s.store.Err()
+			// Each failed sync sets a new error, so only call the handler
+			// when the error is different from the last one seen.
+			if err != nil && (lastErr == nil || err.Error() != lastErr.Error()) {
+				handler(err)
+			}
+			lastErr = err
+		case <-s.stopWatch:
+			return
+		}
+	}
+}
+
+func (s *Store) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, false, err
+	}
+	defer s.end()
+
+	if s.onSlowOp != nil {
+		defer s.checkSlowOp(SlowOpGet, time.Now(), 1)
+	}
+	return s.get(s.keys.makeIndexKey(m))
+}
+
+// GetForProvider gets only the values of the specified provider that the
+// multihash maps to. Values of other providers are skipped without being fully
+// decoded.
+func (s *Store) GetForProvider(m multihash.Multihash, providerID peer.ID) ([]indexer.Value, bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, false, err
+	}
+	defer s.end()
+
+	k := s.keys.makeIndexKey(m)
+	valueKeys, err := s.getValueKeys(k)
 	if err != nil {
-		return nil, fmt.Errorf("error opening storethehash primary: %w", err)
+		return nil, false, err
+	}
+	if valueKeys == nil {
+		return nil, false, nil
 	}
 
-	cfg := config{
-		indexSizeBits: defaultIndexSizeBits,
-		indexFileSize: defaultIndexFileSize,
-		syncInterval:  defaultSyncInterval,
-		burstRate:     defaultBurstRate,
-		gcInterval:    defaultGCInterval,
+	values, _, err := s.getProviderValues(k, valueKeys, providerID)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot get values for multihash: %w", err)
+	}
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+	if s.sortValues {
+		sortValues(values)
 	}
-	cfg.apply(options)
+	return values, true, nil
+}
+
+// ValueWithKey is a value along with the value-key that identifies the value
+// record in the store. Multihashes that map to the same value have the same
+// value-key.
+type ValueWithKey struct {
+	Value indexer.Value
+	Key   []byte
+}
 
-	s, err := sth.OpenStore(ctx, indexPath, primary, cfg.indexSizeBits, cfg.indexFileSize, cfg.syncInterval, cfg.burstRate, cfg.gcInterval, false)
+// GetWithKeys is the same as Get, but returns the value-key of each value
+// along with the value.
+func (s *Store) GetWithKeys(m multihash.Multihash) ([]ValueWithKey, bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, false, err
+	}
+	defer s.end()
+
+	k := s.keys.makeIndexKey(m)
+	valueKeys, err := s.getValueKeys(k)
 	if err != nil {
-		return nil, fmt.Errorf("error opening storethehash index: %w", err)
+		return nil, false, err
+	}
+	if valueKeys == nil {
+		return nil, false, nil
+	}
+	s.observeValueKeys(len(valueKeys))
+
+	values, keys, err := s.getProviderValues(k, valueKeys, "")
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot get values for multihash: %w", err)
+	}
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+	vks := make([]ValueWithKey, len(values))
+	for i := range values {
+		vks[i] = ValueWithKey{
+			Value: values[i],
+			Key:   keys[i],
+		}
+	}
+	if s.sortValues {
+		sort.Slice(vks, func(i, j int) bool {
+			return lessValue(vks[i].Value, vks[j].Value)
+		})
+	}
+	return vks, true, nil
+}
+
+// ValueKeys returns the value-keys that a multihash maps to, without reading
+// the values. These are the same keys returned by GetWithKeys, and can be
+// compared to find multihashes that map to the same values. A value-key may
+// refer to a value that was removed, since references to removed values are
+// only pruned when the values are read. Returns false if the multihash is not
+// in the store.
+func (s *Store) ValueKeys(m multihash.Multihash) ([][]byte, bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, false, err
+	}
+	defer s.end()
+
+	valueKeys, err := s.getValueKeys(s.keys.makeIndexKey(m))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(valueKeys) == 0 {
+		return nil, false, nil
+	}
+	return valueKeys, true, nil
+}
+
+// HasBatch reports whether each of the multihashes is in the store. The
+// returned slice has one element for each multihash, in the same order. This
+// only checks the index, and does not read the values, so it is much cheaper
+// than calling Get for each multihash. Like ValueKeys, a multihash that only
+// maps to values that were removed may be reported as present until its values
+// are read.
+func (s *Store) HasBatch(mhs []multihash.Multihash) ([]bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
+
+	found := make([]bool, len(mhs))
+	for i, m := range mhs {
+		has, err := s.store.Has(s.keys.makeIndexKey(m))
+		if err != nil {
+			return nil, fmt.Errorf("cannot check multihash in store: %w", err)
+		}
+		found[i] = has
+	}
+	return found, nil
+}
+
+// Put stores the value and maps the multihashes to it. If the value has the
+// same provider ID and context ID as a stored value, then the stored value is
+// updated.
+//
+// Put with no multihashes only updates a stored value. If there is no stored
+// value with the same provider ID and context ID, then nothing is stored and no
+// error is returned. Use RegisterValue to store a value without multihashes.
+func (s *Store) Put(value indexer.Value, mhs ...multihash.Multihash) error {
+	_, err := s.PutReturningPrevious(value, mhs...)
+	return err
+}
+
+// PutReturningPrevious is the same as Put, and also returns the value record
+// that was replaced. If there was no previous value for the provider and
+// context ID, or the previous value was not changed, then nil is returned.
+func (s *Store) PutReturningPrevious(value indexer.Value, mhs ...multihash.Multihash) (*indexer.Value, error) {
+	prev, _, err := s.put(value, mhs, nil)
+	return prev, err
+}
+
+// PutMany is the same as Put, and also returns the number of multihashes that
+// were newly mapped to the value. Multihashes that were already mapped to the
+// value are not counted.
+//
+// The value record is read and written at most once for the whole set of
+// multihashes, however many there are. Only the value-key list of each
+// multihash is read and written per multihash.
+func (s *Store) PutMany(value indexer.Value, mhs []multihash.Multihash) (int, error) {
+	_, added, err := s.put(value, mhs, nil)
+	return added, err
+}
+
+// ErrDuplicatePut is returned by PutStrict when some of the multihashes were
+// already mapped to the value.
+var ErrDuplicatePut = errors.New("multihashes already mapped to value")
+
+// PutStrict is the same as PutMany, but reports the multihashes that were
+// already mapped to the value instead of silently skipping them. It returns
+// the number of multihashes that were newly mapped to the value and the number
+// that were already mapped to it. If any were already mapped, then the error
+// wraps ErrDuplicatePut, and the new mappings are still stored. A multihash
+// given more than once is counted as already mapped after the first time.
+//
+// With the SkipDuplicateCheck option, duplicates are not detected, so all
+// multihashes are counted as newly mapped.
+func (s *Store) PutStrict(value indexer.Value, mhs ...multihash.Multihash) (int, int, error) {
+	_, added, err := s.put(value, mhs, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dups := len(mhs) - added; dups != 0 {
+		return added, dups, fmt.Errorf("%d of %d multihashes: %w", dups, len(mhs), ErrDuplicatePut)
+	}
+	return added, 0, nil
+}
+
+// RegisterValue stores the value without mapping any multihashes to it, or
+// updates the stored value that has the same provider ID and context ID.
+// Multihashes can be mapped to the value later with Put.
+func (s *Store) RegisterValue(value indexer.Value) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	done, err := s.logWrite(walRecord{op: walRegister, value: value})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if _, _, err := s.updateValue(value, true); err != nil {
+		return fmt.Errorf("cannot store value: %w", err)
+	}
+	return s.countWrite()
+}
+
+// streamBatchSize is the number of multihashes that PutStream puts at a time.
+const streamBatchSize = 1024
+
+// PutStream is the same as PutMany, but reads the multihashes from a channel
+// until it is closed, so that the multihashes do not all need to be held in
+// memory. The multihashes are put in batches of up to streamBatchSize, each
+// the same as a call to PutMany, so all of the options that apply to Put also
+// apply to each batch. A batch is put when it is full, when the channel is
+// closed, or when the context is canceled. Returns the number of multihashes
+// that were newly mapped to the value.
+//
+// If the context is canceled, then PutStream stops reading the channel and
+// returns the context's error. Multihashes received before then are stored.
+// The store only waits for the batch being put when it is closed, not for the
+// rest of the stream.
+func (s *Store) PutStream(ctx context.Context, value indexer.Value, mhs <-chan multihash.Multihash) (uint64, error) {
+	var added uint64
+	batch := make([]multihash.Multihash, 0, streamBatchSize)
+	putBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, n, err := s.put(value, batch, nil)
+		added += uint64(n)
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := putBatch(); err != nil {
+				return added, err
+			}
+			return added, ctx.Err()
+		case m, ok := <-mhs:
+			if !ok {
+				return added, putBatch()
+			}
+			batch = append(batch, m)
+			if len(batch) == streamBatchSize {
+				if err := putBatch(); err != nil {
+					return added, err
+				}
+			}
+		}
+	}
+}
+
+// PutNew is a faster Put for the initial load of an empty store. It writes
+// each multihash's index entry without first reading the existing entry, so
+// each multihash is mapped only to the given value, replacing anything that it
+// was previously mapped to.
+//
+// PutNew must not be used on a store that already has data, or to put a
+// multihash that was put before, since that silently drops the multihash's
+// mappings to other values.
+func (s *Store) PutNew(value indexer.Value, mhs ...multihash.Multihash) error {
+	_, _, err := s.put(value, mhs, s.putNewIndex)
+	return err
+}
+
+// put stores the value and maps the multihashes to it using putIndex. It
+// returns the previous value if that was changed, and the number of
+// multihashes newly mapped to the value. If putIndex is nil, the value is added
+// to the existing value-keys of each multihash, coalescing the index writes if
+// CoalesceWindow is set.
+func (s *Store) put(value indexer.Value, mhs []multihash.Multihash, putIndex func(multihash.Multihash, []byte) (bool, error)) (*indexer.Value, int, error) {
+	if err := s.begin(); err != nil {
+		return nil, 0, err
+	}
+	defer s.end()
+
+	if s.onSlowOp != nil {
+		defer s.checkSlowOp(SlowOpPut, time.Now(), len(mhs))
+	}
+
+	op := walPut
+	if putIndex != nil {
+		op = walPutNew
+	}
+	done, err := s.logWrite(walRecord{op: op, value: value, mhs: mhs})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer done()
+
+	rl := s.replaceLock(s.keys.makeValueKey(value))
+	rl.RLock()
+	defer rl.RUnlock()
+
+	return s.putLocked(value, mhs, putIndex)
+}
+
+// putLocked stores the value and maps the multihashes to it, without logging
+// the write. The caller must hold the value's replace lock.
+func (s *Store) putLocked(value indexer.Value, mhs []multihash.Multihash, putIndex func(multihash.Multihash, []byte) (bool, error)) (*indexer.Value, int, error) {
+	if s.removeOrphanValues {
+		s.orphanLock.RLock()
+		defer s.orphanLock.RUnlock()
+	}
+
+	valKey, prev, err := s.updateValue(value, len(mhs) != 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot store value: %w", err)
+	}
+
+	coalesce := putIndex == nil && s.coalescer != nil
+	if putIndex == nil {
+		putIndex = s.putIndex
+	}
+
+	var added int
+	if coalesce && len(mhs) != 0 {
+		added, err = s.coalescer.putIndexes(mhs, valKey)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else if s.putConcurrency > 1 && len(mhs) > 1 {
+		added, err = s.putIndexes(mhs, valKey, putIndex)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		for i := range mhs {
+			ok, err := putIndex(mhs[i], valKey)
+			if err != nil {
+				return nil, 0, fmt.Errorf("cannot store index: %w", err)
+			}
+			if ok {
+				added++
+			}
+		}
+	}
+
+	if err = s.indexMultihashes(valKey, mhs); err != nil {
+		return nil, 0, fmt.Errorf("cannot update reverse index: %w", err)
+	}
+	if err = s.orderMultihashes(mhs); err != nil {
+		return nil, 0, fmt.Errorf("cannot update ordered index: %w", err)
+	}
+	if err = s.countWrite(); err != nil {
+		return nil, 0, err
+	}
+	if s.onPut != nil {
+		s.onPut(value, len(mhs))
+	}
+	return prev, added, nil
+}
+
+// putIndexes writes the index entries for the multihashes by calling putIndex
+// from putConcurrency goroutines, and returns the number of entries added.
+// Each putIndex locks its own index key, so duplicate multihashes are still
+// only mapped to the value once. All multihashes are attempted even if some
+// fail, and the first error is returned along with the number of failures.
+func (s *Store) putIndexes(mhs []multihash.Multihash, valKey []byte, putIndex func(multihash.Multihash, []byte) (bool, error)) (int, error) {
+	workers := s.putConcurrency
+	if workers > len(mhs) {
+		workers = len(mhs)
+	}
+
+	var (
+		errMutex sync.Mutex
+		firstErr error
+		errCount int
+		added    int
+		wg       sync.WaitGroup
+	)
+	mhChan := make(chan multihash.Multihash)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for m := range mhChan {
+				ok, err := putIndex(m, valKey)
+				errMutex.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					errCount++
+				} else if ok {
+					added++
+				}
+				errMutex.Unlock()
+			}
+		}()
+	}
+	for i := range mhs {
+		mhChan <- mhs[i]
+	}
+	close(mhChan)
+	wg.Wait()
+
+	if firstErr != nil {
+		if errCount > 1 {
+			return 0, fmt.Errorf("cannot store %d indexes: %w", errCount, firstErr)
+		}
+		return 0, fmt.Errorf("cannot store index: %w", firstErr)
+	}
+	return added, nil
+}
+
+func (s *Store) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	done, err := s.logWrite(walRecord{op: walRemove, value: value, mhs: mhs})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for i := range mhs {
+		err := s.removeIndex(mhs[i], value)
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.unindexMultihashes(s.keys.makeValueKey(value), mhs); err != nil {
+		return err
+	}
+	if err := s.removeOrphans([]indexer.Value{value}); err != nil {
+		return err
+	}
+	return s.countWrite()
+}
+
+// RemoveBatch removes the mapping of each group of multihashes in mhs to the
+// value at the same position in values. The value-keys list of each multihash
+// is only read and rewritten once, no matter how many of the values it is
+// mapped to are removed.
+func (s *Store) RemoveBatch(values []indexer.Value, mhs ...[]multihash.Multihash) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	if len(values) != len(mhs) {
+		return fmt.Errorf("number of values (%d) does not match number of multihash groups (%d)", len(values), len(mhs))
+	}
+
+	recs := make([]walRecord, len(values))
+	for i := range values {
+		recs[i] = walRecord{op: walRemove, value: values[i], mhs: mhs[i]}
+	}
+	done, err := s.logWrite(recs...)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// Collect the value-keys to remove from each index key, keeping the order
+	// in which index keys were first seen.
+	var indexKeys []multihash.Multihash
+	rmKeys := make(map[string]map[string]struct{})
+	for i := range values {
+		valKey := string(s.keys.makeValueKey(values[i]))
+		for _, m := range mhs[i] {
+			k := s.keys.makeIndexKey(m)
+			keys, ok := rmKeys[string(k)]
+			if !ok {
+				keys = make(map[string]struct{})
+				rmKeys[string(k)] = keys
+				indexKeys = append(indexKeys, k)
+			}
+			keys[valKey] = struct{}{}
+		}
+	}
+
+	for _, k := range indexKeys {
+		err := s.removeValueKeys(k, rmKeys[string(k)])
+		if err != nil {
+			return err
+		}
+	}
+	for i := range values {
+		if err := s.unindexMultihashes(s.keys.makeValueKey(values[i]), mhs[i]); err != nil {
+			return err
+		}
+	}
+	if err := s.removeOrphans(values); err != nil {
+		return err
+	}
+	return s.countWrite()
+}
+
+func (s *Store) RemoveProvider(ctx context.Context, providerID peer.ID) error {
+	_, err := s.RemoveProviderCount(ctx, providerID)
+	return err
+}
+
+// RemoveProviderCount is the same as RemoveProvider, and also returns the
+// number of value records that were removed.
+func (s *Store) RemoveProviderCount(ctx context.Context, providerID peer.ID) (uint64, error) {
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+	defer s.end()
+
+	if s.onSlowOp != nil {
+		defer s.checkSlowOp(SlowOpRemoveProvider, time.Now(), 0)
+	}
+
+	done, err := s.logLongWrite(walRecord{op: walRemoveProvider, providerID: providerID})
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	s.lockValues()
+	defer s.valLock.Unlock()
+
+	var count uint64
+	err = s.scanProviderValues(ctx, providerID, s.removeBatchSize, func(key []byte) error {
+		// Delete the value of the provider being removed.
+		s.valueCache.remove(key)
+		removed, err := s.removeWithTimeout(key)
+		if err != nil {
+			return err
+		}
+		if removed {
+			count++
+		}
+		if s.reverseIndex {
+			return s.removeReverseList(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if s.reverseIndex {
+		_, err = s.removeWithTimeout(s.keys.makeProviderKey(providerID))
+	}
+	return count, err
+}
+
+// RemoveValuesOlderThan removes the values that were last put before the
+// given time, and returns the number of values removed. This expires the
+// values of providers that have stopped re-advertising their content. Index
+// entries that refer to removed values are pruned when they are next read.
+//
+// Only values stored with a time, by a store opened with the ValueTimestamps
+// option, are removed. Values stored without a time are kept until they are
+// put again with timestamps enabled.
+func (s *Store) RemoveValuesOlderThan(ctx context.Context, t time.Time) (uint64, error) {
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+	defer s.end()
+
+	done, err := s.logLongWrite(walRecord{op: walRemoveValuesOlderThan, time: t})
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	s.lockValues()
+	defer s.valLock.Unlock()
+
+	var removed uint64
+	err = s.scanValues(ctx, 0, func(key, valueData []byte) error {
+		value, updated, err := indexer.UnmarshalValueTime(valueData)
+		if err != nil {
+			return err
+		}
+		if updated.IsZero() || !updated.Before(t) {
+			return nil
+		}
+		s.valueCache.remove(key)
+		if _, err = s.removeWithTimeout(key); err != nil {
+			return err
+		}
+		if err = s.unindexValue(value.ProviderID, key); err != nil {
+			return fmt.Errorf("cannot update reverse index: %w", err)
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.countWrite()
+}
+
+// ProviderRemovalEstimate describes the records that RemoveProvider would
+// delete for a provider.
+type ProviderRemovalEstimate struct {
+	// Values is the number of value records stored for the provider.
+	Values int
+	// Indexes is the number of multihashes mapped to the provider's values,
+	// counted once for each value, as recorded in the reverse index. It is
+	// zero if the ReverseIndex option is not enabled.
+	Indexes int
+}
+
+// CountProviderRecords performs the same scan as RemoveProvider, but only
+// counts the records belonging to the provider instead of removing them.
+//
+// With the ReverseIndex option, the multihashes mapped to the provider's
+// values are counted from the reverse index, which may include multihashes
+// whose index entries were pruned. Without it, they are not counted, since
+// that would read every multihash in the store. RemoveProvider does not
+// delete index entries; their references to removed values are pruned when
+// they are next read.
+func (s *Store) CountProviderRecords(ctx context.Context, providerID peer.ID) (ProviderRemovalEstimate, error) {
+	if err := s.begin(); err != nil {
+		return ProviderRemovalEstimate{}, err
+	}
+	defer s.end()
+
+	s.rlockValues()
+	defer s.valLock.RUnlock()
+
+	// The primary storage may hold more than one record for the same key, if
+	// that key was updated, so count each key only once.
+	seen := make(map[string]struct{})
+	err := s.scanProviderValues(ctx, providerID, 0, func(key []byte) error {
+		seen[string(key)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return ProviderRemovalEstimate{}, err
+	}
+	est := ProviderRemovalEstimate{
+		Values: len(seen),
+	}
+	if !s.reverseIndex {
+		return est, nil
+	}
+	for key := range seen {
+		if err = ctx.Err(); err != nil {
+			return ProviderRemovalEstimate{}, err
+		}
+		mhs, err := s.getReverseList([]byte(key))
+		if err != nil {
+			return ProviderRemovalEstimate{}, err
+		}
+		est.Indexes += len(mhs)
+	}
+	return est, nil
+}
+
+// scanProviderValues iterates through all records in the primary storage and
+// calls valueFunc with the key of each stored value that belongs to the
+// specified provider. The caller must hold valLock, as described by scanValues.
+func (s *Store) scanProviderValues(ctx context.Context, providerID peer.ID, batchSize int, valueFunc func([]byte) error) error {
+	return s.scanValues(ctx, batchSize, func(key, valueData []byte) error {
+		// Skip the value if the provider is different than the one being
+		// scanned for.
+		value, err := indexer.UnmarshalValue(valueData)
+		if err != nil {
+			return err
+		}
+		if value.ProviderID != providerID {
+			return nil
+		}
+		return valueFunc(key)
+	})
+}
+
+// scanValues iterates through all records in the primary storage and calls
+// valueFunc with the key and the current data of each stored value. The caller
+// must hold valLock.
+//
+// If batchSize is greater than 0, then the caller must hold valLock for
+// writing, and valLock is released and acquired again after every batchSize
+// values, so that other operations on values are not blocked for the whole
+// scan. The same primary iterator is used for all batches, so that the scan
+// continues from where the previous batch stopped. Records are appended to
+// the primary storage, so values that are put between batches are scanned if
+// they are flushed to the primary storage before the iterator reaches its end.
+func (s *Store) scanValues(ctx context.Context, batchSize int, valueFunc func(key, valueData []byte) error) error {
+	s.flush()
+	iter, err := s.primary.Iter()
+	if err != nil {
+		return err
+	}
+
+	var count, inBatch int
+	for {
+		if count%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		count++
+
+		// Iterate through all stored items, examining values and skipping
+		// multihashes.
+		key, _, err := iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		// Decode the key and see if it is a value key.
+		dm, err := multihash.Decode(key)
+		if err != nil {
+			return err
+		}
+		if len(dm.Digest) != valueKeySize+len(s.keys.value) || !bytes.HasSuffix(dm.Digest, s.keys.value) {
+			// Key does not have value suffix, so not a value key.
+			continue
+		}
+
+		valueData, found, err := s.getWithTimeout(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// Value was already removed.
+			continue
+		}
+
+		if err = valueFunc(key, valueData); err != nil {
+			return err
+		}
+
+		if batchSize > 0 {
+			inBatch++
+			if inBatch == batchSize {
+				inBatch = 0
+				s.valLock.Unlock()
+				s.lockValues()
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	done, err := s.logWrite(walRecord{op: walRemoveProviderContext, providerID: providerID, contextID: contextID})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	valKey := s.keys.makeValueKey(indexer.Value{
+		ProviderID: providerID,
+		ContextID:  contextID,
+	})
+
+	s.lockValue(valKey)
+	defer s.unlockValue(valKey)
+
+	// Remove any previous value.
+	s.valueCache.remove(valKey)
+	if _, err := s.store.Remove(valKey); err != nil {
+		return err
+	}
+	if err := s.unindexValue(providerID, valKey); err != nil {
+		return err
+	}
+	return s.countWrite()
+}
+
+func (s *Store) Size() (int64, error) {
+	indexBytes, dataBytes, err := s.SizeBreakdown()
+	if err != nil {
+		return 0, err
+	}
+	return indexBytes + dataBytes, nil
+}
+
+// SizeBreakdown returns the number of bytes used by the storethehash index,
+// and the number of bytes used by the primary storage. The primary storage
+// holds the values and the value-key list of each multihash. The sizes are
+// read from the files, without scanning the store. If a custom primary
+// storage is used, then its size is not known and dataBytes is 0. Writes that
+// are not yet flushed are not included, unless SizeAfterFlush is set.
+func (s *Store) SizeBreakdown() (indexBytes, dataBytes int64, err error) {
+	if err = s.begin(); err != nil {
+		return 0, 0, err
+	}
+	defer s.end()
+
+	if s.sizeAfterFlush {
+		if err = s.flush(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	indexBytes, err = s.store.IndexStorageSize()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The size of a custom primary storage is not known.
+	if s.dataPath != "" {
+		fi, err := os.Stat(s.dataPath)
+		if err != nil {
+			return 0, 0, err
+		}
+		dataBytes = fi.Size()
+	}
+
+	return indexBytes, dataBytes, nil
+}
+
+// Ping checks that the store is open, that the underlying store has not
+// failed, and that the primary storage file can be read. It returns the
+// context's error if the file is not read before the context is done.
+func (s *Store) Ping(ctx context.Context) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	if err := s.store.Err(); err != nil {
+		return err
+	}
+	// The file of a custom primary storage is not known.
+	if s.dataPath == "" {
+		return ctx.Err()
+	}
+
+	// Buffered so that the goroutine can exit if the context is done first.
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(s.dataPath)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Store) Flush() error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	if s.wal == nil {
+		return s.flush()
+	}
+	return s.flushWriteLog()
+}
+
+// flushWriteLog flushes the store and then clears the write-ahead log. It
+// waits for logged writes that are in progress, so that every write in the log
+// is in the flushed store when the log is cleared.
+func (s *Store) flushWriteLog() error {
+	s.wal.applyLock.Lock()
+	defer s.wal.applyLock.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.wal.truncate()
+}
+
+func (s *Store) flush() error {
+	atomic.StoreUint64(&s.pendingWrites, 0)
+	s.store.Flush()
+	return s.store.Err()
+}
+
+// countWrite counts a write operation and, if FlushEvery is set, flushes the
+// store once that many writes have been made since the last flush.
+func (s *Store) countWrite() error {
+	if s.flushEvery == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&s.pendingWrites, 1)
+	// Only the goroutine that resets the count does the flush. If the CAS
+	// fails, then another write has been counted and that goroutine will try.
+	if n >= s.flushEvery && atomic.CompareAndSwapUint64(&s.pendingWrites, n, 0) {
+		s.store.Flush()
+		return s.store.Err()
+	}
+	return nil
+}
+
+// ErrCloseTimeout is returned by Close when operations that are in progress do
+// not finish within the time set by the CloseTimeout option.
+var ErrCloseTimeout = errors.New("timed out waiting for operations to finish")
+
+// Close closes the store. Any operations started after Close is called return
+// indexer.ErrClosed. Close waits for operations that are already in progress
+// to finish, then flushes and closes the underlying storage. If they do not
+// finish within the time set by the CloseTimeout option, then Close returns
+// ErrCloseTimeout and leaves the underlying storage open for them, and Close
+// may be called again to wait for them and finish closing. Calling Close after
+// it has succeeded has no effect.
+func (s *Store) Close() error {
+	s.shutdownMutex.Lock()
+	defer s.shutdownMutex.Unlock()
+
+	if s.shutDown {
+		return nil
+	}
+	s.closeMutex.Lock()
+	s.closed = true
+	s.closeMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.opWait.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(s.closeTimeout)
+	select {
+	case <-done:
+		timer.Stop()
+	case <-timer.C:
+		log.Warnw("Timed out waiting for operations to finish", "timeout", s.closeTimeout)
+		return ErrCloseTimeout
+	}
+	s.shutDown = true
+
+	if s.stopWatch != nil {
+		close(s.stopWatch)
+		<-s.watchDone
+	}
+	if s.stopWALSync != nil {
+		close(s.stopWALSync)
+		<-s.walSyncDone
+	}
+
+	var flushErr error
+	if s.wal != nil {
+		// The log is only cleared if the flush succeeds, so that the writes
+		// are replayed when the store is opened again.
+		flushErr = s.flushWriteLog()
+		if err := s.wal.close(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+	} else {
+		s.store.Flush()
+		flushErr = s.store.Err()
+	}
+	if s.ordered != nil {
+		if err := s.ordered.Close(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+	}
+	if err := s.store.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// begin registers the start of an operation, and returns indexer.ErrClosed if
+// the store is closed. If begin does not return an error, then end must be
+// called when the operation is finished.
+func (s *Store) begin() error {
+	s.closeMutex.RLock()
+	defer s.closeMutex.RUnlock()
+
+	if s.closed {
+		return indexer.ErrClosed
+	}
+	s.opWait.Add(1)
+	return nil
+}
+
+func (s *Store) end() {
+	s.opWait.Done()
+}
+
+// Stats returns statistics about the values stored in the value store.
+func (s *Store) Stats() (*indexer.Stats, error) {
+	return &indexer.Stats{
+		PrunedValueKeys: atomic.LoadUint64(&s.prunedValueKeys),
+		CorruptValues:   atomic.LoadUint64(&s.corruptValues),
+		ValueLockWait:   time.Duration(atomic.LoadUint64(&s.valueLockWait)),
+		KeyLockWait:     time.Duration(atomic.LoadUint64(&s.keyLockWait)),
+		MaxValueKeys:    int(atomic.LoadUint64(&s.maxValueKeys)),
+		AvgValueKeys:    s.avgValueKeys(),
+	}, nil
+}
+
+func (s *Store) Iter() (indexer.Iterator, error) {
+	return s.IterContext(context.Background())
+}
+
+// IterContext creates an iterator that stops, returning the context's error
+// from Next, when the context is canceled.
+//
+// The returned iterator has a Progress method that returns the number of
+// bytes of primary storage scanned so far, and the total number of bytes to
+// scan. The total is 0 if the store uses a custom primary storage.
+//
+// The iterator keeps recently decoded values, so a value that is updated
+// during iteration may be returned as it was when the iterator first read it.
+func (s *Store) IterContext(ctx context.Context) (indexer.Iterator, error) {
+	iters, err := s.newIterators(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return iters[0], nil
+}
+
+// IterShards creates n iterators that together return every multihash in the
+// store once, so that the multihashes can be processed by n goroutines. The
+// multihashes are divided between the iterators by a hash of the multihash.
+// Each iterator is the same as one returned by IterContext, and may be used by
+// a different goroutine.
+//
+// Each iterator reads all of the primary storage, and only looks up the
+// values of its own multihashes. Looking up values is most of the work of
+// iterating, so this is faster than one iterator when there are enough CPUs
+// and the primary storage is cached or fast to read.
+func (s *Store) IterShards(ctx context.Context, n int) ([]indexer.Iterator, error) {
+	if n < 1 {
+		return nil, errors.New("number of shards must be at least 1")
+	}
+	iters, err := s.newIterators(ctx, n)
+	if err != nil {
+		return nil, err
 	}
-	s.Start()
-	return &sthStorage{
-		dir:     dir,
-		store:   s,
-		mlk:     keymutex.New(0),
-		primary: primary,
-	}, nil
+	shards := make([]indexer.Iterator, n)
+	for i := range iters {
+		shards[i] = iters[i]
+	}
+	return shards, nil
 }
 
-func (s *sthStorage) Get(m multihash.Multihash) ([]indexer.Value, bool, error) {
-	return s.get(makeIndexKey(m))
-}
+// newIterators creates n iterators that each return a disjoint set of the
+// multihashes in the store.
+func (s *Store) newIterators(ctx context.Context, n int) ([]*sthIterator, error) {
+	if err := s.begin(); err != nil {
+		return nil, err
+	}
+	defer s.end()
 
-func (s *sthStorage) Put(value indexer.Value, mhs ...multihash.Multihash) error {
-	valKey, err := s.updateValue(value, len(mhs) != 0)
+	err := s.flush()
 	if err != nil {
-		return fmt.Errorf("cannot store value: %w", err)
+		return nil, err
 	}
-
-	for i := range mhs {
-		err = s.putIndex(mhs[i], valKey)
+	var total uint64
+	if s.dataPath != "" {
+		fi, err := os.Stat(s.dataPath)
 		if err != nil {
-			return fmt.Errorf("cannot store index: %w", err)
+			return nil, err
 		}
+		total = uint64(fi.Size())
 	}
-	return nil
-}
-
-func (s *sthStorage) Remove(value indexer.Value, mhs ...multihash.Multihash) error {
-	for i := range mhs {
-		err := s.removeIndex(mhs[i], value)
+	iters := make([]*sthIterator, n)
+	for i := range iters {
+		iter, err := s.primary.Iter()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		iters[i] = &sthIterator{
+			ctx:      ctx,
+			iter:     iter,
+			storage:  s,
+			uniqKeys: map[string]struct{}{},
+			total:    total,
+			values:   newValueCache(iterValueCacheSize),
+		}
+		if n > 1 {
+			iters[i].shard = uint32(i)
+			iters[i].shards = uint32(n)
 		}
 	}
-	return nil
+	return iters, nil
 }
 
-func (s *sthStorage) RemoveProvider(ctx context.Context, providerID peer.ID) error {
-	s.Flush()
-	iter, err := s.primary.Iter()
+// ForEach calls fn for each multihash in the store and the values it maps to,
+// until all multihashes are visited, fn returns an error, or the context is
+// canceled. It returns the error from fn or the context's error, and nil when
+// all multihashes were visited. The same things that apply to iterators
+// returned by IterContext apply to ForEach.
+func (s *Store) ForEach(ctx context.Context, fn func(multihash.Multihash, []indexer.Value) error) error {
+	iter, err := s.IterContext(ctx)
 	if err != nil {
 		return err
 	}
-
-	s.valLock.Lock()
-	defer s.valLock.Unlock()
-
-	var count int
 	for {
-		if count%1024 == 0 && ctx.Err() != nil {
-			return ctx.Err()
-		}
-		count++
-
-		// Iterate through all stored items, examining values and skipping
-		// multihashes.
-		key, _, err := iter.Next()
+		m, values, err := iter.Next()
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return err
 		}
-
-		// Decode the key and see if it is a value key.
-		dm, err := multihash.Decode(key)
-		if err != nil {
-			return err
-		}
-		if !bytes.HasSuffix(dm.Digest, valueKeySuffix) {
-			// Key does not have value suffix, so not a value key.
-			continue
-		}
-
-		valueData, found, err := s.store.Get(multihash.Multihash(key))
-		if err != nil {
-			return err
-		}
-
-		// If a value was found, skip it if the provider is different than the
-		// one being removed.
-		if found {
-			value, err := indexer.UnmarshalValue(valueData)
-			if err != nil {
-				return err
-			}
-
-			if value.ProviderID != providerID {
-				continue
-			}
-		}
-
-		// Delete the value of the provider being removed.
-		_, err = s.store.Remove(key)
-		if err != nil {
+		if err = fn(m, values); err != nil {
 			return err
 		}
 	}
-
-	return nil
-}
-
-func (s *sthStorage) RemoveProviderContext(providerID peer.ID, contextID []byte) error {
-	valKey := makeValueKey(indexer.Value{
-		ProviderID: providerID,
-		ContextID:  contextID,
-	})
-
-	s.valLock.Lock()
-	defer s.valLock.Unlock()
-
-	// Remove any previous value.
-	_, err := s.store.Remove(valKey)
-	return err
-}
-
-func (s *sthStorage) Size() (int64, error) {
-	size, err := s.store.IndexStorageSize()
-	if err != nil {
-		return 0, err
-	}
-
-	fi, err := os.Stat(filepath.Join(s.dir, "storethehash.data"))
-	if err != nil {
-		return 0, err
-	}
-	size += fi.Size()
-
-	return size, nil
-}
-
-func (s *sthStorage) Flush() error {
-	s.store.Flush()
-	return s.store.Err()
 }
 
-func (s *sthStorage) Close() error {
-	return s.store.Close()
+// Progress returns the number of bytes of primary storage that the iterator
+// has scanned, and the total number of bytes to scan, or 0 if unknown. Data
+// written after the iterator was created may also be scanned, so scanned can
+// become greater than total.
+func (it *sthIterator) Progress() (scanned, total uint64) {
+	return it.scanned, it.total
 }
 
-func (s *sthStorage) Iter() (indexer.Iterator, error) {
-	err := s.Flush()
-	if err != nil {
-		return nil, err
-	}
-	iter, err := s.primary.Iter()
-	if err != nil {
-		return nil, err
+func (it *sthIterator) Next() (multihash.Multihash, []indexer.Value, error) {
+	if err := it.storage.begin(); err != nil {
+		return nil, nil, err
 	}
-	return &sthIterator{
-		iter:     iter,
-		storage:  s,
-		uniqKeys: map[string]struct{}{},
-	}, nil
-}
+	defer it.storage.end()
 
-func (it *sthIterator) Next() (multihash.Multihash, []indexer.Value, error) {
 	for {
-		key, _, err := it.iter.Next()
+		if err := it.ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		key, value, err := it.iter.Next()
 		if err != nil {
 			if err == io.EOF {
 				it.uniqKeys = nil
+				it.values = nil
 			}
 			return nil, nil, err
 		}
+		// Each primary record is a 4-byte size followed by the key and value.
+		it.scanned += uint64(4 + len(key) + len(value))
 
-		// Decode the key and see if it is an index key.
-		dm, err := multihash.Decode(key)
-		if err != nil {
-			return nil, nil, err
+		origMultihash, ok := it.storage.keys.decodeIndexKey(key)
+		if !ok {
+			// Not an index key.
+			continue
 		}
-		if !bytes.HasSuffix(dm.Digest, indexKeySuffix) {
-			// Key does not have index prefix, so is not an index key.
+		if it.shards != 0 && shardOf(origMultihash, it.shards) != it.shard {
 			continue
 		}
-
-		mhb := make([]byte, len(dm.Digest)-len(indexKeySuffix))
-		copy(mhb, dm.Digest)
-		reverseBytes(mhb)
-		origMultihash := multihash.Multihash(mhb)
 		k := string(origMultihash)
 		_, found := it.uniqKeys[k]
 		if found {
@@ -273,7 +1558,7 @@ func (it *sthIterator) Next() (multihash.Multihash, []indexer.Value, error) {
 		}
 
 		// Get the value for each value key
-		values, err := it.storage.getValues(key, valueKeys)
+		values, _, err := it.storage.getCachedValues(key, valueKeys, "", it.values)
 		if err != nil {
 			return nil, nil, fmt.Errorf("cannot get values for multihash: %w", err)
 		}
@@ -286,7 +1571,19 @@ func (it *sthIterator) Next() (multihash.Multihash, []indexer.Value, error) {
 	}
 }
 
-func (s *sthStorage) getValueKeys(k []byte) ([][]byte, error) {
+// shardOf returns the iterator shard, out of shards, that returns the
+// multihash. This uses FNV-1a, since the digest of a multihash may not be
+// evenly distributed.
+func shardOf(m multihash.Multihash, shards uint32) uint32 {
+	h := uint32(2166136261)
+	for _, b := range m {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h % shards
+}
+
+func (s *Store) getValueKeys(k []byte) ([][]byte, error) {
 	valueKeysData, found, err := s.store.Get(k)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get multihash from store: %w", err)
@@ -298,7 +1595,7 @@ func (s *sthStorage) getValueKeys(k []byte) ([][]byte, error) {
 	return indexer.UnmarshalValueKeys(valueKeysData)
 }
 
-func (s *sthStorage) get(k []byte) ([]indexer.Value, bool, error) {
+func (s *Store) get(k []byte) ([]indexer.Value, bool, error) {
 	valueKeys, err := s.getValueKeys(k)
 	if err != nil {
 		return nil, false, err
@@ -306,6 +1603,7 @@ func (s *sthStorage) get(k []byte) ([]indexer.Value, bool, error) {
 	if valueKeys == nil {
 		return nil, false, nil
 	}
+	s.observeValueKeys(len(valueKeys))
 
 	// Get the value for each value key.
 	values, err := s.getValues(k, valueKeys)
@@ -316,91 +1614,214 @@ func (s *sthStorage) get(k []byte) ([]indexer.Value, bool, error) {
 	if len(values) == 0 {
 		return nil, false, nil
 	}
+	if s.sortValues {
+		sortValues(values)
+	}
 
 	return values, true, nil
 }
 
-func (s *sthStorage) putIndex(m multihash.Multihash, valKey []byte) error {
-	k := makeIndexKey(m)
+// sortValues sorts values by provider ID, and then by context ID.
+func sortValues(values []indexer.Value) {
+	sort.Slice(values, func(i, j int) bool {
+		return lessValue(values[i], values[j])
+	})
+}
+
+// lessValue returns true if a sorts before b, by provider ID and then by
+// context ID.
+func lessValue(a, b indexer.Value) bool {
+	if a.ProviderID != b.ProviderID {
+		return a.ProviderID < b.ProviderID
+	}
+	return bytes.Compare(a.ContextID, b.ContextID) < 0
+}
+
+// putIndex adds valKey to the value-keys that the multihash maps to, and
+// returns true if it was not already there.
+func (s *Store) putIndex(m multihash.Multihash, valKey []byte) (bool, error) {
+	k := s.keys.makeIndexKey(m)
 
 	s.lock(k)
 	defer s.unlock(k)
 
 	existingValKeys, err := s.getValueKeys(k)
 	if err != nil {
-		return fmt.Errorf("cannot get value keys for multihash: %w", err)
+		return false, fmt.Errorf("cannot get value keys for multihash: %w", err)
 	}
 	// If found it means there is already a value there. Check if we are trying
 	// to put a duplicate value.
-	for _, existing := range existingValKeys {
-		if bytes.Equal(valKey, existing) {
-			return nil
+	if !s.skipDupCheck {
+		for _, existing := range existingValKeys {
+			if bytes.Equal(valKey, existing) {
+				return false, nil
+			}
 		}
 	}
+	if s.maxValues != 0 && len(existingValKeys) >= s.maxValues {
+		return false, ErrTooManyValues
+	}
 
 	// Store the new list of value keys for the multihash.
-	b, err := indexer.MarshalValueKeys(append(existingValKeys, valKey))
+	b, err := s.marshalValueKeys(append(existingValKeys, valKey))
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	err = s.store.Put(k, b)
 	if err != nil {
-		return fmt.Errorf("cannot put multihash: %w", err)
+		return false, fmt.Errorf("cannot put multihash: %w", err)
+	}
+	if len(existingValKeys) == 0 {
+		s.countIndexKey(k)
 	}
+	s.observeValueKeys(len(existingValKeys) + 1)
 
-	return nil
+	return true, nil
+}
+
+// putNewIndex stores a value-key list that contains only valKey, without
+// reading the existing list.
+func (s *Store) putNewIndex(m multihash.Multihash, valKey []byte) (bool, error) {
+	b, err := s.marshalValueKeys([][]byte{valKey})
+	if err != nil {
+		return false, err
+	}
+	k := s.keys.makeIndexKey(m)
+	if err = s.store.Put(k, b); err != nil {
+		return false, fmt.Errorf("cannot put multihash: %w", err)
+	}
+	s.countIndexKey(k)
+	return true, nil
 }
 
-func (s *sthStorage) updateValue(value indexer.Value, saveNew bool) ([]byte, error) {
+// updateValue stores the value, and returns its value-key and the previous
+// value record if that was changed.
+func (s *Store) updateValue(value indexer.Value, saveNew bool) ([]byte, *indexer.Value, error) {
 	// All values must have metadata, even if this only consists of the
 	// protocol ID.
 	if len(value.MetadataBytes) == 0 {
-		return nil, errors.New("value missing metadata")
+		return nil, nil, indexer.ErrMissingMetadata
 	}
 
-	valKey := makeValueKey(value)
+	valKey := s.keys.makeValueKey(value)
 
-	s.valLock.Lock()
-	defer s.valLock.Unlock()
+	s.lockValue(valKey)
+	defer s.unlockValue(valKey)
 
 	// See if there is a previous value.
 	valData, found, err := s.store.Get(valKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if !found {
 		if saveNew {
 			// Store the new value.
-			valData, err := indexer.MarshalValue(value)
+			valData, err := s.marshalValue(value)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			err = s.store.Put(valKey, valData)
 			if err != nil {
-				return nil, fmt.Errorf("cannot save new value: %w", err)
+				return nil, nil, fmt.Errorf("cannot save new value: %w", err)
+			}
+			if err = s.indexNewValue(value, valKey); err != nil {
+				return nil, nil, fmt.Errorf("cannot update reverse index: %w", err)
 			}
 		}
-		return valKey, nil
+		return valKey, nil, nil
 	}
 
 	// Found previous value.  If it is different, then update it.
 	newValData, err := indexer.MarshalValue(value)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	var prev *indexer.Value
 	if !bytes.Equal(newValData, valData) {
-		if err = s.store.Put(valKey, newValData); err != nil {
-			return nil, fmt.Errorf("cannot update existing value: %w", err)
+		// The stored data may differ only by its timestamp.
+		existing, err := indexer.UnmarshalValue(valData)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.mergeFunc != nil {
+			value, err = s.mergeValue(existing, value)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if !value.Equal(existing) {
+			prev = &existing
+		}
+	}
+	if prev == nil {
+		if !s.timestamps {
+			return valKey, nil, nil
 		}
+		// Refresh the timestamp of the unchanged value.
+	} else {
+		s.valueCache.remove(valKey)
+	}
+
+	newValData, err = s.marshalValue(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = s.store.Put(valKey, newValData); err != nil {
+		return nil, nil, fmt.Errorf("cannot update existing value: %w", err)
+	}
+
+	return valKey, prev, nil
+}
+
+// mergeValue calls the configured MergeFunc with the existing value and the
+// incoming value, and returns the result.
+func (s *Store) mergeValue(existing, value indexer.Value) (indexer.Value, error) {
+	merged := s.mergeFunc(existing, value)
+	if !merged.Match(existing) {
+		return indexer.Value{}, errors.New("merged value does not match existing provider and context")
+	}
+	if len(merged.MetadataBytes) == 0 {
+		return indexer.Value{}, fmt.Errorf("merged value: %w", indexer.ErrMissingMetadata)
+	}
+	return merged, nil
+}
+
+// marshalValue serializes a value for storage, with the current time if value
+// timestamps are enabled, and the metadata compressed if metadata compression
+// is enabled.
+func (s *Store) marshalValue(value indexer.Value) ([]byte, error) {
+	var t time.Time
+	if s.timestamps {
+		t = s.now()
 	}
+	return s.marshalValueTime(value, t)
+}
 
-	return valKey, nil
+// marshalValueTime serializes a value for storage with the given time, or with
+// no time if t is zero, and the metadata compressed if metadata compression is
+// enabled.
+func (s *Store) marshalValueTime(value indexer.Value, t time.Time) ([]byte, error) {
+	if s.mdCodec != indexer.MetadataUncompressed {
+		return indexer.MarshalValueCompressed(value, t, s.mdCodec, defaultCompressMinSize)
+	}
+	if !t.IsZero() {
+		return indexer.MarshalValueTime(value, t)
+	}
+	return indexer.MarshalValue(value)
 }
 
-func (s *sthStorage) removeIndex(m multihash.Multihash, value indexer.Value) error {
-	k := makeIndexKey(m)
+func (s *Store) removeIndex(m multihash.Multihash, value indexer.Value) error {
+	valKey := s.keys.makeValueKey(value)
+	return s.removeValueKeys(s.keys.makeIndexKey(m), map[string]struct{}{
+		string(valKey): {},
+	})
+}
 
+// removeValueKeys removes all of the value-keys in rmKeys from the list of
+// value-keys that the index key k maps to, rewriting the list at most once.
+// The remaining value-keys keep their order.
+func (s *Store) removeValueKeys(k []byte, rmKeys map[string]struct{}) error {
 	s.lock(k)
 	defer s.unlock(k)
 
@@ -409,49 +1830,164 @@ func (s *sthStorage) removeIndex(m multihash.Multihash, value indexer.Value) err
 		return err
 	}
 
-	valKey := makeValueKey(value)
+	keep := valueKeys[:0]
+	for _, valKey := range valueKeys {
+		if _, ok := rmKeys[string(valKey)]; !ok {
+			keep = append(keep, valKey)
+		}
+	}
+	if len(keep) == len(valueKeys) {
+		return nil
+	}
+	valueKeys = keep
 
-	for i := range valueKeys {
-		if bytes.Equal(valKey, valueKeys[i]) {
-			if len(valueKeys) == 1 {
-				_, err = s.store.Remove(k)
-				return err
-			}
-			// Remove the value-key from the list of value-keys.
-			valueKeys[i] = valueKeys[len(valueKeys)-1]
-			valueKeys[len(valueKeys)-1] = nil
-			valueKeys = valueKeys[:len(valueKeys)-1]
-			// Update the list of value-keys that the multihash maps to.
-			b, err := indexer.MarshalValueKeys(valueKeys)
-			if err != nil {
-				return err
-			}
-			return s.store.Put(k, b)
+	if len(valueKeys) == 0 {
+		if _, err = s.store.Remove(k); err != nil {
+			return err
 		}
+		return s.unorderIndexKey(k)
 	}
-	return nil
+	// Update the list of value-keys that the multihash maps to.
+	b, err := s.marshalValueKeys(valueKeys)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(k, b)
 }
 
-func (s *sthStorage) lock(k []byte) {
+// replaceLockCount is the number of replace locks that values are spread
+// across.
+const replaceLockCount = 64
+
+// replaceLock returns the replace lock of the value with the value-key.
+func (s *Store) replaceLock(valKey []byte) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write(valKey)
+	return &s.replaceLocks[h.Sum32()%replaceLockCount]
+}
+
+func (s *Store) lock(k []byte) {
+	if !s.lockTiming {
+		s.mlk.LockBytes(k)
+		return
+	}
+	start := time.Now()
 	s.mlk.LockBytes(k)
+	atomic.AddUint64(&s.keyLockWait, uint64(time.Since(start)))
 }
 
-func (s *sthStorage) unlock(k []byte) {
+func (s *Store) unlock(k []byte) {
 	s.mlk.UnlockBytes(k)
 }
 
-func (s *sthStorage) getValues(key []byte, valueKeys [][]byte) ([]indexer.Value, error) {
-	values := make([]indexer.Value, 0, len(valueKeys))
+// lockValues locks valLock for writing, and records the time spent waiting
+// for the lock if LockTiming is enabled.
+func (s *Store) lockValues() {
+	if !s.lockTiming {
+		s.valLock.Lock()
+		return
+	}
+	start := time.Now()
+	s.valLock.Lock()
+	atomic.AddUint64(&s.valueLockWait, uint64(time.Since(start)))
+}
+
+// lockValue locks a single value for writing, by locking valLock for reading
+// and locking the value-key. Time spent waiting for either lock is recorded if
+// LockTiming is enabled.
+func (s *Store) lockValue(valKey []byte) {
+	if !s.lockTiming {
+		s.valLock.RLock()
+		s.vlk.LockBytes(valKey)
+		return
+	}
+	start := time.Now()
+	s.valLock.RLock()
+	s.vlk.LockBytes(valKey)
+	atomic.AddUint64(&s.valueLockWait, uint64(time.Since(start)))
+}
+
+func (s *Store) unlockValue(valKey []byte) {
+	s.vlk.UnlockBytes(valKey)
+	s.valLock.RUnlock()
+}
 
+// rlockValues locks valLock for reading, and records the time spent waiting
+// for the lock if LockTiming is enabled.
+func (s *Store) rlockValues() {
+	if !s.lockTiming {
+		s.valLock.RLock()
+		return
+	}
+	start := time.Now()
 	s.valLock.RLock()
+	atomic.AddUint64(&s.valueLockWait, uint64(time.Since(start)))
+}
+
+func (s *Store) getValues(key []byte, valueKeys [][]byte) ([]indexer.Value, error) {
+	values, _, err := s.getProviderValues(key, valueKeys, "")
+	return values, err
+}
+
+// errCorruptValue is returned, wrapped, when a stored value cannot be decoded.
+var errCorruptValue = errors.New("corrupt value")
+
+// fetchValue reads a value from the datastore and adds it to the cache. If
+// providerID is not empty and the value belongs to another provider, then the
+// value is not decoded and nil is returned with found set to true. The caller
+// must hold valLock for reading. The value-key is locked so that a concurrent
+// update cannot change the value after it is read and before it is cached.
+func (s *Store) fetchValue(valKey []byte, providerID peer.ID, cache *valueCache) (*indexer.Value, bool, error) {
+	s.vlk.LockBytes(valKey)
+	defer s.vlk.UnlockBytes(valKey)
+
+	valData, found, err := s.store.Get(valKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot get value: %w", err)
+	}
+	if !found {
+		return nil, false, nil
+	}
+	if providerID != "" {
+		var vp valueProvider
+		if err = json.Unmarshal(valData, &vp); err != nil {
+			return nil, false, fmt.Errorf("%w: %s", errCorruptValue, err)
+		}
+		if vp.ProviderID != providerID {
+			return nil, true, nil
+		}
+	}
+	val, err := indexer.UnmarshalValue(valData)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", errCorruptValue, err)
+	}
+	cache.put(valKey, val)
+	return &val, true, nil
+}
+
+// getProviderValues resolves value-keys into values, and returns the values
+// along with the value-key of each. If providerID is not empty, only the values
+// of that provider are returned, and the values of other providers are not
+// fully decoded.
+func (s *Store) getProviderValues(key []byte, valueKeys [][]byte, providerID peer.ID) ([]indexer.Value, [][]byte, error) {
+	return s.getCachedValues(key, valueKeys, providerID, s.valueCache)
+}
+
+// getCachedValues is getProviderValues with the cache of decoded values to
+// use. The cache may be nil.
+func (s *Store) getCachedValues(key []byte, valueKeys [][]byte, providerID peer.ID, cache *valueCache) ([]indexer.Value, [][]byte, error) {
+	var values []indexer.Value
+	var keys [][]byte
+	keyCount := len(valueKeys)
+
+	s.rlockValues()
 	for i := 0; i < len(valueKeys); {
-		// Fetch value from datastore.
-		valData, found, err := s.store.Get(valueKeys[i])
+		val, prune, err := s.resolveValue(valueKeys[i], providerID, cache)
 		if err != nil {
 			s.valLock.RUnlock()
-			return nil, fmt.Errorf("cannot get value: %w", err)
+			return nil, nil, err
 		}
-		if !found {
+		if prune {
 			// If value not in datastore, this means it has been deleted, and
 			// the mapping from the multihash to that value should also be
 			// removed.
@@ -460,57 +1996,166 @@ func (s *sthStorage) getValues(key []byte, valueKeys [][]byte) ([]indexer.Value,
 			valueKeys = valueKeys[:len(valueKeys)-1]
 			continue
 		}
-		val, err := indexer.UnmarshalValue(valData)
-		if err != nil {
-			s.valLock.RUnlock()
-			return nil, err
+		if val == nil {
+			i++
+			continue
 		}
-		values = append(values, val)
+		values = append(values, *val)
+		keys = append(keys, valueKeys[i])
 		i++
 	}
 	s.valLock.RUnlock()
 
 	// If some of the values were removed, then update the value-key list for
 	// the multihash.
-	if len(valueKeys) < cap(values) {
-		s.lock(key)
-		defer s.unlock(key)
-
+	if len(valueKeys) < keyCount {
+		if err := s.writePrunedValueKeys(key, valueKeys, keyCount-len(valueKeys)); err != nil {
+			return nil, nil, err
+		}
 		if len(valueKeys) == 0 {
-			_, err := s.store.Remove(key)
-			if err != nil {
-				return nil, fmt.Errorf("cannot delete multihash: %w", err)
-			}
-			return nil, nil
+			return nil, nil, nil
+		}
+	}
+
+	return values, keys, nil
+}
+
+// resolveValue returns the value with the value-key, from the cache or from
+// the datastore. The value is nil if it belongs to a provider other than
+// providerID, when providerID is not empty, or if it is corrupt and skipped.
+// Returns true if the value-key should be pruned from the value-key list of
+// the multihash, because the value no longer exists or is corrupt and
+// PruneCorruptValues is set. The caller must hold valLock for reading.
+func (s *Store) resolveValue(valKey []byte, providerID peer.ID, cache *valueCache) (*indexer.Value, bool, error) {
+	if val, ok := cache.get(valKey); ok {
+		if providerID != "" && val.ProviderID != providerID {
+			return nil, false, nil
+		}
+		return &val, false, nil
+	}
+
+	// Fetch value from datastore.
+	val, found, err := s.fetchValue(valKey, providerID, cache)
+	if err != nil {
+		if !s.skipCorruptValues || !errors.Is(err, errCorruptValue) {
+			return nil, false, err
 		}
+		atomic.AddUint64(&s.corruptValues, 1)
+		stats.Record(context.Background(), metrics.CorruptValues.M(1))
+		log.Warnw("Skipped corrupt value", "err", err, "pruned", s.pruneCorruptValues)
+		return nil, s.pruneCorruptValues, nil
+	}
+	if !found {
+		return nil, true, nil
+	}
+	return val, false, nil
+}
+
+// writePrunedValueKeys writes the value-key list of the multihash with the
+// index key, after pruned value-keys were removed from it. The multihash is
+// removed if no value-keys are left.
+func (s *Store) writePrunedValueKeys(key []byte, valueKeys [][]byte, pruned int) error {
+	s.countPrunedValueKeys(pruned)
 
-		// Update the values this mmultihash maps to.
-		b, err := indexer.MarshalValueKeys(valueKeys)
+	s.lock(key)
+	defer s.unlock(key)
+
+	if len(valueKeys) == 0 {
+		_, err := s.store.Remove(key)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("cannot delete multihash: %w", err)
 		}
-		if err = s.store.Put(key, b); err != nil {
-			return nil, fmt.Errorf("cannot update value keys for multihash: %w", err)
+		if err = s.unorderIndexKey(key); err != nil {
+			return fmt.Errorf("cannot update ordered index: %w", err)
 		}
+		return nil
 	}
 
-	return values, nil
+	// Update the values this mmultihash maps to.
+	b, err := s.marshalValueKeys(valueKeys)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Put(key, b); err != nil {
+		return fmt.Errorf("cannot update value keys for multihash: %w", err)
+	}
+	return nil
+}
+
+// countPrunedValueKeys adds the number of pruned value-keys to the statistics
+// and metrics.
+func (s *Store) countPrunedValueKeys(pruned int) {
+	atomic.AddUint64(&s.prunedValueKeys, uint64(pruned))
+	stats.Record(context.Background(), metrics.PrunedValueKeys.M(int64(pruned)))
+}
+
+// valueProvider decodes only the provider ID of a stored value.
+type valueProvider struct {
+	ProviderID peer.ID `json:"p"`
 }
 
-func makeIndexKey(m multihash.Multihash) multihash.Multihash {
+func (kf keyFormat) makeIndexKey(m multihash.Multihash) multihash.Multihash {
 	mhb := []byte(m)
 	var b bytes.Buffer
-	b.Grow(len(mhb) + len(indexKeySuffix))
+	b.Grow(len(mhb) + len(kf.index))
 	b.Write(mhb)
-	b.Write(indexKeySuffix)
+	b.Write(kf.index)
 	data := b.Bytes()
 	// Reverse the bytes in the identity-wrapped multihash so that the hash
-	// portion of the data is first.
-	reverseBytes(data[:len(data)-len(indexKeySuffix)])
+	// portion of the data is first. storethehash chooses the index bucket from
+	// the first bytes of the key, and the multihash code and length are the
+	// same for most keys.
+	reverseBytes(data[:len(data)-len(kf.index)])
 	mh, _ := multihash.Encode(data, multihash.IDENTITY)
 	return mh
 }
 
+// DecodeIndexKey returns the multihash that an index key was made from. An
+// index key is the multihash, with its bytes reversed and a suffix added,
+// wrapped in an identity multihash. Returns false if the key is not an index
+// key. The returned multihash does not share memory with key.
+//
+// DecodeIndexKey decodes the index keys of a store with no Namespace.
+func DecodeIndexKey(key multihash.Multihash) (multihash.Multihash, bool) {
+	return defaultKeys.decodeIndexKey(key)
+}
+
+func (kf keyFormat) decodeIndexKey(key multihash.Multihash) (multihash.Multihash, bool) {
+	dm, err := multihash.Decode(key)
+	if err != nil || dm.Code != multihash.IDENTITY || !kf.isIndexDigest(dm.Digest) {
+		return nil, false
+	}
+	mhb := make([]byte, len(dm.Digest)-len(kf.index))
+	copy(mhb, dm.Digest)
+	reverseBytes(mhb)
+	return multihash.Multihash(mhb), true
+}
+
+// isIndexDigest returns true if digest is the digest of an index key made by
+// makeIndexKey.
+func (kf keyFormat) isIndexDigest(digest []byte) bool {
+	return len(digest) > len(kf.index) && bytes.HasSuffix(digest, kf.index)
+}
+
+// checkWritableDir returns an error if dir is not an existing directory that
+// files can be created in.
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".writetest-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
 func reverseBytes(b []byte) {
 	i := 0
 	j := len(b) - 1
@@ -521,7 +2166,14 @@ func reverseBytes(b []byte) {
 	}
 }
 
-func makeValueKey(value indexer.Value) multihash.Multihash {
+// makeValueKey returns the key that a value is stored under. The key depends
+// only on the ProviderID and ContextID. An empty ContextID is allowed, and its
+// key is different from the key of any non-empty ContextID for the same
+// provider. A nil ContextID and an empty ContextID have the same key, the same
+// as Value.Match treats them as the same. A valid ProviderID is a multihash,
+// which encodes its own length, so no two pairs of valid ProviderID and
+// ContextID hash the same input.
+func (kf keyFormat) makeValueKey(value indexer.Value) multihash.Multihash {
 	// Create a hash of the ProviderID and ContextID so that the key length is
 	// fixed. This hash is used to look up the Value, which contains
 	// ProviderID, ContextID, and Metadata.
@@ -533,9 +2185,9 @@ func makeValueKey(value indexer.Value) multihash.Multihash {
 	h.Write(value.ContextID)
 
 	var b bytes.Buffer
-	b.Grow(h.Size() + len(valueKeySuffix))
+	b.Grow(h.Size() + len(kf.value))
 	b.Write(h.Sum(nil))
-	b.Write(valueKeySuffix)
+	b.Write(kf.value)
 	mh, _ := multihash.Encode(b.Bytes(), multihash.IDENTITY)
 	return mh
 }
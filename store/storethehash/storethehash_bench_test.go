@@ -1,16 +1,18 @@
-package storethehash_test
+package storethehash
 
 import (
 	"context"
 	"testing"
 
 	indexer "github.com/filecoin-project/go-indexer-core"
-	"github.com/filecoin-project/go-indexer-core/store/storethehash"
 	"github.com/filecoin-project/go-indexer-core/store/test"
 )
 
+// benchMetadataSize is the size of value metadata used in put benchmarks.
+const benchMetadataSize = 128
+
 func initBenchStore(b *testing.B) indexer.Interface {
-	s, err := storethehash.New(context.Background(), b.TempDir())
+	s, err := New(context.Background(), b.TempDir())
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -23,6 +25,12 @@ func BenchmarkGet(b *testing.B) {
 func BenchmarkParallelGet(b *testing.B) {
 	test.BenchParallelMultihashGet(initBenchStore(b), b)
 }
+func BenchmarkPut(b *testing.B) {
+	test.BenchMultihashPut(initBenchStore(b), benchMetadataSize, b)
+}
+func BenchmarkParallelPut(b *testing.B) {
+	test.BenchParallelMultihashPut(initBenchStore(b), benchMetadataSize, b)
+}
 
 // To run this storage benchmarks run:
 // TEST_STORAGE=true go test -v -timeout=30m
@@ -1,18 +1,30 @@
-package storethehash_test
+package storethehash
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/filecoin-project/go-indexer-core"
-	"github.com/filecoin-project/go-indexer-core/store/storethehash"
 	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/ipld/go-storethehash/store/primary"
+	mhprimary "github.com/ipld/go-storethehash/store/primary/multihash"
+	sthtypes "github.com/ipld/go-storethehash/store/types"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
 )
 
 func initSth(t *testing.T) indexer.Interface {
-	s, err := storethehash.New(context.Background(), t.TempDir())
+	s, err := New(context.Background(), t.TempDir())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,6 +47,11 @@ func TestSize(t *testing.T) {
 	}
 }
 
+func TestPing(t *testing.T) {
+	s := initSth(t)
+	test.PingTest(t, s)
+}
+
 func TestMany(t *testing.T) {
 	s := initSth(t)
 	test.RemoveTest(t, s)
@@ -73,7 +90,7 @@ func TestPeriodicFlush(t *testing.T) {
 
 	syncInterval := 200 * time.Millisecond
 
-	s, err := storethehash.New(context.Background(), tmpDir, storethehash.SyncInterval(syncInterval))
+	s, err := New(context.Background(), tmpDir, SyncInterval(syncInterval))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,7 +116,7 @@ func TestPeriodicFlush(t *testing.T) {
 	time.Sleep(2 * syncInterval)
 
 	// Regenerate new storage
-	s2, err := storethehash.New(context.Background(), tmpDir)
+	s2, err := New(context.Background(), tmpDir)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -126,12 +143,2525 @@ func TestPeriodicFlush(t *testing.T) {
 
 func TestClose(t *testing.T) {
 	s := initSth(t)
-	err := s.Close()
+	iter, err := s.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Methods called after Close must return ErrClosed, not use the closed
+	// store.
+	if _, _, err = s.Get(test.RandomMultihashes(1)[0]); !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Get, got %v", err)
+	}
+	if _, err = s.Size(); !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Size, got %v", err)
+	}
+	if err = s.Flush(); !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Flush, got %v", err)
+	}
+	if _, _, err = iter.Next(); !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed from iterator, got %v", err)
+	}
+}
+
+// testPeer returns the provider ID of the values stored by tests.
+func testPeer(t testing.TB) peer.ID {
+	t.Helper()
+	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testValue returns a value of the test provider, with context ID "ctxid"
+// and metadata "meta".
+func testValue(t testing.TB) indexer.Value {
+	return indexer.Value{ProviderID: testPeer(t), ContextID: []byte("ctxid"), MetadataBytes: []byte("meta")}
+}
+
+// newStore opens a store in dir, failing the test if it cannot be opened.
+func newStore(t testing.TB, dir string, options ...Option) *Store {
+	t.Helper()
+	s, err := New(context.Background(), dir, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*Store)
+}
+
+func TestRemoveValuesOlderThan(t *testing.T) {
+	dir := t.TempDir()
+	p := testPeer(t)
+	legacyValue := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-0"), MetadataBytes: []byte("meta")}
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta")}
+	mhs := test.RandomMultihashes(3)
+
+	// Store a value without a timestamp.
+	s := newStore(t, dir)
+	if err := s.Put(legacyValue, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStore(t, dir, ValueTimestamps(true))
+	now := time.Unix(1650000000, 0)
+	s.now = func() time.Time { return now }
+
+	if err := s.Put(value1, mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Putting the unchanged value again refreshes its timestamp.
+	now = now.Add(time.Hour)
+	prev, err := s.PutReturningPrevious(value2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != nil {
+		t.Fatal("refreshing timestamp should not return previous value")
+	}
+
+	removed, err := s.RemoveValuesOlderThan(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 value removed, got %d", removed)
+	}
+
+	_, found, err := s.Get(mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expired value should have been removed")
+	}
+	for i, value := range []indexer.Value{legacyValue, value2} {
+		m := mhs[i*2]
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !vals[0].Equal(value) {
+			t.Fatalf("value %d should not have been removed", i)
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutMany(t *testing.T) {
+	for _, concurrency := range []int{1, 8} {
+		s := newStore(t, t.TempDir(), PutConcurrency(concurrency))
+		value := testValue(t)
+		mhs := test.RandomMultihashes(100)
+
+		added, err := s.PutMany(value, mhs[:60])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != 60 {
+			t.Fatalf("expected 60 multihashes added, got %d", added)
+		}
+		// Only multihashes not already mapped to the value are counted.
+		added, err = s.PutMany(value, mhs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != 40 {
+			t.Fatalf("expected 40 multihashes added, got %d", added)
+		}
+
+		if n := countValueRecords(t, s); n != 1 {
+			t.Fatalf("expected value record to be written once, got %d records", n)
+		}
+
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// countValueRecords returns the number of value records in the primary
+// storage, including records that have been replaced.
+func countValueRecords(t *testing.T, s *Store) int {
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	iter, err := s.primary.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		key, _, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm, err := multihash.Decode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasSuffix(dm.Digest, valueKeySuffix) {
+			count++
+		}
+	}
+	return count
+}
+
+// BenchmarkIterValues compares iterating a store where many multihashes share
+// a few values, with and without the iterator's cache of decoded values.
+func BenchmarkIterValues(b *testing.B) {
+	s := newStore(b, b.TempDir())
+	defer s.Close()
+	p := testPeer(b)
+	metadata := make([]byte, 128)
+	for i := 0; i < 10; i++ {
+		value := indexer.Value{ProviderID: p, ContextID: []byte(fmt.Sprint("ctxid-", i)), MetadataBytes: metadata}
+		if err := s.Put(value, test.RandomMultihashes(1000)...); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, cache := range []bool{true, false} {
+		b.Run(fmt.Sprint("cache-", cache), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				iter, err := s.Iter()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !cache {
+					iter.(*sthIterator).values = nil
+				}
+				for {
+					_, _, err = iter.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestValueKeyContextID(t *testing.T) {
+	p := testPeer(t)
+	emptyKey := defaultKeys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte{}})
+	nilKey := defaultKeys.makeValueKey(indexer.Value{ProviderID: p})
+	if !bytes.Equal(emptyKey, nilKey) {
+		t.Fatal("nil and empty context IDs should have the same value key")
+	}
+
+	seen := map[string]string{string(emptyKey): "empty"}
+	for _, ctxID := range []string{" ", "  ", "\t", "\n", "\x00", "ctxid"} {
+		key := defaultKeys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte(ctxID)})
+		if prev, ok := seen[string(key)]; ok {
+			t.Fatalf("context ID %q has same value key as %q", ctxID, prev)
+		}
+		seen[string(key)] = ctxID
+	}
+
+}
+
+func TestEmptyContextID(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(2)
+	emptyValue := indexer.Value{ProviderID: p, MetadataBytes: []byte("empty")}
+	spaceValue := indexer.Value{ProviderID: p, ContextID: []byte(" "), MetadataBytes: []byte("space")}
+	if err := s.Put(emptyValue, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(spaceValue, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	vals, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(vals))
+	}
+	for _, v := range vals {
+		if !v.Equal(emptyValue) && !v.Equal(spaceValue) {
+			t.Fatal("got unexpected value")
+		}
+	}
+
+	// Removing the empty context ID, given as a non-nil empty slice, leaves
+	// the other value.
+	if err = s.RemoveProviderContext(p, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	vals, _, err = s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || !vals[0].Equal(spaceValue) {
+		t.Fatal("expected only value with non-empty context ID")
+	}
+	if _, found, _ = s.Get(mhs[1]); found {
+		t.Fatal("expected multihash with only empty context ID value to be removed")
+	}
+}
+
+func TestDecodeIndexKey(t *testing.T) {
+	for _, m := range test.RandomMultihashes(10) {
+		key := defaultKeys.makeIndexKey(m)
+		decoded, ok := DecodeIndexKey(key)
+		if !ok {
+			t.Fatal("index key not decoded")
+		}
+		if !bytes.Equal(decoded, m) {
+			t.Fatal("decoded multihash does not match original")
+		}
+		// The decoded multihash must not share memory with the key.
+		decoded[0]++
+		if decoded2, _ := DecodeIndexKey(key); !bytes.Equal(decoded2, m) {
+			t.Fatal("decoding modified the index key")
+		}
+	}
+
+	p := testPeer(t)
+	valKey := defaultKeys.makeValueKey(indexer.Value{ProviderID: p, ContextID: []byte("ctxid")})
+	if _, ok := DecodeIndexKey(valKey); ok {
+		t.Fatal("value key decoded as index key")
+	}
+	// A multihash that is not an identity multihash is not an index key.
+	m, err := multihash.Sum([]byte("data"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := DecodeIndexKey(m); ok {
+		t.Fatal("non-identity multihash decoded as index key")
+	}
+	if _, ok := DecodeIndexKey(multihash.Multihash("not a multihash")); ok {
+		t.Fatal("invalid multihash decoded as index key")
+	}
+}
+
+func TestCloseInFlight(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(2000)
+
+	// Store many values so that RemoveProvider takes a while.
+	for i := range mhs {
+		value := indexer.Value{
+			ProviderID:    p,
+			ContextID:     []byte(fmt.Sprint("ctxid-", i)),
+			MetadataBytes: []byte("metadata"),
+		}
+		if err := s.Put(value, mhs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.RemoveProvider(context.Background(), p)
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// RemoveProvider either finished before the store was closed, or was not
+	// started until after Close was called.
+	err := <-errChan
+	if err != nil && !errors.Is(err, indexer.ErrClosed) {
+		t.Fatal(err)
+	}
+
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("metadata"),
+	}
+	if err = s.Put(value, mhs[0]); !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Put, got %v", err)
+	}
+	if _, _, err = s.Get(mhs[0]); !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed from Get, got %v", err)
+	}
+}
+
+func TestCountProviderRecords(t *testing.T) {
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(3)
+	values := []indexer.Value{
+		{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")},
+		{ProviderID: p1, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")},
+		// Update of the first value, which must not be counted twice.
+		{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-3")},
+		{ProviderID: p2, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")},
+	}
+
+	for _, reverse := range []bool{false, true} {
+		s := newStore(t, t.TempDir(), ReverseIndex(reverse))
+		for i, v := range values {
+			if err = s.Put(v, mhs[i%len(mhs)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Index entries are only counted with the reverse index.
+		expectIndexes := func(n int) int {
+			if reverse {
+				return n
+			}
+			return 0
+		}
+
+		est, err := s.CountProviderRecords(context.Background(), p1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est.Values != 2 {
+			t.Fatalf("expected 2 value records, got %d", est.Values)
+		}
+		if est.Indexes != expectIndexes(3) {
+			t.Fatalf("expected %d index entries, got %d", expectIndexes(3), est.Indexes)
+		}
+
+		// Counting must not remove anything.
+		vals, found, err := s.Get(mhs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 {
+			t.Fatal("expected value to still be stored")
+		}
+
+		if err = s.RemoveProvider(context.Background(), p1); err != nil {
+			t.Fatal(err)
+		}
+		est, err = s.CountProviderRecords(context.Background(), p1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est.Values != 0 || est.Indexes != 0 {
+			t.Fatalf("expected no records after removal, got %d values and %d index entries", est.Values, est.Indexes)
+		}
+		est, err = s.CountProviderRecords(context.Background(), p2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est.Values != 1 {
+			t.Fatalf("expected 1 value record for other provider, got %d", est.Values)
+		}
+		if est.Indexes != expectIndexes(1) {
+			t.Fatalf("expected %d index entries for other provider, got %d", expectIndexes(1), est.Indexes)
+		}
+
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSeparateDirs(t *testing.T) {
+	indexDir := t.TempDir()
+	dataDir := t.TempDir()
+	s, err := New(context.Background(), t.TempDir(),
+		IndexDir(indexDir), DataDir(dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.E2ETest(t, s)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is made up of multiple files with the same prefix.
+	indexFiles, err := filepath.Glob(filepath.Join(indexDir, "storethehash.index*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexFiles) == 0 {
+		t.Fatal("index files not in index directory")
+	}
+	if _, err = os.Stat(filepath.Join(dataDir, "storethehash.data")); err != nil {
+		t.Fatal("data file not in data directory:", err)
+	}
+
+	// Opening with a missing directory must fail.
+	_, err = New(context.Background(), t.TempDir(),
+		DataDir(filepath.Join(dataDir, "missing")))
+	if err == nil {
+		t.Fatal("expected error opening store with missing data directory")
+	}
+}
+
+func TestFlushEvery(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Use a long sync interval so that only FlushEvery causes a flush.
+	s, err := New(context.Background(), tmpDir,
+		SyncInterval(time.Hour), FlushEvery(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(3)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("some-metadata"),
+	}
+
+	findInNewStore := func(m []byte) bool {
+		s2 := newStore(t, tmpDir)
+		defer s2.Close()
+		_, found, err := s2.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = s.Put(value, mhs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if findInNewStore(mhs[0]) {
+		t.Fatal("data should not be flushed before threshold")
+	}
+
+	if err = s.Put(value, mhs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if !findInNewStore(mhs[0]) {
+		t.Fatal("data not flushed after threshold")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetForProvider(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(1)
+	value1 := indexer.Value{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p1, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	value3 := indexer.Value{ProviderID: p2, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	for _, v := range []indexer.Value{value1, value2, value3} {
+		if err = s.Put(v, mhs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vals, found, err := s.GetForProvider(mhs[0], p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 1 || !vals[0].Equal(value3) {
+		t.Fatal("did not get only the value of the requested provider")
+	}
+
+	// Removing a value of the other provider must still prune its value-key.
+	if err = s.RemoveProviderContext(p1, value1.ContextID); err != nil {
+		t.Fatal(err)
+	}
+	vals, found, err = s.GetForProvider(mhs[0], p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 1 || !vals[0].Equal(value2) {
+		t.Fatal("did not get remaining value of provider")
+	}
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PrunedValueKeys != 1 {
+		t.Fatalf("expected 1 pruned value-key, got %d", st.PrunedValueKeys)
+	}
+
+	_, found, err = s.GetForProvider(test.RandomMultihashes(1)[0], p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("should not have found unknown multihash")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetWithKeys(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+	mhs := test.RandomMultihashes(2)
+	if err := s.Put(value1, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	vks1, found, err := s.GetWithKeys(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vks1) != 1 || !vks1[0].Value.Equal(value1) {
+		t.Fatal("did not get expected value")
+	}
+	vks2, found, err := s.GetWithKeys(mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vks2) != 2 {
+		t.Fatal("did not get expected values")
+	}
+
+	// The same value has the same key at both multihashes, and different
+	// values have different keys.
+	var matched int
+	for _, vk := range vks2 {
+		if vk.Value.Equal(value1) {
+			if !bytes.Equal(vk.Key, vks1[0].Key) {
+				t.Fatal("same value has different keys")
+			}
+			matched++
+		} else if bytes.Equal(vk.Key, vks1[0].Key) {
+			t.Fatal("different values have same key")
+		}
+	}
+	if matched != 1 {
+		t.Fatal("value not found at second multihash")
+	}
+
+	// ValueKeys returns the same keys without the values.
+	keys, found, err := s.ValueKeys(mhs[1])
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !found || len(keys) != len(vks2) {
+		t.Fatal("did not get expected value keys")
+	}
+	for _, vk := range vks2 {
+		var found bool
+		for _, k := range keys {
+			if bytes.Equal(k, vk.Key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatal("value key missing from ValueKeys")
+		}
+	}
+	if _, found, err = s.ValueKeys(test.RandomMultihashes(1)[0]); err != nil || found {
+		t.Fatal("expected no value keys for unknown multihash")
+	}
 
 	if err = s.Close(); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestGetWithKeysSorted(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir, SortValues(true))
+
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(1)
+	// Put values in reverse order.
+	for _, ctxID := range []string{"ctx-3", "ctx-2", "ctx-1"} {
+		value := indexer.Value{ProviderID: p, ContextID: []byte(ctxID), MetadataBytes: []byte("meta")}
+		if err := s.Put(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen the store so that the stats only count the value-keys read by
+	// GetWithKeys.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = newStore(t, dir, SortValues(true))
+	defer s.Close()
+
+	vks, found, err := s.GetWithKeys(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vks) != 3 {
+		t.Fatal("did not get expected values")
+	}
+	for i, ctxID := range []string{"ctx-1", "ctx-2", "ctx-3"} {
+		if string(vks[i].Value.ContextID) != ctxID {
+			t.Fatalf("expected value %d to have context ID %s, got %s", i, ctxID, vks[i].Value.ContextID)
+		}
+		if !bytes.Equal(vks[i].Key, s.keys.makeValueKey(vks[i].Value)) {
+			t.Fatal("value-key does not match value after sorting")
+		}
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MaxValueKeys != 3 {
+		t.Fatalf("expected max of 3 value-keys, got %d", stats.MaxValueKeys)
+	}
+}
+
+func TestIterContext(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	value := testValue(t)
+	if err := s.Put(value, test.RandomMultihashes(50)...); err != nil {
+		t.Fatal(err)
+	}
+
+	type progresser interface {
+		Progress() (uint64, uint64)
+	}
+
+	iter, err := s.IterContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		_, _, err = iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 50 {
+		t.Fatalf("expected 50 multihashes, got %d", count)
+	}
+	scanned, total := iter.(progresser).Progress()
+	if total == 0 || scanned != total {
+		t.Fatalf("expected all %d bytes scanned, got %d", total, scanned)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter, err = s.IterContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = iter.Next(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, _, err = iter.Next(); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeValues(t *testing.T) {
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(2)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("meta-1"),
+	}
+	update := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("meta-2"),
+	}
+
+	// Keep the existing value.
+	mergeOlder := func(existing, incoming indexer.Value) indexer.Value {
+		return existing
+	}
+	s := newStore(t, t.TempDir(), MergeValues(mergeOlder))
+	if err := s.Put(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(update, mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+	vals, found, err := s.Get(mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("multihash not found")
+	}
+	if !vals[0].Equal(value) {
+		t.Fatal("expected existing value to be kept")
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Combine existing and incoming metadata.
+	mergeUnion := func(existing, incoming indexer.Value) indexer.Value {
+		existing.MetadataBytes = append(existing.MetadataBytes, incoming.MetadataBytes...)
+		return existing
+	}
+	s = newStore(t, t.TempDir(), MergeValues(mergeUnion))
+	if err = s.Put(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(update, mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+	vals, _, err = s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(vals[0].MetadataBytes) != "meta-1meta-2" {
+		t.Fatalf("wrong merged metadata: %q", vals[0].MetadataBytes)
+	}
+
+	// Merge result must keep the same provider and context.
+	badMerge := func(existing, incoming indexer.Value) indexer.Value {
+		existing.ContextID = []byte("other")
+		return existing
+	}
+	s2 := newStore(t, t.TempDir(), MergeValues(badMerge))
+	if err = s2.Put(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.Put(update, mhs[1]); err == nil {
+		t.Fatal("expected error from merge that changes context")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnPut(t *testing.T) {
+	type putEvent struct {
+		value   indexer.Value
+		mhCount int
+	}
+	var events []putEvent
+	s := newStore(t, t.TempDir(), OnPut(func(value indexer.Value, mhCount int) {
+		events = append(events, putEvent{value, mhCount})
+	}))
+	p := testPeer(t)
+	value := testValue(t)
+
+	if err := s.Put(value, test.RandomMultihashes(3)...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutMany(value, test.RandomMultihashes(5)); err != nil {
+		t.Fatal(err)
+	}
+	// A failed put does not call the hook.
+	if err := s.Put(indexer.Value{ProviderID: p, ContextID: []byte("ctxid")}, test.RandomMultihashes(1)...); err == nil {
+		t.Fatal("expected error putting value without metadata")
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 put events, got %d", len(events))
+	}
+	for i, mhCount := range []int{3, 5} {
+		if !events[i].value.Equal(value) {
+			t.Fatal("hook got wrong value")
+		}
+		if events[i].mhCount != mhCount {
+			t.Fatalf("expected multihash count %d, got %d", mhCount, events[i].mhCount)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCustomPrimary(t *testing.T) {
+	dir := t.TempDir()
+	primaryPath := filepath.Join(t.TempDir(), "custom.data")
+	p, err := mhprimary.OpenMultihashPrimary(primaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newStore(t, dir, Primary(p))
+	test.E2ETest(t, s)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(primaryPath); err != nil {
+		t.Fatal("custom primary not used:", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "storethehash.data")); !os.IsNotExist(err) {
+		t.Fatal("default primary should not be created")
+	}
+
+	_, err = New(context.Background(), t.TempDir(), Primary(nil))
+	if err == nil {
+		t.Fatal("expected error opening store with nil primary")
+	}
+}
+
+func TestPrunedValueKeys(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(1)
+	value1 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("meta-1"),
+	}
+	value2 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-2"),
+		MetadataBytes: []byte("meta-2"),
+	}
+	if err := s.Put(value1, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the value record, leaving its value-key in the multihash's
+	// value-key list.
+	if err := s.RemoveProviderContext(p, value1.ContextID); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PrunedValueKeys != 0 {
+		t.Fatalf("expected 0 pruned value-keys, got %d", st.PrunedValueKeys)
+	}
+
+	vals, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(vals) != 1 {
+		t.Fatal("expected 1 value for multihash")
+	}
+
+	st, err = s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PrunedValueKeys != 1 {
+		t.Fatalf("expected 1 pruned value-key, got %d", st.PrunedValueKeys)
+	}
+
+	// Reading again should not prune anything more.
+	if _, _, err = s.Get(mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	st, _ = s.Stats()
+	if st.PrunedValueKeys != 1 {
+		t.Fatalf("expected 1 pruned value-key, got %d", st.PrunedValueKeys)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutConcurrency(t *testing.T) {
+	s := newStore(t, t.TempDir(), PutConcurrency(4))
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(100)
+	// Include duplicate multihashes, which must only be mapped once.
+	dups := append(mhs, mhs[:50]...)
+	if err := s.Put(value, dups...); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatal("multihash not found")
+		}
+		if len(vals) != 1 || !vals[0].Equal(value) {
+			t.Fatalf("expected exactly 1 value, got %d", len(vals))
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStore(t, t.TempDir(), PutConcurrency(4))
+	test.E2ETest(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkPut100k(b *testing.B) {
+	for _, n := range []int{1, 8} {
+		b.Run(fmt.Sprint("concurrency-", n), func(b *testing.B) {
+			benchPut(b, 100000, PutConcurrency(n))
+		})
+	}
+}
+
+// BenchmarkPut50k compares the ways of writing the index entries of a large
+// advertisement: one store write per multihash, concurrent writes, and writes
+// collected by the coalescer.
+func BenchmarkPut50k(b *testing.B) {
+	b.Run("per-key", func(b *testing.B) {
+		benchPut(b, 50000)
+	})
+	b.Run("concurrency-8", func(b *testing.B) {
+		benchPut(b, 50000, PutConcurrency(8))
+	})
+	b.Run("coalesce", func(b *testing.B) {
+		benchPut(b, 50000, PutConcurrency(8), CoalesceWindow(time.Millisecond))
+	})
+}
+
+func benchPut(b *testing.B, count int, options ...Option) {
+	p := testPeer(b)
+	// test.RandomMultihashes is too slow for this many multihashes.
+	mhs := make([]multihash.Multihash, count)
+	var err error
+	for i := range mhs {
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s := newStore(b, b.TempDir(), options...)
+		value := indexer.Value{
+			ProviderID:    p,
+			ContextID:     []byte(fmt.Sprint("ctxid-", i)),
+			MetadataBytes: []byte("metadata"),
+		}
+		b.StartTimer()
+
+		if err = s.Put(value, mhs...); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		if err = s.Close(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func TestPutNew(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(10)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta-2")}
+
+	if err := s.PutNew(value1, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(value1) {
+			t.Fatal("did not get value put with PutNew")
+		}
+	}
+
+	// PutNew replaces existing mappings instead of adding to them.
+	if err := s.PutNew(value2, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	vals, _, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || !vals[0].Equal(value2) {
+		t.Fatal("expected multihash to map only to new value")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveBatch(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(4)
+	value1 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-1"),
+		MetadataBytes: []byte("meta-1"),
+	}
+	value2 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-2"),
+		MetadataBytes: []byte("meta-2"),
+	}
+	value3 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid-3"),
+		MetadataBytes: []byte("meta-3"),
+	}
+	if err := s.Put(value1, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value3, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlapping groups: mhs[1] appears for both values and twice for value1.
+	err := s.RemoveBatch([]indexer.Value{value1, value2, value1},
+		mhs[:2], mhs[1:3], mhs[1:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := [][]indexer.Value{
+		{value2, value3},
+		nil,
+		{value1},
+		{value1, value2},
+	}
+	for i, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expect[i]) == 0 {
+			if found {
+				t.Fatalf("multihash %d should have been removed", i)
+			}
+			continue
+		}
+		if len(vals) != len(expect[i]) {
+			t.Fatalf("multihash %d: expected %d values, got %d", i, len(expect[i]), len(vals))
+		}
+		for _, ev := range expect[i] {
+			var ok bool
+			for _, v := range vals {
+				if v.Equal(ev) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				t.Fatalf("multihash %d: missing value %s", i, ev.ContextID)
+			}
+		}
+	}
+
+	if err = s.RemoveBatch([]indexer.Value{value1}); err == nil {
+		t.Fatal("expected error for mismatched values and multihash groups")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveProviderCount(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(3)
+	for i := range mhs {
+		value := indexer.Value{ProviderID: p1, ContextID: []byte(fmt.Sprint("ctxid-", i)), MetadataBytes: []byte("meta")}
+		if err = s.Put(value, mhs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := indexer.Value{ProviderID: p2, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta")}
+	if err = s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := s.RemoveProviderCount(context.Background(), p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != uint64(len(mhs)) {
+		t.Fatalf("expected %d values removed, got %d", len(mhs), count)
+	}
+	count, err = s.RemoveProviderCount(context.Background(), p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no values removed, got %d", count)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSizeBreakdown(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	value := testValue(t)
+	if err := s.Put(value, test.RandomMultihashes(100)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	indexBytes, dataBytes, err := s.SizeBreakdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexBytes == 0 || dataBytes == 0 {
+		t.Fatalf("expected non-zero sizes, got index %d and data %d", indexBytes, dataBytes)
+	}
+	size, err := s.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != indexBytes+dataBytes {
+		t.Fatalf("size %d is not sum of index %d and data %d", size, indexBytes, dataBytes)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingPrimary is a primary storage that fails to flush once fail is set.
+type failingPrimary struct {
+	primary.PrimaryStorage
+	fail int32
+}
+
+func (p *failingPrimary) Flush() (sthtypes.Work, error) {
+	if atomic.LoadInt32(&p.fail) != 0 {
+		return 0, errors.New("disk failure")
+	}
+	return p.PrimaryStorage.Flush()
+}
+
+func TestOnSyncError(t *testing.T) {
+	mp, err := mhprimary.OpenMultihashPrimary(filepath.Join(t.TempDir(), "custom.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &failingPrimary{PrimaryStorage: mp}
+	syncErrs := make(chan error, 1)
+	s, err := New(context.Background(), t.TempDir(),
+		Primary(fp),
+		SyncInterval(10*time.Millisecond),
+		OnSyncError(func(err error) {
+			syncErrs <- err
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := testValue(t)
+
+	atomic.StoreInt32(&fp.fail, 1)
+	// Write something so that the background sync has work to do.
+	if err = s.Put(value, test.RandomMultihashes(1)...); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case err = <-syncErrs:
+		if err == nil || err.Error() != "disk failure" {
+			t.Fatalf("unexpected sync error: %v", err)
+		}
+	case <-timeout:
+		t.Fatal("sync error handler was not called")
+	}
+
+	// The handler is not called again for the same error.
+	select {
+	case <-syncErrs:
+		t.Fatal("sync error handler called more than once for same error")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing also returns the error.
+	if err = s.Close(); err == nil {
+		t.Fatal("expected error from close")
+	}
+}
+
+func TestPutReturningPrevious(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(2)
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctxid"), MetadataBytes: []byte("meta-1")}
+
+	prev, err := s.PutReturningPrevious(value, mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != nil {
+		t.Fatal("expected no previous value for new value")
+	}
+
+	// Storing the same value again does not change it.
+	prev, err = s.PutReturningPrevious(value, mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != nil {
+		t.Fatal("expected no previous value for unchanged value")
+	}
+
+	updated := value
+	updated.MetadataBytes = []byte("meta-2")
+	prev, err = s.PutReturningPrevious(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev == nil || !prev.Equal(value) {
+		t.Fatal("did not get previous value")
+	}
+
+	vals, _, err := s.Get(mhs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 1 || !vals[0].Equal(updated) {
+		t.Fatal("value was not updated")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressMetadata(t *testing.T) {
+	p := testPeer(t)
+	bigMeta := bytes.Repeat([]byte("compressible-metadata-"), 50)
+	values := []indexer.Value{
+		{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: bigMeta},
+		{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: append([]byte("gzip-"), bigMeta...)},
+		{ProviderID: p, ContextID: []byte("ctxid-3"), MetadataBytes: append([]byte("zstd-"), bigMeta...)},
+		{ProviderID: p, ContextID: []byte("ctxid-4"), MetadataBytes: []byte("small-metadata")},
+	}
+	mhs := test.RandomMultihashes(4)
+	dir := t.TempDir()
+
+	// Store values without compression, then with each codec, in the same
+	// store, so that it holds a mix of compressed and uncompressed records.
+	codecs := []indexer.MetadataCodec{indexer.MetadataUncompressed, indexer.MetadataGzip, indexer.MetadataZstd, indexer.MetadataZstd}
+	for i, codec := range codecs {
+		s := newStore(t, dir, CompressMetadata(codec))
+		if err := s.Put(values[i], mhs...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataSize := func(codec indexer.MetadataCodec) int64 {
+		s := newStore(t, t.TempDir(), CompressMetadata(codec))
+		defer s.Close()
+		if err := s.Put(values[0], mhs[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		_, dataBytes, err := s.SizeBreakdown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dataBytes
+	}
+	if dataSize(indexer.MetadataZstd) >= dataSize(indexer.MetadataUncompressed) {
+		t.Fatal("expected compressed store to be smaller")
+	}
+
+	// All values are read back, whether or not compression is enabled.
+	for _, codec := range []indexer.MetadataCodec{indexer.MetadataUncompressed, indexer.MetadataGzip} {
+		s := newStore(t, dir, CompressMetadata(codec))
+		for _, m := range mhs {
+			got, found, err := s.Get(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || len(got) != len(values) {
+				t.Fatalf("expected %d values, got %d", len(values), len(got))
+			}
+			for i := range values {
+				if !got[i].Equal(values[i]) {
+					t.Fatal("value did not round-trip")
+				}
+			}
+		}
+
+		headers, _, err := s.GetHeaders(mhs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, h := range headers {
+			if h.MetadataLen != len(values[i].MetadataBytes) {
+				t.Fatalf("expected metadata length %d, got %d", len(values[i].MetadataBytes), h.MetadataLen)
+			}
+		}
+
+		// Putting an unchanged value that is stored compressed does not
+		// replace it.
+		prev, err := s.PutReturningPrevious(values[2], mhs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev != nil {
+			t.Fatal("expected no previous value for unchanged value")
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSkipCorruptValues(t *testing.T) {
+	p := testPeer(t)
+	value1 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta")}
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta")}
+	mhs := test.RandomMultihashes(2)
+
+	// putCorrupt maps both multihashes to both values, and then overwrites the
+	// record of the first value with data that cannot be decoded.
+	putCorrupt := func(s *Store) {
+		if err := s.Put(value1, mhs...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(value2, mhs...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.store.Put(s.keys.makeValueKey(value1), []byte("junk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// By default, a corrupt value fails the Get.
+	s := newStore(t, t.TempDir())
+	putCorrupt(s)
+	if _, _, err := s.Get(mhs[0]); err == nil {
+		t.Fatal("expected error getting corrupt value")
+	}
+	s.Close()
+
+	s = newStore(t, t.TempDir(), SkipCorruptValues(true))
+	defer s.Close()
+	putCorrupt(s)
+	for i := 0; i < 2; i++ {
+		values, found, err := s.Get(mhs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(values) != 1 || !values[0].Equal(value2) {
+			t.Fatalf("expected only the second value, got %v", values)
+		}
+	}
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.CorruptValues != 2 || st.PrunedValueKeys != 0 {
+		t.Fatalf("expected 2 corrupt values and no pruned value-keys, got %d and %d", st.CorruptValues, st.PrunedValueKeys)
+	}
+
+	s2 := newStore(t, t.TempDir(), PruneCorruptValues(true))
+	defer s2.Close()
+	putCorrupt(s2)
+	for i := 0; i < 2; i++ {
+		values, found, err := s2.Get(mhs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(values) != 1 || !values[0].Equal(value2) {
+			t.Fatalf("expected only the second value, got %v", values)
+		}
+	}
+	// The corrupt value is only read once, since its value-key was pruned.
+	st, err = s2.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.CorruptValues != 1 || st.PrunedValueKeys != 1 {
+		t.Fatalf("expected 1 corrupt value and 1 pruned value-key, got %d and %d", st.CorruptValues, st.PrunedValueKeys)
+	}
+	// The other multihash still maps to the corrupt value.
+	if _, found, err := s2.Get(mhs[1]); err != nil || !found {
+		t.Fatalf("expected second multihash to be found, got found %t, err %v", found, err)
+	}
+}
+
+func TestSkipDuplicateCheck(t *testing.T) {
+	s := newStore(t, t.TempDir(), SkipDuplicateCheck(true))
+	defer s.Close()
+
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(1)
+	if err := s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Putting the same value again maps the multihash to it twice.
+	if err := s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	valueKeys, _, err := s.ValueKeys(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valueKeys) != 2 {
+		t.Fatalf("expected 2 value-keys, got %d", len(valueKeys))
+	}
+
+	// Repair removes the duplicate.
+	report, err := s.RepairValueKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DuplicateKeys != 1 {
+		t.Fatalf("expected 1 duplicate value-key repaired, got %d", report.DuplicateKeys)
+	}
+	values, _, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 {
+		t.Fatalf("expected 1 value after repair, got %d", len(values))
+	}
+}
+
+// BenchmarkPutDuplicateCheck puts a value for multihashes that each already
+// map to several values, with and without checking for a duplicate value.
+func BenchmarkPutDuplicateCheck(b *testing.B) {
+	const (
+		mhCount        = 1000
+		existingValues = 8
+	)
+	p := testPeer(b)
+	mhs := make([]multihash.Multihash, mhCount)
+	var err error
+	for i := range mhs {
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprint("skip-", skip), func(b *testing.B) {
+			s := newStore(b, b.TempDir(), SkipDuplicateCheck(skip))
+			defer s.Close()
+			for i := 0; i < existingValues; i++ {
+				value := indexer.Value{
+					ProviderID:    p,
+					ContextID:     []byte(fmt.Sprint("existing-", i)),
+					MetadataBytes: []byte("metadata"),
+				}
+				if err = s.Put(value, mhs...); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				value := indexer.Value{
+					ProviderID:    p,
+					ContextID:     []byte(fmt.Sprint("ctxid-", i)),
+					MetadataBytes: []byte("metadata"),
+				}
+				if err = s.Put(value, mhs...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(20)
+	if err := s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]struct{})
+	err := s.ForEach(context.Background(), func(m multihash.Multihash, values []indexer.Value) error {
+		if len(values) != 1 || !values[0].Equal(value) {
+			t.Fatal("wrong values for multihash")
+		}
+		seen[string(m)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(mhs) {
+		t.Fatalf("visited %d multihashes, expected %d", len(seen), len(mhs))
+	}
+
+	// An error from the callback stops iteration.
+	errStop := errors.New("stop")
+	var count int
+	err = s.ForEach(context.Background(), func(multihash.Multihash, []indexer.Value) error {
+		count++
+		if count == 5 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("expected callback error, got %v", err)
+	}
+	if count != 5 {
+		t.Fatalf("expected 5 callbacks, got %d", count)
+	}
+
+	// Canceling the context stops iteration.
+	ctx, cancel := context.WithCancel(context.Background())
+	count = 0
+	err = s.ForEach(ctx, func(multihash.Multihash, []indexer.Value) error {
+		count++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 callback, got %d", count)
+	}
+}
+
+func TestGCIntervalDisabled(t *testing.T) {
+	// gcRunning counts the goroutines running index garbage collection, which
+	// are the only goroutines that opening the index starts.
+	gcRunning := func() int {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		return strings.Count(string(buf), "created by github.com/ipld/go-storethehash/store/index.OpenIndex")
+	}
+	before := gcRunning()
+
+	s := newStore(t, t.TempDir(), GCInterval(0))
+	defer s.Close()
+	if n := gcRunning(); n != before {
+		t.Fatalf("expected no garbage collection goroutine, found %d", n-before)
+	}
+
+	// A tiny interval is allowed, and starts garbage collection.
+	s2 := newStore(t, t.TempDir(), GCInterval(time.Nanosecond))
+	defer s2.Close()
+	if n := gcRunning(); n != before+1 {
+		t.Fatalf("expected 1 garbage collection goroutine, found %d", n-before)
+	}
+}
+
+func TestHasBatch(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	mhs := test.RandomMultihashes(10)
+	if err := s.Put(value, mhs[:6]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(value, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.HasBatch(mhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(mhs) {
+		t.Fatalf("returned %d results, expected %d", len(found), len(mhs))
+	}
+	for i, has := range found {
+		want := i >= 1 && i < 6
+		if has != want {
+			t.Fatalf("multihash %d: has is %t, expected %t", i, has, want)
+		}
+	}
+
+	found, err = s.HasBatch(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatal("expected no results for no multihashes")
+	}
+}
+
+// BenchmarkHasBatch checks whether a batch of multihashes, half of which are
+// in the store, are present using HasBatch and using Get for each multihash.
+func BenchmarkHasBatch(b *testing.B) {
+	const mhCount = 1000
+	p := testPeer(b)
+	mhs := make([]multihash.Multihash, mhCount)
+	var err error
+	for i := range mhs {
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("mh-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	s := newStore(b, b.TempDir())
+	defer s.Close()
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("metadata"),
+	}
+	if err = s.Put(value, mhs[:mhCount/2]...); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("HasBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.HasBatch(mhs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, m := range mhs {
+				if _, _, err := s.Get(m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestIterShards(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(100)
+	for i, ctxID := range []string{"ctx-1", "ctx-2"} {
+		value := indexer.Value{
+			ProviderID:    p,
+			ContextID:     []byte(ctxID),
+			MetadataBytes: []byte("metadata"),
+		}
+		// Put some multihashes twice, so that they are stored more than once
+		// in primary storage.
+		if err := s.Put(value, mhs[i*25:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := make(map[string]int)
+	err := s.ForEach(context.Background(), func(m multihash.Multihash, values []indexer.Value) error {
+		want[string(m)] = len(values)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != len(mhs) {
+		t.Fatalf("expected %d multihashes, got %d", len(mhs), len(want))
+	}
+
+	if _, err = s.IterShards(context.Background(), 0); err == nil {
+		t.Fatal("expected error for 0 shards")
+	}
+	for _, n := range []int{1, 3, 8} {
+		shards, err := s.IterShards(context.Background(), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shards) != n {
+			t.Fatalf("expected %d shards, got %d", n, len(shards))
+		}
+		got := make(map[string]int)
+		for _, iter := range shards {
+			for {
+				m, values, err := iter.Next()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					t.Fatal(err)
+				}
+				if _, ok := got[string(m)]; ok {
+					t.Fatal("multihash returned by more than one shard")
+				}
+				got[string(m)] = len(values)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("shards returned %d multihashes, expected %d", len(got), len(want))
+		}
+		for k, n := range want {
+			if got[k] != n {
+				t.Fatal("shards returned different values than single iterator")
+			}
+		}
+	}
+}
+
+func TestLockTiming(t *testing.T) {
+	p := testPeer(t)
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctxid"), MetadataBytes: []byte("metadata")}
+	mhs := test.RandomMultihashes(10)
+
+	for _, enable := range []bool{false, true} {
+		s := newStore(t, t.TempDir(), LockTiming(enable))
+		if err := s.Put(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+		st, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enable {
+			if st.ValueLockWait == 0 || st.KeyLockWait == 0 {
+				t.Fatal("expected lock wait times to be recorded")
+			}
+		} else if st.ValueLockWait != 0 || st.KeyLockWait != 0 {
+			t.Fatal("expected no lock wait times when lock timing is disabled")
+		}
+		s.Close()
+	}
+}
+
+func TestMaxValuesPerMultihash(t *testing.T) {
+	const maxValues = 3
+	for _, coalesce := range []bool{false, true} {
+		opts := []Option{MaxValuesPerMultihash(maxValues)}
+		if coalesce {
+			opts = append(opts, CoalesceWindow(time.Millisecond))
+		}
+		s := newStore(t, t.TempDir(), opts...)
+		defer s.Close()
+
+		p := testPeer(t)
+		mhs := test.RandomMultihashes(1)
+		values := make([]indexer.Value, maxValues+1)
+		for i := range values {
+			values[i] = indexer.Value{
+				ProviderID:    p,
+				ContextID:     []byte(fmt.Sprint("ctx-", i)),
+				MetadataBytes: []byte("metadata"),
+			}
+		}
+		for _, value := range values[:maxValues] {
+			if err := s.Put(value, mhs...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Putting a value that the multihash already maps to is not an error.
+		if err := s.Put(values[0], mhs...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(values[maxValues], mhs...); !errors.Is(err, ErrTooManyValues) {
+			t.Fatalf("expected ErrTooManyValues, got %v", err)
+		}
+
+		got, _, err := s.Get(mhs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != maxValues {
+			t.Fatalf("expected %d values, got %d", maxValues, len(got))
+		}
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.MaxValueKeys != maxValues {
+			t.Fatalf("expected max of %d value-keys, got %d", maxValues, stats.MaxValueKeys)
+		}
+		if stats.AvgValueKeys < 1 || stats.AvgValueKeys > maxValues {
+			t.Fatalf("average of %f value-keys out of range", stats.AvgValueKeys)
+		}
+	}
+}
+
+// sharedPrimary is a primary storage shared by more than one store, which is
+// closed by the test instead of by the stores.
+type sharedPrimary struct {
+	primary.PrimaryStorage
+}
+
+func (sharedPrimary) Close() error { return nil }
+
+func TestNamespace(t *testing.T) {
+	p, err := mhprimary.OpenMultihashPrimary(filepath.Join(t.TempDir(), "shared.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	dirA := t.TempDir()
+	storeA := newStore(t, dirA, Primary(sharedPrimary{p}), Namespace("a"))
+	storeB := newStore(t, t.TempDir(), Primary(sharedPrimary{p}), Namespace("b"))
+
+	provID := testPeer(t)
+	// Both stores have a value with the same provider and context, so the
+	// value is stored under the same value-key without a namespace.
+	valueA := indexer.Value{ProviderID: provID, ContextID: []byte("ctx"), MetadataBytes: []byte("meta-a")}
+	valueB := indexer.Value{ProviderID: provID, ContextID: []byte("ctx"), MetadataBytes: []byte("meta-b")}
+	mhsA := test.RandomMultihashes(10)
+	mhsB := test.RandomMultihashes(10)
+	if err = storeA.Put(valueA, mhsA...); err != nil {
+		t.Fatal(err)
+	}
+	if err = storeB.Put(valueB, mhsB...); err != nil {
+		t.Fatal(err)
+	}
+	if err = storeA.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = storeB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Iterating a store, which scans the shared primary storage, only finds
+	// the multihashes of the store's namespace.
+	iter, err := storeA.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		m, values, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for i := range mhsA {
+			if bytes.Equal(m, mhsA[i]) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("iterator returned multihash from other namespace")
+		}
+		if len(values) != 1 || !values[0].Equal(valueA) {
+			t.Fatal("iterator returned wrong value")
+		}
+		count++
+	}
+	if count != len(mhsA) {
+		t.Fatalf("iterator returned %d multihashes, expected %d", count, len(mhsA))
+	}
+
+	// Removing the provider from one store, which scans the shared primary
+	// storage for the provider's values, does not remove them from the other.
+	if err = storeA.RemoveProvider(context.Background(), provID); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := storeA.Get(mhsA[0]); err != nil || found {
+		t.Fatalf("expected provider to be removed, found %t, err %v", found, err)
+	}
+	values, found, err := storeB.Get(mhsB[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(values) != 1 || !values[0].Equal(valueB) {
+		t.Fatal("value removed from other namespace")
+	}
+
+	if err = storeA.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = storeB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store must be opened again with the same namespace.
+	_, err = New(context.Background(), dirA, Primary(sharedPrimary{p}), Namespace("b"))
+	if err == nil {
+		t.Fatal("expected error opening store with different namespace")
+	}
+
+	// A store with a namespace that was created before the namespace key
+	// layout was recorded has keys in a different layout.
+	oldMarker := fmt.Sprintf(`{"formatVersion":%d,"indexKeys":"reversed","namespace":"a"}`, FormatVersion)
+	if err = os.WriteFile(filepath.Join(dirA, markerFileName), []byte(oldMarker), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(context.Background(), dirA, Primary(sharedPrimary{p}), Namespace("a"))
+	if err == nil {
+		t.Fatal("expected error opening store with earlier namespace key layout")
+	}
+
+	_, err = New(context.Background(), t.TempDir(), Primary(sharedPrimary{p}), Namespace(strings.Repeat("n", 256)))
+	if err == nil {
+		t.Fatal("expected error opening store with namespace that is too long")
+	}
+}
+
+func TestNamespaceSharedKeys(t *testing.T) {
+	// Each pair of namespaces would have matching key suffixes if the
+	// namespace was put right before the kind suffix.
+	for _, nss := range [][2]string{{"", "X"}, {"A", "BA"}} {
+		t.Run(fmt.Sprintf("%q-%q", nss[0], nss[1]), func(t *testing.T) {
+			p, err := mhprimary.OpenMultihashPrimary(filepath.Join(t.TempDir(), "shared.data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			var stores [2]*Store
+			var mhs [2][]multihash.Multihash
+			value := testValue(t)
+			for i, ns := range nss {
+				stores[i] = newStore(t, t.TempDir(), Primary(sharedPrimary{p}), Namespace(ns))
+				defer stores[i].Close()
+				mhs[i] = test.RandomMultihashes(10)
+				if err = stores[i].Put(value, mhs[i]...); err != nil {
+					t.Fatal(err)
+				}
+				if err = stores[i].Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Scans that do not look keys up in the store's own index, such as
+			// building the ordered index, rely on only decoding the keys of
+			// the store's own namespace.
+			for i, s := range stores {
+				other := stores[1-i]
+				if _, ok := other.keys.decodeIndexKey(s.keys.makeIndexKey(mhs[i][0])); ok {
+					t.Fatalf("store %d decoded index key of store %d", 1-i, i)
+				}
+				if other.keys.isValueKey(s.keys.makeValueKey(value)) {
+					t.Fatalf("store %d decoded value key of store %d", 1-i, i)
+				}
+			}
+
+			for i, s := range stores {
+				iter, err := s.Iter()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var count int
+				for {
+					m, _, err := iter.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					var found bool
+					for j := range mhs[i] {
+						if bytes.Equal(m, mhs[i][j]) {
+							found = true
+						}
+					}
+					if !found {
+						t.Fatalf("iterator of store %d returned multihash of other store", i)
+					}
+					count++
+				}
+				if count != len(mhs[i]) {
+					t.Fatalf("iterator of store %d returned %d multihashes, expected %d", i, count, len(mhs[i]))
+				}
+			}
+
+			for i, s := range stores {
+				other := stores[1-i]
+				if err = s.RemoveProvider(context.Background(), value.ProviderID); err != nil {
+					t.Fatal(err)
+				}
+				if _, found, err := s.Get(mhs[i][0]); err != nil || found {
+					t.Fatalf("expected provider to be removed from store %d, found %t, err %v", i, found, err)
+				}
+				values, found, err := other.Get(mhs[1-i][0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found || len(values) != 1 || !values[0].Equal(value) {
+					t.Fatalf("value removed from store %d by store %d", 1-i, i)
+				}
+				// Put the value back, so that removing it from the other
+				// store can be checked.
+				if err = s.Put(value, mhs[i]...); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPutStream(t *testing.T) {
+	p := testPeer(t)
+	value := testValue(t)
+	s := newStore(t, t.TempDir(), ReverseIndex(true))
+	defer s.Close()
+
+	mhs := make([]multihash.Multihash, 2500)
+	var err error
+	for i := range mhs {
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("stream-", i)), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := func(mhs []multihash.Multihash) <-chan multihash.Multihash {
+		mhChan := make(chan multihash.Multihash)
+		go func() {
+			defer close(mhChan)
+			for _, m := range mhs {
+				mhChan <- m
+			}
+		}()
+		return mhChan
+	}
+
+	// Nothing is stored for an empty stream.
+	added, err := s.PutStream(context.Background(), value, stream(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Fatalf("expected 0 multihashes added, got %d", added)
+	}
+	est, err := s.CountProviderRecords(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Values != 0 {
+		t.Fatal("expected value not to be stored for empty stream")
+	}
+
+	added, err = s.PutStream(context.Background(), value, stream(mhs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != uint64(len(mhs)) {
+		t.Fatalf("expected %d multihashes added, got %d", len(mhs), added)
+	}
+	for _, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(value) {
+			t.Fatal("multihash not stored")
+		}
+	}
+	found, err := s.MultihashesForValue(context.Background(), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(mhs) {
+		t.Fatalf("expected %d multihashes in reverse index, got %d", len(mhs), len(found))
+	}
+
+	// Multihashes that are already mapped to the value are not counted.
+	added, err = s.PutStream(context.Background(), value, stream(mhs[:10]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Fatalf("expected 0 multihashes added, got %d", added)
+	}
+
+	// Canceling stops reading the stream, and keeps what was stored.
+	value2 := indexer.Value{ProviderID: p, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("meta")}
+	ctx, cancel := context.WithCancel(context.Background())
+	mhChan := make(chan multihash.Multihash)
+	go func() {
+		for _, m := range mhs[:5] {
+			mhChan <- m
+		}
+		cancel()
+	}()
+	added, err = s.PutStream(ctx, value2, mhChan)
+	if err != context.Canceled {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if added != 5 {
+		t.Fatalf("expected 5 multihashes added before cancel, got %d", added)
+	}
+	vals, _, err := s.Get(mhs[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 2 {
+		t.Fatalf("expected 2 values for multihash, got %d", len(vals))
+	}
+
+	// A stream that is still open does not keep Close waiting.
+	mhChan = make(chan multihash.Multihash)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := s.PutStream(context.Background(), value2, mhChan)
+		errChan <- err
+	}()
+	mhChan <- mhs[5]
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(mhChan)
+	if err = <-errChan; !errors.Is(err, indexer.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPutStrict(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	value := testValue(t)
+	mhs := test.RandomMultihashes(10)
+
+	added, dups, err := s.PutStrict(value, mhs[:6]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 6 || dups != 0 {
+		t.Fatalf("expected 6 added and no duplicates, got %d and %d", added, dups)
+	}
+
+	// Putting the same multihashes again reports all of them as duplicates.
+	added, dups, err = s.PutStrict(value, mhs[:6]...)
+	if !errors.Is(err, ErrDuplicatePut) {
+		t.Fatalf("expected ErrDuplicatePut, got %v", err)
+	}
+	if added != 0 || dups != 6 {
+		t.Fatalf("expected no multihashes added and 6 duplicates, got %d and %d", added, dups)
+	}
+
+	// New multihashes are still stored when some are duplicates.
+	added, dups, err = s.PutStrict(value, mhs...)
+	if !errors.Is(err, ErrDuplicatePut) {
+		t.Fatalf("expected ErrDuplicatePut, got %v", err)
+	}
+	if added != 4 || dups != 6 {
+		t.Fatalf("expected 4 added and 6 duplicates, got %d and %d", added, dups)
+	}
+	for _, m := range mhs {
+		if _, found, err := s.Get(m); err != nil || !found {
+			t.Fatalf("multihash not found after put: %v", err)
+		}
+	}
+}
+
+func TestPutNoMultihashes(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-id"),
+		MetadataBytes: []byte("metadata"),
+	}
+	updated := value
+	updated.MetadataBytes = []byte("new-metadata")
+
+	// Put with no multihashes does not store a new value.
+	if err := s.Put(value); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := s.PutReturningPrevious(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev != nil {
+		t.Fatal("value was stored by put with no multihashes")
+	}
+
+	// RegisterValue stores the value, which put then updates.
+	if err = s.RegisterValue(value); err != nil {
+		t.Fatal(err)
+	}
+	prev, err = s.PutReturningPrevious(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev == nil || !prev.Equal(value) {
+		t.Fatal("registered value was not stored")
+	}
+
+	mhs := test.RandomMultihashes(1)
+	if err = s.Put(updated, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	values, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || len(values) != 1 || !values[0].Equal(updated) {
+		t.Fatal("did not get updated value")
+	}
+}
+
+// iterCountPrimary is a primary storage that counts the iterators it opens.
+type iterCountPrimary struct {
+	primary.PrimaryStorage
+	iters int32
+}
+
+func (p *iterCountPrimary) Iter() (primary.PrimaryStorageIter, error) {
+	atomic.AddInt32(&p.iters, 1)
+	return p.PrimaryStorage.Iter()
+}
+
+func TestRemoveBatchSize(t *testing.T) {
+	mp, err := mhprimary.OpenMultihashPrimary(filepath.Join(t.TempDir(), "custom.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &iterCountPrimary{PrimaryStorage: mp}
+	s := newStore(t, t.TempDir(),
+		Primary(cp),
+		RemoveBatchSize(2))
+	defer s.Close()
+
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(10)
+	for i, m := range mhs {
+		ctxID := []byte(fmt.Sprint("ctxid-", i))
+		if err = s.Put(indexer.Value{ProviderID: p1, ContextID: ctxID, MetadataBytes: []byte("meta")}, m); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put(indexer.Value{ProviderID: p2, ContextID: ctxID, MetadataBytes: []byte("meta")}, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(&cp.iters, 0)
+	count, err := s.RemoveProviderCount(context.Background(), p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != uint64(len(mhs)) {
+		t.Fatalf("expected %d values removed, got %d", len(mhs), count)
+	}
+	if n := atomic.LoadInt32(&cp.iters); n != 1 {
+		t.Fatalf("expected one primary iterator for all batches, got %d", n)
+	}
+	for _, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || vals[0].ProviderID != p2 {
+			t.Fatal("expected only the value of the other provider")
+		}
+	}
+}
+
+func TestSortValues(t *testing.T) {
+	s := newStore(t, t.TempDir(), SortValues(true))
+	defer s.Close()
+
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(1)
+
+	// Put values in reverse order.
+	var values []indexer.Value
+	for _, p := range []peer.ID{p2, p1} {
+		for _, ctxID := range []string{"ctx-3", "ctx-2", "ctx-1"} {
+			value := indexer.Value{
+				ProviderID:    p,
+				ContextID:     []byte(ctxID),
+				MetadataBytes: []byte("metadata"),
+			}
+			if err = s.Put(value, mhs...); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, value)
+		}
+	}
+	// Removing a value moves the last value in the stored list.
+	if err = s.RemoveProviderContext(p2, []byte("ctx-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("multihash not found")
+	}
+	want := []indexer.Value{values[5], values[4], values[3], values[2], values[0]}
+	if p2 < p1 {
+		want = []indexer.Value{values[2], values[0], values[5], values[4], values[3]}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d values, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Fatalf("value %d is provider %s context %s, expected provider %s context %s", i, got[i].ProviderID, got[i].ContextID, want[i].ProviderID, want[i].ContextID)
+		}
+	}
+}
+
+func TestSizeAfterFlush(t *testing.T) {
+	value := testValue(t)
+	mhs := test.RandomMultihashes(100)
+
+	// dataSize puts the multihashes, without flushing, and returns the size
+	// of the primary storage.
+	dataSize := func(opts ...Option) int64 {
+		opts = append(opts, SyncInterval(time.Hour))
+		s := newStore(t, t.TempDir(), opts...)
+		defer s.Close()
+		if err := s.Put(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+		_, dataBytes, err := s.SizeBreakdown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dataBytes
+	}
+
+	unflushed := dataSize()
+	flushed := dataSize(SizeAfterFlush(true))
+	if flushed <= unflushed {
+		t.Fatalf("expected flushed size to be larger than %d, got %d", unflushed, flushed)
+	}
+}
+
+// BenchmarkParallelPutManyProviders measures concurrent PutMany calls that
+// each store a value for a different provider, so that the values being
+// updated do not conflict.
+func BenchmarkParallelPutManyProviders(b *testing.B) {
+	const mhsPerPut = 100
+	s := newStore(b, b.TempDir())
+	defer s.Close()
+
+	var next uint64
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mhs := make([]multihash.Multihash, mhsPerPut)
+		for pb.Next() {
+			i := atomic.AddUint64(&next, 1)
+			pmh, err := multihash.Sum([]byte(fmt.Sprint("provider-", i)), multihash.SHA2_256, -1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for j := range mhs {
+				mhs[j], err = multihash.Sum([]byte(fmt.Sprint("mh-", i, "-", j)), multihash.SHA2_256, -1)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			value := indexer.Value{
+				ProviderID:    peer.ID(pmh),
+				ContextID:     []byte("ctxid"),
+				MetadataBytes: []byte("metadata"),
+			}
+			if _, err = s.PutMany(value, mhs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package storethehash
+
+import (
+	"math/bits"
+
+	sthtypes "github.com/ipld/go-storethehash/store/types"
+)
+
+// Index parameter suggestions are derived from how go-storethehash lays out
+// its index:
+//
+// The index has 2^IndexBitSize buckets. Each bucket holds a record list with
+// one record for every key whose prefix maps to that bucket. The bucket
+// positions and sizes are kept in memory, taking 12 bytes per bucket. Every
+// write to a bucket appends a new copy of its whole record list to the index
+// file, so the amount written per put grows with the number of keys per
+// bucket. The bit size is chosen so that there are about targetBucketKeys keys
+// per bucket:
+//
+//	bits = ceil(log2(expectedKeys / targetBucketKeys))
+//
+// Each record is about indexRecordSize bytes: a 1 byte key size, an 8 byte
+// file offset, a 4 byte record size, and the part of the key that is needed to
+// tell it apart from the other keys in the bucket. The live index size is
+// therefore about:
+//
+//	expectedKeys * indexRecordSize + 2^bits * bucketHeaderSize
+//
+// The index is split into files of IndexFileSize bytes, and garbage
+// collection removes whole files. go-storethehash recommends keeping the file
+// size within a factor of 4 of its 1GiB default, so the suggested size is a
+// quarter of the live index size, rounded up to a power of 2 and clamped to
+// between 256MiB and 1GiB. Smaller stores get smaller files, which lets GC
+// reclaim space sooner.
+//
+// The in-memory bucket table is the part of the index that uses memory in
+// proportion to the index size: 2^bits buckets of bucketMemorySize bytes each.
+// A memory budget for the index therefore limits the bit size to:
+//
+//	bits <= floor(log2(budget / bucketMemorySize))
+//
+// With fewer bits than suggested for the number of keys, buckets hold more
+// keys, so each put writes more to the index file.
+//
+// BurstRate is the amount of outstanding work, in bytes, above which the store
+// is flushed early if data is coming in faster than it was last flushed. The
+// work for a put is the primary record, which is the key plus the value plus
+// a size prefix, and the rewritten bucket. The suggested burst rate is the
+// work of burstPuts puts, clamped to between the 4MiB default and 64MiB.
+const (
+	targetBucketKeys = 4
+	indexRecordSize  = 1 + 8 + 4 + 4
+	bucketHeaderSize = 4 + 4
+	bucketMemorySize = 8 + 4
+	primaryKeySize   = 40
+	burstPuts        = 16 * 1024
+
+	minSuggestedBits      = 16
+	maxSuggestedBits      = 30
+	minSuggestedIndexFile = 256 * 1024 * 1024
+	maxSuggestedIndexFile = 1024 * 1024 * 1024
+	maxSuggestedBurstRate = 64 * 1024 * 1024
+)
+
+// SuggestIndexParams returns IndexBitSize, IndexFileSize and BurstRate options
+// suited to a store that is expected to hold expectedKeys keys with values
+// that are, on average, avgValueSize bytes. Each multihash is one key, and
+// each distinct provider and context ID is another.
+//
+// The index bit size cannot be changed once the store is created, so
+// expectedKeys should allow for growth.
+func SuggestIndexParams(expectedKeys uint64, avgValueSize int) []Option {
+	indexBits, indexFileSize, burstRate := suggestIndexParams(expectedKeys, avgValueSize)
+	return []Option{
+		IndexBitSize(indexBits),
+		IndexFileSize(indexFileSize),
+		BurstRate(burstRate),
+	}
+}
+
+// IndexMemoryBudget sets the IndexBitSize, IndexFileSize and BurstRate
+// options suggested by SuggestIndexParams for expectedKeys keys, with the
+// index bit size reduced, if needed, so that the in-memory bucket table of the
+// index uses no more than budget bytes. The bit size is never less than 16,
+// which uses 768KiB, even if the budget is smaller.
+//
+// The budget only covers the bucket table, which is 12 bytes for each of the
+// 2^IndexBitSize buckets. It does not cover caches, or records that are
+// buffered before they are flushed to the index.
+func IndexMemoryBudget(budget int64, expectedKeys uint64) Option {
+	indexBits, indexFileSize, burstRate := suggestIndexParams(expectedKeys, 0)
+	if maxBits := budgetIndexBits(budget); indexBits > maxBits {
+		indexBits = maxBits
+	}
+	return func(cfg *config) {
+		cfg.indexSizeBits = indexBits
+		cfg.indexFileSize = indexFileSize
+		cfg.burstRate = sthtypes.Work(burstRate)
+	}
+}
+
+// budgetIndexBits returns the largest index bit size for which the bucket
+// table fits in budget bytes, clamped to the range of suggested bit sizes.
+func budgetIndexBits(budget int64) uint8 {
+	var indexBits int
+	if buckets := budget / bucketMemorySize; buckets > 1 {
+		indexBits = bits.Len64(uint64(buckets)) - 1
+	}
+	if indexBits < minSuggestedBits {
+		indexBits = minSuggestedBits
+	} else if indexBits > maxSuggestedBits {
+		indexBits = maxSuggestedBits
+	}
+	return uint8(indexBits)
+}
+
+func suggestIndexParams(expectedKeys uint64, avgValueSize int) (uint8, uint32, uint64) {
+	if avgValueSize < 0 {
+		avgValueSize = 0
+	}
+
+	// Number of bits needed for targetBucketKeys keys per bucket.
+	var indexBits int
+	if buckets := (expectedKeys + targetBucketKeys - 1) / targetBucketKeys; buckets > 1 {
+		indexBits = bits.Len64(buckets - 1)
+	}
+	if indexBits < minSuggestedBits {
+		indexBits = minSuggestedBits
+	} else if indexBits > maxSuggestedBits {
+		indexBits = maxSuggestedBits
+	}
+
+	liveIndexSize := expectedKeys*indexRecordSize + (uint64(1)<<indexBits)*bucketHeaderSize
+	indexFileSize := uint64(minSuggestedIndexFile)
+	for indexFileSize < liveIndexSize/4 && indexFileSize < maxSuggestedIndexFile {
+		indexFileSize *= 2
+	}
+
+	putWork := uint64(primaryKeySize+avgValueSize+4) + targetBucketKeys*indexRecordSize + bucketHeaderSize
+	burstRate := putWork * burstPuts
+	if burstRate < defaultBurstRate {
+		burstRate = defaultBurstRate
+	} else if burstRate > maxSuggestedBurstRate {
+		burstRate = maxSuggestedBurstRate
+	}
+
+	return uint8(indexBits), uint32(indexFileSize), burstRate
+}
@@ -0,0 +1,81 @@
+package storethehash
+
+import "testing"
+
+func TestSuggestIndexParams(t *testing.T) {
+	// Small stores get the minimums.
+	indexBits, indexFileSize, burstRate := suggestIndexParams(1000, 100)
+	if indexBits != minSuggestedBits {
+		t.Fatalf("expected %d index bits, got %d", minSuggestedBits, indexBits)
+	}
+	if indexFileSize != minSuggestedIndexFile {
+		t.Fatalf("expected index file size %d, got %d", minSuggestedIndexFile, indexFileSize)
+	}
+	if burstRate != defaultBurstRate {
+		t.Fatalf("expected burst rate %d, got %d", defaultBurstRate, burstRate)
+	}
+
+	// The default bit size is suggested for the number of keys it is suited
+	// to.
+	indexBits, _, _ = suggestIndexParams(targetBucketKeys<<defaultIndexSizeBits, 100)
+	if indexBits != defaultIndexSizeBits {
+		t.Fatalf("expected %d index bits, got %d", defaultIndexSizeBits, indexBits)
+	}
+
+	// Suggestions never decrease as the dataset grows, and stay in range.
+	var prevBits uint8
+	var prevFileSize uint32
+	var prevBurst uint64
+	for keys := uint64(1); keys < 1<<40; keys *= 4 {
+		indexBits, indexFileSize, burstRate = suggestIndexParams(keys, int(keys>>20))
+		if indexBits < prevBits || indexFileSize < prevFileSize || burstRate < prevBurst {
+			t.Fatalf("suggestion decreased for %d keys", keys)
+		}
+		if indexBits > maxSuggestedBits {
+			t.Fatalf("index bits %d too large", indexBits)
+		}
+		if indexFileSize > maxSuggestedIndexFile {
+			t.Fatalf("index file size %d too large", indexFileSize)
+		}
+		if burstRate > maxSuggestedBurstRate {
+			t.Fatalf("burst rate %d too large", burstRate)
+		}
+		prevBits, prevFileSize, prevBurst = indexBits, indexFileSize, burstRate
+	}
+	if prevBits != maxSuggestedBits || prevFileSize != maxSuggestedIndexFile || prevBurst != maxSuggestedBurstRate {
+		t.Fatal("expected maximum suggestions for largest dataset")
+	}
+
+	if opts := SuggestIndexParams(1000, 100); len(opts) != 3 {
+		t.Fatalf("expected 3 options, got %d", len(opts))
+	}
+}
+
+func TestIndexMemoryBudget(t *testing.T) {
+	// A budget that fits the suggested bit size does not change it.
+	var cfg config
+	IndexMemoryBudget(2<<30, targetBucketKeys<<defaultIndexSizeBits)(&cfg)
+	if cfg.indexSizeBits != defaultIndexSizeBits {
+		t.Fatalf("expected %d index bits, got %d", defaultIndexSizeBits, cfg.indexSizeBits)
+	}
+
+	// A smaller budget limits the bit size to what fits in it.
+	IndexMemoryBudget(100<<20, 1<<40)(&cfg)
+	if cfg.indexSizeBits != 23 {
+		t.Fatalf("expected 23 index bits, got %d", cfg.indexSizeBits)
+	}
+	if mem := int64(bucketMemorySize) << cfg.indexSizeBits; mem > 100<<20 {
+		t.Fatalf("bucket table uses %d bytes, more than budget", mem)
+	}
+	if cfg.indexFileSize != maxSuggestedIndexFile {
+		t.Fatalf("expected index file size %d, got %d", maxSuggestedIndexFile, cfg.indexFileSize)
+	}
+
+	// The bit size stays in range for tiny and huge budgets.
+	for _, budget := range []int64{-1, 0, 1024, 1 << 62} {
+		bits := budgetIndexBits(budget)
+		if bits < minSuggestedBits || bits > maxSuggestedBits {
+			t.Fatalf("index bits %d out of range for budget %d", bits, budget)
+		}
+	}
+}
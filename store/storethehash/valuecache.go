@@ -0,0 +1,93 @@
+package storethehash
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/filecoin-project/go-indexer-core"
+)
+
+// valueCache is a fixed-size LRU cache of decoded values, keyed by value-key.
+// It avoids unmarshalling the same value repeatedly when many multihashes map
+// to it. A nil *valueCache is valid and caches nothing.
+type valueCache struct {
+	lru   *list.List
+	items map[string]*list.Element
+	mutex sync.Mutex
+	size  int
+}
+
+type valueCacheEntry struct {
+	key   string
+	value indexer.Value
+}
+
+// newValueCache creates a valueCache that holds up to size values. Returns nil
+// if size is not positive.
+func newValueCache(size int) *valueCache {
+	if size <= 0 {
+		return nil
+	}
+	return &valueCache{
+		lru:   list.New(),
+		items: make(map[string]*list.Element, size),
+		size:  size,
+	}
+}
+
+func (c *valueCache) get(valKey []byte) (indexer.Value, bool) {
+	if c == nil {
+		return indexer.Value{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.items[string(valKey)]
+	if !ok {
+		return indexer.Value{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*valueCacheEntry).value, true
+}
+
+func (c *valueCache) put(valKey []byte, value indexer.Value) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[string(valKey)]; ok {
+		elem.Value.(*valueCacheEntry).value = value
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*valueCacheEntry).key)
+	}
+
+	k := string(valKey)
+	c.items[k] = c.lru.PushFront(&valueCacheEntry{
+		key:   k,
+		value: value,
+	})
+}
+
+func (c *valueCache) remove(valKey []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[string(valKey)]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, string(valKey))
+	}
+}
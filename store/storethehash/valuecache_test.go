@@ -0,0 +1,66 @@
+package storethehash
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestValueCache(t *testing.T) {
+	s := newStore(t, t.TempDir(), ValueCacheSize(2))
+	test.E2ETest(t, s)
+	s.Close()
+
+	s = newStore(t, t.TempDir(), ValueCacheSize(2))
+	test.RemoveProviderContextTest(t, s)
+	s.Close()
+
+	s = newStore(t, t.TempDir(), ValueCacheSize(2))
+	test.RemoveProviderTest(t, s)
+	s.Close()
+
+	// Check that cached values are updated and removed.
+	s = newStore(t, t.TempDir(), ValueCacheSize(2))
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(4)
+	value := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctxid"),
+		MetadataBytes: []byte("meta-1"),
+	}
+	if err := s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mhs {
+		if _, _, err := s.Get(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value.MetadataBytes = []byte("meta-2")
+	if err := s.Put(value); err != nil {
+		t.Fatal(err)
+	}
+	vals, found, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !vals[0].Equal(value) {
+		t.Fatal("did not get updated value")
+	}
+
+	if err = s.RemoveProviderContext(p, value.ContextID); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err = s.Get(mhs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("removed value should not be found")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
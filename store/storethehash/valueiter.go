@@ -0,0 +1,126 @@
+package storethehash
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/multiformats/go-multihash"
+)
+
+// ValueIterator iterates the values that a multihash maps to, reading each
+// value from the store when it is reached.
+type ValueIterator interface {
+	// Next returns the next value. Returns io.EOF when finished iterating.
+	Next() (indexer.Value, error)
+	// Close ends the iteration, and removes the value-keys of the values that
+	// were found not to exist from the multihash's value-key list. Close is
+	// called by Next when it reaches the end, and may be called more than
+	// once.
+	Close() error
+}
+
+// GetIter gets an iterator over the values that the multihash maps to. Unlike
+// Get, which reads all of the values before returning, the iterator reads one
+// value at a time as Next is called. This saves memory and time when a
+// multihash maps to very many values, and the caller may not need all of them.
+//
+// Values are returned in the order that they are stored, even if SortValues is
+// set. The iterator is returned with found set to true if the multihash maps
+// to any value-keys, but the iterator may still return no values if none of
+// the values exist. As with Get, the value-keys of values that do not exist
+// are pruned, but only those that the iterator reached before it was closed.
+func (s *Store) GetIter(m multihash.Multihash) (ValueIterator, bool, error) {
+	if err := s.begin(); err != nil {
+		return nil, false, err
+	}
+	defer s.end()
+
+	k := s.keys.makeIndexKey(m)
+	valueKeys, err := s.getValueKeys(k)
+	if err != nil {
+		return nil, false, err
+	}
+	if valueKeys == nil {
+		return nil, false, nil
+	}
+	s.observeValueKeys(len(valueKeys))
+
+	return &valueIter{
+		storage:   s,
+		key:       k,
+		valueKeys: valueKeys,
+	}, true, nil
+}
+
+type valueIter struct {
+	storage   *Store
+	key       []byte
+	valueKeys [][]byte
+	// next is the index of the next value-key to read.
+	next int
+	// pruned holds the indexes of the value-keys to prune.
+	pruned []int
+	closed bool
+}
+
+func (it *valueIter) Next() (indexer.Value, error) {
+	if it.closed {
+		return indexer.Value{}, io.EOF
+	}
+	s := it.storage
+	if err := s.begin(); err != nil {
+		return indexer.Value{}, err
+	}
+	defer s.end()
+
+	for it.next < len(it.valueKeys) {
+		i := it.next
+		it.next++
+
+		s.rlockValues()
+		val, prune, err := s.resolveValue(it.valueKeys[i], "", s.valueCache)
+		s.valLock.RUnlock()
+		if err != nil {
+			return indexer.Value{}, fmt.Errorf("cannot get value for multihash: %w", err)
+		}
+		if prune {
+			it.pruned = append(it.pruned, i)
+			continue
+		}
+		if val == nil {
+			continue
+		}
+		return *val, nil
+	}
+
+	if err := it.Close(); err != nil {
+		return indexer.Value{}, err
+	}
+	return indexer.Value{}, io.EOF
+}
+
+func (it *valueIter) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	if len(it.pruned) == 0 {
+		return nil
+	}
+
+	s := it.storage
+	if err := s.begin(); err != nil {
+		return err
+	}
+	defer s.end()
+
+	// The list may have changed since it was read, so remove only the pruned
+	// value-keys from the current list.
+	rmKeys := make(map[string]struct{}, len(it.pruned))
+	for _, i := range it.pruned {
+		rmKeys[string(it.valueKeys[i])] = struct{}{}
+	}
+	s.countPrunedValueKeys(len(it.pruned))
+	return s.removeValueKeys(it.key, rmKeys)
+}
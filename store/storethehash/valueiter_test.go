@@ -0,0 +1,137 @@
+package storethehash
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestGetIter(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(2)
+	values := make([]indexer.Value, 4)
+	for i := range values {
+		values[i] = indexer.Value{
+			ProviderID:    p,
+			ContextID:     []byte(fmt.Sprint("ctxid-", i)),
+			MetadataBytes: []byte(fmt.Sprint("meta-", i)),
+		}
+		if err := s.Put(values[i], mhs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Delete the records of the first and third values, leaving their
+	// value-keys in the multihash's value-key list.
+	for _, i := range []int{0, 2} {
+		if err := s.RemoveProviderContext(p, values[i].ContextID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, found, err := s.GetIter(mhs[1]); err != nil || found {
+		t.Fatalf("expected multihash not to be found, got found %t, err %v", found, err)
+	}
+
+	// Stop after the first value, so only the value-key before it is pruned.
+	iter, found, err := s.GetIter(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("multihash not found")
+	}
+	val, err := iter.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !val.Equal(values[1]) {
+		t.Fatalf("expected second value, got %v", val)
+	}
+	if err = iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = iter.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF after close, got %v", err)
+	}
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PrunedValueKeys != 1 {
+		t.Fatalf("expected 1 pruned value-key, got %d", st.PrunedValueKeys)
+	}
+
+	// Iterating to the end prunes the other value-key.
+	iter, _, err = s.GetIter(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []indexer.Value
+	for {
+		val, err = iter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+		got = append(got, val)
+	}
+	if len(got) != 2 || !got[0].Equal(values[1]) || !got[1].Equal(values[3]) {
+		t.Fatalf("expected second and fourth values, got %v", got)
+	}
+	if st, err = s.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if st.PrunedValueKeys != 2 {
+		t.Fatalf("expected 2 pruned value-keys, got %d", st.PrunedValueKeys)
+	}
+	vals, _, err := s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(vals))
+	}
+	if st, err = s.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if st.PrunedValueKeys != 2 {
+		t.Fatalf("expected no more pruned value-keys, got %d", st.PrunedValueKeys)
+	}
+
+	// A value put while the iterator is open is kept when the iterator prunes
+	// the list on close.
+	if err = s.RemoveProviderContext(p, values[1].ContextID); err != nil {
+		t.Fatal(err)
+	}
+	iter, _, err = s.GetIter(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err = iter.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if !val.Equal(values[3]) {
+		t.Fatalf("expected fourth value, got %v", val)
+	}
+	if err = s.Put(values[0], mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	vals, _, err = s.Get(mhs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 2 || !vals[0].Equal(values[3]) || !vals[1].Equal(values[0]) {
+		t.Fatalf("expected fourth and first values, got %v", vals)
+	}
+}
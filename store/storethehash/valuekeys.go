@@ -0,0 +1,44 @@
+package storethehash
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/filecoin-project/go-indexer-core"
+)
+
+// ErrTooManyValues is returned when putting a value for a multihash that
+// already maps to as many values as the MaxValuesPerMultihash option allows.
+var ErrTooManyValues = errors.New("multihash maps to too many values")
+
+// observeValueKeys records the length of a value-key list that was read or
+// written, for the value-key statistics.
+func (s *Store) observeValueKeys(n int) {
+	atomic.AddUint64(&s.valueKeyLists, 1)
+	atomic.AddUint64(&s.valueKeysTotal, uint64(n))
+	for {
+		max := atomic.LoadUint64(&s.maxValueKeys)
+		if uint64(n) <= max || atomic.CompareAndSwapUint64(&s.maxValueKeys, max, uint64(n)) {
+			return
+		}
+	}
+}
+
+// avgValueKeys returns the average length of the value-key lists that were
+// read or written.
+func (s *Store) avgValueKeys() float64 {
+	lists := atomic.LoadUint64(&s.valueKeyLists)
+	if lists == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&s.valueKeysTotal)) / float64(lists)
+}
+
+// marshalValueKeys serializes a list of value-keys, or other keys, using the
+// packed encoding if the PackedValueKeys option is enabled.
+func (s *Store) marshalValueKeys(keys [][]byte) ([]byte, error) {
+	if s.packValueKeys {
+		return indexer.MarshalValueKeysPacked(keys)
+	}
+	return indexer.MarshalValueKeys(keys)
+}
@@ -0,0 +1,53 @@
+package storethehash
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+)
+
+func TestPackedValueKeys(t *testing.T) {
+	p := testPeer(t)
+	mhs := test.RandomMultihashes(10)
+	dir := t.TempDir()
+
+	// Put a value with each encoding, reopening the store with the other
+	// encoding each time, so that each list is read in one encoding and
+	// rewritten in the other.
+	var values []indexer.Value
+	for i, pack := range []bool{false, true, false, true} {
+		s := newStore(t, dir, PackedValueKeys(pack), ReverseIndex(true))
+		value := indexer.Value{
+			ProviderID:    p,
+			ContextID:     []byte(fmt.Sprint("ctx-", i)),
+			MetadataBytes: []byte("metadata"),
+		}
+		if err := s.Put(value, mhs...); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+
+		for _, m := range mhs {
+			got, found, err := s.Get(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || len(got) != len(values) {
+				t.Fatalf("expected %d values, got %d", len(values), len(got))
+			}
+		}
+		got, err := s.MultihashesForValue(context.Background(), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(mhs) {
+			t.Fatalf("reverse index has %d multihashes for value, expected %d", len(got), len(mhs))
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
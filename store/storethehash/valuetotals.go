@@ -0,0 +1,57 @@
+package storethehash
+
+import "context"
+
+// ValueTotals holds totals over all stored values, for capacity planning.
+type ValueTotals struct {
+	// Values is the number of stored values.
+	Values int
+	// Providers is the number of providers that have stored values.
+	Providers int
+	// MetadataBytes is the total size of the metadata of the stored values,
+	// uncompressed.
+	MetadataBytes int64
+}
+
+// AvgMetadataBytes returns the average size of the metadata of a value, or 0
+// if there are no values.
+func (t ValueTotals) AvgMetadataBytes() float64 {
+	if t.Values == 0 {
+		return 0
+	}
+	return float64(t.MetadataBytes) / float64(t.Values)
+}
+
+// ValueTotals reads every stored value and returns all of the totals, in a
+// single pass over the primary storage. Values can still be read while the
+// totals are computed, but not put or removed. Multihashes are not read. Use
+// Analyze to compute these along with other aggregates.
+func (s *Store) ValueTotals(ctx context.Context) (ValueTotals, error) {
+	if err := s.begin(); err != nil {
+		return ValueTotals{}, err
+	}
+	defer s.end()
+
+	s.rlockValues()
+	defer s.valLock.RUnlock()
+
+	report, err := s.Analyze(ctx, AnalyzeOptions{Values: true, Providers: true})
+	if err != nil {
+		return ValueTotals{}, err
+	}
+	return ValueTotals{
+		Values:        report.Values,
+		Providers:     len(report.Providers),
+		MetadataBytes: report.MetadataBytes,
+	}, nil
+}
+
+// TotalMetadataBytes returns the total size of the metadata of all stored
+// values. Use ValueTotals to get this with the other totals in the same pass.
+func (s *Store) TotalMetadataBytes(ctx context.Context) (int64, error) {
+	totals, err := s.ValueTotals(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return totals.MetadataBytes, nil
+}
@@ -0,0 +1,60 @@
+package storethehash
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestValueTotals(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	defer s.Close()
+
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mhs := test.RandomMultihashes(3)
+	values := []indexer.Value{
+		{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-1")},
+		{ProviderID: p1, ContextID: []byte("ctxid-2"), MetadataBytes: []byte("metadata-2")},
+		// Update of the first value, which replaces its metadata.
+		{ProviderID: p1, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("metadata-3")},
+		{ProviderID: p2, ContextID: []byte("ctxid-1"), MetadataBytes: []byte("meta-4")},
+	}
+	for i, v := range values {
+		if err = s.Put(v, mhs[i%len(mhs)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	totals, err := s.ValueTotals(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ValueTotals{Values: 3, Providers: 2, MetadataBytes: 26}
+	if totals != want {
+		t.Fatalf("expected totals %+v, got %+v", want, totals)
+	}
+	if avg := totals.AvgMetadataBytes(); avg < 8.66 || avg > 8.67 {
+		t.Fatalf("expected average metadata size of 8.67, got %f", avg)
+	}
+	n, err := s.TotalMetadataBytes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 26 {
+		t.Fatalf("expected 26 metadata bytes, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = s.TotalMetadataBytes(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+}
@@ -0,0 +1,432 @@
+package storethehash
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// walFileName is the name of the write-ahead log file, kept with the index.
+const walFileName = "storethehash.wal"
+
+// Operations recorded in the write-ahead log.
+const (
+	walPut byte = iota + 1
+	walPutNew
+	walRegister
+	walRemove
+	walRemoveProvider
+	walRemoveProviderContext
+	walReplace
+	walRemoveValuesOlderThan
+	walRemapProvider
+	walRepairValueKeys
+	walCoalesceIdenticalValues
+)
+
+// walHeaderSize is the size of the header written before each record, which
+// holds the length of the record and its CRC.
+const walHeaderSize = 8
+
+// walRecord is an operation recorded in the write-ahead log. Only the fields
+// used by the operation are set.
+type walRecord struct {
+	op         byte
+	value      indexer.Value
+	mhs        []multihash.Multihash
+	providerID peer.ID
+	contextID  []byte
+	// newID is the new provider ID of a remapped provider.
+	newID peer.ID
+	// time is the time given to RemoveValuesOlderThan.
+	time time.Time
+}
+
+// writeLog is the write-ahead log of a store, which records each write before
+// it is made, so that writes that were not synced to the store when the
+// process stopped are made again when the store is next opened.
+type writeLog struct {
+	// applyLock is held for reading from the time an operation is logged
+	// until the operation has been made, and for writing while the store is
+	// flushed and the log is truncated. This keeps the log from being
+	// truncated while it has records of writes that are not in the flushed
+	// store.
+	applyLock sync.RWMutex
+
+	mutex sync.Mutex
+	file  *os.File
+	buf   []byte
+	// pending holds the records of long operations that are in progress,
+	// which are written to the log again each time it is truncated.
+	pending     map[int]walRecord
+	nextPending int
+}
+
+// openWriteLog opens the write-ahead log at path for appending, creating it
+// if it does not exist.
+func openWriteLog(path string) (*writeLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open write-ahead log: %w", err)
+	}
+	return &writeLog{
+		file:    f,
+		pending: make(map[int]walRecord),
+	}, nil
+}
+
+// append writes the records to the log and syncs the log file, so that the
+// records are on disk when append returns.
+func (w *writeLog) append(recs []walRecord) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.write(recs)
+}
+
+// appendPending appends the record of a long operation to the log, and keeps
+// it until the returned function is called. Until then, the record is written
+// to the log again each time the log is truncated.
+func (w *writeLog) appendPending(rec walRecord) (func(), error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.write([]walRecord{rec}); err != nil {
+		return nil, err
+	}
+	id := w.nextPending
+	w.nextPending++
+	w.pending[id] = rec
+	return func() {
+		w.mutex.Lock()
+		delete(w.pending, id)
+		w.mutex.Unlock()
+	}, nil
+}
+
+// write writes the records to the log and syncs the log file. The caller must
+// hold mutex.
+func (w *writeLog) write(recs []walRecord) error {
+	w.buf = w.buf[:0]
+	for i := range recs {
+		start := len(w.buf)
+		w.buf = append(w.buf, make([]byte, walHeaderSize)...)
+		var err error
+		w.buf, err = recs[i].appendTo(w.buf)
+		if err != nil {
+			return err
+		}
+		payload := w.buf[start+walHeaderSize:]
+		binary.LittleEndian.PutUint32(w.buf[start:], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(w.buf[start+4:], crc32.ChecksumIEEE(payload))
+	}
+	if _, err := w.file.Write(w.buf); err != nil {
+		return fmt.Errorf("cannot write to write-ahead log: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// truncate removes all records from the log, except for the records of long
+// operations that are still in progress.
+func (w *writeLog) truncate() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("cannot truncate write-ahead log: %w", err)
+	}
+	if len(w.pending) == 0 {
+		return w.file.Sync()
+	}
+	recs := make([]walRecord, 0, len(w.pending))
+	for _, rec := range w.pending {
+		recs = append(recs, rec)
+	}
+	return w.write(recs)
+}
+
+func (w *writeLog) close() error {
+	return w.file.Close()
+}
+
+// readWriteLog reads the records in the write-ahead log at path. Reading stops
+// at the first record that is incomplete or does not match its CRC, since that
+// is a record that was being written when the process stopped, and the
+// operation it records was not made. Returns no records if there is no log.
+func readWriteLog(path string) ([]walRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot open write-ahead log: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat write-ahead log: %w", err)
+	}
+	// remaining is the number of bytes after the record being read. The length
+	// in a record header is checked against it before the record is read, so
+	// that a header damaged by a crash cannot cause a huge allocation.
+	remaining := fi.Size()
+
+	r := bufio.NewReader(f)
+	var recs []walRecord
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				log.Warnw("Ignoring incomplete write-ahead log record", "records", len(recs))
+			}
+			return recs, nil
+		}
+		remaining -= walHeaderSize
+		size := int64(binary.LittleEndian.Uint32(header))
+		if size > remaining {
+			log.Warnw("Ignoring incomplete write-ahead log record", "records", len(recs))
+			return recs, nil
+		}
+		remaining -= size
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			log.Warnw("Ignoring incomplete write-ahead log record", "records", len(recs))
+			return recs, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			log.Warnw("Ignoring write-ahead log record with bad checksum", "records", len(recs))
+			return recs, nil
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode write-ahead log record %d: %w", len(recs), err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// appendTo appends the encoded record to buf.
+func (r *walRecord) appendTo(buf []byte) ([]byte, error) {
+	buf = append(buf, r.op)
+	switch r.op {
+	case walPut, walPutNew, walRegister, walRemove, walReplace:
+		valData, err := indexer.MarshalValue(r.value)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendWALBytes(buf, valData)
+		buf = appendUvarint(buf, uint64(len(r.mhs)))
+		for _, m := range r.mhs {
+			buf = appendWALBytes(buf, m)
+		}
+	case walRemoveProvider:
+		buf = appendWALBytes(buf, []byte(r.providerID))
+	case walRemoveProviderContext:
+		buf = appendWALBytes(buf, []byte(r.providerID))
+		buf = appendWALBytes(buf, r.contextID)
+	case walRemoveValuesOlderThan:
+		buf = appendUvarint(buf, uint64(r.time.UnixNano()))
+	case walRemapProvider:
+		buf = appendWALBytes(buf, []byte(r.providerID))
+		buf = appendWALBytes(buf, []byte(r.newID))
+	case walRepairValueKeys, walCoalesceIdenticalValues:
+	default:
+		return nil, fmt.Errorf("unknown write-ahead log operation %d", r.op)
+	}
+	return buf, nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendWALBytes(buf, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// decodeWALRecord decodes a record encoded by appendTo.
+func decodeWALRecord(data []byte) (walRecord, error) {
+	var rec walRecord
+	if len(data) == 0 {
+		return rec, errors.New("empty record")
+	}
+	rec.op = data[0]
+	data = data[1:]
+
+	var b []byte
+	var err error
+	switch rec.op {
+	case walPut, walPutNew, walRegister, walRemove, walReplace:
+		if b, data, err = readWALBytes(data); err != nil {
+			return rec, err
+		}
+		if rec.value, err = indexer.UnmarshalValue(b); err != nil {
+			return rec, err
+		}
+		count, n := binary.Uvarint(data)
+		if n <= 0 || count > uint64(len(data)) {
+			return rec, errors.New("bad multihash count")
+		}
+		data = data[n:]
+		rec.mhs = make([]multihash.Multihash, count)
+		for i := range rec.mhs {
+			if b, data, err = readWALBytes(data); err != nil {
+				return rec, err
+			}
+			rec.mhs[i] = multihash.Multihash(b)
+		}
+	case walRemoveProvider:
+		if b, _, err = readWALBytes(data); err != nil {
+			return rec, err
+		}
+		rec.providerID = peer.ID(b)
+	case walRemoveProviderContext:
+		if b, data, err = readWALBytes(data); err != nil {
+			return rec, err
+		}
+		rec.providerID = peer.ID(b)
+		if rec.contextID, _, err = readWALBytes(data); err != nil {
+			return rec, err
+		}
+	case walRemoveValuesOlderThan:
+		nanos, n := binary.Uvarint(data)
+		if n <= 0 {
+			return rec, errors.New("bad time")
+		}
+		rec.time = time.Unix(0, int64(nanos))
+	case walRemapProvider:
+		if b, data, err = readWALBytes(data); err != nil {
+			return rec, err
+		}
+		rec.providerID = peer.ID(b)
+		if b, _, err = readWALBytes(data); err != nil {
+			return rec, err
+		}
+		rec.newID = peer.ID(b)
+	case walRepairValueKeys, walCoalesceIdenticalValues:
+	default:
+		return rec, fmt.Errorf("unknown operation %d", rec.op)
+	}
+	return rec, nil
+}
+
+func readWALBytes(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, errors.New("bad field length")
+	}
+	data = data[n:]
+	return data[:size], data[size:], nil
+}
+
+// logWrite records the operations in the write-ahead log, if it is enabled.
+// The returned function must be called once the operations have been made,
+// whether or not they succeed. If the operations cannot be logged, then an
+// error is returned and they must not be made.
+func (s *Store) logWrite(recs ...walRecord) (func(), error) {
+	if s.wal == nil {
+		return func() {}, nil
+	}
+	s.wal.applyLock.RLock()
+	if err := s.wal.append(recs); err != nil {
+		s.wal.applyLock.RUnlock()
+		return nil, err
+	}
+	return s.wal.applyLock.RUnlock, nil
+}
+
+// logLongWrite records a long operation, such as one that scans the whole
+// store, in the write-ahead log, if it is enabled. Unlike logWrite, it does
+// not keep the log from being truncated until the operation is made, which
+// would block Flush, and every logged write behind it, for the whole
+// operation. Instead, the record is written to the log again each time the log
+// is truncated, until the returned function is called. So, the operation must
+// be one that can be replayed after it was partly or fully made.
+func (s *Store) logLongWrite(rec walRecord) (func(), error) {
+	if s.wal == nil {
+		return func() {}, nil
+	}
+	return s.wal.appendPending(rec)
+}
+
+// replayWriteLog makes the operations recorded in the write-ahead log at
+// path, flushes the store, and then opens the log for new records. This is
+// called by New before the store is used, with no write-ahead log set so that
+// the operations are not logged again.
+func (s *Store) replayWriteLog(path string) error {
+	recs, err := readWriteLog(path)
+	if err != nil {
+		return err
+	}
+	if len(recs) != 0 {
+		log.Infow("Replaying write-ahead log", "records", len(recs))
+		for i := range recs {
+			if err = s.applyWALRecord(&recs[i]); err != nil {
+				// The operation may also have failed when it was first made,
+				// so continue with the rest of the log.
+				log.Warnw("Cannot replay write-ahead log record", "err", err)
+			}
+		}
+		if err = s.flush(); err != nil {
+			return fmt.Errorf("cannot flush replayed writes: %w", err)
+		}
+	}
+
+	w, err := openWriteLog(path)
+	if err != nil {
+		return err
+	}
+	if err = w.truncate(); err != nil {
+		w.close()
+		return err
+	}
+	s.wal = w
+	return nil
+}
+
+func (s *Store) applyWALRecord(rec *walRecord) error {
+	switch rec.op {
+	case walPut:
+		return s.Put(rec.value, rec.mhs...)
+	case walPutNew:
+		return s.PutNew(rec.value, rec.mhs...)
+	case walRegister:
+		return s.RegisterValue(rec.value)
+	case walRemove:
+		return s.Remove(rec.value, rec.mhs...)
+	case walRemoveProvider:
+		return s.RemoveProvider(context.Background(), rec.providerID)
+	case walRemoveProviderContext:
+		return s.RemoveProviderContext(rec.providerID, rec.contextID)
+	case walReplace:
+		return s.Replace(rec.value, rec.mhs...)
+	case walRemoveValuesOlderThan:
+		_, err := s.RemoveValuesOlderThan(context.Background(), rec.time)
+		return err
+	case walRemapProvider:
+		_, err := s.RemapProvider(context.Background(), rec.providerID, rec.newID)
+		return err
+	case walRepairValueKeys:
+		_, err := s.RepairValueKeys(context.Background())
+		return err
+	case walCoalesceIdenticalValues:
+		_, err := s.CoalesceIdenticalValues(context.Background())
+		return err
+	}
+	return fmt.Errorf("unknown write-ahead log operation %d", rec.op)
+}
@@ -0,0 +1,289 @@
+package storethehash
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-indexer-core"
+	"github.com/filecoin-project/go-indexer-core/store/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestWALReplay(t *testing.T) {
+	p := testPeer(t)
+	value1 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-1"),
+		MetadataBytes: []byte("metadata-1"),
+	}
+	value2 := indexer.Value{
+		ProviderID:    p,
+		ContextID:     []byte("ctx-2"),
+		MetadataBytes: []byte("metadata-2"),
+	}
+	mhs := test.RandomMultihashes(10)
+
+	dir := t.TempDir()
+	// Keep the log from being cleared at the sync interval while it is read.
+	s := newStore(t, dir, WAL(true), ReverseIndex(true), SyncInterval(time.Hour))
+	if err := s.Put(value1, mhs[:5]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(value2, mhs[5:]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(value1, mhs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveProviderContext(p, value2.ContextID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace(value1, mhs[1:4]...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash that loses everything written to the store, by giving
+	// the log to an empty store. Add part of a record that was being written
+	// when the crash happened.
+	walData, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(walData) == 0 {
+		t.Fatal("expected writes to be logged")
+	}
+	crashDir := t.TempDir()
+	walData = append(walData, 100, 0, 0, 0, 1, 2, 3, 4, walPut)
+	if err = os.WriteFile(filepath.Join(crashDir, walFileName), walData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flush clears the log.
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkWALSize(t, dir, 0)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStore(t, crashDir, WAL(true), ReverseIndex(true))
+	checkWALSize(t, crashDir, 0)
+	checkReplayed := func() {
+		t.Helper()
+		for i, m := range mhs {
+			vals, found, err := s.Get(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i < 1 || i >= 4 {
+				if found {
+					t.Fatalf("multihash %d: expected removed multihash to not be found", i)
+				}
+				continue
+			}
+			if !found || len(vals) != 1 || !vals[0].Equal(value1) {
+				t.Fatalf("multihash %d: put was not replayed", i)
+			}
+		}
+	}
+	checkReplayed()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replayed writes are in the store without the log.
+	s = newStore(t, crashDir, ReverseIndex(true))
+	checkReplayed()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the log over a store that already has the writes, as after a
+	// crash that happened after the store was synced, gives the same result,
+	// and does not call OnPut again.
+	if err = os.WriteFile(filepath.Join(dir, walFileName), walData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var puts int
+	s = newStore(t, dir, WAL(true), ReverseIndex(true), OnPut(func(indexer.Value, int) { puts++ }))
+	defer s.Close()
+	checkWALSize(t, dir, 0)
+	checkReplayed()
+	if puts != 0 {
+		t.Fatalf("expected OnPut not to be called for replayed puts, got %d calls", puts)
+	}
+}
+
+func TestWALClearedAtSyncInterval(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir, WAL(true), SyncInterval(10*time.Millisecond))
+	defer s.Close()
+	if err := s.Put(testValue(t), test.RandomMultihashes(3)...); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		fi, err := os.Stat(filepath.Join(dir, walFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() == 0 {
+			return
+		}
+	}
+	t.Fatal("write-ahead log was not cleared at sync interval")
+}
+
+func TestWALBadRecordLength(t *testing.T) {
+	value := testValue(t)
+	mhs := test.RandomMultihashes(3)
+
+	dir := t.TempDir()
+	s := newStore(t, dir, WAL(true), SyncInterval(time.Hour))
+	if err := s.Put(value, mhs...); err != nil {
+		t.Fatal(err)
+	}
+	walData, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged header with a length much larger than the rest of the log is
+	// treated as an incomplete record, and the records before it are
+	// replayed.
+	crashDir := t.TempDir()
+	walData = append(walData, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, walPut)
+	if err = os.WriteFile(filepath.Join(crashDir, walFileName), walData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	s = newStore(t, crashDir, WAL(true))
+	defer s.Close()
+	runtime.ReadMemStats(&after)
+	if after.TotalAlloc-before.TotalAlloc > 1<<30 {
+		t.Fatal("memory allocated for damaged record")
+	}
+	for _, m := range mhs {
+		vals, found, err := s.Get(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || len(vals) != 1 || !vals[0].Equal(value) {
+			t.Fatal("put before damaged record was not replayed")
+		}
+	}
+}
+
+func TestWALRecordEncoding(t *testing.T) {
+	p1 := testPeer(t)
+	p2, err := peer.Decode("12D3KooWPw6bfQbJHfKa2o5XpusChoq67iZoqgfnhecygjKsQRmG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := []walRecord{
+		{op: walReplace, value: indexer.Value{ProviderID: p1, ContextID: []byte("ctx"), MetadataBytes: []byte("meta")}, mhs: test.RandomMultihashes(3)},
+		{op: walRemoveValuesOlderThan, time: time.Unix(0, 1234567890)},
+		{op: walRemapProvider, providerID: p1, newID: p2},
+		{op: walRepairValueKeys},
+		{op: walCoalesceIdenticalValues},
+	}
+	for _, rec := range recs {
+		data, err := rec.appendTo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeWALRecord(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.op != rec.op || !got.value.Equal(rec.value) || len(got.mhs) != len(rec.mhs) ||
+			got.providerID != rec.providerID || got.newID != rec.newID || !got.time.Equal(rec.time) {
+			t.Fatalf("operation %d: decoded record differs from encoded record", rec.op)
+		}
+	}
+}
+
+func checkWALSize(t *testing.T, dir string, size int64) {
+	t.Helper()
+	fi, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Fatalf("write-ahead log has %d bytes, expected %d", fi.Size(), size)
+	}
+}
+
+func TestWALKeptAfterCloseTimeout(t *testing.T) {
+	p := testPeer(t)
+	value := indexer.Value{ProviderID: p, ContextID: []byte("ctx-1"), MetadataBytes: []byte("metadata-1")}
+
+	dir := t.TempDir()
+	s := newStore(t, dir, WAL(true), CloseTimeout(10*time.Millisecond))
+	// Start an operation that logs a write, but does not make it before the
+	// store is closed.
+	if err := s.begin(); err != nil {
+		t.Fatal(err)
+	}
+	done, err := s.logWrite(walRecord{op: walPut, value: value, mhs: test.RandomMultihashes(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != ErrCloseTimeout {
+		t.Fatalf("expected ErrCloseTimeout, got %v", err)
+	}
+	recs, err := readWriteLog(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("expected logged write to be kept, got %d records", len(recs))
+	}
+
+	// Close finishes once the operation is done.
+	done()
+	s.end()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALLongWrite(t *testing.T) {
+	p := testPeer(t)
+	dir := t.TempDir()
+	s := newStore(t, dir, WAL(true), SyncInterval(time.Hour))
+	defer s.Close()
+
+	// A long write in progress does not block Flush, and its record is kept
+	// in the log when the log is cleared.
+	done, err := s.logLongWrite(walRecord{op: walRemoveProvider, providerID: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := readWriteLog(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].op != walRemoveProvider || recs[0].providerID != p {
+		t.Fatalf("expected record of long write to be kept, got %d records", len(recs))
+	}
+
+	done()
+	if err = s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkWALSize(t, dir, 0)
+}
@@ -191,6 +191,106 @@ func BenchParallelMultihashGet(s indexer.Interface, b *testing.B) {
 	}
 }
 
+// Benchmark single thread put operation, for values with metadata of the
+// given size.
+func BenchMultihashPut(s indexer.Interface, metadataSize int, b *testing.B) {
+	p, _ := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	metadata := make([]byte, metadataSize)
+	rand.Read(metadata)
+
+	var next int
+	for _, batchSize := range []int{1, 16, 1024} {
+		b.Run(fmt.Sprint("Put", batchSize), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				mhs := sequentialMultihashes(next, batchSize)
+				value := indexer.Value{
+					ProviderID:    p,
+					ContextID:     []byte(mhs[0]),
+					MetadataBytes: metadata,
+				}
+				next += batchSize
+				b.StartTimer()
+
+				err := s.Put(value, mhs...)
+				if err != nil {
+					panic(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark concurrent put operations, for values with metadata of the given
+// size.
+func BenchParallelMultihashPut(s indexer.Interface, metadataSize int, b *testing.B) {
+	p, _ := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	metadata := make([]byte, metadataSize)
+	rand.Read(metadata)
+
+	const batchSize = 16
+	var next int
+
+	// Benchmark the average put time for different number of go routines.
+	for rout := 10; rout <= 50; rout += 10 {
+		b.Run(fmt.Sprint("Put parallel", rout), func(b *testing.B) {
+			// Prepare all multihashes up front so that generating them is not
+			// part of the measurement.
+			batches := make([][][]multihash.Multihash, rout)
+			for i := range batches {
+				batches[i] = make([][]multihash.Multihash, b.N)
+				for j := range batches[i] {
+					batches[i][j] = sequentialMultihashes(next, batchSize)
+					next += batchSize
+				}
+			}
+
+			var wg sync.WaitGroup
+			ch := make(chan bool)
+			for i := 0; i < rout; i++ {
+				wg.Add(1)
+				go func(batches [][]multihash.Multihash) {
+					defer wg.Done()
+					// Wait for all routines to be started
+					<-ch
+					for _, mhs := range batches {
+						value := indexer.Value{
+							ProviderID:    p,
+							ContextID:     []byte(mhs[0]),
+							MetadataBytes: metadata,
+						}
+						err := s.Put(value, mhs...)
+						if err != nil {
+							panic(err)
+						}
+					}
+				}(batches[i])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			close(ch)
+			wg.Wait()
+		})
+	}
+}
+
+// sequentialMultihashes returns count unique multihashes, starting from the
+// specified offset. This is much faster than RandomMultihashes for generating
+// large numbers of multihashes.
+func sequentialMultihashes(offset, count int) []multihash.Multihash {
+	mhs := make([]multihash.Multihash, count)
+	for i := range mhs {
+		mh, err := multihash.Sum([]byte(fmt.Sprint("bench-", offset+i)), multihash.SHA2_256, -1)
+		if err != nil {
+			panic(err)
+		}
+		mhs[i] = mh
+	}
+	return mhs
+}
+
 type metric struct {
 	val int64
 	n   uint64
@@ -2,6 +2,7 @@ package test
 
 import (
 	"context"
+	"errors"
 	"io"
 	"sync"
 	"testing"
@@ -48,8 +49,8 @@ func E2ETest(t *testing.T, s indexer.Interface) {
 		ContextID:  ctxid1,
 	}
 	err = s.Put(badValue, single)
-	if err == nil {
-		t.Fatal("expected error putting value missing metadata")
+	if !errors.Is(err, indexer.ErrMissingMetadata) {
+		t.Fatalf("expected ErrMissingMetadata putting value missing metadata, got %v", err)
 	}
 
 	// Put a single multihash
@@ -281,6 +282,20 @@ func SizeTest(t *testing.T, s indexer.Interface) {
 	}
 }
 
+// PingTest checks that Ping succeeds on an open value store, and fails once
+// the value store is closed. This closes the value store.
+func PingTest(t *testing.T, s indexer.Interface) {
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("ping failed on open store: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(context.Background()); err == nil {
+		t.Fatal("expected ping to fail on closed store")
+	}
+}
+
 func RemoveTest(t *testing.T, s indexer.Interface) {
 	// Create new valid peer.ID
 	p, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
@@ -2,7 +2,10 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 )
@@ -12,7 +15,8 @@ import (
 type Value struct {
 	// PrividerID is the peer ID of the provider of the multihash.
 	ProviderID peer.ID `json:"p"`
-	// ContextID identifies the metadata that is part of this value.
+	// ContextID identifies the metadata that is part of this value. An empty
+	// ContextID is allowed, and a nil ContextID is the same as an empty one.
 	ContextID []byte `json:"c"`
 	// MetadataBytes is serialized metadata. The is kept serialized, because
 	// the indexer only uses the serialized form of this data.
@@ -40,17 +44,62 @@ func (v Value) MatchEqual(other Value) (isMatch bool, isEqual bool) {
 	return
 }
 
-// MarshalValue serializes a single value
+// MarshalValue serializes a single value.
+//
+// The value is encoded as JSON, with the ProviderID encoded as its peer ID
+// string, and the ContextID and MetadataBytes encoded as base64. This is the
+// format in which values are persisted by the value stores, so the same
+// encoding can be used to dump values in a human-readable form.
 func MarshalValue(value Value) ([]byte, error) {
 	return json.Marshal(&value)
 }
 
+// UnmarshalValue deserializes a single value, decompressing the metadata if
+// the value was serialized by MarshalValueCompressed.
 func UnmarshalValue(b []byte) (Value, error) {
-	var value Value
-	err := json.Unmarshal(b, &value)
+	value, _, err := UnmarshalValueTime(b)
 	return value, err
 }
 
+// MarshalValueTime serializes a single value along with the time that it was
+// stored. The value is encoded the same as by MarshalValue, with an additional
+// timestamp field, so it can still be decoded by UnmarshalValue.
+func MarshalValueTime(value Value, t time.Time) ([]byte, error) {
+	return json.Marshal(&timedValue{
+		Value: value,
+		Time:  t.UnixNano(),
+	})
+}
+
+// UnmarshalValueTime deserializes a single value and the time that it was
+// stored. If the value was serialized without a time, by MarshalValue, then
+// the returned time is the zero time.
+func UnmarshalValueTime(b []byte) (Value, time.Time, error) {
+	var tv timedValue
+	if err := json.Unmarshal(b, &tv); err != nil {
+		return Value{}, time.Time{}, err
+	}
+	if tv.Codec != MetadataUncompressed {
+		md, err := decompressMetadata(tv.Codec, tv.MetadataBytes)
+		if err != nil {
+			return Value{}, time.Time{}, err
+		}
+		tv.MetadataBytes = md
+	}
+	if tv.Time == 0 {
+		return tv.Value, time.Time{}, nil
+	}
+	return tv.Value, time.Unix(0, tv.Time), nil
+}
+
+// timedValue is a Value with the time it was stored, in Unix nanoseconds, and
+// the codec that its metadata is compressed with.
+type timedValue struct {
+	Value
+	Time  int64         `json:"t,omitempty"`
+	Codec MetadataCodec `json:"z,omitempty"`
+}
+
 // MarshalValues serializes a Value list for storage.
 //
 // TODO: Switch from JSON to a more efficient serialization format once we
@@ -59,9 +108,103 @@ func MarshalValueKeys(valKeys [][]byte) ([]byte, error) {
 	return json.Marshal(&valKeys)
 }
 
-// Unmarshal serialized value keys list.
+// packedValueKeysMarker is the first byte of a value-key list serialized by
+// MarshalValueKeysPacked. It is not valid as the first byte of JSON, so it
+// distinguishes the packed encoding from the JSON encoding.
+const packedValueKeysMarker = 0xff
+
+// MarshalValueKeysPacked serializes a value-key list in a binary form that is
+// smaller and faster to encode and decode than MarshalValueKeys, which matters
+// for multihashes that map to many values. The list is the marker byte, the
+// number of keys, and the key size followed by the keys, if all keys are the
+// same non-zero size. Otherwise the key size is 0 and each key is preceded by
+// its size. All numbers are unsigned varints. UnmarshalValueKeys decodes both
+// encodings.
+func MarshalValueKeysPacked(valKeys [][]byte) ([]byte, error) {
+	size := -1
+	total := 0
+	for _, vk := range valKeys {
+		if size == -1 {
+			size = len(vk)
+		} else if len(vk) != size {
+			size = 0
+		}
+		total += len(vk)
+	}
+	if size == -1 {
+		size = 0
+	}
+
+	capacity := 1 + 2*binary.MaxVarintLen64 + total
+	if size == 0 {
+		capacity += len(valKeys) * binary.MaxVarintLen32
+	}
+	b := make([]byte, 1, capacity)
+	b[0] = packedValueKeysMarker
+	b = appendUvarint(b, uint64(len(valKeys)))
+	b = appendUvarint(b, uint64(size))
+	for _, vk := range valKeys {
+		if size == 0 {
+			b = appendUvarint(b, uint64(len(vk)))
+		}
+		b = append(b, vk...)
+	}
+	return b, nil
+}
+
+// Unmarshal serialized value keys list, encoded by either MarshalValueKeys or
+// MarshalValueKeysPacked.
 func UnmarshalValueKeys(b []byte) ([][]byte, error) {
+	if len(b) != 0 && b[0] == packedValueKeysMarker {
+		return unmarshalValueKeysPacked(b[1:])
+	}
 	var valKeys [][]byte
 	err := json.Unmarshal(b, &valKeys)
 	return valKeys, err
 }
+
+var errBadPackedValueKeys = errors.New("malformed packed value keys")
+
+func unmarshalValueKeysPacked(b []byte) ([][]byte, error) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errBadPackedValueKeys
+	}
+	b = b[n:]
+	size, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errBadPackedValueKeys
+	}
+	// Copy the keys so that they do not refer to the caller's buffer.
+	b = append([]byte(nil), b[n:]...)
+	// Each key takes at least one byte, to hold its size or its data.
+	if count > uint64(len(b)) {
+		return nil, errBadPackedValueKeys
+	}
+
+	valKeys := make([][]byte, count)
+	for i := range valKeys {
+		keySize := size
+		if size == 0 {
+			if keySize, n = binary.Uvarint(b); n <= 0 {
+				return nil, errBadPackedValueKeys
+			}
+			b = b[n:]
+		}
+		if keySize > uint64(len(b)) {
+			return nil, errBadPackedValueKeys
+		}
+		valKeys[i] = b[:keySize:keySize]
+		b = b[keySize:]
+	}
+	if len(b) != 0 {
+		return nil, errBadPackedValueKeys
+	}
+	return valKeys, nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,104 @@
+//go:build go1.18
+
+package indexer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func FuzzValueRoundTrip(f *testing.F) {
+	prov1, err := peer.Decode(string(p1))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte(prov1), testCtxID, []byte("dummy-metadata"), byte(0))
+	f.Add([]byte(prov1), []byte{}, []byte{}, byte(1))
+	f.Add([]byte(prov1), []byte(nil), bytes.Repeat([]byte("huge-metadata-"), 1<<12), byte(2))
+	f.Add([]byte("not-a-peer-id"), []byte("\x00\xff"), []byte("metadata"), byte(3))
+
+	f.Fuzz(func(t *testing.T, providerID, contextID, metadata []byte, codec byte) {
+		value := Value{
+			ProviderID:    peer.ID(providerID),
+			ContextID:     contextID,
+			MetadataBytes: metadata,
+		}
+		other := Value{ProviderID: value.ProviderID, ContextID: metadata, MetadataBytes: contextID}
+		// Must not panic.
+		value.Equal(other)
+		value.Match(other)
+
+		data, err := MarshalValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := MarshalValueCompressed(value, time.Unix(0, 1), MetadataCodec(codec%3), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, validID := peer.IDFromBytes(providerID)
+		for _, b := range [][]byte{data, compressed} {
+			value2, err := UnmarshalValue(b)
+			if validID != nil {
+				// An invalid provider ID is stored, but cannot be decoded.
+				continue
+			}
+			if err != nil {
+				t.Fatalf("cannot decode %s: %s", b, err)
+			}
+			if !value.Equal(value2) {
+				t.Fatalf("value did not round-trip: %s", b)
+			}
+		}
+	})
+}
+
+func FuzzValueKeysRoundTrip(f *testing.F) {
+	nested, err := MarshalValueKeys([][]byte{[]byte("key-1"), []byte("key-2")})
+	if err != nil {
+		f.Fatal(err)
+	}
+	list, err := MarshalValueKeys([][]byte{nested, []byte("key-3"), {}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(nested)
+	f.Add(list)
+	f.Add([]byte(`["a2V5LTE=", null, "!!"]`))
+	f.Add([]byte(`[`))
+	f.Add([]byte(`null`))
+	packed, err := MarshalValueKeysPacked([][]byte{[]byte("key-1"), []byte("key-22")})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packed)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		valKeys, err := UnmarshalValueKeys(data)
+		if err != nil {
+			return
+		}
+		for _, marshal := range []func([][]byte) ([]byte, error){MarshalValueKeys, MarshalValueKeysPacked} {
+			b, err := marshal(valKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			valKeys2, err := UnmarshalValueKeys(b)
+			if err != nil {
+				t.Fatalf("cannot decode re-encoded value keys %s: %s", b, err)
+			}
+			if len(valKeys) != len(valKeys2) {
+				t.Fatalf("expected %d value keys, got %d", len(valKeys), len(valKeys2))
+			}
+			for i := range valKeys {
+				if !bytes.Equal(valKeys[i], valKeys2[i]) {
+					t.Fatal("value key did not round-trip")
+				}
+			}
+		}
+	})
+}
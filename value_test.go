@@ -1,7 +1,12 @@
 package indexer
 
 import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 )
@@ -52,3 +57,263 @@ func TestEqual(t *testing.T) {
 		t.Fatal("values do not match")
 	}
 }
+
+func TestMarshalValue(t *testing.T) {
+	prov1, err := peer.Decode(string(p1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov2, err := peer.Decode(string(p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []Value{
+		{prov1, testCtxID, []byte("dummy-metadata")},
+		{prov1, []byte{}, []byte("dummy-metadata")},
+		{prov2, nil, []byte("dummy-metadata")},
+		{prov2, testCtxID, []byte("métadonnées-メタデータ-\x00\xff")},
+	}
+
+	for _, value := range values {
+		data, err := MarshalValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Check that the provider ID is human-readable.
+		if !strings.Contains(string(data), value.ProviderID.String()) {
+			t.Fatalf("marshaled value does not contain provider ID string: %s", data)
+		}
+
+		value2, err := UnmarshalValue(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !value.Equal(value2) {
+			t.Fatalf("value did not round-trip: %s", data)
+		}
+	}
+
+	// Check exact encoding so that stored values remain readable.
+	data, err := MarshalValue(Value{prov1, []byte("ctx"), []byte("meta")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"p":"12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA","c":"Y3R4","m":"bWV0YQ=="}`
+	if string(data) != expect {
+		t.Fatalf("unexpected encoding %s", data)
+	}
+}
+
+func TestMarshalValueTime(t *testing.T) {
+	prov1, err := peer.Decode(string(p1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := Value{prov1, testCtxID, []byte("dummy-metadata")}
+	now := time.Unix(1650000000, 123456789)
+
+	data, err := MarshalValueTime(value, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value2, ts, err := UnmarshalValueTime(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.Equal(value2) {
+		t.Fatalf("value did not round-trip: %s", data)
+	}
+	if !ts.Equal(now) {
+		t.Fatalf("expected time %s, got %s", now, ts)
+	}
+
+	// A value with a time can be decoded as a value without one.
+	value2, err = UnmarshalValue(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.Equal(value2) {
+		t.Fatalf("timed value not decoded by UnmarshalValue: %s", data)
+	}
+
+	// A value without a time decodes with the zero time.
+	data, err = MarshalValue(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value2, ts, err = UnmarshalValueTime(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.Equal(value2) {
+		t.Fatalf("value did not round-trip: %s", data)
+	}
+	if !ts.IsZero() {
+		t.Fatalf("expected zero time for value without time, got %s", ts)
+	}
+}
+
+func TestMarshalValueCompressed(t *testing.T) {
+	prov1, err := peer.Decode(string(p1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigMeta := []byte(strings.Repeat("compressible-metadata-", 50))
+	smallMeta := []byte("dummy-metadata")
+	now := time.Unix(1650000000, 123456789)
+
+	for _, codec := range []MetadataCodec{MetadataGzip, MetadataZstd} {
+		value := Value{prov1, testCtxID, bigMeta}
+		data, err := MarshalValueCompressed(value, now, codec, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := MarshalValueTime(value, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) >= len(plain) {
+			t.Fatalf("codec %d: compressed value is not smaller", codec)
+		}
+		value2, ts, err := UnmarshalValueTime(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !value.Equal(value2) {
+			t.Fatalf("codec %d: value did not round-trip", codec)
+		}
+		if !ts.Equal(now) {
+			t.Fatalf("expected time %s, got %s", now, ts)
+		}
+		value2, err = UnmarshalValue(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !value.Equal(value2) {
+			t.Fatalf("codec %d: value not decoded by UnmarshalValue", codec)
+		}
+
+		// Metadata smaller than the minimum size is not compressed, and no
+		// time is stored for the zero time.
+		value = Value{prov1, testCtxID, smallMeta}
+		data, err = MarshalValueCompressed(value, time.Time{}, codec, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err = MarshalValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(plain) {
+			t.Fatalf("expected small metadata to be stored uncompressed, got %s", data)
+		}
+	}
+
+	// Corrupt compressed metadata is an error.
+	value := Value{prov1, testCtxID, bigMeta}
+	data, err := MarshalValueCompressed(value, time.Time{}, MetadataZstd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), `"z":2`, `"z":1`, 1))
+	if _, err = UnmarshalValue(data); err == nil {
+		t.Fatal("expected error decoding metadata with wrong codec")
+	}
+}
+
+func TestMarshalValueKeysPacked(t *testing.T) {
+	fixed := make([][]byte, 5)
+	for i := range fixed {
+		fixed[i] = make([]byte, 23)
+		if _, err := rand.Read(fixed[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lists := [][][]byte{
+		nil,
+		fixed,
+		{[]byte("key-1"), []byte("longer-key-2"), {}},
+		{{}, {}},
+	}
+	for _, list := range lists {
+		packed, err := MarshalValueKeysPacked(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := MarshalValueKeys(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 0 && len(packed) >= len(plain) {
+			t.Fatalf("packed encoding is %d bytes, not smaller than %d bytes", len(packed), len(plain))
+		}
+		// Both encodings are decoded by UnmarshalValueKeys.
+		for _, data := range [][]byte{packed, plain} {
+			decoded, err := UnmarshalValueKeys(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(list) {
+				t.Fatalf("expected %d value keys, got %d", len(list), len(decoded))
+			}
+			for i := range list {
+				if !bytes.Equal(decoded[i], list[i]) {
+					t.Fatal("value key did not round-trip")
+				}
+			}
+		}
+	}
+
+	packed, err := MarshalValueKeysPacked(fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]byte{packed[:len(packed)-1], append(packed, 0), packed[:1]} {
+		if _, err = UnmarshalValueKeys(bad); err == nil {
+			t.Fatal("expected error decoding malformed packed value keys")
+		}
+	}
+}
+
+func BenchmarkMarshalValueKeys(b *testing.B) {
+	const count = 1000
+	valKeys := make([][]byte, count)
+	for i := range valKeys {
+		valKeys[i] = make([]byte, 23)
+		if _, err := rand.Read(valKeys[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	encodings := []struct {
+		name    string
+		marshal func([][]byte) ([]byte, error)
+	}{
+		{"json", MarshalValueKeys},
+		{"packed", MarshalValueKeysPacked},
+	}
+	for _, enc := range encodings {
+		data, err := enc.marshal(valKeys)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint("marshal-", enc.name), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := enc.marshal(valKeys); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes")
+		})
+		b.Run(fmt.Sprint("unmarshal-", enc.name), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := UnmarshalValueKeys(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}